@@ -0,0 +1,557 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// The admin API manages a mounted file system over HTTP, next to NFS.
+// Requests that change something are POSTs; replies are JSON, with an
+// "error" field on failure.  It has no authentication, so it should
+// only listen on a trusted address (e.g., localhost).
+//
+
+type server struct {
+	nfs *nfs.Nfs
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+type GrowReply struct {
+	Blocks    uint64 `json:"blocks"`     // (new) size of the file system
+	MaxBlocks uint64 `json:"max_blocks"` // the size it can grow to
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func replyError(w http.ResponseWriter, status int, err error) {
+	util.DPrintf(1, "admin: %v\n", err)
+	reply(w, status, errorReply{Error: err.Error()})
+}
+
+// Returns false, after replying, if r isn't a POST.
+func isPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs POST", r.URL.Path))
+		return false
+	}
+	return true
+}
+
+// GET /grow reports how far the file system can grow, and POST
+// /grow?size=<MB> grows it to size, or to the whole disk without size.
+func (s *server) grow(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		n, maxBlocks := s.nfs.GrowLimit()
+		reply(w, http.StatusOK, GrowReply{Blocks: n, MaxBlocks: maxBlocks})
+		return
+	}
+	if !isPost(w, r) {
+		return
+	}
+	var nblocks uint64 = 0
+	if v := r.URL.Query().Get("size"); v != "" {
+		mb, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || mb == 0 {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("bad size %q", v))
+			return
+		}
+		nblocks, err = super.MegabytesToBlocks(mb)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("bad size %q: %v", v, err))
+			return
+		}
+	}
+	_, err := s.nfs.Grow(nblocks)
+	if err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	n, maxBlocks := s.nfs.GrowLimit()
+	reply(w, http.StatusOK, GrowReply{Blocks: n, MaxBlocks: maxBlocks})
+}
+
+type ReservedReply struct {
+	Blocks uint64 `json:"blocks"`
+}
+
+// POST /reserved?blocks=<n> sets the number of reserved data blocks.
+func (s *server) reserved(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	v := r.URL.Query().Get("blocks")
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("bad blocks %q", v))
+		return
+	}
+	if err := s.nfs.SetReserved(n); err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, ReservedReply{Blocks: n})
+}
+
+// Returns the rate parameter of r, which may be absent (0).
+func rateParam(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("rate")
+	if v == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("bad rate %q", v)
+	}
+	return rate, nil
+}
+
+// GET /scrub returns the scrubber's stats.
+func (s *server) scrub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+		return
+	}
+	reply(w, http.StatusOK, s.nfs.ScrubStats())
+}
+
+// POST /scrub/start?rate=<inodes/s> starts the scrubber, or changes
+// its rate if it is running.
+func (s *server) scrubStart(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	rate, err := rateParam(r)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.nfs.StartScrub(rate)
+	reply(w, http.StatusOK, s.nfs.ScrubStats())
+}
+
+// POST /scrub/stop stops the scrubber.
+func (s *server) scrubStop(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	s.nfs.StopScrub()
+	reply(w, http.StatusOK, s.nfs.ScrubStats())
+}
+
+// POST /scrub/rate?rate=<inodes/s> changes the scrubber's rate.
+func (s *server) scrubRate(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	rate, err := rateParam(r)
+	if err == nil && rate == 0 {
+		err = fmt.Errorf("missing rate")
+	}
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.nfs.SetScrubRate(rate)
+	reply(w, http.StatusOK, s.nfs.ScrubStats())
+}
+
+type SnapshotReply struct {
+	Id       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Ctime    uint64 `json:"ctime"`  // Unix seconds
+	Copies   uint64 `json:"copies"` // inode blocks copied since
+	Deleting bool   `json:"deleting"`
+}
+
+func (s *server) snapshotList() []SnapshotReply {
+	snaps := make([]SnapshotReply, 0)
+	for _, si := range s.nfs.Snapshots() {
+		snaps = append(snaps, SnapshotReply{
+			Id:       si.Id,
+			Name:     si.Name,
+			Ctime:    si.Ctime,
+			Copies:   si.Copies,
+			Deleting: si.Deleting,
+		})
+	}
+	return snaps
+}
+
+// GET /snapshots lists the snapshots, oldest first.
+func (s *server) snapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+		return
+	}
+	reply(w, http.StatusOK, s.snapshotList())
+}
+
+// POST /snapshots/create?name=<name> takes a snapshot.
+func (s *server) snapshotCreate(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	if err := s.nfs.CreateSnapshot(r.URL.Query().Get("name")); err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, s.snapshotList())
+}
+
+// POST /snapshots/delete?name=<name> deletes a snapshot, whose space
+// is freed in the background.
+func (s *server) snapshotDelete(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	if err := s.nfs.DeleteSnapshot(r.URL.Query().Get("name")); err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, s.snapshotList())
+}
+
+// POST /clone?src=<path>&dst=<path> makes dst a copy of file src that
+// shares its blocks; both paths are relative to the root.
+func (s *server) clone(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	src, dst := q.Get("src"), q.Get("dst")
+	if src == "" || dst == "" {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("clone needs src and dst"))
+		return
+	}
+	if err := s.nfs.Clone(src, dst); err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, struct{}{})
+}
+
+type TreeReply struct {
+	Id       uint64 `json:"id"`
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	Dst      string `json:"dst,omitempty"`
+	Files    uint64 `json:"files"`
+	Dirs     uint64 `json:"dirs"`
+	Symlinks uint64 `json:"symlinks"`
+	Bytes    uint64 `json:"bytes"`  // sizes of files and symlinks
+	Blocks   uint64 `json:"blocks"` // for du
+	Txns     uint64 `json:"txns"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+func treeReply(ti nfs.TreeJobInfo) TreeReply {
+	return TreeReply{
+		Id:       ti.Id,
+		Op:       string(ti.Op),
+		Path:     ti.Path,
+		Dst:      ti.Dst,
+		Files:    ti.Files,
+		Dirs:     ti.Dirs,
+		Symlinks: ti.Symlinks,
+		Bytes:    ti.Bytes,
+		Blocks:   ti.Blocks,
+		Txns:     ti.Txns,
+		Done:     ti.Done,
+		Error:    ti.Err,
+	}
+}
+
+// GET /tree lists the running tree jobs and the last ones that
+// finished.
+func (s *server) trees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+		return
+	}
+	jobs := make([]TreeReply, 0)
+	for _, ti := range s.nfs.TreeJobs() {
+		jobs = append(jobs, treeReply(ti))
+	}
+	reply(w, http.StatusOK, jobs)
+}
+
+// Starts a tree job, and replies with it; the job continues in the
+// background, and GET /tree reports its progress.
+func (s *server) treeStart(w http.ResponseWriter, r *http.Request, op nfs.TreeOp, p string, dst string) {
+	if !isPost(w, r) {
+		return
+	}
+	if p == "" || (op == nfs.TreeCopy && dst == "") {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("%s needs a path", r.URL.Path))
+		return
+	}
+	id, err := s.nfs.StartTreeJob(op, p, dst)
+	if err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusAccepted, treeReply(nfs.TreeJobInfo{Id: id, Op: op, Path: p, Dst: dst}))
+}
+
+// POST /tree/remove?path=<path> removes the tree at path.
+func (s *server) treeRemove(w http.ResponseWriter, r *http.Request) {
+	s.treeStart(w, r, nfs.TreeRemove, r.URL.Query().Get("path"), "")
+}
+
+// POST /tree/copy?src=<path>&dst=<path> copies the tree at src to dst,
+// which must not exist.
+func (s *server) treeCopy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.treeStart(w, r, nfs.TreeCopy, q.Get("src"), q.Get("dst"))
+}
+
+// POST /tree/du?path=<path> adds up the sizes and blocks of the tree at
+// path.
+func (s *server) treeDu(w http.ResponseWriter, r *http.Request) {
+	s.treeStart(w, r, nfs.TreeDu, r.URL.Query().Get("path"), "")
+}
+
+// POST /tree/cancel?id=<id> stops a tree job, keeping what it did.
+func (s *server) treeCancel(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	v := r.URL.Query().Get("id")
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("bad id %q", v))
+		return
+	}
+	if err := s.nfs.CancelTreeJob(id); err != nil {
+		replyError(w, http.StatusNotFound, err)
+		return
+	}
+	reply(w, http.StatusOK, struct{}{})
+}
+
+type TrashReply struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Removed uint64 `json:"removed"` // Unix seconds
+}
+
+// GET /trash lists the items of the trash, oldest first.
+func (s *server) trash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+		return
+	}
+	items := make([]TrashReply, 0)
+	for _, it := range s.nfs.TrashItems() {
+		items = append(items, TrashReply{
+			Name:    it.Name,
+			Path:    it.Path,
+			Removed: uint64(it.Removed.Unix()),
+		})
+	}
+	reply(w, http.StatusOK, items)
+}
+
+type ReapReply struct {
+	Freed uint64 `json:"freed"`
+}
+
+// POST /trash/reap frees the items of the trash that the policy lets
+// go now, without waiting for the reaper.
+func (s *server) trashReap(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	n, err := s.nfs.ReapTrash()
+	if err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, ReapReply{Freed: n})
+}
+
+type QuotaReply struct {
+	Type        string `json:"type"` // "user" or "group"
+	Id          uint32 `json:"id"`
+	BlockSoft   uint64 `json:"block_soft"`
+	BlockHard   uint64 `json:"block_hard"`
+	InodeSoft   uint64 `json:"inode_soft"`
+	InodeHard   uint64 `json:"inode_hard"`
+	Blocks      uint64 `json:"blocks"`
+	Inodes      uint64 `json:"inodes"`
+	BlockExpire uint64 `json:"block_expire"` // Unix seconds, 0 if within the soft limit
+	InodeExpire uint64 `json:"inode_expire"`
+}
+
+type QuotasReply struct {
+	BlockGrace uint64       `json:"block_grace"` // seconds
+	InodeGrace uint64       `json:"inode_grace"`
+	Quotas     []QuotaReply `json:"quotas"`
+}
+
+var quotaTypes = map[string]alloctxn.QuotaKind{
+	"user":  alloctxn.UserQuota,
+	"group": alloctxn.GroupQuota,
+}
+
+func quotaType(kind alloctxn.QuotaKind) string {
+	if kind == alloctxn.GroupQuota {
+		return "group"
+	}
+	return "user"
+}
+
+func (s *server) quotasReply() QuotasReply {
+	bg, ig := s.nfs.QuotaGrace()
+	qr := QuotasReply{
+		BlockGrace: uint64(bg / time.Second),
+		InodeGrace: uint64(ig / time.Second),
+		Quotas:     make([]QuotaReply, 0),
+	}
+	for _, q := range s.nfs.Quotas() {
+		qr.Quotas = append(qr.Quotas, QuotaReply{
+			Type:        quotaType(q.Kind),
+			Id:          q.Id,
+			BlockSoft:   q.BlockSoft,
+			BlockHard:   q.BlockHard,
+			InodeSoft:   q.InodeSoft,
+			InodeHard:   q.InodeHard,
+			Blocks:      q.Blocks,
+			Inodes:      q.Inodes,
+			BlockExpire: q.BlockExpire,
+			InodeExpire: q.InodeExpire,
+		})
+	}
+	return qr
+}
+
+// GET /quotas lists the grace periods, and the limits and usage of
+// the users and groups, users first.
+func (s *server) quotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+		return
+	}
+	reply(w, http.StatusOK, s.quotasReply())
+}
+
+// POST /quotas/set?type=<user|group>&id=<n>&bsoft=<blocks>&bhard=<blocks>&isoft=<inodes>&ihard=<inodes>
+// sets the limits of a user or group; a missing limit is 0 (none).
+func (s *server) quotaSet(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	kind, ok := quotaTypes[q.Get("type")]
+	if !ok {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("bad type %q", q.Get("type")))
+		return
+	}
+	id, err := strconv.ParseUint(q.Get("id"), 10, 32)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("bad id %q", q.Get("id")))
+		return
+	}
+	var limits [4]uint64
+	for i, name := range []string{"bsoft", "bhard", "isoft", "ihard"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		limits[i], err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("bad %s %q", name, v))
+			return
+		}
+	}
+	err = s.nfs.SetQuota(alloctxn.QuotaId{Kind: kind, Id: uint32(id)}, alloctxn.QuotaLimits{
+		BlockSoft: limits[0],
+		BlockHard: limits[1],
+		InodeSoft: limits[2],
+		InodeHard: limits[3],
+	})
+	if err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, s.quotasReply())
+}
+
+// POST /quotas/grace?block=<duration>&inode=<duration> sets the grace
+// periods (e.g., 168h); a missing one stays as it is.
+func (s *server) quotaGrace(w http.ResponseWriter, r *http.Request) {
+	if !isPost(w, r) {
+		return
+	}
+	bg, ig := s.nfs.QuotaGrace()
+	for _, p := range []struct {
+		name string
+		d    *time.Duration
+	}{{"block", &bg}, {"inode", &ig}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("bad %s %q", p.name, v))
+			return
+		}
+		*p.d = d
+	}
+	if err := s.nfs.SetQuotaGrace(bg, ig); err != nil {
+		replyError(w, http.StatusConflict, err)
+		return
+	}
+	reply(w, http.StatusOK, s.quotasReply())
+}
+
+// Handler returns the admin API for nfs.
+func Handler(nfs *nfs.Nfs) http.Handler {
+	s := &server{nfs: nfs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/grow", s.grow)
+	mux.HandleFunc("/reserved", s.reserved)
+	mux.HandleFunc("/scrub", s.scrub)
+	mux.HandleFunc("/scrub/start", s.scrubStart)
+	mux.HandleFunc("/scrub/stop", s.scrubStop)
+	mux.HandleFunc("/scrub/rate", s.scrubRate)
+	mux.HandleFunc("/snapshots", s.snapshots)
+	mux.HandleFunc("/snapshots/create", s.snapshotCreate)
+	mux.HandleFunc("/snapshots/delete", s.snapshotDelete)
+	mux.HandleFunc("/clone", s.clone)
+	mux.HandleFunc("/tree", s.trees)
+	mux.HandleFunc("/tree/remove", s.treeRemove)
+	mux.HandleFunc("/tree/copy", s.treeCopy)
+	mux.HandleFunc("/tree/du", s.treeDu)
+	mux.HandleFunc("/tree/cancel", s.treeCancel)
+	mux.HandleFunc("/trash", s.trash)
+	mux.HandleFunc("/trash/reap", s.trashReap)
+	mux.HandleFunc("/quotas", s.quotas)
+	mux.HandleFunc("/quotas/set", s.quotaSet)
+	mux.HandleFunc("/quotas/grace", s.quotaGrace)
+	return mux
+}
@@ -0,0 +1,530 @@
+package alloc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Allocator uses a bit map to allocate and free numbers. Bit 0
+// corresponds to number 0, bit 1 to 1, and so on. Number 0 is never
+// allocated.
+//
+// The bit map is split into allocation groups of GROUPSZ numbers (one
+// bitmap block each). Each group keeps a count of its free numbers,
+// so that the allocator can skip full groups and report the number of
+// free numbers without scanning. Groups can be loaded lazily: a group
+// is read the first time the allocator needs it, and LoadAll loads
+// the remaining groups in parallel in the background.
+//
+// Callers can pass a goal, in which case the allocator returns the
+// first free number at or after the goal, so that related objects
+// (e.g., consecutive blocks of a file) end up next to each other.
+// Streaming writers can additionally allocate from a preallocation
+// window: a run of numbers reserved for one owner, so that concurrent
+// writers don't interleave their blocks.
+type Alloc struct {
+	mu      *sync.Mutex
+	next    uint64 // first number to try
+	max     uint64
+	groups  []*group
+	load    func(g uint64) []byte
+	nfree   uint64 // # free numbers in loaded groups
+	nloaded uint64
+	stop    uint32 // set to stop the background loader
+	loaders *sync.WaitGroup
+	windows map[uint64]*window
+	clock   uint64 // for evicting the least-recently used window
+	stats   Stats
+}
+
+type group struct {
+	lmu    *sync.Mutex // serializes loading of this group
+	loaded bool
+	bitmap []byte
+	nfree  uint64
+	hint   uint64 // no free number in this group below hint
+}
+
+// A window reserves the numbers [next, end) for one owner. Reserved
+// numbers are marked in use in the bitmap, but only in memory.
+type window struct {
+	next uint64
+	end  uint64
+	used uint64 // clock value of last use
+}
+
+const (
+	GROUPSZ    uint64 = 8 * 4096 // # numbers per allocation group
+	WINDOWSZ   uint64 = 64       // # numbers reserved per window
+	MAXWINDOWS int    = 64
+	NLOADER    int    = 8 // # threads loading groups in the background
+)
+
+// Stats counts goal-directed allocations, and how many of those
+// were placed exactly at the goal.
+type Stats struct {
+	Goal uint64
+	Hit  uint64
+}
+
+// Fragmentation returns the percentage of goal-directed allocations
+// that could not be placed at their goal.
+func (s Stats) Fragmentation() float64 {
+	if s.Goal == 0 {
+		return 0
+	}
+	return 100 * float64(s.Goal-s.Hit) / float64(s.Goal)
+}
+
+func mkAlloc(ngroup uint64, max uint64, load func(g uint64) []byte) *Alloc {
+	a := &Alloc{
+		mu:      new(sync.Mutex),
+		next:    0,
+		max:     max,
+		groups:  make([]*group, ngroup),
+		load:    load,
+		loaders: new(sync.WaitGroup),
+		windows: make(map[uint64]*window),
+	}
+	for i := range a.groups {
+		a.groups[i] = &group{lmu: new(sync.Mutex)}
+	}
+	return a
+}
+
+// MkAlloc initializes with a bitmap.
+//
+// 0 bits correspond to free numbers and 1 bits correspond to in-use numbers.
+func MkAlloc(bitmap []byte) *Alloc {
+	max := uint64(len(bitmap)) * 8
+	ngroup := (max + GROUPSZ - 1) / GROUPSZ
+	a := mkAlloc(ngroup, max, nil)
+	for g := uint64(0); g < ngroup; g++ {
+		end := (g + 1) * GROUPSZ / 8
+		if end > uint64(len(bitmap)) {
+			end = uint64(len(bitmap))
+		}
+		a.install(g, bitmap[g*GROUPSZ/8:end])
+	}
+	return a
+}
+
+// MkLazyAlloc initializes an allocator with ngroup groups, whose
+// bitmaps are read on demand by calling load with the group number.
+// load must return GROUPSZ/8 bytes, and may be called concurrently for
+// different groups.
+func MkLazyAlloc(ngroup uint64, load func(g uint64) []byte) *Alloc {
+	return mkAlloc(ngroup, ngroup*GROUPSZ, load)
+}
+
+// MkMaxAlloc initializes an allocator to be fully free with a range of (0,
+// max).
+//
+// Requires 0 < max and max % 8 == 0.
+func MkMaxAlloc(max uint64) *Alloc {
+	if !(0 < max && max%8 == 0) {
+		panic("invalid max, must be at least 0 and divisible by 8")
+	}
+	bitmap := make([]byte, max/8)
+	a := MkAlloc(bitmap)
+	return a
+}
+
+// Install bitmap as the bitmap of group g. Assumes caller holds a.mu.
+func (a *Alloc) install(g uint64, bitmap []byte) {
+	grp := a.groups[g]
+	grp.bitmap = bitmap
+	grp.nfree = 8*uint64(len(bitmap)) - popCntBytes(bitmap)
+	grp.loaded = true
+	a.nfree += grp.nfree
+	a.nloaded++
+	if g == 0 {
+		a.setBit(0) // never hand out 0
+	}
+}
+
+// Load group g, if it isn't loaded yet. Assumes caller doesn't hold
+// a.mu.
+func (a *Alloc) loadGroup(g uint64) {
+	grp := a.groups[g]
+	grp.lmu.Lock()
+	a.mu.Lock()
+	loaded := grp.loaded
+	a.mu.Unlock()
+	if !loaded {
+		bitmap := a.load(g)
+		a.mu.Lock()
+		a.install(g, bitmap)
+		a.mu.Unlock()
+	}
+	grp.lmu.Unlock()
+}
+
+// Load group g with a.mu held, releasing a.mu while reading.
+func (a *Alloc) loadGroupLocked(g uint64) {
+	a.mu.Unlock()
+	a.loadGroup(g)
+	a.mu.Lock()
+}
+
+// LoadAll loads all groups that aren't loaded yet, using NLOADER
+// threads, and returns immediately.
+func (a *Alloc) LoadAll() {
+	var next = uint64(0)
+	for i := 0; i < NLOADER; i++ {
+		a.loaders.Add(1)
+		go func() {
+			for atomic.LoadUint32(&a.stop) == 0 {
+				g := atomic.AddUint64(&next, 1) - 1
+				if g >= uint64(len(a.groups)) {
+					break
+				}
+				a.loadGroup(g)
+			}
+			a.loaders.Done()
+		}()
+	}
+}
+
+// StopLoader stops background loading started by LoadAll and waits for
+// the loader threads to exit.
+func (a *Alloc) StopLoader() {
+	atomic.StoreUint32(&a.stop, 1)
+	a.loaders.Wait()
+}
+
+// Load the groups that the background loader hasn't loaded yet.
+// Assumes caller holds a.mu.
+func (a *Alloc) loadAllLocked() {
+	for g := uint64(0); a.nloaded < uint64(len(a.groups)); g++ {
+		a.ensureLoaded(g)
+	}
+}
+
+func (a *Alloc) MarkUsed(bn uint64) {
+	a.mu.Lock()
+	a.ensureLoaded(bn / GROUPSZ)
+	a.setBit(bn)
+	a.mu.Unlock()
+}
+
+// Assumes caller holds a.mu.
+func (a *Alloc) ensureLoaded(g uint64) {
+	if !a.groups[g].loaded {
+		a.loadGroupLocked(g)
+	}
+}
+
+// The following helpers assume caller holds a.mu and that num's
+// group is loaded.
+
+func (a *Alloc) isFree(num uint64) bool {
+	grp := a.groups[num/GROUPSZ]
+	off := num % GROUPSZ
+	return grp.bitmap[off/8]&(1<<(off%8)) == 0
+}
+
+func (a *Alloc) setBit(num uint64) {
+	grp := a.groups[num/GROUPSZ]
+	off := num % GROUPSZ
+	b := grp.bitmap[off/8]
+	if b&(1<<(off%8)) == 0 {
+		grp.bitmap[off/8] = b | (1 << (off % 8))
+		grp.nfree--
+		a.nfree--
+	}
+}
+
+func (a *Alloc) clearBit(num uint64) {
+	grp := a.groups[num/GROUPSZ]
+	off := num % GROUPSZ
+	b := grp.bitmap[off/8]
+	if b&(1<<(off%8)) != 0 {
+		grp.bitmap[off/8] = b & ^(1 << (off % 8))
+		grp.nfree++
+		a.nfree++
+		if off < grp.hint {
+			grp.hint = off
+		}
+	}
+}
+
+// Returns the offset of the first free number in grp at or after off,
+// or GROUPSZ if there is none.
+func (grp *group) findFree(off uint64) uint64 {
+	max := 8 * uint64(len(grp.bitmap))
+	var start = off
+	if start <= grp.hint {
+		start = grp.hint
+	}
+	var o = start
+	for o < max {
+		if o%8 == 0 && grp.bitmap[o/8] == 0xff {
+			o += 8 // skip full bytes
+			continue
+		}
+		if grp.bitmap[o/8]&(1<<(o%8)) == 0 {
+			break
+		}
+		o++
+	}
+	if off <= grp.hint {
+		grp.hint = o
+	}
+	if o >= max {
+		return GROUPSZ
+	}
+	return o
+}
+
+// Returns the first free number at or after start, wrapping around,
+// loading groups as needed. Returns 0 if there is none. Assumes
+// caller holds a.mu.
+func (a *Alloc) findFree(start uint64) uint64 {
+	ngroup := uint64(len(a.groups))
+	g0 := (start % a.max) / GROUPSZ
+	// visit g0 twice: first from start, and, after wrapping around,
+	// from its beginning.
+	for i := uint64(0); i <= ngroup; i++ {
+		g := (g0 + i) % ngroup
+		a.ensureLoaded(g)
+		grp := a.groups[g]
+		if grp.nfree == 0 {
+			continue
+		}
+		var off = uint64(0)
+		if i == 0 {
+			off = (start % a.max) % GROUPSZ
+		}
+		o := grp.findFree(off)
+		if o < GROUPSZ {
+			return g*GROUPSZ + o
+		}
+	}
+	return 0
+}
+
+// Returns a free number and marks it in use, or 0 if none is
+// free. If no number is free outside of preallocation windows, the
+// windows are given up.
+func (a *Alloc) allocBit(start uint64) uint64 {
+	var num = a.findFree(start)
+	if num == 0 && len(a.windows) > 0 {
+		a.releaseAll()
+		num = a.findFree(start)
+	}
+	if num != 0 {
+		a.setBit(num)
+	}
+	return num
+}
+
+// AllocNum returns a free number, rotating through the bitmap.
+func (a *Alloc) AllocNum() uint64 {
+	a.mu.Lock()
+	num := a.allocBit(a.next + 1)
+	if num != 0 {
+		a.next = num
+	}
+	a.mu.Unlock()
+	return num
+}
+
+func (a *Alloc) recordGoal(goal uint64, num uint64) {
+	atomic.AddUint64(&a.stats.Goal, 1)
+	if num == goal {
+		atomic.AddUint64(&a.stats.Hit, 1)
+	}
+}
+
+// AllocNumNear returns the first free number at or after goal. A goal
+// of 0 means no preference.
+func (a *Alloc) AllocNumNear(goal uint64) uint64 {
+	if goal == 0 || goal >= a.max {
+		return a.AllocNum()
+	}
+	a.mu.Lock()
+	num := a.allocBit(goal)
+	a.mu.Unlock()
+	a.recordGoal(goal, num)
+	return num
+}
+
+// Release the unused part of w. Assumes caller holds a.mu.
+func (a *Alloc) releaseWindow(owner uint64, w *window) {
+	for num := w.next; num < w.end; num++ {
+		a.clearBit(num)
+	}
+	delete(a.windows, owner)
+}
+
+func (a *Alloc) releaseAll() {
+	for owner, w := range a.windows {
+		a.releaseWindow(owner, w)
+	}
+}
+
+func (a *Alloc) evictWindow() {
+	var victim uint64
+	var oldest *window
+	for owner, w := range a.windows {
+		if oldest == nil || w.used < oldest.used {
+			victim = owner
+			oldest = w
+		}
+	}
+	if oldest != nil {
+		a.releaseWindow(victim, oldest)
+	}
+}
+
+// Reserve a window for owner starting at num, which the caller has
+// already allocated. A window doesn't extend past num's group. Assumes
+// caller holds a.mu.
+func (a *Alloc) reserveWindow(owner uint64, num uint64) {
+	if len(a.windows) >= MAXWINDOWS {
+		a.evictWindow()
+	}
+	gend := (num/GROUPSZ + 1) * GROUPSZ
+	var end = num + 1
+	for end < num+WINDOWSZ && end < gend && end < a.max && a.isFree(end) {
+		a.setBit(end)
+		end++
+	}
+	a.windows[owner] = &window{next: num + 1, end: end, used: a.clock}
+}
+
+// AllocNumWindow allocates a number for owner near goal. If goal is
+// the next number in owner's preallocation window, it is taken from
+// the window; otherwise, the window is moved to start at goal (or
+// the first free number after goal).
+func (a *Alloc) AllocNumWindow(owner uint64, goal uint64) uint64 {
+	if goal == 0 || goal >= a.max {
+		return a.AllocNum()
+	}
+	a.mu.Lock()
+	a.clock++
+	var num uint64
+	w := a.windows[owner]
+	if w != nil && w.next == goal && w.next < w.end {
+		num = w.next
+		w.next++
+		w.used = a.clock
+	} else {
+		if w != nil {
+			a.releaseWindow(owner, w)
+		}
+		num = a.allocBit(goal)
+		if num != 0 {
+			a.reserveWindow(owner, num)
+		}
+	}
+	a.mu.Unlock()
+	a.recordGoal(goal, num)
+	return num
+}
+
+// ReleaseWindow gives up owner's preallocation window, if any.
+func (a *Alloc) ReleaseWindow(owner uint64) {
+	a.mu.Lock()
+	w := a.windows[owner]
+	if w != nil {
+		a.releaseWindow(owner, w)
+	}
+	a.mu.Unlock()
+}
+
+// FreeNum marks num free. If num's group hasn't been loaded yet, it
+// is loaded first; its on-disk bitmap may or may not reflect the free
+// already.
+func (a *Alloc) FreeNum(num uint64) {
+	if num == 0 {
+		panic("FreeNum")
+	}
+	a.mu.Lock()
+	a.ensureLoaded(num / GROUPSZ)
+	a.clearBit(num)
+	a.mu.Unlock()
+}
+
+// FreeRange marks the numbers [lo, hi) free, e.g., when the file
+// system grows.
+func (a *Alloc) FreeRange(lo uint64, hi uint64) {
+	if lo == 0 || hi > a.max {
+		panic("FreeRange")
+	}
+	a.mu.Lock()
+	for num := lo; num < hi; num++ {
+		a.ensureLoaded(num / GROUPSZ)
+		a.clearBit(num)
+	}
+	a.mu.Unlock()
+}
+
+func popCnt(b byte) uint64 {
+	var count uint64
+	var x = b
+	for i := uint64(0); i < 8; i++ {
+		count += uint64(x & 1)
+		x = x >> 1
+	}
+	return count
+}
+
+func popCntBytes(bitmap []byte) uint64 {
+	var count uint64
+	for _, b := range bitmap {
+		count += popCnt(b)
+	}
+	return count
+}
+
+// NumFree returns the number of free numbers, counting numbers
+// reserved in preallocation windows as free. Once all groups are
+// loaded, this doesn't scan the bitmap.
+func (a *Alloc) NumFree() uint64 {
+	a.mu.Lock()
+	a.loadAllLocked()
+	var count = a.nfree
+	for _, w := range a.windows {
+		count += w.end - w.next
+	}
+	a.mu.Unlock()
+	return count
+}
+
+// NumUnreserved returns the number of free numbers that aren't
+// reserved in preallocation windows, which only their owners can take.
+func (a *Alloc) NumUnreserved() uint64 {
+	a.mu.Lock()
+	a.loadAllLocked()
+	count := a.nfree
+	a.mu.Unlock()
+	return count
+}
+
+// ReleaseWindows gives up all preallocation windows (e.g., when free
+// numbers run short).
+func (a *Alloc) ReleaseWindows() {
+	a.mu.Lock()
+	a.releaseAll()
+	a.mu.Unlock()
+}
+
+// Max returns the number of numbers the allocator manages, including
+// those that are always in use (e.g., 0).
+func (a *Alloc) Max() uint64 {
+	return a.max
+}
+
+func (a *Alloc) Stats() Stats {
+	return Stats{
+		Goal: atomic.LoadUint64(&a.stats.Goal),
+		Hit:  atomic.LoadUint64(&a.stats.Hit),
+	}
+}
+
+func (a *Alloc) ResetStats() {
+	atomic.StoreUint64(&a.stats.Goal, 0)
+	atomic.StoreUint64(&a.stats.Hit, 0)
+}
@@ -0,0 +1,158 @@
+package alloc
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopCnt(t *testing.T) {
+	assert.Equal(t, uint64(0), popCnt(0))
+	assert.Equal(t, uint64(1), popCnt(1))
+	assert.Equal(t, uint64(2), popCnt(3))
+	assert.Equal(t, uint64(8), popCnt(255))
+}
+
+func TestAlloc(t *testing.T) {
+	assert := assert.New(t)
+	max := uint64(32)
+	a := MkMaxAlloc(max)
+
+	assert.Equal(max-1, a.NumFree(), "everything (but 0) should be initially free")
+
+	n := a.AllocNum()
+	assert.NotEqual(uint64(0), n, "should not allocate 0")
+
+	a.MarkUsed(n + 1)
+	n2 := a.AllocNum()
+	assert.NotEqual(n+1, n2, "should not allocate something marked used")
+
+	for a.NumFree() > 0 {
+		assert.NotEqual(uint64(0), a.AllocNum())
+	}
+	assert.Equal(uint64(0), a.AllocNum(), "should be out of numbers")
+	a.FreeNum(n)
+	assert.Equal(n, a.AllocNum(), "should re-allocate freed number")
+}
+
+func TestAllocNear(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(64)
+
+	assert.Equal(uint64(10), a.AllocNumNear(10))
+	assert.Equal(uint64(11), a.AllocNumNear(10), "should use next free number")
+	a.MarkUsed(63)
+	assert.Equal(uint64(1), a.AllocNumNear(63), "should wrap around, skipping 0")
+
+	s := a.Stats()
+	assert.Equal(uint64(3), s.Goal)
+	assert.Equal(uint64(1), s.Hit)
+	a.ResetStats()
+	assert.Equal(uint64(0), a.Stats().Goal)
+	assert.Equal(float64(0), a.Stats().Fragmentation())
+}
+
+func TestAllocWindow(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(1024)
+	free := a.NumFree()
+
+	// two interleaved streams get contiguous runs
+	n1 := a.AllocNumWindow(1, 100)
+	n2 := a.AllocNumWindow(2, 100)
+	assert.Equal(uint64(100), n1)
+	assert.Equal(100+WINDOWSZ, n2)
+	for i := uint64(1); i < WINDOWSZ; i++ {
+		assert.Equal(n1+i, a.AllocNumWindow(1, n1+i))
+		assert.Equal(n2+i, a.AllocNumWindow(2, n2+i))
+	}
+	assert.Equal(free-2*WINDOWSZ, a.NumFree())
+
+	// window blocks aren't handed out to others
+	n3 := a.AllocNumNear(100)
+	assert.Equal(100+2*WINDOWSZ, n3)
+
+	// releasing a window frees its unused numbers
+	n4 := a.AllocNumWindow(1, n3+1)
+	assert.Equal(n3+1, n4)
+	a.ReleaseWindow(1)
+	assert.Equal(n3+2, a.AllocNumNear(n3+1))
+	assert.Equal(free-2*WINDOWSZ-3, a.NumFree())
+
+	// only numbers outside windows (2's is used up) are unreserved
+	assert.Equal(a.NumFree(), a.NumUnreserved())
+	a.AllocNumWindow(3, 500)
+	assert.Equal(a.NumFree()-(WINDOWSZ-1), a.NumUnreserved())
+	a.ReleaseWindows()
+	assert.Equal(a.NumFree(), a.NumUnreserved())
+}
+
+func TestAllocWindowFull(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(64)
+
+	a.AllocNumWindow(1, 1)
+	for a.NumFree() > 0 {
+		assert.NotEqual(uint64(0), a.AllocNumNear(1),
+			"windows should be given up when out of numbers")
+	}
+	assert.Equal(uint64(0), a.AllocNumNear(1))
+}
+
+func TestLazyAlloc(t *testing.T) {
+	assert := assert.New(t)
+	var mu sync.Mutex
+	var loads []uint64
+	a := MkLazyAlloc(4, func(g uint64) []byte {
+		mu.Lock()
+		loads = append(loads, g)
+		mu.Unlock()
+		bitmap := make([]byte, GROUPSZ/8)
+		if g == 1 {
+			for i := range bitmap {
+				bitmap[i] = 0xff // group 1 is full
+			}
+		}
+		return bitmap
+	})
+
+	goal := 2*GROUPSZ + 5
+	assert.Equal(goal, a.AllocNumNear(goal))
+	assert.Equal([]uint64{2}, loads, "should load only the goal's group")
+
+	// allocation skips over the full group
+	assert.Equal(2*GROUPSZ, a.AllocNumNear(GROUPSZ+3))
+
+	// freeing in an unloaded group loads it first
+	a.FreeNum(3*GROUPSZ + 1)
+	assert.Equal(3, len(loads))
+
+	a.LoadAll()
+	a.StopLoader()
+	assert.Equal(3*GROUPSZ-1-2, a.NumFree())
+	assert.Equal(4, len(loads), "should load each group once")
+}
+
+func TestAllocFull(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(2 * GROUPSZ)
+	for i := uint64(1); i < 2*GROUPSZ; i++ {
+		assert.Equal(i, a.AllocNum())
+	}
+	assert.Equal(uint64(0), a.NumFree())
+	assert.Equal(uint64(0), a.AllocNumNear(7))
+	a.FreeNum(GROUPSZ + 7)
+	assert.Equal(GROUPSZ+7, a.AllocNumNear(7), "should find the one free number")
+}
+
+func TestFreeRange(t *testing.T) {
+	assert := assert.New(t)
+	a := MkMaxAlloc(2 * GROUPSZ)
+	for i := uint64(1); i < 2*GROUPSZ; i++ {
+		a.MarkUsed(i)
+	}
+	a.FreeRange(GROUPSZ-2, GROUPSZ+3) // spans groups
+	assert.Equal(uint64(5), a.NumFree())
+	assert.Equal(GROUPSZ-2, a.AllocNumNear(1))
+}
@@ -1,13 +1,15 @@
 package alloctxn
 
 import (
+	"github.com/tchajed/goose/machine/disk"
+
 	"github.com/mit-pdos/go-journal/addr"
-	"github.com/mit-pdos/go-journal/alloc"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/super"
 )
 
@@ -16,27 +18,70 @@ import (
 // support for (1) block and inode allocation.
 //
 
+// State is what transactions share: the log, and the allocators and
+// tables that they update.  A transaction that only writes blocks
+// (e.g., fsck's raw repairs) needs only Super and Log.
+type State struct {
+	Super  *super.FsSuper
+	Log    *obj.Log
+	Balloc *alloc.Alloc
+	Ialloc *alloc.Alloc
+	Chunks *ChunkMap
+	Csums  *Csums
+	// nil if the disk can't discard
+	Discards *Discards
+	Snaps    *Snapshots
+	Quotas   *Quotas
+}
+
 type AllocTxn struct {
-	Super      *super.FsSuper
+	*State
 	Op         *jrnl.Op
-	Balloc     *alloc.Alloc
-	Ialloc     *alloc.Alloc
 	allocInums []common.Inum
 	freeInums  []common.Inum
 	allocBnums []common.Bnum
 	freeBnums  []common.Bnum
+	// share counts read under Snaps.mu, or changed
+	shares map[common.Bnum]*share
+	// holds Snaps.mu until the transaction commits or aborts
+	sharing bool
+	// changes to snapshots and their maps, applied at commit
+	preserved []preservedBlock
+	released  []preservedBlock
+	created   []*Snapshot
+	deleted   []*Snapshot
+	removed   []*Snapshot
+	// quota charges, limits and grace periods, written at commit
+	charges   map[QuotaId]quotaDelta
+	limits    map[QuotaId]QuotaLimits
+	grace     []uint64
+	qents     map[QuotaId]*quotaEnt // the entries charged or limited
+	quotas    []*Quota              // the entries as written at commit
+	overQuota bool
+	// holds the locks of the entries in qents (and Quotas.mu, if it
+	// sets the grace periods) until the transaction commits or aborts
+	charging bool
+	// must not commit (see Fail)
+	failed bool
+	// read metadata that failed its checksum (see FailRead)
+	badRead bool
+	// may allocate the superblock's reserved blocks (e.g., to free
+	// space on a full file system)
+	UseReserved bool
 }
 
-func Begin(super *super.FsSuper, log *obj.Log, balloc *alloc.Alloc, ialloc *alloc.Alloc) *AllocTxn {
+func Begin(st *State) *AllocTxn {
 	atxn := &AllocTxn{
-		Super:      super,
-		Op:         jrnl.Begin(log),
-		Ialloc:     ialloc,
-		Balloc:     balloc,
+		State:      st,
+		Op:         jrnl.Begin(st.Log),
 		allocInums: make([]common.Inum, 0),
 		freeInums:  make([]common.Inum, 0),
 		allocBnums: make([]common.Bnum, 0),
 		freeBnums:  make([]common.Bnum, 0),
+		shares:     make(map[common.Bnum]*share),
+		charges:    make(map[QuotaId]quotaDelta),
+		limits:     make(map[QuotaId]QuotaLimits),
+		qents:      make(map[QuotaId]*quotaEnt),
 	}
 	return atxn
 }
@@ -46,8 +91,14 @@ func (atxn *AllocTxn) Id() *jrnl.Op {
 	return atxn.Op
 }
 
-func (atxn *AllocTxn) AllocINum() common.Inum {
-	inum := common.Inum(atxn.Ialloc.AllocNum())
+// AllocINum allocates an inode number, preferably close to goal (e.g.,
+// the parent directory's inode number).  If the inode table is full,
+// it allocates from an inode chunk.
+func (atxn *AllocTxn) AllocINum(goal common.Inum) common.Inum {
+	var inum = common.Inum(atxn.Ialloc.AllocNumNear(uint64(goal)))
+	if inum == common.NULLINUM {
+		inum = atxn.allocChunkInum(goal)
+	}
 	util.DPrintf(1, "AllocINum -> # %v\n", inum)
 	if inum != common.NULLINUM {
 		atxn.allocInums = append(atxn.allocInums, inum)
@@ -60,6 +111,38 @@ func (atxn *AllocTxn) FreeINum(inum common.Inum) {
 	atxn.freeInums = append(atxn.freeInums, inum)
 }
 
+// ValidInum returns whether inum names an inode in the table or in a
+// chunk (e.g., when checking a file handle).
+func (atxn *AllocTxn) ValidInum(inum common.Inum) bool {
+	if inum == common.NULLINUM {
+		return false
+	}
+	if atxn.Super.InTable(inum) {
+		return true
+	}
+	bn, _ := atxn.Super.Inum2Chunk(inum)
+	return atxn.Chunks.IsChunk(bn)
+}
+
+// Returns the inums of inums that are in the inode table.
+func (atxn *AllocTxn) tableInums(inums []common.Inum) []uint64 {
+	var nums = make([]uint64, 0)
+	for _, inum := range inums {
+		if atxn.Super.InTable(inum) {
+			nums = append(nums, uint64(inum))
+		}
+	}
+	return nums
+}
+
+func (atxn *AllocTxn) freeInum(inum common.Inum) {
+	if atxn.Super.InTable(inum) {
+		atxn.Ialloc.FreeNum(uint64(inum))
+	} else {
+		atxn.Chunks.free(atxn.Super, inum)
+	}
+}
+
 func (atxn *AllocTxn) WriteBits(nums []uint64, blk uint64, alloc bool) {
 	for _, n := range nums {
 		a := addr.MkBitAddr(blk, n)
@@ -76,33 +159,130 @@ func (atxn *AllocTxn) PreCommit() {
 	util.DPrintf(1, "commitBitmaps: alloc inums %v blks %v\n", atxn.allocInums,
 		atxn.allocBnums)
 
-	atxn.WriteBits(atxn.allocInums, atxn.Super.BitmapInodeStart(), true)
+	atxn.WriteBits(atxn.tableInums(atxn.allocInums), atxn.Super.BitmapInodeStart(), true)
 	atxn.WriteBits(atxn.allocBnums, atxn.Super.BitmapBlockStart(), true)
 
 	util.DPrintf(1, "commitBitmaps: free inums %v blks %v\n", atxn.freeInums,
 		atxn.freeBnums)
 
-	atxn.WriteBits(atxn.freeInums, atxn.Super.BitmapInodeStart(), false)
+	atxn.WriteBits(atxn.tableInums(atxn.freeInums), atxn.Super.BitmapInodeStart(), false)
 	atxn.WriteBits(atxn.freeBnums, atxn.Super.BitmapBlockStart(), false)
+	atxn.commitShares()
+	atxn.commitQuotas()
 }
 
-// On-disk bitmap has been updated; update in-memory state for free bits
+// Failed returns whether the transaction must not commit, because it
+// couldn't finish a change it started (e.g., copy an inode block for
+// snapshots before changing it).
+func (atxn *AllocTxn) Failed() bool {
+	return atxn.failed
+}
+
+// Fail makes the transaction fail to commit.
+func (atxn *AllocTxn) Fail() {
+	atxn.failed = true
+}
+
+// FailRead makes the transaction fail to commit because it read a
+// block that failed its checksum (e.g., one with directory entries, or
+// one a write changes part of), so that nothing it changes relies on
+// corrupt data.
+func (atxn *AllocTxn) FailRead() {
+	atxn.failed = true
+	atxn.badRead = true
+}
+
+// ReadFailed returns whether the transaction read a block that failed
+// its checksum (see FailRead).
+func (atxn *AllocTxn) ReadFailed() bool {
+	return atxn.badRead
+}
+
+// ChangedBlocks returns the blocks whose allocation or share count the
+// transaction changes, for the scrubber (see fstxn.Changes).
+func (atxn *AllocTxn) ChangedBlocks() []common.Bnum {
+	bns := make([]common.Bnum, 0, len(atxn.allocBnums)+len(atxn.freeBnums))
+	bns = append(bns, atxn.allocBnums...)
+	bns = append(bns, atxn.freeBnums...)
+	for bn, s := range atxn.shares {
+		if s.dirty {
+			bns = append(bns, bn)
+		}
+	}
+	return bns
+}
+
+// Commit commits the transaction to the log, and waits until it is
+// durable if wait.  A transaction that holds Snaps.mu or quota entries
+// commits before releasing them, and applies its changes to snapshots
+// while holding their listMu, but waits without any of them.
+func (atxn *AllocTxn) Commit(wait bool) bool {
+	if !atxn.sharing && !atxn.charging {
+		return atxn.Op.CommitWait(wait)
+	}
+	var ok bool
+	if atxn.Snaps != nil && atxn.changesSnapshots() {
+		atxn.Snaps.listMu.Lock()
+		ok = atxn.Op.CommitWait(false)
+		if ok {
+			atxn.Snaps.apply(atxn)
+		}
+		atxn.Snaps.listMu.Unlock()
+	} else {
+		ok = atxn.Op.CommitWait(false)
+	}
+	atxn.unlockQuotas(ok)
+	atxn.unlockShares()
+	if ok && wait {
+		ok = atxn.Log.Flush()
+	}
+	return ok
+}
+
+// On-disk bitmap has been updated; update in-memory state for free
+// bits.  Freed blocks that must be discarded stay in use until the
+// commit is durable.
 func (atxn *AllocTxn) PostCommit() {
+	atxn.unlockQuotas(false)
+	atxn.unlockShares()
 	util.DPrintf(1, "updateFree: inums %v blks %v\n", atxn.freeInums, atxn.freeBnums)
 	for _, inum := range atxn.freeInums {
-		atxn.Ialloc.FreeNum(uint64(inum))
+		atxn.freeInum(inum)
+	}
+	if atxn.Discards != nil {
+		atxn.Discards.queue(atxn.freeBnums)
+		return
 	}
 	for _, bn := range atxn.freeBnums {
 		atxn.Balloc.FreeNum(bn)
 	}
 }
 
+// PostCommitDurable is PostCommit for a durable commit, which started
+// after Discards.Mark returned mark: it discards and frees the blocks
+// freed by this transaction and by those that committed before it.
+func (atxn *AllocTxn) PostCommitDurable(mark uint64) {
+	atxn.unlockQuotas(false)
+	atxn.unlockShares()
+	if atxn.Discards == nil {
+		atxn.PostCommit()
+		return
+	}
+	util.DPrintf(1, "updateFree: inums %v blks %v\n", atxn.freeInums, atxn.freeBnums)
+	for _, inum := range atxn.freeInums {
+		atxn.freeInum(inum)
+	}
+	atxn.Discards.Flush(mark, atxn.freeBnums)
+}
+
 // Abort: free allocated inums and bnums. Nothing to do for freed
 // ones, because in-memory state hasn't been updated by freeINum()/freeBlock().
 func (atxn *AllocTxn) PostAbort() {
+	atxn.unlockQuotas(false)
+	atxn.unlockShares()
 	util.DPrintf(1, "Abort: inums %v blks %v\n", atxn.allocInums, atxn.allocBnums)
 	for _, inum := range atxn.allocInums {
-		atxn.Ialloc.FreeNum(uint64(inum))
+		atxn.freeInum(inum)
 	}
 	for _, bn := range atxn.allocBnums {
 		atxn.Balloc.FreeNum(bn)
@@ -117,25 +297,99 @@ func (atxn *AllocTxn) AssertValidBlock(blkno common.Bnum) {
 	}
 }
 
-func (atxn *AllocTxn) AllocBlock() common.Bnum {
-	util.DPrintf(5, "alloc block\n")
-	bn := common.Bnum(atxn.Balloc.AllocNum())
+// InodeGoal returns the block near which inum's blocks should be
+// allocated if there is no better hint.  It spreads the inode table
+// evenly over the data area, so that files with nearby inode numbers
+// (e.g., files in the same directory) have nearby blocks.  Inodes in
+// a chunk start right after their chunk.
+func (atxn *AllocTxn) InodeGoal(inum common.Inum) common.Bnum {
+	if !atxn.Super.InTable(inum) {
+		bn, _ := atxn.Super.Inum2Chunk(inum)
+		return bn + 1
+	}
+	start := uint64(atxn.Super.DataStart())
+	ndata := uint64(atxn.Super.MaxBnum()) - start
+	n := uint64(atxn.Super.NInode())
+	i := uint64(inum) % n
+	return common.Bnum(start + i*(ndata/n) + i*(ndata%n)/n)
+}
+
+// New blocks are zeroed, because free blocks may hold stale data
+// (e.g., after mkfs over an old file system).
+func (atxn *AllocTxn) recordAlloc(bn common.Bnum) common.Bnum {
 	atxn.AssertValidBlock(bn)
 	util.DPrintf(1, "alloc block -> %v\n", bn)
 	if bn != common.NULLBNUM {
+		atxn.ZeroBlock(bn)
 		atxn.allocBnums = append(atxn.allocBnums, bn)
 	}
 	return bn
 }
 
-func (atxn *AllocTxn) FreeBlock(blkno common.Bnum) {
+// Returns whether the transaction may allocate a block: only a
+// transaction with UseReserved may take the last NReserved free ones.
+// Concurrent transactions may together take a few more.  Blocks in
+// preallocation windows don't count, since their owners can take them
+// regardless; the windows are given up once the rest runs short.
+func (atxn *AllocTxn) mayAlloc() bool {
+	if atxn.UseReserved || atxn.Super.NReserved() == 0 {
+		return true
+	}
+	if atxn.Balloc.NumUnreserved() > atxn.Super.NReserved() {
+		return true
+	}
+	atxn.Balloc.ReleaseWindows()
+	if atxn.Balloc.NumUnreserved() > atxn.Super.NReserved() {
+		return true
+	}
+	util.DPrintf(1, "alloc block: only reserved blocks left\n")
+	return false
+}
+
+// AllocBlock allocates a block, preferably at goal. A goal of 0
+// means no preference.
+func (atxn *AllocTxn) AllocBlock(goal common.Bnum) common.Bnum {
+	util.DPrintf(5, "alloc block near %v\n", goal)
+	if !atxn.mayAlloc() {
+		return common.NULLBNUM
+	}
+	bn := common.Bnum(atxn.Balloc.AllocNumNear(uint64(goal)))
+	return atxn.recordAlloc(bn)
+}
+
+// AllocBlockWindow allocates a block at goal from owner's
+// preallocation window, for appends to a file.
+func (atxn *AllocTxn) AllocBlockWindow(owner common.Inum, goal common.Bnum) common.Bnum {
+	util.DPrintf(5, "alloc block for # %v near %v\n", owner, goal)
+	if !atxn.mayAlloc() {
+		return common.NULLBNUM
+	}
+	bn := common.Bnum(atxn.Balloc.AllocNumWindow(uint64(owner), uint64(goal)))
+	return atxn.recordAlloc(bn)
+}
+
+// ReleaseWindow gives up owner's preallocated blocks (e.g., because
+// the file shrinks or is freed).
+func (atxn *AllocTxn) ReleaseWindow(owner common.Inum) {
+	atxn.Balloc.ReleaseWindow(uint64(owner))
+}
+
+// FreeBlock frees blkno, and returns false if it just lost a reference
+// (or is 0).  The block keeps its data until it is discarded or
+// allocated again, which zeroes it.
+func (atxn *AllocTxn) FreeBlock(blkno common.Bnum) bool {
 	util.DPrintf(1, "free block %v\n", blkno)
 	atxn.AssertValidBlock(blkno)
 	if blkno == 0 {
-		return
+		return false
+	}
+	// a shared block just loses a reference
+	if atxn.unshare(blkno) {
+		return false
 	}
-	atxn.ZeroBlock(blkno)
+	atxn.clearCsum(blkno)
 	atxn.freeBnums = append(atxn.freeBnums, blkno)
+	return true
 }
 
 func (atxn *AllocTxn) ReadBlock(blkno common.Bnum) *buf.Buf {
@@ -145,11 +399,10 @@ func (atxn *AllocTxn) ReadBlock(blkno common.Bnum) *buf.Buf {
 	return atxn.Op.ReadBuf(addr, common.NBITBLOCK)
 }
 
+// ZeroBlock overwrites blkno with zeros, without reading it.
 func (atxn *AllocTxn) ZeroBlock(blkno common.Bnum) {
 	util.DPrintf(5, "zero block %d\n", blkno)
-	buf := atxn.ReadBlock(blkno)
-	for i := range buf.Data {
-		buf.Data[i] = 0
-	}
-	buf.SetDirty()
+	atxn.AssertValidBlock(blkno)
+	atxn.Op.OverWrite(atxn.Super.Block2addr(blkno), common.NBITBLOCK,
+		make([]byte, disk.BlockSize))
 }
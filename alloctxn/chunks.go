@@ -0,0 +1,291 @@
+package alloctxn
+
+import (
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// Inode chunks extend the fixed inode table.  When the table is full,
+// AllocINum turns a data block into a chunk of INODEBLK inodes.  A
+// chunk slot is free if its inode's kind is 0 on disk, like in the
+// table.  Chunks are never returned to the block allocator.
+//
+// The chunk block numbers are recorded in a registry, rooted in the
+// slot of inode 0 (which is never allocated): NREGROOT pointers to
+// index blocks, each pointing to NPTR registry blocks with NPTR chunk
+// block numbers each.  An image whose inode 0 is all zeros has no
+// chunks.
+//
+
+const (
+	NPTR     uint64 = disk.BlockSize / 8
+	NREGROOT uint64 = common.INODESZ / 8
+	allSlots uint32 = 0xffffffff // INODEBLK bits
+)
+
+type chunk struct {
+	bnum common.Bnum
+	free uint32 // bit i is set if slot i is free
+}
+
+type ChunkMap struct {
+	mu     *sync.Mutex
+	growMu *sync.Mutex // serializes adding chunks
+	chunks []*chunk    // in registry order
+	byBnum map[common.Bnum]*chunk
+	nfree  uint64
+	next   uint64 // chunk to try first
+}
+
+func (cm *ChunkMap) add(bn common.Bnum, free uint32) {
+	c := &chunk{bnum: bn, free: free}
+	cm.chunks = append(cm.chunks, c)
+	cm.byBnum[bn] = c
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		if free&(1<<i) != 0 {
+			cm.nfree++
+		}
+	}
+}
+
+func readPtr(log *obj.Log, bn common.Bnum, i uint64) common.Bnum {
+	b := log.Load(addr.MkAddr(bn, i*64), 64)
+	return b.BnumGet(0)
+}
+
+// Returns the free slots of chunk bn.
+func chunkFree(log *obj.Log, bn common.Bnum) uint32 {
+	b := log.Load(addr.MkAddr(bn, 0), common.NBITBLOCK)
+	var free = uint32(0)
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		dec := marshal.NewDec(b.Data[i*common.INODESZ : (i+1)*common.INODESZ])
+		if dec.GetInt32() == 0 { // NF3FREE
+			free = free | (1 << i)
+		}
+	}
+	return free
+}
+
+// WalkRegistry calls f on each block of the chunk registry: on index
+// and registry blocks with chunk false, and on chunks with chunk true.
+// It follows the pointers in a block only if f returns true for it.
+func WalkRegistry(super *super.FsSuper, log *obj.Log, f func(bn common.Bnum, chunk bool) bool) {
+	rootblk := super.InodeStart() // inode 0 is at offset 0
+	for r := uint64(0); r < NREGROOT; r++ {
+		ind := readPtr(log, rootblk, r)
+		if ind == common.NULLBNUM {
+			break
+		}
+		if !f(ind, false) {
+			continue
+		}
+		for i := uint64(0); i < NPTR; i++ {
+			reg := readPtr(log, ind, i)
+			if reg == common.NULLBNUM {
+				break
+			}
+			if !f(reg, false) {
+				continue
+			}
+			for j := uint64(0); j < NPTR; j++ {
+				bn := readPtr(log, reg, j)
+				if bn == common.NULLBNUM {
+					break
+				}
+				f(bn, true)
+			}
+		}
+	}
+}
+
+// MkChunkMap reads the chunk registry and the free slots of each
+// chunk.
+func MkChunkMap(super *super.FsSuper, log *obj.Log) *ChunkMap {
+	cm := &ChunkMap{
+		mu:     new(sync.Mutex),
+		growMu: new(sync.Mutex),
+		chunks: make([]*chunk, 0),
+		byBnum: make(map[common.Bnum]*chunk),
+	}
+	WalkRegistry(super, log, func(bn common.Bnum, chunk bool) bool {
+		if chunk {
+			cm.add(bn, chunkFree(log, bn))
+		}
+		return true
+	})
+	util.DPrintf(1, "MkChunkMap: %d chunks %d free\n", len(cm.chunks), cm.nfree)
+	return cm
+}
+
+// IsChunk returns whether bn is an inode chunk.
+func (cm *ChunkMap) IsChunk(bn common.Bnum) bool {
+	cm.mu.Lock()
+	_, ok := cm.byBnum[bn]
+	cm.mu.Unlock()
+	return ok
+}
+
+func (cm *ChunkMap) NumChunks() uint64 {
+	cm.mu.Lock()
+	n := uint64(len(cm.chunks))
+	cm.mu.Unlock()
+	return n
+}
+
+// Bnums returns the chunk blocks, in registry order.
+func (cm *ChunkMap) Bnums() []common.Bnum {
+	cm.mu.Lock()
+	bns := make([]common.Bnum, len(cm.chunks))
+	for i, c := range cm.chunks {
+		bns[i] = c.bnum
+	}
+	cm.mu.Unlock()
+	return bns
+}
+
+func (cm *ChunkMap) NumFree() uint64 {
+	cm.mu.Lock()
+	n := cm.nfree
+	cm.mu.Unlock()
+	return n
+}
+
+// Take a free slot from c, if any.  Assumes caller holds cm.mu.
+func (cm *ChunkMap) take(sup *super.FsSuper, c *chunk) common.Inum {
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		if c.free&(1<<i) != 0 {
+			c.free = c.free & ^(1 << i)
+			cm.nfree--
+			return sup.ChunkInum(c.bnum, i)
+		}
+	}
+	return common.NULLINUM
+}
+
+// Allocates a free slot, preferably in the chunk of goal.
+func (cm *ChunkMap) alloc(sup *super.FsSuper, goal common.Inum) common.Inum {
+	var inum = common.NULLINUM
+	cm.mu.Lock()
+	if cm.nfree > 0 {
+		if !sup.InTable(goal) {
+			bn, _ := sup.Inum2Chunk(goal)
+			c := cm.byBnum[bn]
+			if c != nil {
+				inum = cm.take(sup, c)
+			}
+		}
+		n := uint64(len(cm.chunks))
+		for i := uint64(0); i < n && inum == common.NULLINUM; i++ {
+			idx := (cm.next + i) % n
+			inum = cm.take(sup, cm.chunks[idx])
+			if inum != common.NULLINUM {
+				cm.next = idx
+			}
+		}
+	}
+	cm.mu.Unlock()
+	return inum
+}
+
+func (cm *ChunkMap) free(sup *super.FsSuper, inum common.Inum) {
+	bn, slot := sup.Inum2Chunk(inum)
+	cm.mu.Lock()
+	c := cm.byBnum[bn]
+	if c == nil || c.free&(1<<slot) != 0 {
+		panic("ChunkMap.free")
+	}
+	c.free = c.free | (1 << slot)
+	cm.nfree++
+	cm.mu.Unlock()
+}
+
+// Returns the pointer at index i of block bn, allocating a block for it near goal if it doesn't exist.
+func (atxn *AllocTxn) getOrAllocPtr(bn common.Bnum, i uint64, goal common.Bnum) common.Bnum {
+	b := atxn.Op.ReadBuf(addr.MkAddr(bn, i*64), 64)
+	var ptr = b.BnumGet(0)
+	if ptr == common.NULLBNUM {
+		ptr = atxn.AllocBlock(goal)
+		if ptr != common.NULLBNUM {
+			b.BnumPut(0, ptr)
+		}
+	}
+	return ptr
+}
+
+// Record chunk bn as entry idx of the registry.
+func (atxn *AllocTxn) registerChunk(idx uint64, bn common.Bnum) bool {
+	r := idx / (NPTR * NPTR)
+	if r >= NREGROOT {
+		return false
+	}
+	ind := atxn.getOrAllocPtr(atxn.Super.InodeStart(), r, bn)
+	if ind == common.NULLBNUM {
+		return false
+	}
+	reg := atxn.getOrAllocPtr(ind, (idx/NPTR)%NPTR, bn)
+	if reg == common.NULLBNUM {
+		return false
+	}
+	b := atxn.Op.ReadBuf(addr.MkAddr(reg, (idx%NPTR)*64), 64)
+	b.BnumPut(0, bn)
+	return true
+}
+
+// Adds a chunk in a separate transaction, so that it doesn't matter
+// whether atxn commits, and returns whether it succeeded.  The new
+// chunk is placed near goal.
+func (atxn *AllocTxn) growChunks(goal common.Inum) bool {
+	cm := atxn.Chunks
+	var bgoal common.Bnum
+	if atxn.Super.InTable(goal) {
+		bgoal = atxn.InodeGoal(goal)
+	} else {
+		bn, _ := atxn.Super.Inum2Chunk(goal)
+		bgoal = bn + 1
+	}
+	sub := Begin(atxn.State)
+	bn := sub.AllocBlock(bgoal)
+	if bn == common.NULLBNUM {
+		sub.PostAbort()
+		return false
+	}
+	if !sub.registerChunk(cm.NumChunks(), bn) {
+		sub.PostAbort()
+		return false
+	}
+	sub.PreCommit()
+	ok := sub.Op.CommitWait(false)
+	sub.PostCommit()
+	if !ok {
+		return false
+	}
+	cm.mu.Lock()
+	cm.add(bn, allSlots)
+	cm.mu.Unlock()
+	util.DPrintf(1, "growChunks: new chunk %v\n", bn)
+	return true
+}
+
+// Allocates an inode from a chunk, adding a chunk if all are full.
+func (atxn *AllocTxn) allocChunkInum(goal common.Inum) common.Inum {
+	cm := atxn.Chunks
+	var inum = cm.alloc(atxn.Super, goal)
+	if inum == common.NULLINUM {
+		cm.growMu.Lock()
+		inum = cm.alloc(atxn.Super, goal) // maybe someone else grew
+		if inum == common.NULLINUM && atxn.growChunks(goal) {
+			inum = cm.alloc(atxn.Super, goal)
+		}
+		cm.growMu.Unlock()
+	}
+	return inum
+}
@@ -0,0 +1,101 @@
+package alloctxn
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+)
+
+//
+// Data blocks written through an inode have a CRC32C checksum in the
+// checksum blocks, which the transaction that writes the data updates
+// too.  A checksum of 0 means the block has none: it was never written
+// through an inode, or it is free (FreeBlock clears its checksum); data
+// whose CRC is 0 is recorded as sum 1 instead (see blockCsum).  Legacy
+// images, without checksum blocks, skip all of this.
+//
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Csums counts checksum verifications.
+type Csums struct {
+	verified uint64 // accessed atomically
+	bad      uint64 // accessed atomically
+}
+
+type CsumStats struct {
+	Verified uint64
+	Bad      uint64
+}
+
+func MkCsums() *Csums {
+	return &Csums{}
+}
+
+func (cs *Csums) Stats() CsumStats {
+	return CsumStats{
+		Verified: atomic.LoadUint64(&cs.verified),
+		Bad:      atomic.LoadUint64(&cs.bad),
+	}
+}
+
+// Returns the checksum of data, which is never 0.
+func blockCsum(data []byte) uint32 {
+	sum := crc32.Checksum(data, castagnoli)
+	if sum == 0 {
+		return 1
+	}
+	return sum
+}
+
+func encodeCsum(sum uint32) []byte {
+	enc := marshal.NewEnc(4)
+	enc.PutInt32(sum)
+	return enc.Finish()
+}
+
+func (atxn *AllocTxn) readCsum(blkno common.Bnum) uint32 {
+	b := atxn.Op.ReadBuf(atxn.Super.Csum2addr(blkno), 32)
+	return marshal.NewDec(b.Data).GetInt32()
+}
+
+func (atxn *AllocTxn) writeCsum(blkno common.Bnum, sum uint32) {
+	atxn.Op.OverWrite(atxn.Super.Csum2addr(blkno), 32, encodeCsum(sum))
+}
+
+// SetCsum records the checksum of data, the new contents of blkno.
+func (atxn *AllocTxn) SetCsum(blkno common.Bnum, data []byte) {
+	if atxn.Super.Legacy() {
+		return
+	}
+	atxn.writeCsum(blkno, blockCsum(data))
+}
+
+// VerifyCsum returns false if blkno has a checksum and data doesn't
+// match it.
+func (atxn *AllocTxn) VerifyCsum(blkno common.Bnum, data []byte) bool {
+	if atxn.Super.Legacy() {
+		return true
+	}
+	sum := atxn.readCsum(blkno)
+	if sum == 0 {
+		return true
+	}
+	ok := sum == blockCsum(data)
+	if atxn.Csums != nil {
+		atomic.AddUint64(&atxn.Csums.verified, 1)
+		if !ok {
+			atomic.AddUint64(&atxn.Csums.bad, 1)
+		}
+	}
+	return ok
+}
+
+func (atxn *AllocTxn) clearCsum(blkno common.Bnum) {
+	if !atxn.Super.Legacy() {
+		atxn.writeCsum(blkno, 0)
+	}
+}
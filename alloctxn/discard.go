@@ -0,0 +1,142 @@
+package alloctxn
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+//
+// On a disk that can discard (e.g., a sparse image file), freed blocks
+// are discarded, but only once the transaction that freed them is
+// durable: before that, a crash would bring back the file that used
+// them.  Until then, they stay allocated in memory, so that no
+// transaction can reuse them and have its data discarded.  A
+// transaction that waits for its commit discards its blocks and those
+// of the transactions that committed before it; blocks of transactions
+// that don't wait are pending until then.
+//
+// Discarding only saves space: a block may still get old data from the
+// log after it was discarded, but a block is zeroed when it is
+// allocated anyway.
+//
+
+type pendingBlock struct {
+	seq uint64
+	bn  common.Bnum
+}
+
+type Discards struct {
+	d         diskfile.Discarder
+	balloc    *alloc.Alloc
+	mu        *sync.Mutex
+	pending   []pendingBlock
+	next      uint64 // seq of the next pending block
+	discarded uint64 // accessed atomically
+	failed    uint64 // accessed atomically
+}
+
+type DiscardStats struct {
+	Discarded uint64
+	Failed    uint64
+	Pending   uint64
+}
+
+// MkDiscards returns nil if d can't discard.
+func MkDiscards(d disk.Disk, balloc *alloc.Alloc) *Discards {
+	dd, ok := d.(diskfile.Discarder)
+	if !ok {
+		return nil
+	}
+	return &Discards{
+		d:       dd,
+		balloc:  balloc,
+		mu:      new(sync.Mutex),
+		pending: make([]pendingBlock, 0),
+	}
+}
+
+func (ds *Discards) Stats() DiscardStats {
+	if ds == nil {
+		return DiscardStats{}
+	}
+	ds.mu.Lock()
+	n := uint64(len(ds.pending))
+	ds.mu.Unlock()
+	return DiscardStats{
+		Discarded: atomic.LoadUint64(&ds.discarded),
+		Failed:    atomic.LoadUint64(&ds.failed),
+		Pending:   n,
+	}
+}
+
+// Mark returns a mark for the blocks pending so far, to pass to Flush
+// once a commit that started after Mark is durable.
+func (ds *Discards) Mark() uint64 {
+	if ds == nil {
+		return 0
+	}
+	ds.mu.Lock()
+	seq := ds.next
+	ds.mu.Unlock()
+	return seq
+}
+
+func (ds *Discards) queue(bns []common.Bnum) {
+	ds.mu.Lock()
+	for _, bn := range bns {
+		ds.pending = append(ds.pending, pendingBlock{seq: ds.next, bn: bn})
+		ds.next++
+	}
+	ds.mu.Unlock()
+}
+
+// Flush discards and frees the blocks pending before mark, and own.
+func (ds *Discards) Flush(mark uint64, own []common.Bnum) {
+	if ds == nil {
+		return
+	}
+	var bns = append([]common.Bnum{}, own...)
+	ds.mu.Lock()
+	var i = 0
+	for i < len(ds.pending) && ds.pending[i].seq < mark {
+		bns = append(bns, ds.pending[i].bn)
+		i++
+	}
+	ds.pending = ds.pending[i:]
+	ds.mu.Unlock()
+	if len(bns) == 0 {
+		return
+	}
+	ds.discard(bns)
+	for _, bn := range bns {
+		ds.balloc.FreeNum(uint64(bn))
+	}
+}
+
+// Discards bns in runs of consecutive blocks.
+func (ds *Discards) discard(bns []common.Bnum) {
+	sort.Slice(bns, func(i, j int) bool { return bns[i] < bns[j] })
+	var start = 0
+	for i := 1; i <= len(bns); i++ {
+		if i < len(bns) && bns[i] == bns[i-1]+1 {
+			continue
+		}
+		n := uint64(i - start)
+		err := ds.d.Discard(uint64(bns[start]), n)
+		if err != nil {
+			util.DPrintf(0, "discard [%d, %d): %v\n", bns[start], uint64(bns[start])+n, err)
+			atomic.AddUint64(&ds.failed, n)
+		} else {
+			atomic.AddUint64(&ds.discarded, n)
+		}
+		start = i
+	}
+}
@@ -0,0 +1,555 @@
+package alloctxn
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// Quotas limit the blocks and inodes of each user and group: an inode
+// and the blocks allocated for it are charged to its owner's uid and
+// gid.  The quota table has an entry per user or group with limits or
+// usage, after a header with the grace periods.  An entry has soft and
+// hard limits (0 is no limit); once usage goes over the soft limit, a
+// grace period starts, after which the soft limit holds like the hard
+// one.  A user or group gets an entry the first time it is charged,
+// and loses it when it has neither limits nor usage; if the table has
+// no room for the entry, the charge fails like one over quota.
+//
+// A transaction charges an entry as it allocates, under the entry's
+// lock: what it adds is pending until it commits, and counts against
+// the limits for every transaction, so that concurrent ones don't go
+// over a limit together.  At commit, it locks the entries it changed,
+// in order, and writes them; it holds their locks only until its
+// changes are in the log, so that the entries commit in the order they
+// are written.  Quotas.mu guards only the table (and the grace
+// periods), and is never taken while holding an entry's lock.  Frees
+// are never held to the limits, nor are the copies of shared blocks
+// that freeing needs.  A block shared with a snapshot or a clone stays
+// charged to the owner that allocated it until it is freed.
+//
+
+const (
+	// default grace period, in seconds
+	DEFGRACE uint64 = 7 * 24 * 60 * 60
+)
+
+type QuotaKind uint32
+
+const (
+	UserQuota  QuotaKind = 1
+	GroupQuota QuotaKind = 2
+)
+
+// A QuotaId names a user or a group.
+type QuotaId struct {
+	Kind QuotaKind
+	Id   uint32
+}
+
+// An Owner is the uid and gid an inode is charged to.
+type Owner struct {
+	Uid uint32
+	Gid uint32
+}
+
+func (o Owner) ids() []QuotaId {
+	return []QuotaId{{Kind: UserQuota, Id: o.Uid}, {Kind: GroupQuota, Id: o.Gid}}
+}
+
+// QuotaLimits are the limits of a user or group, in blocks and inodes.
+type QuotaLimits struct {
+	BlockSoft uint64
+	BlockHard uint64
+	InodeSoft uint64
+	InodeHard uint64
+}
+
+// A Quota is the entry of a user or group.  An expiry is the Unix time
+// at which its grace period ends, or 0 if usage is within the soft
+// limit.
+type Quota struct {
+	QuotaId
+	QuotaLimits
+	Blocks      uint64
+	Inodes      uint64
+	BlockExpire uint64
+	InodeExpire uint64
+	slot        uint64
+}
+
+type Quotas struct {
+	mu         *sync.Mutex
+	ents       map[QuotaId]*quotaEnt
+	free       []uint64 // free slots, lowest last
+	blockGrace uint64
+	inodeGrace uint64
+}
+
+// A quotaEnt is an entry in memory: q as committed, and the charges
+// pending in transactions that use it, as far as they increase usage.
+// users counts those transactions, under Quotas.mu; the rest is under
+// mu.
+type quotaEnt struct {
+	mu      *sync.Mutex
+	q       Quota
+	pending quotaDelta
+	users   uint64
+}
+
+type quotaDelta struct {
+	blocks int64
+	inodes int64
+}
+
+func decodeQuota(data []byte, slot uint64) *Quota {
+	dec := marshal.NewDec(data)
+	kind := QuotaKind(dec.GetInt32())
+	if kind == 0 {
+		return nil
+	}
+	q := &Quota{slot: slot}
+	q.Kind = kind
+	q.Id = dec.GetInt32()
+	q.BlockSoft = dec.GetInt()
+	q.BlockHard = dec.GetInt()
+	q.InodeSoft = dec.GetInt()
+	q.InodeHard = dec.GetInt()
+	q.Blocks = dec.GetInt()
+	q.Inodes = dec.GetInt()
+	q.BlockExpire = uint64(dec.GetInt32())
+	q.InodeExpire = uint64(dec.GetInt32())
+	return q
+}
+
+// Returns whether q has neither limits nor usage, and so no entry.
+func (q *Quota) empty() bool {
+	return q.QuotaLimits == (QuotaLimits{}) && q.Blocks == 0 && q.Inodes == 0
+}
+
+func (q *Quota) encode() []byte {
+	enc := marshal.NewEnc(super.QUOTASZ)
+	enc.PutInt32(uint32(q.Kind))
+	enc.PutInt32(q.Id)
+	enc.PutInt(q.BlockSoft)
+	enc.PutInt(q.BlockHard)
+	enc.PutInt(q.InodeSoft)
+	enc.PutInt(q.InodeHard)
+	enc.PutInt(q.Blocks)
+	enc.PutInt(q.Inodes)
+	enc.PutInt32(uint32(q.BlockExpire))
+	enc.PutInt32(uint32(q.InodeExpire))
+	return enc.Finish()
+}
+
+// MkQuotas loads the quota table of an image, which has none if it is
+// from before quotas.
+func MkQuotas(sup *super.FsSuper, log *obj.Log) *Quotas {
+	qs := &Quotas{
+		mu:         new(sync.Mutex),
+		ents:       make(map[QuotaId]*quotaEnt),
+		free:       make([]uint64, 0),
+		blockGrace: DEFGRACE,
+		inodeGrace: DEFGRACE,
+	}
+	if sup.Legacy() {
+		return qs
+	}
+	hdr := marshal.NewDec(log.Load(sup.Quota2addr(0), super.QUOTASZ*8).Data)
+	if g := hdr.GetInt(); g != 0 {
+		qs.blockGrace = g
+	}
+	if g := hdr.GetInt(); g != 0 {
+		qs.inodeGrace = g
+	}
+	for slot := sup.NQuota() - 1; slot > 0; slot-- {
+		b := log.Load(sup.Quota2addr(slot), super.QUOTASZ*8)
+		q := decodeQuota(b.Data, slot)
+		if q == nil {
+			qs.free = append(qs.free, slot)
+			continue
+		}
+		qs.ents[q.QuotaId] = &quotaEnt{mu: new(sync.Mutex), q: *q}
+	}
+	util.DPrintf(1, "MkQuotas: %d entries\n", len(qs.ents))
+	return qs
+}
+
+// Get returns the entry of id, and false if it has none.
+func (qs *Quotas) Get(id QuotaId) (Quota, bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	e := qs.ents[id]
+	if e == nil {
+		return Quota{QuotaId: id}, false
+	}
+	e.mu.Lock()
+	q := e.q
+	e.mu.Unlock()
+	return q, !q.empty()
+}
+
+// List returns the entries, users first, by id.
+func (qs *Quotas) List() []Quota {
+	qs.mu.Lock()
+	var l = make([]Quota, 0, len(qs.ents))
+	for _, e := range qs.ents {
+		e.mu.Lock()
+		if !e.q.empty() {
+			l = append(l, e.q)
+		}
+		e.mu.Unlock()
+	}
+	qs.mu.Unlock()
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Kind != l[j].Kind {
+			return l[i].Kind < l[j].Kind
+		}
+		return l[i].Id < l[j].Id
+	})
+	return l
+}
+
+// Grace returns the grace periods for blocks and inodes, in seconds.
+func (qs *Quotas) Grace() (uint64, uint64) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.blockGrace, qs.inodeGrace
+}
+
+// Returns whether used can change by delta within the limits soft and
+// hard, whose grace period ends at expire, at time now.
+func withinLimit(used uint64, delta int64, soft uint64, hard uint64, expire uint64, now uint64) bool {
+	if delta <= 0 {
+		return true
+	}
+	n := addDelta(used, delta)
+	if hard != 0 && n > hard {
+		return false
+	}
+	return soft == 0 || n <= soft || expire == 0 || now < expire
+}
+
+// Returns used changed by delta, but not below 0 (e.g., when freeing
+// a block that a clone's owner was charged for).
+func addDelta(used uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > used {
+		return 0
+	}
+	return uint64(int64(used) + delta)
+}
+
+// Returns the expiry of usage used with soft limit soft, which was old.
+func expiry(used uint64, soft uint64, old uint64, grace uint64, now uint64) uint64 {
+	if soft == 0 || used <= soft {
+		return 0
+	}
+	if old != 0 {
+		return old
+	}
+	return now + grace
+}
+
+// Returns n if it is positive, and 0 otherwise.
+func pos(n int64) int64 {
+	if n > 0 {
+		return n
+	}
+	return 0
+}
+
+// The part of charge c that is pending in its entry.
+func (c quotaDelta) pending() quotaDelta {
+	return quotaDelta{blocks: pos(c.blocks), inodes: pos(c.inodes)}
+}
+
+// Changes a transaction's pending charge to e from that of c to that
+// of n, if what that adds keeps e within its limits at time now (or
+// regardless, unless check).
+func (e *quotaEnt) reserve(c quotaDelta, n quotaDelta, check bool, now uint64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d := quotaDelta{
+		blocks: n.pending().blocks - c.pending().blocks,
+		inodes: n.pending().inodes - c.pending().inodes,
+	}
+	q := &e.q
+	if check && (!withinLimit(q.Blocks+uint64(e.pending.blocks), d.blocks,
+		q.BlockSoft, q.BlockHard, q.BlockExpire, now) ||
+		!withinLimit(q.Inodes+uint64(e.pending.inodes), d.inodes,
+			q.InodeSoft, q.InodeHard, q.InodeExpire, now)) {
+		return false
+	}
+	e.pending.blocks += d.blocks
+	e.pending.inodes += d.inodes
+	return true
+}
+
+// Returns the entry of id, which the transaction then uses until it
+// commits or aborts.  If id has none, it makes one if create and the
+// table has room, and returns nil otherwise.
+func (atxn *AllocTxn) useQuota(id QuotaId, create bool) *quotaEnt {
+	if e := atxn.qents[id]; e != nil {
+		return e
+	}
+	qs := atxn.Quotas
+	qs.mu.Lock()
+	var e = qs.ents[id]
+	if e == nil {
+		if !create || len(qs.free) == 0 {
+			qs.mu.Unlock()
+			if create {
+				util.DPrintf(0, "quota table full: no entry for %v\n", id)
+			}
+			return nil
+		}
+		slot := qs.free[len(qs.free)-1]
+		qs.free = qs.free[:len(qs.free)-1]
+		e = &quotaEnt{mu: new(sync.Mutex), q: Quota{QuotaId: id, slot: slot}}
+		qs.ents[id] = e
+	}
+	e.users++
+	qs.mu.Unlock()
+	atxn.qents[id] = e
+	return e
+}
+
+// Charges the deltas to the transaction, if the users and groups that
+// they increase are within their limits (or regardless, unless check),
+// and have room for an entry.  What the transaction frees first counts
+// against what it charges: a move or a free that doesn't increase usage
+// overall passes even over quota.
+func (atxn *AllocTxn) charge(ds map[QuotaId]quotaDelta, check bool) bool {
+	if atxn.Quotas == nil || atxn.Super.Legacy() {
+		return true
+	}
+	now := uint64(time.Now().Unix())
+	var reserved = make(map[QuotaId]*quotaEnt)
+	var ok = true
+	for id, d := range ds {
+		c := atxn.charges[id]
+		n := quotaDelta{blocks: c.blocks + d.blocks, inodes: c.inodes + d.inodes}
+		grows := n.blocks > 0 || n.inodes > 0
+		// without an entry, usage is 0, which can't go down
+		e := atxn.useQuota(id, grows)
+		if e == nil && grows {
+			ok = false
+			break
+		}
+		if e == nil {
+			continue
+		}
+		if !e.reserve(c, n, check, now) {
+			util.DPrintf(1, "charge %v: over quota\n", id)
+			ok = false
+			break
+		}
+		reserved[id] = e
+	}
+	if !ok {
+		for id, e := range reserved {
+			c := atxn.charges[id]
+			d := ds[id]
+			e.reserve(quotaDelta{blocks: c.blocks + d.blocks, inodes: c.inodes + d.inodes}, c, false, now)
+		}
+		atxn.overQuota = true
+		return false
+	}
+	for id, d := range ds {
+		c := atxn.charges[id]
+		c.blocks += d.blocks
+		c.inodes += d.inodes
+		atxn.charges[id] = c
+	}
+	return true
+}
+
+func ownerDeltas(o Owner, blocks int64, inodes int64) map[QuotaId]quotaDelta {
+	ds := make(map[QuotaId]quotaDelta)
+	for _, id := range o.ids() {
+		ds[id] = quotaDelta{blocks: blocks, inodes: inodes}
+	}
+	return ds
+}
+
+// ChargeBlock charges a block to o, and returns false if that would
+// take o over quota.
+func (atxn *AllocTxn) ChargeBlock(o Owner) bool {
+	return atxn.charge(ownerDeltas(o, 1, 0), true)
+}
+
+// ChargeBlockFreeing charges a block to o whatever o's limits, for a
+// copy that lets the transaction free blocks (e.g., of an index block
+// shared with a snapshot).
+func (atxn *AllocTxn) ChargeBlockFreeing(o Owner) {
+	over := atxn.overQuota
+	// fails only if there is no room for o's entry, and then o isn't
+	// charged
+	atxn.charge(ownerDeltas(o, 1, 0), false)
+	atxn.overQuota = over
+}
+
+// UnchargeBlock credits o with a block.
+func (atxn *AllocTxn) UnchargeBlock(o Owner) {
+	atxn.charge(ownerDeltas(o, -1, 0), true)
+}
+
+// ChargeInode charges an inode to o, and returns false if that would
+// take o over quota.
+func (atxn *AllocTxn) ChargeInode(o Owner) bool {
+	return atxn.charge(ownerDeltas(o, 0, 1), true)
+}
+
+// UnchargeInode credits o with an inode.
+func (atxn *AllocTxn) UnchargeInode(o Owner) {
+	atxn.charge(ownerDeltas(o, 0, -1), true)
+}
+
+// MoveCharge moves an inode and its blocks from owner from to owner to
+// (e.g., when it changes owner), and returns false if that would take
+// to over quota.
+func (atxn *AllocTxn) MoveCharge(from Owner, to Owner, blocks uint64) bool {
+	ds := make(map[QuotaId]quotaDelta)
+	for _, id := range from.ids() {
+		ds[id] = quotaDelta{blocks: -int64(blocks), inodes: -1}
+	}
+	for _, id := range to.ids() {
+		d := ds[id]
+		d.blocks += int64(blocks)
+		d.inodes += 1
+		ds[id] = d
+	}
+	return atxn.charge(ds, true)
+}
+
+// OverQuota returns whether an allocation failed because it would have
+// taken a user or group over quota, or the quota table had no room for
+// their entry.
+func (atxn *AllocTxn) OverQuota() bool {
+	return atxn.overQuota
+}
+
+// SetQuota sets the limits of id when the transaction commits.  Returns
+// false if id has no entry and the quota table has no room for one.
+func (atxn *AllocTxn) SetQuota(id QuotaId, limits QuotaLimits) bool {
+	if atxn.useQuota(id, limits != QuotaLimits{}) == nil {
+		return limits == QuotaLimits{}
+	}
+	atxn.limits[id] = limits
+	return true
+}
+
+// SetGrace sets the grace periods, in seconds, when the transaction
+// commits.
+func (atxn *AllocTxn) SetGrace(block uint64, inode uint64) {
+	atxn.grace = []uint64{block, inode}
+}
+
+func (atxn *AllocTxn) changesQuotas() bool {
+	return len(atxn.qents) > 0 || atxn.grace != nil
+}
+
+// Writes the entries the transaction changed, locking them until the
+// transaction commits or aborts, and Quotas.mu too if it changes the
+// grace periods.
+func (atxn *AllocTxn) commitQuotas() {
+	if !atxn.changesQuotas() {
+		return
+	}
+	qs := atxn.Quotas
+	qs.mu.Lock()
+	var bgrace, igrace = qs.blockGrace, qs.inodeGrace
+	if atxn.grace != nil {
+		bgrace, igrace = atxn.grace[0], atxn.grace[1]
+		enc := marshal.NewEnc(super.QUOTASZ)
+		enc.PutInt(bgrace)
+		enc.PutInt(igrace)
+		atxn.Op.OverWrite(atxn.Super.Quota2addr(0), super.QUOTASZ*8, enc.Finish())
+	} else {
+		qs.mu.Unlock()
+	}
+	atxn.charging = true
+	now := uint64(time.Now().Unix())
+	var ids = make([]QuotaId, 0, len(atxn.qents))
+	for id := range atxn.qents {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Kind != ids[j].Kind {
+			return ids[i].Kind < ids[j].Kind
+		}
+		return ids[i].Id < ids[j].Id
+	})
+	for _, id := range ids {
+		e := atxn.qents[id]
+		e.mu.Lock()
+		var q = e.q
+		if l, ok := atxn.limits[id]; ok {
+			q.QuotaLimits = l
+		}
+		c := atxn.charges[id]
+		q.Blocks = addDelta(q.Blocks, c.blocks)
+		q.Inodes = addDelta(q.Inodes, c.inodes)
+		q.BlockExpire = expiry(q.Blocks, q.BlockSoft, q.BlockExpire, bgrace, now)
+		q.InodeExpire = expiry(q.Inodes, q.InodeSoft, q.InodeExpire, igrace, now)
+		a := atxn.Super.Quota2addr(q.slot)
+		if q.empty() {
+			atxn.Op.OverWrite(a, super.QUOTASZ*8, make([]byte, super.QUOTASZ))
+		} else {
+			atxn.Op.OverWrite(a, super.QUOTASZ*8, q.encode())
+		}
+		atxn.quotas = append(atxn.quotas, &q)
+	}
+}
+
+// Releases the entries the transaction uses, after applying the ones
+// it wrote if it committed, and drops its pending charges from them.
+// An entry left with neither limits nor usage, and that no transaction
+// uses, goes, freeing its slot.
+func (atxn *AllocTxn) unlockQuotas(committed bool) {
+	if len(atxn.qents) == 0 && !atxn.charging {
+		return
+	}
+	qs := atxn.Quotas
+	var written = make(map[QuotaId]*Quota)
+	for _, q := range atxn.quotas {
+		written[q.QuotaId] = q
+	}
+	for id, e := range atxn.qents {
+		if !atxn.charging {
+			e.mu.Lock()
+		}
+		p := atxn.charges[id].pending()
+		e.pending.blocks -= p.blocks
+		e.pending.inodes -= p.inodes
+		if q := written[id]; committed && q != nil {
+			e.q = *q
+		}
+		e.mu.Unlock()
+	}
+	if atxn.charging && atxn.grace != nil {
+		if committed {
+			qs.blockGrace, qs.inodeGrace = atxn.grace[0], atxn.grace[1]
+		}
+		qs.mu.Unlock()
+	}
+	atxn.charging = false
+	qs.mu.Lock()
+	for id, e := range atxn.qents {
+		e.users--
+		if e.users == 0 && e.q.empty() {
+			delete(qs.ents, id)
+			qs.free = append(qs.free, e.q.slot)
+		}
+	}
+	qs.mu.Unlock()
+	atxn.qents = make(map[QuotaId]*quotaEnt)
+	atxn.quotas = nil
+}
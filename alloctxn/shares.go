@@ -0,0 +1,205 @@
+package alloctxn
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// A block is shared when more than one pointer refers to it: a file's
+// and those in the copies of its inode that snapshots keep.  Its share
+// count, in the share blocks, is the number of pointers beyond the
+// first, so that a block that was never shared (and every block of an
+// image from before snapshots) has count 0.  A writer copies a shared
+// block before changing it, and freeing a shared block just drops a
+// reference (see CopyShared and FreeBlock).  When the copy of an index
+// block is made, the blocks it points to gain a reference, so that
+// sharing a whole tree only takes a reference to its root.
+//
+// Share counts change under Snapshots.mu: a transaction that reads a
+// nonzero count or changes one holds it until it commits or aborts, so
+// that the counts it commits agree with the pointers it changes.  A
+// count of 0 can be read without the lock if the blocks above it are
+// private, since only a transaction that can reach a block can share
+// it.
+//
+
+const MAXSHARES uint64 = 0xffff
+
+type share struct {
+	n     uint64
+	dirty bool
+}
+
+// ReadShares returns the committed share count of bn, for checkers.
+func ReadShares(sup *super.FsSuper, log *obj.Log, bn common.Bnum) uint64 {
+	if sup.Legacy() {
+		return 0
+	}
+	b := log.Load(sup.Share2addr(bn), 16)
+	return uint64(b.Data[0]) | uint64(b.Data[1])<<8
+}
+
+func (atxn *AllocTxn) loadShares(bn common.Bnum) uint64 {
+	return ReadShares(atxn.Super, atxn.Log, bn)
+}
+
+func (atxn *AllocTxn) writeShares(bn common.Bnum, n uint64) {
+	atxn.Op.OverWrite(atxn.Super.Share2addr(bn), 16, []byte{byte(n), byte(n >> 8)})
+}
+
+// Takes Snapshots.mu until the transaction commits or aborts.  Offline
+// transactions (without Snaps) have nothing to exclude.
+func (atxn *AllocTxn) lockShares() {
+	if atxn.sharing {
+		return
+	}
+	if atxn.Snaps != nil {
+		atxn.Snaps.mu.Lock()
+	}
+	atxn.sharing = true
+}
+
+// Sharing returns whether the transaction holds Snapshots.mu (see
+// lockShares).  Another transaction may hold an inode lock while it
+// waits for Snapshots.mu, so a transaction that holds it must not wait
+// for an inode lock.
+func (atxn *AllocTxn) Sharing() bool {
+	return atxn.sharing && atxn.Snaps != nil
+}
+
+func (atxn *AllocTxn) unlockShares() {
+	if !atxn.sharing {
+		return
+	}
+	atxn.sharing = false
+	if atxn.Snaps != nil {
+		atxn.Snaps.mu.Unlock()
+	}
+}
+
+// Shares returns the share count of bn as of this transaction.
+func (atxn *AllocTxn) Shares(bn common.Bnum) uint64 {
+	if atxn.Super.Legacy() || bn == common.NULLBNUM {
+		return 0
+	}
+	if s, ok := atxn.shares[bn]; ok {
+		return s.n
+	}
+	if !atxn.sharing && atxn.loadShares(bn) == 0 {
+		return 0
+	}
+	atxn.lockShares()
+	n := atxn.loadShares(bn)
+	atxn.shares[bn] = &share{n: n}
+	return n
+}
+
+func (atxn *AllocTxn) setShares(bn common.Bnum, n uint64) {
+	atxn.lockShares()
+	atxn.shares[bn] = &share{n: n, dirty: true}
+}
+
+// Share adds a reference to bn, and returns false if bn already has
+// the most references a share count can record.
+func (atxn *AllocTxn) Share(bn common.Bnum) bool {
+	atxn.lockShares()
+	n := atxn.Shares(bn)
+	if n >= MAXSHARES {
+		util.DPrintf(0, "block %d is shared too often\n", bn)
+		return false
+	}
+	atxn.setShares(bn, n+1)
+	return true
+}
+
+// Drops a reference to bn, and returns false if it was the last one
+// (so that the caller frees bn).
+func (atxn *AllocTxn) unshare(bn common.Bnum) bool {
+	n := atxn.Shares(bn)
+	if n == 0 {
+		return false
+	}
+	atxn.setShares(bn, n-1)
+	return true
+}
+
+// Shares the non-null pointers of index block data.
+func (atxn *AllocTxn) shareChildren(data []byte) bool {
+	for off := uint64(0); off < disk.BlockSize; off += 8 {
+		bn := common.Bnum(getPtr(data, off))
+		if bn != common.NULLBNUM && !atxn.Share(bn) {
+			return false
+		}
+	}
+	return true
+}
+
+func getPtr(data []byte, off uint64) uint64 {
+	return marshal.NewDec(data[off : off+8]).GetInt()
+}
+
+// CopyShared makes nb, a block the caller just allocated, a private
+// copy of shared block bn, and drops the caller's reference to bn.
+// The copy of an index block shares the blocks bn points to.  It
+// returns false if one of them can't take another reference.
+func (atxn *AllocTxn) CopyShared(bn common.Bnum, nb common.Bnum, index bool) bool {
+	b := atxn.ReadBlock(bn)
+	data := make([]byte, disk.BlockSize)
+	copy(data, b.Data)
+	if index && !atxn.shareChildren(data) {
+		return false
+	}
+	atxn.Op.OverWrite(atxn.Super.Block2addr(nb), common.NBITBLOCK, data)
+	if !atxn.Super.Legacy() {
+		if sum := atxn.readCsum(bn); sum != 0 {
+			atxn.writeCsum(nb, sum)
+		}
+	}
+	atxn.unshare(bn)
+	util.DPrintf(1, "copy shared block %d to %d\n", bn, nb)
+	return true
+}
+
+// CopyCost returns how many blocks copying bn may dirty: the copy,
+// bn's share block, and, for an index block, the share blocks of the
+// blocks it points to.
+func (atxn *AllocTxn) CopyCost(bn common.Bnum, index bool) uint64 {
+	var n uint64 = 2
+	if !index {
+		return n
+	}
+	b := atxn.ReadBlock(bn)
+	seen := make(map[common.Bnum]bool)
+	for off := uint64(0); off < disk.BlockSize; off += 8 {
+		p := common.Bnum(getPtr(b.Data, off))
+		if p == common.NULLBNUM {
+			continue
+		}
+		sb := atxn.Super.Share2addr(p).Blkno
+		if !seen[sb] {
+			seen[sb] = true
+			n++
+		}
+	}
+	return n
+}
+
+// RepairShares sets the share count of bn, for fsck.
+func (atxn *AllocTxn) RepairShares(bn common.Bnum, n uint64) {
+	atxn.writeShares(bn, n)
+}
+
+// Writes the share counts the transaction changed.
+func (atxn *AllocTxn) commitShares() {
+	for bn, s := range atxn.shares {
+		if s.dirty {
+			atxn.writeShares(bn, s.n)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package alloctxn
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/buf"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// A snapshot is a read-only image of the file system at the moment it
+// was taken.  Taking one copies nothing: inode blocks are copied on
+// write instead.  The first transaction after the snapshot that
+// changes an inode in an inode block (of the table or a chunk) first
+// copies the block as it was committed, and records the copy in the
+// snapshot's map from inode blocks to copies.  An inode block without
+// a copy is the same in the snapshot as in the live file system.  The
+// copy's inodes point to the same blocks as the live ones, so the
+// roots of their trees gain a reference (see shares.go), and the live
+// file copies a block before changing it from then on.  One copy
+// serves all snapshots that didn't have the block yet; it has a
+// reference per snapshot.
+//
+// The snapshot table is a block of MAXSNAPSHOT entries of SNAPENTSZ
+// bytes, after a header with the next snapshot id (ids are never
+// reused, so that handles of a deleted snapshot go stale).  Each map is
+// a radix tree of three levels of NPTR pointers, indexed by inode block
+// number.  Deleting a snapshot marks its entry, after which its copies
+// (and the blocks only they reference) are freed in the background,
+// and finally its map and entry.
+//
+// Snapshots.mu (see shares.go) also serializes copying inode blocks,
+// and listMu protects the in-memory list and maps.  A transaction that
+// copies inode blocks records them in the maps when it commits, while
+// holding listMu, so that a reader of a snapshot (see SnapInodeBuf)
+// sees either the copy or the committed inode block from before the
+// transaction.
+//
+
+const (
+	SNAPENTSZ   uint64 = 64
+	SNAPNAMESZ  uint64 = 32
+	MAXSNAPSHOT uint64 = disk.BlockSize/SNAPENTSZ - 1
+	snapLive    uint64 = 0
+	snapDeleted uint64 = 1
+)
+
+type Snapshot struct {
+	Id       uint64
+	Name     string
+	Ctime    uint64 // Unix seconds
+	slot     uint64
+	root     common.Bnum // of the map
+	copies   map[common.Bnum]common.Bnum
+	deleting bool
+}
+
+// SnapshotInfo describes a snapshot for listing.
+type SnapshotInfo struct {
+	Id       uint64
+	Name     string
+	Ctime    uint64
+	Copies   uint64 // inode blocks copied
+	Deleting bool
+}
+
+type Snapshots struct {
+	mu     *sync.Mutex   // share counts and copying inode blocks
+	listMu *sync.RWMutex // snaps, their maps, and nextId
+	snaps  []*Snapshot   // oldest first
+	nextId uint64
+	nlive  uint64 // # snapshots not being deleted, accessed atomically
+	// returns the roots of an encoded inode's trees
+	roots func(data []byte) []common.Bnum
+}
+
+// A preservedBlock is an inode block that a transaction copied for
+// snaps.
+type preservedBlock struct {
+	bn    common.Bnum
+	copy  common.Bnum
+	snaps []*Snapshot
+}
+
+func snapAddr(sup *super.FsSuper, slot uint64) addr.Addr {
+	return addr.MkAddr(sup.SnapStart(), slot*SNAPENTSZ*8)
+}
+
+// Loads the map of s, whose root is s.root.
+func (s *Snapshot) load(log *obj.Log) {
+	for i := uint64(0); i < NPTR; i++ {
+		mid := readPtr(log, s.root, i)
+		if mid == common.NULLBNUM {
+			continue
+		}
+		for j := uint64(0); j < NPTR; j++ {
+			leaf := readPtr(log, mid, j)
+			if leaf == common.NULLBNUM {
+				continue
+			}
+			for k := uint64(0); k < NPTR; k++ {
+				c := readPtr(log, leaf, k)
+				if c != common.NULLBNUM {
+					s.copies[common.Bnum((i*NPTR+j)*NPTR+k)] = c
+				}
+			}
+		}
+	}
+}
+
+// MkSnapshots loads the snapshot table and maps of an image, which has
+// none if it is from before snapshots.  roots decodes an inode.
+func MkSnapshots(sup *super.FsSuper, log *obj.Log, roots func(data []byte) []common.Bnum) *Snapshots {
+	ss := &Snapshots{
+		mu:     new(sync.Mutex),
+		listMu: new(sync.RWMutex),
+		snaps:  make([]*Snapshot, 0),
+		nextId: 1,
+		roots:  roots,
+	}
+	if sup.Legacy() {
+		return ss
+	}
+	hdr := log.Load(snapAddr(sup, 0), SNAPENTSZ*8)
+	if id := marshal.NewDec(hdr.Data).GetInt(); id != 0 {
+		ss.nextId = id
+	}
+	for slot := uint64(1); slot <= MAXSNAPSHOT; slot++ {
+		b := log.Load(snapAddr(sup, slot), SNAPENTSZ*8)
+		s := decodeSnapshot(b.Data, slot)
+		if s == nil {
+			continue
+		}
+		s.load(log)
+		ss.snaps = append(ss.snaps, s)
+		if !s.deleting {
+			ss.nlive++
+		}
+	}
+	sort.Slice(ss.snaps, func(i, j int) bool { return ss.snaps[i].Id < ss.snaps[j].Id })
+	util.DPrintf(1, "MkSnapshots: %d snapshots\n", len(ss.snaps))
+	return ss
+}
+
+// WalkSnapshots calls f on each block of the snapshots' maps, with of
+// 0, and on each copy of an inode block, with of the inode block, once
+// per snapshot that has it.  It follows the pointers in a map block
+// only if f returns true for it.
+func WalkSnapshots(sup *super.FsSuper, log *obj.Log, f func(bn common.Bnum, of common.Bnum) bool) {
+	if sup.Legacy() {
+		return
+	}
+	for slot := uint64(1); slot <= MAXSNAPSHOT; slot++ {
+		b := log.Load(snapAddr(sup, slot), SNAPENTSZ*8)
+		s := decodeSnapshot(b.Data, slot)
+		if s == nil || !f(s.root, common.NULLBNUM) {
+			continue
+		}
+		for i := uint64(0); i < NPTR; i++ {
+			mid := readPtr(log, s.root, i)
+			if mid == common.NULLBNUM || !f(mid, common.NULLBNUM) {
+				continue
+			}
+			for j := uint64(0); j < NPTR; j++ {
+				leaf := readPtr(log, mid, j)
+				if leaf == common.NULLBNUM || !f(leaf, common.NULLBNUM) {
+					continue
+				}
+				for k := uint64(0); k < NPTR; k++ {
+					c := readPtr(log, leaf, k)
+					if c != common.NULLBNUM {
+						f(c, common.Bnum((i*NPTR+j)*NPTR+k))
+					}
+				}
+			}
+		}
+	}
+}
+
+func decodeSnapshot(data []byte, slot uint64) *Snapshot {
+	dec := marshal.NewDec(data)
+	id := dec.GetInt()
+	if id == 0 {
+		return nil
+	}
+	s := &Snapshot{Id: id, slot: slot, copies: make(map[common.Bnum]common.Bnum)}
+	s.root = common.Bnum(dec.GetInt())
+	s.Ctime = dec.GetInt()
+	s.deleting = dec.GetInt() == snapDeleted
+	name := dec.GetBytes(SNAPNAMESZ)
+	var n = 0
+	for n < len(name) && name[n] != 0 {
+		n++
+	}
+	s.Name = string(name[:n])
+	return s
+}
+
+func (s *Snapshot) encode() []byte {
+	enc := marshal.NewEnc(SNAPENTSZ)
+	enc.PutInt(s.Id)
+	enc.PutInt(uint64(s.root))
+	enc.PutInt(s.Ctime)
+	if s.deleting {
+		enc.PutInt(snapDeleted)
+	} else {
+		enc.PutInt(snapLive)
+	}
+	name := make([]byte, SNAPNAMESZ)
+	copy(name, s.Name)
+	enc.PutBytes(name)
+	return enc.Finish()
+}
+
+func (s *Snapshot) info() SnapshotInfo {
+	return SnapshotInfo{
+		Id:       s.Id,
+		Name:     s.Name,
+		Ctime:    s.Ctime,
+		Copies:   uint64(len(s.copies)),
+		Deleting: s.deleting,
+	}
+}
+
+// List returns the snapshots, oldest first, including those being
+// deleted.
+func (ss *Snapshots) List() []SnapshotInfo {
+	ss.listMu.RLock()
+	infos := make([]SnapshotInfo, 0, len(ss.snaps))
+	for _, s := range ss.snaps {
+		infos = append(infos, s.info())
+	}
+	ss.listMu.RUnlock()
+	return infos
+}
+
+// Lookup returns the snapshot named name, or nil if there is none (or
+// it is being deleted).
+func (ss *Snapshots) Lookup(name string) *Snapshot {
+	ss.listMu.RLock()
+	defer ss.listMu.RUnlock()
+	for _, s := range ss.snaps {
+		if s.Name == name && !s.deleting {
+			return s
+		}
+	}
+	return nil
+}
+
+// Get returns the snapshot with id, or nil if there is none (or it is
+// being deleted).
+func (ss *Snapshots) Get(id uint64) *Snapshot {
+	ss.listMu.RLock()
+	defer ss.listMu.RUnlock()
+	for _, s := range ss.snaps {
+		if s.Id == id && !s.deleting {
+			return s
+		}
+	}
+	return nil
+}
+
+// Deleting returns the snapshots being deleted.
+func (ss *Snapshots) Deleting() []*Snapshot {
+	ss.listMu.RLock()
+	var del = make([]*Snapshot, 0)
+	for _, s := range ss.snaps {
+		if s.deleting {
+			del = append(del, s)
+		}
+	}
+	ss.listMu.RUnlock()
+	return del
+}
+
+// Returns the live snapshots that don't have a copy of inode block bn.
+// Since a copy serves all snapshots that lack the block, those are the
+// newest ones.
+func (ss *Snapshots) lacking(bn common.Bnum) []*Snapshot {
+	ss.listMu.RLock()
+	var lack = make([]*Snapshot, 0)
+	for i := len(ss.snaps) - 1; i >= 0; i-- {
+		s := ss.snaps[i]
+		if s.deleting {
+			continue
+		}
+		if _, ok := s.copies[bn]; ok {
+			break
+		}
+		lack = append(lack, s)
+	}
+	ss.listMu.RUnlock()
+	return lack
+}
+
+// ValidSnapshotName returns an error if name can't name a snapshot.
+func ValidSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("bad snapshot name %q", name)
+	}
+	if uint64(len(name)) > SNAPNAMESZ {
+		return fmt.Errorf("snapshot name %q is longer than %d bytes", name, SNAPNAMESZ)
+	}
+	return nil
+}
+
+// SnapInodeBuf returns (a copy of) the buffer with inum's inode as of
+// snapshot s.
+func (atxn *AllocTxn) SnapInodeBuf(s *Snapshot, inum common.Inum) *buf.Buf {
+	ss := atxn.Snaps
+	a := atxn.Super.Inum2Addr(inum)
+	ss.listMu.RLock()
+	if c, ok := s.copies[a.Blkno]; ok {
+		a = addr.MkAddr(c, a.Off)
+	}
+	b := atxn.Log.Load(a, common.INODESZ*8)
+	ss.listMu.RUnlock()
+	return b
+}
+
+// SnapValidInum returns whether inum may be an inode of snapshot s: a
+// live one, or one of a chunk that was freed since, which s has a copy
+// of.
+func (atxn *AllocTxn) SnapValidInum(s *Snapshot, inum common.Inum) bool {
+	if atxn.ValidInum(inum) {
+		return true
+	}
+	if inum == common.NULLINUM {
+		return false
+	}
+	bn, _ := atxn.Super.Inum2Chunk(inum)
+	atxn.Snaps.listMu.RLock()
+	_, ok := s.copies[bn]
+	atxn.Snaps.listMu.RUnlock()
+	return ok
+}
+
+// Allocates a block for snapshot metadata, which may use the reserved
+// blocks: an inode block must be copied before anything can change in
+// it, including freeing space.
+func (atxn *AllocTxn) allocSnapBlock(goal common.Bnum) common.Bnum {
+	bn := common.Bnum(atxn.Balloc.AllocNumNear(uint64(goal)))
+	return atxn.recordAlloc(bn)
+}
+
+// Records c as the copy of bn in the map of s (or removes the entry if
+// c is 0), allocating map blocks as needed.  Map blocks are always
+// accessed whole, as a new one is when it is zeroed.
+func (atxn *AllocTxn) mapPut(s *Snapshot, bn common.Bnum, c common.Bnum) bool {
+	i := uint64(bn) / (NPTR * NPTR)
+	j := (uint64(bn) / NPTR) % NPTR
+	k := uint64(bn) % NPTR
+	if i >= NPTR {
+		return false
+	}
+	var blk = s.root
+	for _, idx := range []uint64{i, j} {
+		b := atxn.ReadBlock(blk)
+		next := b.BnumGet(idx * 8)
+		if next == common.NULLBNUM {
+			if c == common.NULLBNUM {
+				return true
+			}
+			next = atxn.allocSnapBlock(blk)
+			if next == common.NULLBNUM {
+				return false
+			}
+			b.BnumPut(idx*8, next)
+		}
+		blk = next
+	}
+	atxn.ReadBlock(blk).BnumPut(k*8, c)
+	return true
+}
+
+// Returns whether the transaction already copied inode block bn.
+func (atxn *AllocTxn) preservedBlock(bn common.Bnum) bool {
+	for _, p := range atxn.preserved {
+		if p.bn == bn {
+			return true
+		}
+	}
+	return false
+}
+
+// PreserveInode copies the inode block of inum for the snapshots that
+// don't have a copy yet, before the transaction changes the inode.  It
+// returns false if it couldn't (e.g., for lack of space), and then the
+// transaction can't commit.
+func (atxn *AllocTxn) PreserveInode(inum common.Inum) bool {
+	ss := atxn.Snaps
+	if ss == nil || atomic.LoadUint64(&ss.nlive) == 0 {
+		return true
+	}
+	bn := atxn.Super.Inum2Addr(inum).Blkno
+	if atxn.preservedBlock(bn) || len(ss.lacking(bn)) == 0 {
+		return true
+	}
+	atxn.lockShares()
+	// another transaction may have copied it meanwhile
+	lack := ss.lacking(bn)
+	if len(lack) == 0 {
+		return true
+	}
+	if !atxn.preserve(bn, lack) {
+		util.DPrintf(0, "can't copy inode block %d for snapshots\n", bn)
+		atxn.failed = true
+		return false
+	}
+	return true
+}
+
+func (atxn *AllocTxn) preserve(bn common.Bnum, lack []*Snapshot) bool {
+	c := atxn.allocSnapBlock(bn)
+	if c == common.NULLBNUM {
+		return false
+	}
+	b := atxn.Log.Load(atxn.Super.Block2addr(bn), common.NBITBLOCK)
+	data := make([]byte, disk.BlockSize)
+	copy(data, b.Data)
+	for slot := uint64(0); slot < common.INODEBLK; slot++ {
+		if bn == atxn.Super.InodeStart() && slot == 0 {
+			continue // the chunk registry
+		}
+		for _, r := range atxn.Snaps.inodeRoots(data, slot) {
+			if !atxn.Share(r) {
+				return false
+			}
+		}
+	}
+	atxn.Op.OverWrite(atxn.Super.Block2addr(c), common.NBITBLOCK, data)
+	if len(lack) > 1 {
+		atxn.setShares(c, uint64(len(lack)-1))
+	}
+	for _, s := range lack {
+		if !atxn.mapPut(s, bn, c) {
+			return false
+		}
+	}
+	atxn.preserved = append(atxn.preserved, preservedBlock{bn: bn, copy: c, snaps: lack})
+	util.DPrintf(1, "preserve inode block %d as %d for %d snapshots\n", bn, c, len(lack))
+	return true
+}
+
+// Returns the roots of the inode in slot of inode block data.
+func (ss *Snapshots) inodeRoots(data []byte, slot uint64) []common.Bnum {
+	return ss.roots(data[slot*common.INODESZ : (slot+1)*common.INODESZ])
+}
+
+// CreateSnapshot adds a snapshot named name, taken when the transaction
+// commits.  The caller must make sure no other transaction is open, so
+// that the snapshot doesn't catch one halfway.
+func (atxn *AllocTxn) CreateSnapshot(name string) error {
+	ss := atxn.Snaps
+	if atxn.Super.Legacy() {
+		return errors.New("file system doesn't support snapshots (legacy image)")
+	}
+	if err := ValidSnapshotName(name); err != nil {
+		return err
+	}
+	if atxn.Super.MaxSize() >= super.MAXSNAPSIZE {
+		return errors.New("file system is too large for snapshots")
+	}
+	atxn.lockShares()
+	ss.listMu.RLock()
+	used := make(map[uint64]bool)
+	var exists = false
+	for _, s := range ss.snaps {
+		used[s.slot] = true
+		exists = exists || (s.Name == name && !s.deleting)
+	}
+	id := ss.nextId
+	ss.listMu.RUnlock()
+	if exists {
+		return fmt.Errorf("snapshot %q exists", name)
+	}
+	var slot = uint64(1)
+	for slot <= MAXSNAPSHOT && used[slot] {
+		slot++
+	}
+	if slot > MAXSNAPSHOT {
+		return fmt.Errorf("too many snapshots (at most %d)", MAXSNAPSHOT)
+	}
+	root := atxn.AllocBlock(atxn.Super.DataStart())
+	if root == common.NULLBNUM {
+		return errors.New("no space for a snapshot")
+	}
+	s := &Snapshot{
+		Id:     id,
+		Name:   name,
+		Ctime:  uint64(time.Now().Unix()),
+		slot:   slot,
+		root:   root,
+		copies: make(map[common.Bnum]common.Bnum),
+	}
+	atxn.Op.OverWrite(snapAddr(atxn.Super, slot), SNAPENTSZ*8, s.encode())
+	hdr := marshal.NewEnc(SNAPENTSZ)
+	hdr.PutInt(id + 1)
+	atxn.Op.OverWrite(snapAddr(atxn.Super, 0), SNAPENTSZ*8, hdr.Finish())
+	atxn.created = append(atxn.created, s)
+	util.DPrintf(1, "snapshot %d %q (slot %d, map %d)\n", id, name, slot, root)
+	return nil
+}
+
+// DeleteSnapshot marks s deleted when the transaction commits; from
+// then on, it can't be read, and its blocks are freed with ReleaseCopy
+// and RemoveSnapshot.  The caller must make sure no other transaction
+// is open, so that none is reading s.
+func (atxn *AllocTxn) DeleteSnapshot(s *Snapshot) {
+	atxn.lockShares()
+	d := *s
+	d.deleting = true
+	atxn.Op.OverWrite(snapAddr(atxn.Super, s.slot), SNAPENTSZ*8, d.encode())
+	atxn.deleted = append(atxn.deleted, s)
+}
+
+// NextCopy returns an inode block that deleted snapshot s has a copy
+// of, and the copy, or false if it has none left.
+func (ss *Snapshots) NextCopy(s *Snapshot) (common.Bnum, common.Bnum, bool) {
+	ss.listMu.RLock()
+	defer ss.listMu.RUnlock()
+	var first = common.NULLBNUM
+	var found = false
+	for bn := range s.copies {
+		if !found || bn < first {
+			first = bn
+			found = true
+		}
+	}
+	return first, s.copies[first], found
+}
+
+// CopyIsShared returns whether a copy of an inode block belongs to other
+// snapshots as well, so that releasing it just drops a reference.
+func (atxn *AllocTxn) CopyIsShared(c common.Bnum) bool {
+	return atxn.Shares(c) > 0
+}
+
+// CopySkips returns whether slot of a copy of inode block bn doesn't
+// hold an inode (but the chunk registry).
+func (atxn *AllocTxn) CopySkips(bn common.Bnum, slot uint64) bool {
+	return bn == atxn.Super.InodeStart() && slot == 0
+}
+
+// ReleaseCopy removes the copy of inode block bn from the map of
+// deleted snapshot s, and drops its reference to the copy.  If s was
+// the last snapshot with the copy, the caller must have freed the
+// blocks of the copy's inodes.
+func (atxn *AllocTxn) ReleaseCopy(s *Snapshot, bn common.Bnum) {
+	atxn.lockShares()
+	atxn.Snaps.listMu.RLock()
+	c := s.copies[bn]
+	atxn.Snaps.listMu.RUnlock()
+	atxn.mapPut(s, bn, common.NULLBNUM)
+	atxn.FreeBlock(c)
+	atxn.released = append(atxn.released, preservedBlock{bn: bn, copy: c,
+		snaps: []*Snapshot{s}})
+}
+
+// RemoveSnapshot frees the map of deleted snapshot s, which must have
+// no copies left, as far as the transaction has room, and removes s
+// once it is all free.  Returns whether s is gone.
+func (atxn *AllocTxn) RemoveSnapshot(s *Snapshot, room uint64) bool {
+	atxn.lockShares()
+	root := atxn.ReadBlock(s.root)
+	for i := uint64(0); i < NPTR; i++ {
+		mid := root.BnumGet(i * 8)
+		if mid == common.NULLBNUM {
+			continue
+		}
+		m := atxn.ReadBlock(mid)
+		for j := uint64(0); j < NPTR; j++ {
+			leaf := m.BnumGet(j * 8)
+			if leaf == common.NULLBNUM {
+				continue
+			}
+			if atxn.Op.NDirty()+4 >= room {
+				return false
+			}
+			atxn.FreeBlock(leaf)
+			m.BnumPut(j*8, common.NULLBNUM)
+		}
+		if atxn.Op.NDirty()+4 >= room {
+			return false
+		}
+		atxn.FreeBlock(mid)
+		root.BnumPut(i*8, common.NULLBNUM)
+	}
+	atxn.FreeBlock(s.root)
+	atxn.Op.OverWrite(snapAddr(atxn.Super, s.slot), SNAPENTSZ*8, make([]byte, SNAPENTSZ))
+	atxn.removed = append(atxn.removed, s)
+	util.DPrintf(1, "snapshot %d %q removed\n", s.Id, s.Name)
+	return true
+}
+
+// Applies the changes of a transaction that just committed to the
+// in-memory list and maps.
+func (ss *Snapshots) apply(atxn *AllocTxn) {
+	for _, p := range atxn.preserved {
+		for _, s := range p.snaps {
+			s.copies[p.bn] = p.copy
+		}
+	}
+	for _, p := range atxn.released {
+		for _, s := range p.snaps {
+			delete(s.copies, p.bn)
+		}
+	}
+	for _, s := range atxn.created {
+		ss.snaps = append(ss.snaps, s)
+		ss.nextId = s.Id + 1
+		atomic.AddUint64(&ss.nlive, 1)
+	}
+	for _, s := range atxn.deleted {
+		s.deleting = true
+		atomic.AddUint64(&ss.nlive, ^uint64(0))
+	}
+	for _, s := range atxn.removed {
+		for i, x := range ss.snaps {
+			if x == s {
+				ss.snaps = append(ss.snaps[:i], ss.snaps[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Returns whether the transaction changed snapshots or their maps.
+func (atxn *AllocTxn) changesSnapshots() bool {
+	return len(atxn.preserved) > 0 || len(atxn.released) > 0 || len(atxn.created) > 0 ||
+		len(atxn.deleted) > 0 || len(atxn.removed) > 0
+}
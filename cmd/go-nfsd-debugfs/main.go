@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/debugfs"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-debugfs [flags] <disk image or device>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+const help = `commands:
+  super                 show the layout
+  ls [path]             list a directory (default /)
+  stat <path|#inum>     show an inode and its block map
+  block <bn>            write a block to stdout, raw
+  hex <bn>              hex dump a block
+  testb <bn>...         show block bitmap bits
+  testi <#inum>...      show inode allocation
+  icheck <bn>...        show what holds blocks
+  help                  show this message
+  quit
+`
+
+type shell struct {
+	im  *debugfs.Image
+	out io.Writer
+}
+
+func kindString(kind nfstypes.Ftype3) string {
+	switch kind {
+	case inode.NF3FREE:
+		return "free"
+	case nfstypes.NF3REG:
+		return "file"
+	case nfstypes.NF3DIR:
+		return "dir"
+	case nfstypes.NF3LNK:
+		return "symlink"
+	}
+	return fmt.Sprintf("kind %d", kind)
+}
+
+func parseNum(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "#"), 0, 64)
+}
+
+// An argument starting with # is an inum, and otherwise a path.
+func (sh *shell) inode(arg string) (*inode.Inode, error) {
+	if strings.HasPrefix(arg, "#") {
+		n, err := parseNum(arg)
+		if err != nil {
+			return nil, err
+		}
+		return sh.im.ReadInode(common.Inum(n))
+	}
+	return sh.im.Lookup(arg)
+}
+
+func (sh *shell) super() error {
+	sup := sh.im.Sup
+	if sup.Sb != nil {
+		fmt.Fprintf(sh.out, "uuid %s label %q, %d reserved blocks\n",
+			sup.Sb.UUIDString(), sup.Sb.LabelString(), sup.Sb.NReserved)
+	} else {
+		fmt.Fprintf(sh.out, "legacy image (no superblock)\n")
+	}
+	fmt.Fprintf(sh.out, "%d blocks on a %d-block disk\n", sup.Size, sup.Disk.Size())
+	fmt.Fprintf(sh.out, "block bitmap  %d (%d blocks)\n", sup.BitmapBlockStart(), sup.NBlockBitmap)
+	fmt.Fprintf(sh.out, "inode bitmap  %d (%d blocks)\n", sup.BitmapInodeStart(), sup.NInodeBitmap)
+	fmt.Fprintf(sh.out, "inode table   %d (%d inodes)\n", sup.InodeStart(), sup.NInode())
+	if !sup.Legacy() {
+		fmt.Fprintf(sh.out, "checksums     %d\n", sup.CsumStart())
+		fmt.Fprintf(sh.out, "shares        %d\n", sup.ShareStart())
+		fmt.Fprintf(sh.out, "snapshots     %d\n", sup.SnapStart())
+		fmt.Fprintf(sh.out, "quotas        %d (%d entries)\n", sup.QuotaStart(), sup.NQuota()-1)
+	}
+	fmt.Fprintf(sh.out, "data          %d\n", sup.DataStart())
+	return nil
+}
+
+func (sh *shell) ls(args []string) error {
+	var path = "/"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	dip, err := sh.inode(path)
+	if err != nil {
+		return err
+	}
+	ents, err := sh.im.ReadDir(dip)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if e.Bad {
+			fmt.Fprintf(sh.out, "%8s  %-7s  (malformed entry at offset %d)\n", "", "", e.Off)
+			continue
+		}
+		var what = "?"
+		ip, err := sh.im.ReadInode(e.Inum)
+		if err == nil {
+			what = kindString(ip.Kind)
+		}
+		fmt.Fprintf(sh.out, "%8d  %-7s  %s\n", e.Inum, what, e.Name)
+	}
+	return nil
+}
+
+// Prints the block map of ip, with runs of contiguous data blocks on
+// one line.
+func (sh *shell) blockMap(ip *inode.Inode) {
+	var run *inode.BlockRef
+	var n uint64
+	flush := func() {
+		if run == nil {
+			return
+		}
+		if n == 1 {
+			fmt.Fprintf(sh.out, "  %d: %d\n", run.Lbn, run.Bn)
+		} else {
+			fmt.Fprintf(sh.out, "  %d-%d: %d-%d\n", run.Lbn, run.Lbn+n-1,
+				run.Bn, run.Bn+common.Bnum(n-1))
+		}
+		run = nil
+	}
+	sh.im.Blocks(ip, func(ref inode.BlockRef) {
+		if ref.Level > 0 {
+			flush()
+			fmt.Fprintf(sh.out, "  (level %d index from %d): %d\n", ref.Level, ref.Lbn, ref.Bn)
+			return
+		}
+		if run != nil && ref.Lbn == run.Lbn+n && ref.Bn == run.Bn+common.Bnum(n) {
+			n++
+			return
+		}
+		flush()
+		r := ref
+		run, n = &r, 1
+	})
+	flush()
+}
+
+func (sh *shell) stat(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: stat <path|#inum>")
+	}
+	ip, err := sh.inode(args[0])
+	if err != nil {
+		return err
+	}
+	alloc, err := sh.im.InodeAllocated(ip.Inum)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%v\n", ip)
+	fmt.Fprintf(sh.out, "%s, allocated %v, owner %d:%d, atime %d.%09d, mtime %d.%09d\n",
+		kindString(ip.Kind), alloc, ip.Uid, ip.Gid,
+		ip.Atime.Seconds, ip.Atime.Nseconds, ip.Mtime.Seconds, ip.Mtime.Nseconds)
+	if ip.IsShrinking() {
+		fmt.Fprintf(sh.out, "shrinking from %d blocks\n", ip.ShrinkSize)
+	}
+	if ip.IsInline() {
+		fmt.Fprintf(sh.out, "data inline\n")
+		return nil
+	}
+	fmt.Fprintf(sh.out, "blocks:\n")
+	sh.blockMap(ip)
+	return nil
+}
+
+func (sh *shell) block(args []string, dump bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: block|hex <bn>")
+	}
+	n, err := parseNum(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := sh.im.ReadBlock(common.Bnum(n))
+	if err != nil {
+		return err
+	}
+	if dump {
+		d := hex.Dumper(sh.out)
+		d.Write(data)
+		d.Close()
+		return nil
+	}
+	_, err = sh.out.Write(data)
+	return err
+}
+
+func (sh *shell) testb(args []string) error {
+	for _, arg := range args {
+		n, err := parseNum(arg)
+		if err != nil {
+			return err
+		}
+		set, err := sh.im.BlockAllocated(common.Bnum(n))
+		if err != nil {
+			return err
+		}
+		var s = "free"
+		if set {
+			s = "marked in use"
+		}
+		fmt.Fprintf(sh.out, "block %d %s\n", n, s)
+	}
+	return nil
+}
+
+func (sh *shell) testi(args []string) error {
+	for _, arg := range args {
+		n, err := parseNum(arg)
+		if err != nil {
+			return err
+		}
+		set, err := sh.im.InodeAllocated(common.Inum(n))
+		if err != nil {
+			return err
+		}
+		var s = "free"
+		if set {
+			s = "marked in use"
+		}
+		fmt.Fprintf(sh.out, "inode %d %s\n", n, s)
+	}
+	return nil
+}
+
+func (sh *shell) icheck(args []string) error {
+	bns := make([]common.Bnum, 0, len(args))
+	for _, arg := range args {
+		n, err := parseNum(arg)
+		if err != nil {
+			return err
+		}
+		bns = append(bns, common.Bnum(n))
+	}
+	for _, o := range sh.im.Owners(bns) {
+		fmt.Fprintf(sh.out, "block %d: %v\n", o.Bn, o)
+	}
+	return nil
+}
+
+// Runs one command line, and returns false on quit.
+func (sh *shell) run(line string) bool {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return true
+	}
+	var err error
+	switch args[0] {
+	case "super":
+		err = sh.super()
+	case "ls":
+		err = sh.ls(args[1:])
+	case "stat":
+		err = sh.stat(args[1:])
+	case "block":
+		err = sh.block(args[1:], false)
+	case "hex":
+		err = sh.block(args[1:], true)
+	case "testb":
+		err = sh.testb(args[1:])
+	case "testi":
+		err = sh.testi(args[1:])
+	case "icheck":
+		err = sh.icheck(args[1:])
+	case "help":
+		fmt.Fprint(sh.out, help)
+	case "quit", "q":
+		return false
+	default:
+		err = fmt.Errorf("unknown command %q; try help", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+	}
+	return true
+}
+
+func main() {
+	var request string
+	flag.StringVar(&request, "R", "", "run a single command and exit")
+
+	var legacy bool
+	flag.BoolVar(&legacy, "legacy", false, "the image is from before superblocks")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key of an encrypted image (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	path := flag.Arg(0)
+
+	d, err := diskfile.OpenReadOnly(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	im, err := debugfs.Open(d, legacy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer im.Close()
+
+	sh := &shell{im: im, out: os.Stdout}
+	if request != "" {
+		sh.run(request)
+		return
+	}
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "debugfs: ")
+		if !in.Scan() || !sh.run(in.Text()) {
+			break
+		}
+	}
+}
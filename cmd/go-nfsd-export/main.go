@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mit-pdos/go-journal/util"
+	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-export [flags] <disk image or device> [path]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var out string
+	flag.StringVar(&out, "o", "-", "tar file to write (- for stdout)")
+
+	var legacy bool
+	flag.BoolVar(&legacy, "legacy", false, "the image is from before superblocks")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key of an encrypted image (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
+	}
+	path := flag.Arg(0)
+	var src = "/"
+	if flag.NArg() == 2 {
+		src = flag.Arg(1)
+	}
+
+	// reading may fill in holes, and mounting updates the superblock;
+	// keep those writes in memory
+	d, err := diskfile.OpenReadOnly(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	var nfs *go_nfs.Nfs
+	if legacy {
+		nfs, err = go_nfs.MountLegacy(d)
+	} else {
+		nfs, err = go_nfs.MountNfs(d)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer nfs.ShutdownNfs()
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	err = nfs.Export(src, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
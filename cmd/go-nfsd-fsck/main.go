@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fsck"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+// Exit codes, as for e2fsck
+const (
+	exitClean   = 0
+	exitFixed   = 1
+	exitErrors  = 4
+	exitFailure = 8
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-fsck [flags] <disk image or device>\n")
+	flag.PrintDefaults()
+	os.Exit(exitFailure)
+}
+
+func main() {
+	var repair bool
+	flag.BoolVar(&repair, "repair", false,
+		"repair problems, reconnecting orphans to /"+fsck.LOSTFOUND)
+
+	var asJSON bool
+	flag.BoolVar(&asJSON, "json", false, "report in JSON")
+
+	var legacy bool
+	flag.BoolVar(&legacy, "legacy", false, "the image is from before superblocks")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key of an encrypted image (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	path := flag.Arg(0)
+
+	d, err := diskfile.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitFailure)
+	}
+	d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(exitFailure)
+	}
+	rep, err := fsck.Check(d, repair, legacy)
+	d.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(exitFailure)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		for _, p := range rep.Problems {
+			fmt.Printf("%v\n", p)
+		}
+		fmt.Printf("%s: %d inodes (%d directories), %d blocks, %d inode chunks, %d problems\n",
+			path, rep.Inodes, rep.Dirs, rep.Blocks, rep.Chunks, len(rep.Problems))
+	}
+
+	if !rep.Clean() {
+		os.Exit(exitErrors)
+	}
+	if len(rep.Problems) > 0 {
+		os.Exit(exitFixed)
+	}
+	os.Exit(exitClean)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mit-pdos/go-journal/util"
+	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-grow [flags] <disk image or device>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var sizeMegabytes uint64
+	flag.Uint64Var(&sizeMegabytes, "size", 0,
+		"new size of the file system (in MB; extends an image file; 0 for the whole file or device)")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key of an encrypted image (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	path := flag.Arg(0)
+
+	sizeBlocks, err := super.MegabytesToBlocks(sizeMegabytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-size: %v\n", err)
+		os.Exit(2)
+	}
+
+	d, err := diskfile.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	nfs, err := go_nfs.MountNfs(d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	old := nfs.Superblock().Size
+	_, err = nfs.Grow(sizeBlocks)
+	n, maxSize := nfs.GrowLimit()
+	nfs.ShutdownNfs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: grew from %d to %d blocks (can grow to %d)\n", path, old, n, maxSize)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-import [flags] <directory> <disk image or device>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	var dst string
+	flag.StringVar(&dst, "dst", "/", "directory in the file system to import into")
+
+	var mkfs bool
+	flag.BoolVar(&mkfs, "mkfs", false,
+		"make a new file system first, with the default geometry (destroys the image's contents)")
+
+	var sizeMegabytes uint64
+	flag.Uint64Var(&sizeMegabytes, "size", 0,
+		"size of file system for -mkfs (in MB; 0 for the whole file or device)")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key of an encrypted image (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	src, path := flag.Arg(0), flag.Arg(1)
+
+	sizeBlocks, err := super.MegabytesToBlocks(sizeMegabytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-size: %v\n", err)
+		os.Exit(2)
+	}
+
+	var d disk.Disk
+	if mkfs {
+		d, err = diskfile.Create(path, sizeBlocks)
+	} else {
+		d, err = diskfile.Open(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	if mkfs {
+		d, err = cryptdisk.FormatKeyFile(d, keyFile)
+	} else {
+		d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	if mkfs {
+		_, err = go_nfs.Mkfs(d, super.DefaultMkfsOpts())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mkfs: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	nfs, err := go_nfs.MountNfs(d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	st, err := nfs.Import(src, dst)
+	nfs.ShutdownNfs()
+	fmt.Printf("%d files, %d directories, %d symlinks, %d bytes in %d transactions",
+		st.Files, st.Dirs, st.Symlinks, st.Bytes, st.Txns)
+	if st.Skipped > 0 {
+		fmt.Printf(" (%d special files skipped)", st.Skipped)
+	}
+	fmt.Printf("\n")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go-nfsd-mkfs [flags] <disk image or device>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// Exits if path holds anything but a blank (or missing) disk.
+func checkBlank(path string) {
+	d, err := diskfile.Open(path)
+	if err != nil {
+		return // doesn't exist or is empty
+	}
+	if cryptdisk.IsEncrypted(d) {
+		d.Close()
+		fmt.Fprintf(os.Stderr, "%s is encrypted; use -force to overwrite it\n", path)
+		os.Exit(1)
+	}
+	_, err = super.ReadSuperblock(d)
+	legacy := super.CheckLegacy(d)
+	d.Close()
+	if err == super.ErrBlank {
+		return
+	}
+	if err == nil || legacy == nil {
+		fmt.Fprintf(os.Stderr, "%s holds a file system; use -force to overwrite it\n", path)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s is not blank (%v); use -force to overwrite it\n", path, err)
+	}
+	os.Exit(1)
+}
+
+func main() {
+	var sizeMegabytes uint64
+	flag.Uint64Var(&sizeMegabytes, "size", 0,
+		"size of file system (in MB; 0 for the whole file or device)")
+
+	var maxSizeMegabytes uint64
+	flag.Uint64Var(&maxSizeMegabytes, "max-size", 0,
+		"size the file system can grow to (in MB; 0 for "+
+			strconv.FormatUint(super.GROWFACTOR, 10)+" times -size)")
+
+	var ninode uint64
+	flag.Uint64Var(&ninode, "inodes", 0, "number of inodes in the inode table")
+
+	var bytesPerInode uint64
+	flag.Uint64Var(&bytesPerInode, "bytes-per-inode", 0,
+		"size the inode table to one inode per this many bytes")
+
+	var reservedPercent uint64
+	flag.Uint64Var(&reservedPercent, "reserved", super.RESERVEDPCT,
+		"percentage of data blocks reserved for the superuser")
+
+	var nquota uint64
+	flag.Uint64Var(&nquota, "quotas", super.NQUOTA,
+		"number of users and groups the quota table has room for")
+
+	var label string
+	flag.StringVar(&label, "label", "", "file system label")
+
+	var force bool
+	flag.BoolVar(&force, "force", false, "overwrite an existing file system")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key to encrypt the image with (default $"+cryptdisk.KEYENV+")")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	path := flag.Arg(0)
+
+	sizeBlocks, err := super.MegabytesToBlocks(sizeMegabytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-size: %v\n", err)
+		os.Exit(2)
+	}
+	maxSizeBlocks, err := super.MegabytesToBlocks(maxSizeMegabytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-max-size: %v\n", err)
+		os.Exit(2)
+	}
+
+	if ninode != 0 && bytesPerInode != 0 {
+		fmt.Fprintf(os.Stderr, "-inodes and -bytes-per-inode are exclusive\n")
+		os.Exit(2)
+	}
+	if reservedPercent >= 50 {
+		fmt.Fprintf(os.Stderr, "-reserved must be less than 50%%\n")
+		os.Exit(2)
+	}
+
+	// check before Create, which may resize the file
+	if !force {
+		checkBlank(path)
+	}
+
+	d, err := diskfile.Create(path, sizeBlocks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer d.Close()
+	d, err = cryptdisk.FormatKeyFile(d, keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if bytesPerInode != 0 {
+		ninode = d.Size() * disk.BlockSize / bytesPerInode
+	}
+	sb, err := go_nfs.Mkfs(d, super.MkfsOpts{
+		MaxSize:     maxSizeBlocks,
+		NInode:      ninode,
+		ReservedPct: reservedPercent,
+		NQuota:      nquota,
+		Label:       label,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: uuid %s label %q\n", path, sb.UUIDString(), sb.LabelString())
+	fmt.Printf("%d blocks (%d data, %d reserved; can grow to %d), %d inodes (more on demand)\n",
+		sb.Size, sb.Size-sb.DataStart(), sb.NReserved, sb.MaxSize(), sb.NInodeBlk*common.INODEBLK)
+}
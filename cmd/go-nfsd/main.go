@@ -6,18 +6,24 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	"github.com/tchajed/goose/machine/disk"
 	"github.com/zeldovich/go-rpcgen/rfc1057"
 	"github.com/zeldovich/go-rpcgen/xdr"
 
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/admin"
 	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
 	"github.com/mit-pdos/go-nfsd/util/timed_disk"
 )
 
@@ -67,11 +73,42 @@ func main() {
 	var unstable bool
 	flag.BoolVar(&unstable, "unstable", true, "use unstable writes if requested")
 
+	var jukebox bool
+	flag.BoolVar(&jukebox, "jukebox", false, "reply JUKEBOX (try later) rather than wait for shrinking files or a busy log")
+
+	var atime string
+	flag.StringVar(&atime, "atime", "noatime", "when reads update access times: noatime, relatime or strictatime")
+
+	var trash bool
+	flag.BoolVar(&trash, "trash", false, "move removed files and directories to /.trash rather than free them")
+
+	var trashRetention time.Duration
+	flag.DurationVar(&trashRetention, "trash-retention", 7*24*time.Hour, "free items of the trash this long after their removal (0 to keep them)")
+
+	var trashMinFree uint64
+	flag.Uint64Var(&trashMinFree, "trash-min-free", 0, "free the oldest items of the trash early while free space is below this percent (0 to disable)")
+
+	var scrubRate uint64
+	flag.Uint64Var(&scrubRate, "scrub-rate", 0, "check the file system in the background at this many inodes per second (0 to disable)")
+
 	var filesizeMegabytes uint64
-	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of file system (in MB)")
+	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of file system (in MB; for MemDisk or -mkfs)")
+
+	var diskPath string
+	flag.StringVar(&diskPath, "disk", "", "disk image (empty for MemDisk)")
+
+	var mkfs bool
+	flag.BoolVar(&mkfs, "mkfs", false, "make a new file system on -disk (destroys its contents)")
+
+	var legacy bool
+	flag.BoolVar(&legacy, "legacy", false, "-disk is an image from before superblocks (no -mkfs)")
+
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "",
+		"file with the hex key to encrypt the disk with (default $"+cryptdisk.KEYENV+")")
 
-	var diskfile string
-	flag.StringVar(&diskfile, "disk", "", "disk image (empty for MemDisk)")
+	var adminAddr string
+	flag.StringVar(&adminAddr, "admin", "", "serve the admin API on this address (e.g., localhost:2050; empty to disable)")
 
 	var dumpStats bool
 	flag.BoolVar(&dumpStats, "stats", false, "dump stats to stderr at end")
@@ -79,7 +116,15 @@ func main() {
 	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
 	flag.Parse()
 
-	diskBlocks := 1500 + filesizeMegabytes*1024/4
+	diskBlocks, err := super.MegabytesToBlocks(filesizeMegabytes)
+	if err != nil {
+		log.Fatalf("-size: %v", err)
+	}
+
+	atimePolicy, err := go_nfs.ParseAtime(atime)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -115,25 +160,80 @@ func main() {
 	}
 	defer pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, port, false)
 
+	// quota(1) on clients asks rquotad, on the same port
+	for _, vers := range []uint32{nfstypes.RQUOTAVERS, nfstypes.EXT_RQUOTAVERS} {
+		pmap_set_unset(nfstypes.RQUOTAPROG, vers, 0, false)
+		err = pmap_set_unset(nfstypes.RQUOTAPROG, vers, port, true)
+		if err != nil {
+			panic(err)
+		}
+		defer pmap_set_unset(nfstypes.RQUOTAPROG, vers, port, false)
+	}
+
 	var d disk.Disk
-	if diskfile == "" {
+	if diskPath == "" {
 		d = disk.NewMemDisk(diskBlocks)
+		mkfs = true
+	} else if mkfs {
+		d, err = diskfile.Create(diskPath, diskBlocks)
 	} else {
-		d, err = disk.NewFileDisk(diskfile, diskBlocks)
-		if err != nil {
-			panic(fmt.Errorf("could not create disk: %w", err))
-		}
+		d, err = diskfile.Open(diskPath)
+	}
+	if err != nil {
+		log.Fatalf("could not open disk: %v", err)
+	}
+	if mkfs {
+		d, err = cryptdisk.FormatKeyFile(d, keyFile)
+	} else {
+		d, err = cryptdisk.WrapKeyFile(d, keyFile)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", diskPath, err)
 	}
 	if dumpStats {
 		d = timed_disk.New(d)
 	}
-	server := go_nfs.MakeNfs(d)
+	if mkfs {
+		_, err = go_nfs.Mkfs(d, super.DefaultMkfsOpts())
+		if err != nil {
+			log.Fatalf("mkfs: %v", err)
+		}
+	}
+	var server *go_nfs.Nfs
+	if legacy {
+		server, err = go_nfs.MountLegacy(d)
+	} else {
+		server, err = go_nfs.MountNfs(d)
+	}
+	if err != nil {
+		log.Fatalf("mount %s: %v", diskPath, err)
+	}
 	server.Unstable = unstable
+	server.Jukebox = jukebox
+	server.Atime = atimePolicy
 	defer server.ShutdownNfs()
+	if scrubRate > 0 {
+		server.StartScrub(scrubRate)
+	}
+	if trash {
+		server.StartTrash(go_nfs.TrashPolicy{
+			Retention:  trashRetention,
+			MinFreePct: trashMinFree,
+		})
+	}
+
+	if adminAddr != "" {
+		go func() {
+			err := http.ListenAndServe(adminAddr, admin.Handler(server))
+			log.Printf("admin: %v", err)
+		}()
+	}
 
-	srv := rfc1057.MakeServer()
+	srv := go_nfs.MakeRpcServer()
 	srv.RegisterMany(nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(server))
-	srv.RegisterMany(nfstypes.NFS_PROGRAM_NFS_V3_regs(server))
+	server.RegisterRpcs(srv)
+	srv.RegisterMany(nfstypes.RQUOTAPROG_RQUOTAVERS_regs(server))
+	srv.RegisterMany(nfstypes.RQUOTAPROG_EXT_RQUOTAVERS_regs(server))
 
 	interruptSig := make(chan os.Signal, 1)
 	shutdown := false
@@ -144,6 +244,11 @@ func main() {
 		listener.Close()
 		if dumpStats {
 			server.WriteOpStats(os.Stderr)
+			server.WriteAllocStats(os.Stderr)
+			server.WriteShrinkStats(os.Stderr)
+			server.WriteCsumStats(os.Stderr)
+			server.WriteDiscardStats(os.Stderr)
+			server.WriteScrubStats(os.Stderr)
 			d.(*timed_disk.Disk).WriteStats(os.Stderr)
 		}
 	}()
@@ -156,6 +261,12 @@ func main() {
 				<-statSig
 				server.WriteOpStats(os.Stderr)
 				server.ResetOpStats()
+				server.WriteAllocStats(os.Stderr)
+				server.ResetAllocStats()
+				server.WriteShrinkStats(os.Stderr)
+				server.WriteCsumStats(os.Stderr)
+				server.WriteDiscardStats(os.Stderr)
+				server.WriteScrubStats(os.Stderr)
 				d := d.(*timed_disk.Disk)
 				d.WriteStats(os.Stderr)
 				d.ResetStats()
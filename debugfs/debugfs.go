@@ -0,0 +1,303 @@
+package debugfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// debugfs inspects an unmounted file system, reading it through the
+// log after recovery.  It never writes through the log, but recovery
+// does; open the image with diskfile.OpenReadOnly to leave it
+// untouched.  Unlike fsck, it trusts nothing it reads: every block
+// number is checked against the disk size before it is read.
+//
+
+type Image struct {
+	Sup    *super.FsSuper
+	log    *obj.Log
+	chunks map[common.Bnum]bool
+	reg    map[common.Bnum]bool // index and registry blocks
+}
+
+// An Entry is a directory entry; a malformed one has Bad set.
+type Entry struct {
+	Off  uint64
+	Inum common.Inum
+	Name string
+	Bad  bool
+}
+
+// An Owner says what block Bn holds: Region for metadata, otherwise
+// the inode Inum that points to it with Ref.  A data block with
+// neither is free.
+type Owner struct {
+	Bn     common.Bnum
+	Region string
+	Inum   common.Inum
+	Ref    inode.BlockRef
+}
+
+func (o *Owner) String() string {
+	if o.Region != "" {
+		return o.Region
+	}
+	if o.Inum == common.NULLINUM {
+		return "free"
+	}
+	if o.Ref.Level == 0 {
+		return fmt.Sprintf("inode %d, logical block %d", o.Inum, o.Ref.Lbn)
+	}
+	return fmt.Sprintf("inode %d, level-%d index block from logical block %d",
+		o.Inum, o.Ref.Level, o.Ref.Lbn)
+}
+
+// Open opens the file system on d, which must not be mounted, and is an
+// image from before superblocks if legacy.
+func Open(d disk.Disk, legacy bool) (*Image, error) {
+	sup, err := super.Open(d, legacy)
+	if err != nil {
+		return nil, err
+	}
+	im := &Image{
+		Sup:    sup,
+		log:    obj.MkLog(d), // runs recovery
+		chunks: make(map[common.Bnum]bool),
+		reg:    make(map[common.Bnum]bool),
+	}
+	alloctxn.WalkRegistry(sup, im.log, func(bn common.Bnum, chunk bool) bool {
+		if !im.inData(bn) {
+			return false
+		}
+		if chunk {
+			im.chunks[bn] = true
+		} else {
+			im.reg[bn] = true
+		}
+		return true
+	})
+	return im, nil
+}
+
+func (im *Image) Close() {
+	im.log.Shutdown()
+}
+
+func (im *Image) inData(bn common.Bnum) bool {
+	return bn >= im.Sup.DataStart() && bn < im.Sup.MaxBnum()
+}
+
+// Reads block bn, which must be on the disk.
+func (im *Image) read(bn common.Bnum) []byte {
+	return im.log.Load(addr.MkAddr(bn, 0), common.NBITBLOCK).Data
+}
+
+// ReadBlock returns the contents of block bn.
+func (im *Image) ReadBlock(bn common.Bnum) ([]byte, error) {
+	if uint64(bn) >= im.Sup.Disk.Size() {
+		return nil, fmt.Errorf("block %d is beyond the disk (%d blocks)", bn, im.Sup.Disk.Size())
+	}
+	return im.read(bn), nil
+}
+
+// ReadInode decodes inode inum, free or not.
+func (im *Image) ReadInode(inum common.Inum) (*inode.Inode, error) {
+	if inum == common.NULLINUM {
+		return nil, fmt.Errorf("inode 0 holds the chunk registry")
+	}
+	if !im.Sup.InTable(inum) {
+		bn, _ := im.Sup.Inum2Chunk(inum)
+		if !im.chunks[bn] {
+			return nil, fmt.Errorf("inode %d is neither in the inode table nor in a chunk", inum)
+		}
+	}
+	b := im.log.Load(im.Sup.Inum2Addr(inum), common.INODESZ*8)
+	return inode.Decode(im.Sup, b, inum), nil
+}
+
+// Blocks calls f on the block pointers of ip, like inode.Blocks, but
+// doesn't follow pointers outside the data area.
+func (im *Image) Blocks(ip *inode.Inode, f func(ref inode.BlockRef)) {
+	ip.Blocks(im.read, func(ref inode.BlockRef) bool {
+		f(ref)
+		return im.inData(ref.Bn)
+	})
+}
+
+// ReadDir returns the entries of directory ip, skipping unused ones.
+func (im *Image) ReadDir(ip *inode.Inode) ([]Entry, error) {
+	if ip.Kind != nfstypes.NF3DIR {
+		return nil, fmt.Errorf("inode %d isn't a directory", ip.Inum)
+	}
+	blks := make(map[uint64]common.Bnum)
+	im.Blocks(ip, func(ref inode.BlockRef) {
+		if ref.Level == 0 && im.inData(ref.Bn) {
+			blks[ref.Lbn] = ref.Bn
+		}
+	})
+	var ents = make([]Entry, 0)
+	for off := uint64(0); off+dir.DIRENTSZ <= ip.Size; off += dir.DIRENTSZ {
+		bn, ok := blks[off/disk.BlockSize]
+		if !ok {
+			continue // hole
+		}
+		boff := off % disk.BlockSize
+		inum, name, ok := dir.DecodeEnt(im.read(bn)[boff : boff+dir.DIRENTSZ])
+		if !ok {
+			ents = append(ents, Entry{Off: off, Bad: true})
+			continue
+		}
+		if inum == common.NULLINUM {
+			continue
+		}
+		ents = append(ents, Entry{Off: off, Inum: inum, Name: name})
+	}
+	return ents, nil
+}
+
+// Lookup returns the inode at path, which is relative to the root.
+func (im *Image) Lookup(path string) (*inode.Inode, error) {
+	ip, err := im.ReadInode(common.ROOTINUM)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		ents, err := im.ReadDir(ip)
+		if err != nil {
+			return nil, err
+		}
+		var inum = common.NULLINUM
+		for _, e := range ents {
+			if e.Name == name {
+				inum = e.Inum
+				break
+			}
+		}
+		if inum == common.NULLINUM {
+			return nil, fmt.Errorf("%s: %s not found", path, name)
+		}
+		ip, err = im.ReadInode(inum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ip, nil
+}
+
+func (im *Image) testBit(start common.Bnum, num uint64) bool {
+	data := im.read(start + common.Bnum(num/common.NBITBLOCK))
+	bit := num % common.NBITBLOCK
+	return data[bit/8]&(1<<(bit%8)) != 0
+}
+
+// BlockAllocated returns the block bitmap bit of bn.
+func (im *Image) BlockAllocated(bn common.Bnum) (bool, error) {
+	if uint64(bn) >= im.Sup.NBlockBitmap*common.NBITBLOCK {
+		return false, fmt.Errorf("block %d is beyond the block bitmap", bn)
+	}
+	return im.testBit(im.Sup.BitmapBlockStart(), uint64(bn)), nil
+}
+
+// InodeAllocated returns the inode bitmap bit of inum, or for an inode
+// in a chunk, whether its kind is not free.
+func (im *Image) InodeAllocated(inum common.Inum) (bool, error) {
+	if im.Sup.InTable(inum) {
+		return im.testBit(im.Sup.BitmapInodeStart(), uint64(inum)), nil
+	}
+	ip, err := im.ReadInode(inum)
+	if err != nil {
+		return false, err
+	}
+	return ip.Kind != inode.NF3FREE, nil
+}
+
+// Returns the metadata region bn is in, if any.
+func (im *Image) region(bn common.Bnum) string {
+	sup := im.Sup
+	switch {
+	case uint64(bn) >= sup.Disk.Size():
+		return "beyond the disk"
+	case bn >= sup.MaxBnum():
+		return "beyond the file system"
+	case sup.Sb != nil && bn == sup.BitmapBlockStart()-1:
+		return "superblock"
+	case bn < sup.BitmapBlockStart():
+		return "log"
+	case bn < sup.BitmapInodeStart():
+		return "block bitmap"
+	case bn < sup.InodeStart():
+		return "inode bitmap"
+	case bn < sup.CsumStart():
+		first := uint64(bn-sup.InodeStart()) * common.INODEBLK
+		return fmt.Sprintf("inode table, inodes [%d, %d)", first, first+common.INODEBLK)
+	case bn < sup.ShareStart():
+		first := uint64(bn-sup.CsumStart()) * super.NCSUMBLK
+		return fmt.Sprintf("checksums, blocks [%d, %d)", first, first+super.NCSUMBLK)
+	case bn < sup.SnapStart():
+		first := uint64(bn-sup.ShareStart()) * super.NSHAREBLK
+		return fmt.Sprintf("share counts, blocks [%d, %d)", first, first+super.NSHAREBLK)
+	case bn < sup.DataStart():
+		return "snapshot table"
+	case im.reg[bn]:
+		return "chunk registry"
+	case im.chunks[bn]:
+		first := sup.ChunkInum(bn, 0)
+		return fmt.Sprintf("inode chunk, inodes [%d, %d)", first, first+common.INODEBLK)
+	}
+	return ""
+}
+
+// Calls f on every inode in the table and in chunks, free or not.
+func (im *Image) inodes(f func(ip *inode.Inode)) {
+	for inum := common.Inum(1); inum < im.Sup.NInode(); inum++ {
+		ip, _ := im.ReadInode(inum)
+		f(ip)
+	}
+	for bn := range im.chunks {
+		for i := uint64(0); i < common.INODEBLK; i++ {
+			ip, _ := im.ReadInode(im.Sup.ChunkInum(bn, i))
+			f(ip)
+		}
+	}
+}
+
+// Owners maps each of bns to what holds it, scanning all inodes (free
+// ones too, which may still point to blocks after a crash).
+func (im *Image) Owners(bns []common.Bnum) []*Owner {
+	owners := make([]*Owner, len(bns))
+	want := make(map[common.Bnum][]*Owner)
+	for i, bn := range bns {
+		owners[i] = &Owner{Bn: bn, Region: im.region(bn)}
+		if owners[i].Region == "" {
+			want[bn] = append(want[bn], owners[i])
+		}
+	}
+	if len(want) == 0 {
+		return owners
+	}
+	im.inodes(func(ip *inode.Inode) {
+		im.Blocks(ip, func(ref inode.BlockRef) {
+			for _, o := range want[ref.Bn] {
+				if o.Inum == common.NULLINUM {
+					o.Inum = ip.Inum
+					o.Ref = ref
+				}
+			}
+		})
+	})
+	return owners
+}
@@ -8,12 +8,21 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
-func mkDcache(dip *inode.Inode, op *fstxn.FsTxn) {
-	dip.Dcache = dcache.MkDcache()
-	Apply(dip, op, 0, dip.Size, 100000000,
-		func(ip *inode.Inode, name string, inum common.Inum, off uint64) {
-			dip.Dcache.Add(name, inum, off)
+// Builds dip's dcache, unless an entry fails its checksum, which fails
+// op (see readEnt).  Returns whether dip has a dcache.  It doesn't lock
+// the entries' inodes: the caller may hold dip and lock them in another
+// order (e.g., a directory and its "..").
+func mkDcache(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	dc := dcache.MkDcache()
+	ApplyEnts(dip, op, 0, ^uint64(0),
+		func(name string, inum common.Inum, off uint64) {
+			dc.Add(name, inum, off)
 		})
+	if op.Atxn.ReadFailed() {
+		return false
+	}
+	dip.Dcache = dc
+	return true
 }
 
 func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
@@ -22,8 +31,8 @@ func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (com
 	}
 	var inum = common.NULLINUM
 	var finalOffset uint64 = 0
-	if dip.Dcache == nil {
-		mkDcache(dip, op)
+	if dip.Dcache == nil && !mkDcache(dip, op) {
+		return common.NULLINUM, 0
 	}
 	dentry, ok := dip.Dcache.Lookup(string(name))
 	if ok {
@@ -37,8 +46,8 @@ func AddName(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.
 	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
 		return false
 	}
-	if dip.Dcache == nil {
-		mkDcache(dip, op)
+	if dip.Dcache == nil && !mkDcache(dip, op) {
+		return false
 	}
 	off, ok := AddNameDir(dip, op, inum, name, dip.Dcache.Lastoff)
 	if ok {
@@ -52,8 +61,8 @@ func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
 	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
 		return false
 	}
-	if dip.Dcache == nil {
-		mkDcache(dip, op)
+	if dip.Dcache == nil && !mkDcache(dip, op) {
+		return false
 	}
 	off, ok := RemNameDir(dip, op, name)
 	if ok {
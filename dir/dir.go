@@ -23,18 +23,35 @@ func IllegalName(name nfstypes.Filename3) bool {
 	return n == "." || n == ".."
 }
 
-func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
+// Reads the entry at off of dip.  If its block fails its checksum, op
+// fails (see alloctxn.FailRead) and readEnt returns false, so that the
+// caller stops rather than act on a corrupt entry.
+func readEnt(dip *inode.Inode, op *fstxn.FsTxn, off uint64) (*dirEnt, bool) {
+	data, _, ok := dip.Read(op.Atxn, off, DIRENTSZ)
+	if !ok {
+		util.DPrintf(0, "dir # %d: entry at %d fails its checksum\n", dip.Inum, off)
+		op.Atxn.FailRead()
+		return nil, false
+	}
+	if uint64(len(data)) != DIRENTSZ {
+		return &dirEnt{inum: common.NULLINUM}, true
+	}
+	return decodeDirEnt(data), true
+}
+
+// ScanName returns the inum and offset of name in dip, without the
+// dcache.  It returns false if an entry failed its checksum.
+func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64, bool) {
 	if dip.Kind != nfstypes.NF3DIR {
-		return common.NULLINUM, 0
+		return common.NULLINUM, 0, true
 	}
 	var inum = common.NULLINUM
 	var finalOffset uint64 = 0
 	for off := uint64(0); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		if uint64(len(data)) != DIRENTSZ {
-			break
+		de, ok := readEnt(dip, op, off)
+		if !ok {
+			return common.NULLINUM, 0, false
 		}
-		de := decodeDirEnt(data)
 		if de.inum == common.NULLINUM {
 			continue
 		}
@@ -44,16 +61,21 @@ func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (commo
 			break
 		}
 	}
-	return inum, finalOffset
+	return inum, finalOffset, true
 }
 
+// AddNameDir adds name to dip in the first free entry at or after
+// lastoff.  It returns false if it is out of space, or if an entry
+// failed its checksum (see readEnt).
 func AddNameDir(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum,
 	name nfstypes.Filename3, lastoff uint64) (uint64, bool) {
 	var finalOff uint64
 
 	for off := uint64(lastoff); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
+		de, ok := readEnt(dip, op, off)
+		if !ok {
+			return 0, false
+		}
 		if de.inum == common.NULLINUM {
 			finalOff = off
 			break
@@ -81,13 +103,17 @@ func RemNameDir(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (uin
 	return off, n == DIRENTSZ
 }
 
+// IsDirEmpty returns whether dip has no entries but . and .., and
+// false if an entry failed its checksum (see readEnt).
 func IsDirEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
 	var empty bool = true
 
 	// check all entries after . and ..
 	for off := uint64(2 * DIRENTSZ); off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
+		de, ok := readEnt(dip, op, off)
+		if !ok {
+			return false
+		}
 		if de.inum == common.NULLINUM {
 			off = off + DIRENTSZ
 			continue
@@ -128,6 +154,10 @@ const entryplus3Baggage uint64 = 8 + // fileid
 	16 + // name_handle
 	8 // pointer
 
+// Apply calls f on the entries of dip from start on, and returns
+// whether it reached the end.  It stops if an entry failed its
+// checksum (see readEnt).
+//
 // XXX inode locking order violated
 func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	dircount uint64, maxcount uint64,
@@ -142,8 +172,10 @@ func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	var n uint64 = uint64(64)
 	var dirbytes uint64 = uint64(0)
 	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
+		de, ok := readEnt(dip, op, off)
+		if !ok {
+			return false
+		}
 		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
 		if de.inum == common.NULLINUM {
 			off = off + DIRENTSZ
@@ -180,6 +212,7 @@ func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	return eof
 }
 
+// ApplyEnts is like Apply, but doesn't lock the entries' inodes.
 func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
 	f func(string, common.Inum, uint64)) bool {
 	var eof bool = true
@@ -191,8 +224,10 @@ func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
 	// bytes, and we somewhat arbitrarily use 64 as the constant overhead
 	var n uint64 = uint64(64)
 	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
+		de, ok := readEnt(dip, op, off)
+		if !ok {
+			return false
+		}
 		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
 		if de.inum == common.NULLINUM {
 			off = off + DIRENTSZ
@@ -212,6 +247,35 @@ func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
 	return eof
 }
 
+// WriteEnt writes an entry mapping name to inum at off (a null inum
+// clears the entry), e.g., to repoint "..".  It drops dip's dcache,
+// which may hold the old entry.
+func WriteEnt(dip *inode.Inode, op *fstxn.FsTxn, off uint64, inum common.Inum,
+	name nfstypes.Filename3) bool {
+	if uint64(len(name)) >= MAXNAMELEN || off%DIRENTSZ != 0 {
+		return false
+	}
+	ent := encodeDirEnt(&dirEnt{inum: inum, name: string(name)})
+	n, _ := dip.Write(op.Atxn, off, DIRENTSZ, ent)
+	dip.Dcache = nil
+	return n == DIRENTSZ
+}
+
+// DecodeEnt decodes the directory entry in d, and returns false if it
+// is malformed (e.g., in a corrupted directory).
+func DecodeEnt(d []byte) (common.Inum, string, bool) {
+	if uint64(len(d)) < DIRENTSZ {
+		return common.NULLINUM, "", false
+	}
+	dec := marshal.NewDec(d)
+	inum := dec.GetInt()
+	l := dec.GetInt()
+	if l >= MAXNAMELEN {
+		return common.NULLINUM, "", false
+	}
+	return common.Inum(inum), string(dec.GetBytes(l)), true
+}
+
 // Caller must ensure de.Name fits
 func encodeDirEnt(de *dirEnt) []byte {
 	enc := marshal.NewEnc(DIRENTSZ)
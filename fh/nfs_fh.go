@@ -8,19 +8,38 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
+// SNAPDIR is the Snap of the handle of the .snapshot directory, which
+// isn't in any snapshot.
+const SNAPDIR uint64 = ^uint64(0)
+
+// Snap is the id of the snapshot an object is in, or 0 for the live
+// file system.  Only handles of snapshot objects encode it, so that
+// handles of live objects stay the same.
 type Fh struct {
-	Ino common.Inum
-	Gen uint64
+	Ino  common.Inum
+	Gen  uint64
+	Snap uint64
 }
 
 func MakeFh(fh3 nfstypes.Nfs_fh3) Fh {
 	dec := marshal.NewDec(fh3.Data)
 	i := dec.GetInt()
 	g := dec.GetInt()
-	return Fh{Ino: common.Inum(i), Gen: g}
+	var s uint64
+	if len(fh3.Data) >= 24 {
+		s = dec.GetInt()
+	}
+	return Fh{Ino: common.Inum(i), Gen: g, Snap: s}
 }
 
 func (fh Fh) MakeFh3() nfstypes.Nfs_fh3 {
+	if fh.Snap != 0 {
+		enc := marshal.NewEnc(24)
+		enc.PutInt(uint64(fh.Ino))
+		enc.PutInt(uint64(fh.Gen))
+		enc.PutInt(fh.Snap)
+		return nfstypes.Nfs_fh3{Data: enc.Finish()}
+	}
 	enc := marshal.NewEnc(16)
 	enc.PutInt(uint64(fh.Ino))
 	enc.PutInt(uint64(fh.Gen))
@@ -35,6 +54,17 @@ func MkRootFh3() nfstypes.Nfs_fh3 {
 	return nfstypes.Nfs_fh3{Data: enc.Finish()}
 }
 
+// MkSnapDirFh3 returns the handle of the .snapshot directory.
+func MkSnapDirFh3() nfstypes.Nfs_fh3 {
+	return Fh{Ino: common.ROOTINUM, Snap: SNAPDIR}.MakeFh3()
+}
+
+// IsSnap returns whether fh3 names an object in a snapshot, or the
+// .snapshot directory, which are read-only.
+func IsSnap(fh3 nfstypes.Nfs_fh3) bool {
+	return MakeFh(fh3).Snap != 0
+}
+
 func Equal(h1 nfstypes.Nfs_fh3, h2 nfstypes.Nfs_fh3) bool {
 	return std.BytesEqual(h1.Data, h2.Data)
 }
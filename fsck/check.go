@@ -0,0 +1,322 @@
+package fsck
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/buf"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// The checks that fsck shares with the online scrubber, which runs
+// them one inode at a time while the file system is mounted.
+//
+
+// Owners of blocks other than inodes
+const (
+	MetaOwner = ^common.Inum(0)
+	MapOwner  = ^common.Inum(1) // a snapshot's map
+	SnapOwner = ^common.Inum(2) // a snapshot's copy of an inode block
+)
+
+// Claims records which blocks are in use in a bitmap, and the owners
+// of some of them: a checker learns which blocks are used twice only
+// when it reaches the second owner, and names the first by checking
+// again with those blocks in owners.
+type Claims struct {
+	used   []byte
+	owners map[common.Bnum]common.Inum
+	dups   map[common.Bnum]bool
+}
+
+// MkClaims returns Claims for nblock blocks that records the owners of
+// the blocks in owners, which may be nil.
+func MkClaims(nblock uint64, owners map[common.Bnum]common.Inum) *Claims {
+	if owners == nil {
+		owners = make(map[common.Bnum]common.Inum)
+	}
+	return &Claims{
+		used:   make([]byte, (nblock+7)/8),
+		owners: owners,
+		dups:   make(map[common.Bnum]bool),
+	}
+}
+
+// Covers returns whether bn is one of the blocks c tracks.
+func (c *Claims) Covers(bn common.Bnum) bool {
+	return uint64(bn) < uint64(len(c.used))*8
+}
+
+func (c *Claims) IsUsed(bn common.Bnum) bool {
+	return c.used[bn/8]&(1<<(bn%8)) != 0
+}
+
+// Claim records inum as the owner of bn, and returns false if bn
+// already has one.
+func (c *Claims) Claim(bn common.Bnum, inum common.Inum) bool {
+	if c.IsUsed(bn) {
+		return false
+	}
+	c.used[bn/8] |= 1 << (bn % 8)
+	if o, ok := c.owners[bn]; ok && o == common.NULLINUM {
+		c.owners[bn] = inum
+	}
+	return true
+}
+
+// Dup records that bn is used twice, and describes its first owner,
+// if known.
+func (c *Claims) Dup(bn common.Bnum) string {
+	c.dups[bn] = true
+	o, ok := c.owners[bn]
+	if !ok || o == common.NULLINUM {
+		return "another inode"
+	}
+	return OwnerString(o)
+}
+
+// Dups returns the blocks found used twice, as owners for the Claims
+// of another check.
+func (c *Claims) Dups() map[common.Bnum]common.Inum {
+	owners := make(map[common.Bnum]common.Inum)
+	for bn := range c.dups {
+		owners[bn] = common.NULLINUM
+	}
+	return owners
+}
+
+// NUsed returns the number of blocks claimed.
+func (c *Claims) NUsed() uint64 {
+	var n uint64 = 0
+	for _, b := range c.used {
+		n += uint64(bits.OnesCount8(b))
+	}
+	return n
+}
+
+func OwnerString(inum common.Inum) string {
+	switch inum {
+	case MetaOwner:
+		return "the chunk registry"
+	case MapOwner:
+		return "a snapshot map"
+	case SnapOwner:
+		return "a snapshot"
+	}
+	return fmt.Sprintf("inode %d", inum)
+}
+
+func KindString(kind nfstypes.Ftype3) string {
+	switch kind {
+	case nfstypes.NF3DIR:
+		return "directory"
+	case nfstypes.NF3LNK:
+		return "symlink"
+	case inode.NF3FREE:
+		return "free"
+	}
+	return "file"
+}
+
+// Ent is the entry of a directory at offset Off; a free or malformed
+// entry has Inum NULLINUM.
+type Ent struct {
+	Off  uint64
+	Inum common.Inum
+	Name string
+	Bad  bool // malformed
+}
+
+// DirEnts returns the entries of a directory of size bytes, whose
+// blocks are blks (logical -> physical), reading blocks with read.  A
+// hole reads as free entries.
+func DirEnts(size uint64, blks map[uint64]common.Bnum, read func(common.Bnum) []byte) []Ent {
+	var ents = make([]Ent, 0)
+	var data []byte
+	var dataLbn uint64
+	for off := uint64(0); off+dir.DIRENTSZ <= size; off += dir.DIRENTSZ {
+		lbn := off / disk.BlockSize
+		bn, ok := blks[lbn]
+		if !ok {
+			ents = append(ents, Ent{Off: off})
+			continue
+		}
+		if data == nil || dataLbn != lbn {
+			data = read(bn)
+			dataLbn = lbn
+		}
+		boff := off % disk.BlockSize
+		inum, name, ok := dir.DecodeEnt(data[boff : boff+dir.DIRENTSZ])
+		if !ok {
+			ents = append(ents, Ent{Off: off, Bad: true})
+			continue
+		}
+		ents = append(ents, Ent{Off: off, Inum: inum, Name: name})
+	}
+	return ents
+}
+
+// DotOk returns whether the first of ents, the entries of directory
+// dinum, names it as ".".
+func DotOk(dinum common.Inum, ents []Ent) bool {
+	return len(ents) >= 1 && ents[0].Inum == dinum && ents[0].Name == "."
+}
+
+// DotDotInum returns the inode that "..", the second of ents, names, or
+// NULLINUM if there is no "..".
+func DotDotInum(ents []Ent) common.Inum {
+	if len(ents) < 2 || ents[1].Name != ".." {
+		return common.NULLINUM
+	}
+	return ents[1].Inum
+}
+
+// CheckEnt checks e, a name entry (after "." and "..") of a directory
+// with the names seen before it, given the kind of the inode e names
+// (NF3FREE if it is free or invalid).  It returns the kind of problem
+// with e and a message, or "" if e names its inode, and adds e's name
+// to names.
+func CheckEnt(e Ent, kind nfstypes.Ftype3, names map[string]bool) (string, string) {
+	if e.Name == "." || e.Name == ".." || e.Name == "" {
+		return BadEntry, fmt.Sprintf("entry %q at offset %d", e.Name, e.Off)
+	}
+	if kind == inode.NF3FREE {
+		return Dangling, fmt.Sprintf("%q names free inode %d", e.Name, e.Inum)
+	}
+	if names[e.Name] {
+		return DupName, fmt.Sprintf("%q appears twice", e.Name)
+	}
+	names[e.Name] = true
+	return "", ""
+}
+
+// DirLinkMsg describes entry e, which names a directory with another
+// name.
+func DirLinkMsg(e Ent) string {
+	return fmt.Sprintf("%q names directory %d, which has another name", e.Name, e.Inum)
+}
+
+// WantNlink returns the link count of inum, which has nref names plus
+// subdirectories (for their "..").
+func WantNlink(inum common.Inum, nref uint32) uint32 {
+	if inum == common.ROOTINUM {
+		return nref + 1 // the root has no name, but starts at 1 like others
+	}
+	return nref
+}
+
+func NlinkMsg(nlink uint32, want uint32) string {
+	return fmt.Sprintf("link count %d, want %d", nlink, want)
+}
+
+// Kinds of the metadata blocks that ClaimRegistry and ClaimSnapshots
+// walk
+const (
+	RegistryBlk = iota // of the chunk registry
+	ChunkBlk           // a chunk of inodes
+	MapBlk             // of a snapshot's map
+	CopyBlk            // a snapshot's copy of an inode block
+	CopyDataBlk        // of an inode in a snapshot's copy
+)
+
+// MetaBlock is a block of the chunk registry or of the snapshots.
+type MetaBlock struct {
+	Bn   common.Bnum
+	Kind int
+	Of   common.Bnum // for CopyBlk and CopyDataBlk, the inode block copied
+	Inum common.Inum // for CopyDataBlk, the inode in the copy
+}
+
+// Owner returns the owner that claims b.
+func (b MetaBlock) Owner() common.Inum {
+	switch b.Kind {
+	case RegistryBlk, ChunkBlk:
+		return MetaOwner
+	case MapBlk:
+		return MapOwner
+	}
+	return SnapOwner
+}
+
+// MetaWalk walks the metadata blocks with a superblock and a log,
+// calling Bad on the blocks outside the data area, and Claim on the
+// others; Claim returns whether to walk the blocks b points to.
+type MetaWalk struct {
+	Sup   *super.FsSuper
+	Log   *obj.Log
+	Bad   func(b MetaBlock)
+	Claim func(b MetaBlock) bool
+}
+
+func (w *MetaWalk) read(bn common.Bnum) []byte {
+	return w.Log.Load(addr.MkAddr(bn, 0), common.NBITBLOCK).Data
+}
+
+func (w *MetaWalk) visit(b MetaBlock) bool {
+	if b.Bn < w.Sup.DataStart() || b.Bn >= w.Sup.MaxBnum() {
+		w.Bad(b)
+		return false
+	}
+	return w.Claim(b)
+}
+
+// ClaimRegistry walks the blocks of the chunk registry and the chunks.
+func (w *MetaWalk) ClaimRegistry() {
+	alloctxn.WalkRegistry(w.Sup, w.Log, func(bn common.Bnum, chunk bool) bool {
+		var kind = RegistryBlk
+		if chunk {
+			kind = ChunkBlk
+		}
+		return w.visit(MetaBlock{Bn: bn, Kind: kind})
+	})
+}
+
+// ClaimSnapshots walks the blocks of the snapshots: their maps, copies
+// of inode blocks, and the blocks of the copies' inodes.
+func (w *MetaWalk) ClaimSnapshots() {
+	alloctxn.WalkSnapshots(w.Sup, w.Log, func(bn common.Bnum, of common.Bnum) bool {
+		if of == common.NULLBNUM {
+			return w.visit(MetaBlock{Bn: bn, Kind: MapBlk})
+		}
+		if !w.visit(MetaBlock{Bn: bn, Kind: CopyBlk, Of: of}) {
+			return false
+		}
+		w.claimCopy(of, bn)
+		return true
+	})
+}
+
+// Returns the first inode of inode block bn, of the table or a chunk.
+func firstInum(sup *super.FsSuper, bn common.Bnum) common.Inum {
+	if bn < sup.CsumStart() {
+		return common.Inum(uint64(bn-sup.InodeStart()) * common.INODEBLK)
+	}
+	return sup.ChunkInum(bn, 0)
+}
+
+// Walks the blocks of the inodes in cp, a copy of inode block bn.
+func (w *MetaWalk) claimCopy(bn common.Bnum, cp common.Bnum) {
+	data := w.read(cp)
+	first := firstInum(w.Sup, bn)
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		if bn == w.Sup.InodeStart() && i == 0 {
+			continue // the chunk registry
+		}
+		inum := first + common.Inum(i)
+		b := buf.MkBuf(w.Sup.Inum2Addr(inum), common.INODESZ*8,
+			data[i*common.INODESZ:(i+1)*common.INODESZ])
+		inode.Decode(w.Sup, b, inum).Blocks(w.read, func(ref inode.BlockRef) bool {
+			return w.visit(MetaBlock{Bn: ref.Bn, Kind: CopyDataBlk, Of: bn, Inum: inum})
+		})
+	}
+}
@@ -0,0 +1,605 @@
+package fsck
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/buf"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// fsck checks an unmounted file system: it walks the directory tree
+// from the root and cross-checks what it finds against the inodes and
+// the bitmaps.  It reads the file system through the log, after
+// recovery, and repairs it with transactions, so a crash during a
+// repair leaves the file system no worse than before.
+//
+
+// Kinds of problems
+const (
+	BadRegistry = "bad-registry" // chunk registry points outside the data area
+	BadKind     = "bad-kind"     // inode has an unknown kind
+	BadGen      = "bad-gen"      // allocated inode has generation 0
+	BadBlock    = "bad-block"    // block pointer outside the data area
+	DupBlock    = "dup-block"    // block used twice
+	StaleBlocks = "stale-blocks" // free inode still points to blocks
+	Shrinking   = "shrinking"    // truncation didn't finish
+	BeyondSize  = "beyond-size"  // blocks beyond the file size
+	DirSize     = "dir-size"     // directory size isn't a multiple of an entry
+	BadInline   = "bad-inline"   // inline inode is a directory or too large
+	BadEntry    = "bad-entry"    // malformed directory entry
+	Dangling    = "dangling"     // entry names a free or invalid inode
+	DupName     = "dup-name"     // name appears twice in a directory
+	DirLink     = "dir-link"     // directory has more than one name
+	Dot         = "dot"          // "." doesn't name the directory
+	DotDot      = "dotdot"       // ".." doesn't name the parent
+	Nlink       = "nlink"        // wrong link count
+	Orphan      = "orphan"       // allocated but unreachable
+	BlockBitmap = "block-bitmap" // block bitmap disagrees with the tree
+	InodeBitmap = "inode-bitmap" // inode bitmap disagrees with the inodes
+	BadSnapshot = "bad-snapshot" // snapshot map has a bad or used block
+	Shares      = "shares"       // share count disagrees with the pointers
+)
+
+type Problem struct {
+	Kind  string      `json:"kind"`
+	Inum  common.Inum `json:"inum,omitempty"`
+	Msg   string      `json:"msg"`
+	Fixed bool        `json:"fixed"`
+}
+
+func (p *Problem) String() string {
+	var s = p.Kind + ": "
+	if p.Inum != common.NULLINUM {
+		s += fmt.Sprintf("inode %d: ", p.Inum)
+	}
+	s += p.Msg
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+type Report struct {
+	Inodes   uint64     `json:"inodes"`
+	Dirs     uint64     `json:"dirs"`
+	Blocks   uint64     `json:"blocks"` // data blocks in use
+	Chunks   uint64     `json:"chunks"`
+	Problems []*Problem `json:"problems"`
+}
+
+// Clean returns whether fsck found nothing that it didn't fix.
+func (r *Report) Clean() bool {
+	for _, p := range r.Problems {
+		if !p.Fixed {
+			return false
+		}
+	}
+	return true
+}
+
+// A repair happens in one of three phases: on the raw log before
+// anything relies on the bitmaps, on the repaired file system, and
+// reconnecting orphans last (which allocates, and relies on link
+// counts being right).
+const (
+	phaseRaw uint64 = iota
+	phaseFs
+	phaseOrphan
+	nphase
+)
+
+type problem struct {
+	*Problem
+	phase uint64
+	fix   func(r *repairer) bool
+}
+
+type checker struct {
+	sup      *super.FsSuper
+	log      *obj.Log
+	problems []*problem
+
+	inodes  map[common.Inum]*inode.Inode // allocated inodes
+	chunks  []common.Bnum
+	claims  *Claims
+	extra   map[common.Bnum]uint64                 // pointers beyond the owner's
+	dirblks map[common.Inum]map[uint64]common.Bnum // logical -> physical
+
+	reached map[common.Inum]bool
+	nref    map[common.Inum]uint32 // # names, plus subdirectories' ..
+	parent  map[common.Inum]common.Inum
+}
+
+func (c *checker) report(kind string, inum common.Inum, phase uint64,
+	fix func(r *repairer) bool, format string, a ...interface{}) {
+	p := &problem{
+		Problem: &Problem{Kind: kind, Inum: inum, Msg: fmt.Sprintf(format, a...)},
+		phase:   phase,
+		fix:     fix,
+	}
+	util.DPrintf(1, "fsck: %v\n", p.Problem)
+	c.problems = append(c.problems, p)
+}
+
+func (c *checker) read(bn common.Bnum) []byte {
+	return c.log.Load(addr.MkAddr(bn, 0), common.NBITBLOCK).Data
+}
+
+func (c *checker) inData(bn common.Bnum) bool {
+	return bn >= c.sup.DataStart() && bn < c.sup.MaxBnum()
+}
+
+// Counts another pointer to bn, which has an owner, if the share count
+// of bn allows it.
+func (c *checker) share(bn common.Bnum) bool {
+	if c.extra[bn] >= alloctxn.ReadShares(c.sup, c.log, bn) {
+		return false
+	}
+	c.extra[bn]++
+	return true
+}
+
+// Reports b, a block of the chunk registry or the snapshots outside
+// the data area.  Snapshots are read-only, so fsck doesn't repair
+// them.
+func (c *checker) badMeta(b MetaBlock) {
+	switch b.Kind {
+	case RegistryBlk, ChunkBlk:
+		c.report(BadRegistry, common.NULLINUM, phaseRaw, nil,
+			"chunk registry has bad block %d", b.Bn)
+	case CopyDataBlk:
+		c.report(BadSnapshot, b.Inum, phaseRaw, nil,
+			"snapshot copy has block %d outside the data area", b.Bn)
+	default:
+		c.report(BadSnapshot, common.NULLINUM, phaseRaw, nil,
+			"snapshot map has bad block %d", b.Bn)
+	}
+}
+
+// Claims b, a block of the chunk registry or the snapshots, which
+// snapshots may share with the live inodes and each other.
+func (c *checker) claimMeta(b MetaBlock) bool {
+	if c.claims.Claim(b.Bn, b.Owner()) {
+		if b.Kind == ChunkBlk {
+			c.chunks = append(c.chunks, b.Bn)
+		}
+		return true
+	}
+	switch b.Kind {
+	case RegistryBlk, ChunkBlk:
+		c.report(BadRegistry, common.NULLINUM, phaseRaw, nil,
+			"chunk registry has bad block %d", b.Bn)
+	case MapBlk:
+		c.report(BadSnapshot, common.NULLINUM, phaseRaw, nil,
+			"snapshot map block %d is also used by %s", b.Bn, c.claims.Dup(b.Bn))
+	case CopyBlk:
+		if !c.share(b.Bn) {
+			c.report(BadSnapshot, common.NULLINUM, phaseRaw, nil,
+				"copy %d of inode block %d is also used by %s", b.Bn, b.Of, c.claims.Dup(b.Bn))
+		}
+	case CopyDataBlk:
+		if !c.share(b.Bn) {
+			c.report(BadSnapshot, b.Inum, phaseRaw, nil,
+				"block %d of a snapshot copy is also used by %s", b.Bn, c.claims.Dup(b.Bn))
+		}
+	}
+	return false
+}
+
+func (c *checker) metaWalk() *MetaWalk {
+	return &MetaWalk{Sup: c.sup, Log: c.log, Bad: c.badMeta, Claim: c.claimMeta}
+}
+
+func (c *checker) checkInode(ip *inode.Inode) {
+	switch ip.Kind {
+	case inode.NF3FREE:
+		if ip.IsShrinking() {
+			c.checkBlocks(ip)
+			return
+		}
+		var stale = false
+		ip.Blocks(c.read, func(ref inode.BlockRef) bool {
+			stale = true
+			return false
+		})
+		if stale {
+			c.report(StaleBlocks, ip.Inum, phaseRaw, func(r *repairer) bool {
+				return r.clearBlocks(ip)
+			}, "free inode has block pointers")
+		}
+		return
+	case nfstypes.NF3REG, nfstypes.NF3DIR, nfstypes.NF3LNK:
+	default:
+		c.report(BadKind, ip.Inum, phaseRaw, func(r *repairer) bool {
+			return r.freeInode(ip)
+		}, "unknown kind %d", ip.Kind)
+		return
+	}
+	c.inodes[ip.Inum] = ip
+	if ip.Gen == 0 {
+		c.report(BadGen, ip.Inum, phaseRaw, func(r *repairer) bool {
+			ip.Gen = 1
+			ip.WriteInode(r.atxn)
+			return true
+		}, "generation is 0")
+	}
+	if ip.IsInline() && (ip.Kind == nfstypes.NF3DIR || ip.Size > inode.InlineSize(c.sup)) {
+		c.report(BadInline, ip.Inum, phaseRaw, nil,
+			"inline %s of %d bytes", KindString(ip.Kind), ip.Size)
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		c.dirblks[ip.Inum] = make(map[uint64]common.Bnum)
+		if ip.Size%dir.DIRENTSZ != 0 {
+			c.report(DirSize, ip.Inum, phaseRaw, nil,
+				"size %d isn't a multiple of %d", ip.Size, dir.DIRENTSZ)
+		}
+	}
+	c.checkBlocks(ip)
+}
+
+// Claims the blocks of ip, and checks that they are within its size.
+func (c *checker) checkBlocks(ip *inode.Inode) {
+	var limit = util.RoundUp(ip.Size, disk.BlockSize)
+	if ip.IsShrinking() {
+		limit = ip.ShrinkSize
+		c.report(Shrinking, ip.Inum, phaseFs, func(r *repairer) bool {
+			return r.shrink(ip.Inum, 0)
+		}, "truncation from %d to %d blocks didn't finish",
+			ip.ShrinkSize, util.RoundUp(ip.Size, disk.BlockSize))
+	}
+	var beyond uint64 = 0
+	ip.Blocks(c.read, func(ref inode.BlockRef) bool {
+		if !c.inData(ref.Bn) {
+			c.report(BadBlock, ip.Inum, phaseRaw, func(r *repairer) bool {
+				return r.clearRef(ip, ref)
+			}, "block %d is outside the data area", ref.Bn)
+			return false
+		}
+		if !c.claims.Claim(ref.Bn, ip.Inum) {
+			if c.share(ref.Bn) {
+				return false // its blocks were claimed already
+			}
+			c.report(DupBlock, ip.Inum, phaseRaw, func(r *repairer) bool {
+				return r.clearRef(ip, ref)
+			}, "block %d is also used by %s", ref.Bn, c.claims.Dup(ref.Bn))
+			return false
+		}
+		if ref.Lbn >= limit && ref.Lbn+1 > beyond {
+			beyond = ref.Lbn + 1
+		}
+		if ref.Level == 0 && c.dirblks[ip.Inum] != nil {
+			c.dirblks[ip.Inum][ref.Lbn] = ref.Bn
+		}
+		return true
+	})
+	if beyond > 0 {
+		c.report(BeyondSize, ip.Inum, phaseFs, func(r *repairer) bool {
+			return r.shrink(ip.Inum, beyond)
+		}, "blocks up to %d, but size is %d blocks", beyond, limit)
+	}
+}
+
+func (c *checker) checkInodeBlock(bn common.Bnum, first common.Inum, skip0 bool) {
+	data := c.read(bn)
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		inum := first + common.Inum(i)
+		if skip0 && inum == common.NULLINUM {
+			continue // the chunk registry
+		}
+		a := c.sup.Inum2Addr(inum)
+		b := buf.MkBuf(a, common.INODESZ*8, data[i*common.INODESZ:(i+1)*common.INODESZ])
+		c.checkInode(inode.Decode(c.sup, b, inum))
+	}
+}
+
+func (c *checker) checkInodes() {
+	for bn := c.sup.InodeStart(); bn < c.sup.CsumStart(); bn++ {
+		first := common.Inum(uint64(bn-c.sup.InodeStart()) * common.INODEBLK)
+		c.checkInodeBlock(bn, first, true)
+	}
+	for _, bn := range c.chunks {
+		c.checkInodeBlock(bn, c.sup.ChunkInum(bn, 0), false)
+	}
+}
+
+// Checks the share counts against the pointers counted.
+func (c *checker) checkShares() {
+	if c.sup.Legacy() {
+		return
+	}
+	for bn := c.sup.DataStart(); bn < c.sup.MaxBnum(); bn++ {
+		n := alloctxn.ReadShares(c.sup, c.log, bn)
+		want := c.extra[bn]
+		if n == want {
+			continue
+		}
+		b := bn
+		c.report(Shares, common.NULLINUM, phaseRaw, func(r *repairer) bool {
+			r.atxn.RepairShares(b, want)
+			return r.maybeCommitRaw()
+		}, "block %d has share count %d, but %d extra pointers", bn, n, want)
+	}
+}
+
+// Returns the entries of directory dip, reporting malformed ones if
+// report is set.
+func (c *checker) entries(dip *inode.Inode, report bool) []Ent {
+	ents := DirEnts(dip.Size, c.dirblks[dip.Inum], c.read)
+	for _, e := range ents {
+		if !e.Bad || !report {
+			continue
+		}
+		o := e.Off
+		c.report(BadEntry, dip.Inum, phaseFs, func(r *repairer) bool {
+			return r.writeEnt(dip.Inum, o, common.NULLINUM, "")
+		}, "malformed entry at offset %d", e.Off)
+	}
+	return ents
+}
+
+func (c *checker) checkDots(dip *inode.Inode, ents []Ent, parent common.Inum) {
+	if !DotOk(dip.Inum, ents) {
+		c.report(Dot, dip.Inum, phaseFs, func(r *repairer) bool {
+			return r.writeEnt(dip.Inum, 0, dip.Inum, ".")
+		}, "\".\" doesn't name the directory")
+	}
+	if parent == common.NULLINUM { // orphan; reconnecting sets ..
+		return
+	}
+	if DotDotInum(ents) != parent {
+		c.report(DotDot, dip.Inum, phaseFs, func(r *repairer) bool {
+			return r.writeEnt(dip.Inum, dir.DIRENTSZ, parent, "..")
+		}, "\"..\" doesn't name parent %d", parent)
+	}
+}
+
+// Walks the tree rooted at directory root (whose parent is parent),
+// counting names and checking entries.
+func (c *checker) walk(root common.Inum, parent common.Inum) {
+	c.reached[root] = true
+	c.parent[root] = parent
+	var queue = []common.Inum{root}
+	for len(queue) > 0 {
+		dinum := queue[0]
+		queue = queue[1:]
+		dip := c.inodes[dinum]
+		ents := c.entries(dip, true)
+		c.checkDots(dip, ents, c.parent[dinum])
+		names := make(map[string]bool)
+		for i, de := range ents {
+			if i < 2 || de.Inum == common.NULLINUM {
+				continue
+			}
+			off := de.Off
+			clear := func(r *repairer) bool {
+				return r.writeEnt(dinum, off, common.NULLINUM, "")
+			}
+			var kind = inode.NF3FREE
+			if ip, ok := c.inodes[de.Inum]; ok {
+				kind = ip.Kind
+			}
+			if pk, msg := CheckEnt(de, kind, names); pk != "" {
+				c.report(pk, dinum, phaseFs, clear, "%s", msg)
+				continue
+			}
+			if kind == nfstypes.NF3DIR {
+				if c.reached[de.Inum] {
+					c.report(DirLink, dinum, phaseFs, clear, "%s", DirLinkMsg(de))
+					continue
+				}
+				c.parent[de.Inum] = dinum
+				c.nref[dinum]++ // for ..
+				queue = append(queue, de.Inum)
+			}
+			c.nref[de.Inum]++
+			c.reached[de.Inum] = true
+		}
+	}
+}
+
+// Finds the allocated inodes that are unreachable from the root, and
+// walks each unreachable subtree from its top, which will be named in
+// lost+found.
+func (c *checker) findOrphans() {
+	var unreached = make([]common.Inum, 0)
+	for inum := range c.inodes {
+		if !c.reached[inum] {
+			unreached = append(unreached, inum)
+		}
+	}
+	sort.Slice(unreached, func(i, j int) bool { return unreached[i] < unreached[j] })
+	named := make(map[common.Inum]bool)
+	for _, inum := range unreached {
+		ip := c.inodes[inum]
+		if ip.Kind != nfstypes.NF3DIR {
+			continue
+		}
+		for i, de := range c.entries(ip, false) {
+			if i >= 2 && de.Inum != inum {
+				named[de.Inum] = true
+			}
+		}
+	}
+	// tops first; then whatever is left, which must be in a cycle
+	for _, pass := range []bool{true, false} {
+		for _, inum := range unreached {
+			if c.reached[inum] || (pass && named[inum]) {
+				continue
+			}
+			c.nref[inum]++ // for its name in lost+found
+			if c.inodes[inum].Kind == nfstypes.NF3DIR {
+				c.walk(inum, common.NULLINUM)
+			} else {
+				c.reached[inum] = true
+			}
+			i := inum
+			c.report(Orphan, inum, phaseOrphan, func(r *repairer) bool {
+				return r.reconnect(i)
+			}, "unreachable %s", KindString(c.inodes[inum].Kind))
+		}
+	}
+}
+
+func (c *checker) checkNlinks() {
+	inums := make([]common.Inum, 0, len(c.inodes))
+	for inum := range c.inodes {
+		inums = append(inums, inum)
+	}
+	sort.Slice(inums, func(i, j int) bool { return inums[i] < inums[j] })
+	for _, inum := range inums {
+		ip := c.inodes[inum]
+		want := WantNlink(inum, c.nref[inum])
+		if ip.Nlink != want {
+			i := inum
+			c.report(Nlink, inum, phaseFs, func(r *repairer) bool {
+				return r.setNlink(i, want)
+			}, "%s", NlinkMsg(ip.Nlink, want))
+		}
+	}
+}
+
+// Reports the runs of bits in the n bitmap blocks at start that differ
+// from used.
+func (c *checker) checkBitmap(kind string, what string, start common.Bnum, n uint64,
+	used func(uint64) bool) {
+	var runStart uint64 = 0
+	var runUsed = false
+	var inRun = false
+	flush := func(end uint64) {
+		if !inRun {
+			return
+		}
+		lo, hi, set := runStart, end, runUsed
+		var msg = "free, but marked allocated"
+		if set {
+			msg = "in use, but marked free"
+		}
+		c.report(kind, common.NULLINUM, phaseRaw, func(r *repairer) bool {
+			return r.writeBits(start, lo, hi, set)
+		}, "%s [%d, %d) %s", what, lo, hi, msg)
+		inRun = false
+	}
+	for i := uint64(0); i < n; i++ {
+		data := c.read(start + common.Bnum(i))
+		for j := uint64(0); j < common.NBITBLOCK; j++ {
+			num := i*common.NBITBLOCK + j
+			set := data[j/8]&(1<<(j%8)) != 0
+			want := used(num)
+			if set == want || (inRun && runUsed != want) {
+				flush(num)
+			}
+			if set != want && !inRun {
+				runStart, runUsed, inRun = num, want, true
+			}
+		}
+	}
+	flush(n * common.NBITBLOCK)
+}
+
+func (c *checker) checkBitmaps() {
+	c.checkBitmap(BlockBitmap, "blocks", c.sup.BitmapBlockStart(), c.sup.NBlockBitmap,
+		func(bn uint64) bool {
+			return !c.inData(common.Bnum(bn)) || c.claims.IsUsed(common.Bnum(bn))
+		})
+	c.checkBitmap(InodeBitmap, "inodes", c.sup.BitmapInodeStart(), c.sup.NInodeBitmap,
+		func(inum uint64) bool {
+			_, ok := c.inodes[common.Inum(inum)]
+			return inum == 0 || ok || !c.sup.InTable(common.Inum(inum))
+		})
+}
+
+// Returns a checker that records the owners of the blocks in owners
+// (see check).
+func mkChecker(sup *super.FsSuper, log *obj.Log, owners map[common.Bnum]common.Inum) *checker {
+	return &checker{
+		sup:      sup,
+		log:      log,
+		problems: make([]*problem, 0),
+		inodes:   make(map[common.Inum]*inode.Inode),
+		chunks:   make([]common.Bnum, 0),
+		claims:   MkClaims(sup.NBlockBitmap*common.NBITBLOCK, owners),
+		extra:    make(map[common.Bnum]uint64),
+		dirblks:  make(map[common.Inum]map[uint64]common.Bnum),
+		reached:  make(map[common.Inum]bool),
+		nref:     make(map[common.Inum]uint32),
+		parent:   make(map[common.Inum]common.Inum),
+	}
+}
+
+func (c *checker) check() error {
+	c.metaWalk().ClaimRegistry()
+	c.checkInodes()
+	c.metaWalk().ClaimSnapshots()
+	c.checkShares()
+	root, ok := c.inodes[common.ROOTINUM]
+	if !ok || root.Kind != nfstypes.NF3DIR {
+		return fmt.Errorf("root inode %d isn't a directory", common.ROOTINUM)
+	}
+	c.walk(common.ROOTINUM, common.ROOTINUM)
+	c.findOrphans()
+	c.checkNlinks()
+	c.checkBitmaps()
+	return nil
+}
+
+func (c *checker) mkReport() *Report {
+	rep := &Report{
+		Inodes:   uint64(len(c.inodes)),
+		Chunks:   uint64(len(c.chunks)),
+		Problems: make([]*Problem, 0, len(c.problems)),
+	}
+	for _, ip := range c.inodes {
+		if ip.Kind == nfstypes.NF3DIR {
+			rep.Dirs++
+		}
+	}
+	rep.Blocks = c.claims.NUsed()
+	for _, p := range c.problems {
+		rep.Problems = append(rep.Problems, p.Problem)
+	}
+	return rep
+}
+
+// Check checks the file system on d, which must not be mounted, and
+// repairs what it can if repair is set; d holds an image from before
+// superblocks if legacy.  It returns an error if d doesn't hold a file
+// system fsck understands.
+func Check(d disk.Disk, repair bool, legacy bool) (*Report, error) {
+	sup, err := super.Open(d, legacy)
+	if err != nil {
+		return nil, err
+	}
+	log := obj.MkLog(d) // runs recovery
+	defer log.Shutdown()
+
+	var c = mkChecker(sup, log, nil)
+	err = c.check()
+	if err != nil {
+		return nil, err
+	}
+	if owners := c.claims.Dups(); len(owners) > 0 {
+		// check again, the same way, to name the owners of the
+		// blocks used twice
+		c = mkChecker(sup, log, owners)
+		err = c.check()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if repair && len(c.problems) > 0 {
+		c.repair()
+	}
+	return c.mkReport(), nil
+}
@@ -0,0 +1,220 @@
+package fsck
+
+import (
+	"strconv"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/shrinker"
+)
+
+const LOSTFOUND = "lost+found"
+
+// Max # buffers in a transaction of the raw phase, well below what
+// fits in the log.
+const maxRawBufs uint64 = 256
+
+type repairer struct {
+	c        *checker
+	atxn     *alloctxn.AllocTxn // raw phase; doesn't allocate
+	st       *fstxn.FsState
+	shrinkst *shrinker.ShrinkerSt
+	lf       common.Inum
+}
+
+// Begins a transaction of the file system phase, which may use the
+// reserved blocks.
+func (r *repairer) begin() *fstxn.FsTxn {
+	op := fstxn.Begin(r.st)
+	op.Atxn.UseReserved = true
+	return op
+}
+
+func (r *repairer) beginRaw() {
+	r.atxn = alloctxn.Begin(&alloctxn.State{Super: r.c.sup, Log: r.c.log})
+}
+
+func (r *repairer) commitRaw() bool {
+	ok := r.atxn.Op.CommitWait(true)
+	r.beginRaw()
+	return ok
+}
+
+// Commit the raw transaction if it is getting big.
+func (r *repairer) maybeCommitRaw() bool {
+	if r.atxn.Op.NDirty() < maxRawBufs {
+		return true
+	}
+	return r.commitRaw()
+}
+
+func (r *repairer) clearRef(ip *inode.Inode, ref inode.BlockRef) bool {
+	ip.ClearRef(r.atxn, ref)
+	return r.maybeCommitRaw()
+}
+
+// Clear the top-level block pointers of ip.
+func (r *repairer) clearBlocks(ip *inode.Inode) bool {
+	ip.Blocks(r.c.read, func(ref inode.BlockRef) bool {
+		ip.ClearRef(r.atxn, ref)
+		return false
+	})
+	return r.maybeCommitRaw()
+}
+
+func (r *repairer) freeInode(ip *inode.Inode) bool {
+	ip.Kind = inode.NF3FREE
+	ip.Gen = ip.Gen + 1
+	ip.Size = 0
+	ip.ShrinkSize = 0
+	ip.WriteInode(r.atxn)
+	return r.clearBlocks(ip)
+}
+
+func (r *repairer) writeBits(start common.Bnum, lo uint64, hi uint64, set bool) bool {
+	for n := lo; n < hi; n += maxRawBufs {
+		nums := make([]uint64, 0, maxRawBufs)
+		for i := n; i < hi && i < n+maxRawBufs; i++ {
+			nums = append(nums, i)
+		}
+		r.atxn.WriteBits(nums, uint64(start), set)
+		if !r.maybeCommitRaw() {
+			return false
+		}
+	}
+	return true
+}
+
+// Finish shrinking inum, after extending the shrink to beyond blocks
+// (to free blocks past the size).
+func (r *repairer) shrink(inum common.Inum, beyond uint64) bool {
+	op := r.begin()
+	ip := op.GetInodeInumFree(inum)
+	if beyond > ip.ShrinkSize {
+		ip.ShrinkSize = beyond
+		ip.WriteInode(op.Atxn)
+	}
+	more := ip.Shrink(op.Atxn)
+	if !op.Commit() {
+		return false
+	}
+	if more {
+		return r.shrinkst.DoShrink(inum)
+	}
+	return true
+}
+
+func (r *repairer) writeEnt(dinum common.Inum, off uint64, inum common.Inum,
+	name nfstypes.Filename3) bool {
+	op := r.begin()
+	dip := op.GetInodeInumFree(dinum)
+	if !dir.WriteEnt(dip, op, off, inum, name) {
+		op.Abort()
+		return false
+	}
+	return op.Commit()
+}
+
+func (r *repairer) setNlink(inum common.Inum, nlink uint32) bool {
+	op := r.begin()
+	ip := op.GetInodeInumFree(inum)
+	ip.Nlink = nlink
+	ip.WriteInode(op.Atxn)
+	return op.Commit()
+}
+
+// Returns the inum of lost+found, making it if it doesn't exist.
+func (r *repairer) lostFound() common.Inum {
+	if r.lf != common.NULLINUM {
+		return r.lf
+	}
+	op := r.begin()
+	root := op.GetInodeInumFree(common.ROOTINUM)
+	inum, _ := dir.LookupName(root, op, LOSTFOUND)
+	if inum != common.NULLINUM {
+		ip := op.GetInodeInumFree(inum)
+		if ip.Kind == nfstypes.NF3DIR {
+			r.lf = inum
+		}
+		op.Abort()
+		return r.lf
+	}
+	ip := op.AllocInode(nfstypes.NF3DIR, common.ROOTINUM, nil)
+	if ip == nil || ip.Kind != nfstypes.NF3DIR ||
+		!dir.InitDir(ip, op, common.ROOTINUM) ||
+		!dir.AddName(root, op, ip.Inum, LOSTFOUND) {
+		op.Abort()
+		return common.NULLINUM
+	}
+	root.Nlink = root.Nlink + 1 // for ..
+	root.WriteInode(op.Atxn)
+	if op.Commit() {
+		r.lf = ip.Inum
+	}
+	return r.lf
+}
+
+// Name orphan inum "#inum" in lost+found.
+func (r *repairer) reconnect(inum common.Inum) bool {
+	lf := r.lostFound()
+	if lf == common.NULLINUM {
+		return false
+	}
+	op := r.begin()
+	var lfip, ip *inode.Inode
+	if lf < inum {
+		lfip = op.GetInodeInumFree(lf)
+		ip = op.GetInodeInumFree(inum)
+	} else {
+		ip = op.GetInodeInumFree(inum)
+		lfip = op.GetInodeInumFree(lf)
+	}
+	name := "#" + strconv.FormatUint(uint64(inum), 10)
+	if !dir.AddName(lfip, op, inum, nfstypes.Filename3(name)) {
+		op.Abort()
+		return false
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		if !dir.WriteEnt(ip, op, dir.DIRENTSZ, lf, "..") {
+			op.Abort()
+			return false
+		}
+		lfip.Nlink = lfip.Nlink + 1
+		lfip.WriteInode(op.Atxn)
+	}
+	util.DPrintf(1, "fsck: reconnect %d as %s\n", inum, name)
+	return op.Commit()
+}
+
+func (c *checker) repair() {
+	r := &repairer{c: c}
+	for phase := phaseRaw; phase < nphase; phase++ {
+		if phase == phaseRaw {
+			r.beginRaw()
+		}
+		if phase == phaseFs {
+			r.st = fstxn.MkFsState(c.sup, c.log)
+			r.shrinkst = shrinker.MkShrinkerSt(r.st)
+		}
+		// raw fixes are only fixed once they commit together
+		var fixed []*problem
+		for _, p := range c.problems {
+			if p.phase == phase && p.fix != nil && p.fix(r) {
+				fixed = append(fixed, p)
+			}
+		}
+		if phase == phaseRaw && !r.commitRaw() {
+			util.DPrintf(0, "fsck: commit failed\n")
+			return
+		}
+		for _, p := range fixed {
+			p.Fixed = true
+		}
+	}
+	r.st.Shutdown()
+}
@@ -0,0 +1,100 @@
+package fstxn
+
+import (
+	"sync"
+
+	"github.com/mit-pdos/go-journal/common"
+)
+
+// MAXCHANGES bounds the inodes and the blocks a Changes records.
+const MAXCHANGES uint64 = 1 << 20
+
+// Changes records the inodes that committed transactions locked and
+// the blocks whose allocation or share count they changed, while it is
+// tracked (see Track), so that a scan that doesn't hold locks across
+// the file system can tell which of its findings may be stale.
+type Changes struct {
+	mu       *sync.Mutex
+	inodes   map[common.Inum]bool
+	blocks   map[common.Bnum]bool
+	overflow bool // recorded more than MAXCHANGES of either
+}
+
+func mkChanges() *Changes {
+	return &Changes{
+		mu:     new(sync.Mutex),
+		inodes: make(map[common.Inum]bool),
+		blocks: make(map[common.Bnum]bool),
+	}
+}
+
+func (c *Changes) record(op *FsTxn) {
+	bns := op.Atxn.ChangedBlocks()
+	c.mu.Lock()
+	for inum := range op.inodes {
+		c.inodes[inum] = true
+	}
+	for _, bn := range bns {
+		c.blocks[bn] = true
+	}
+	if uint64(len(c.inodes)) > MAXCHANGES || uint64(len(c.blocks)) > MAXCHANGES {
+		c.overflow = true
+		c.inodes = make(map[common.Inum]bool)
+		c.blocks = make(map[common.Bnum]bool)
+	}
+	c.mu.Unlock()
+}
+
+// TakeInodes returns the inodes changed since the last call, and
+// whether the changes overflowed (in which case any inode may have
+// changed).
+func (c *Changes) TakeInodes() (map[common.Inum]bool, bool) {
+	c.mu.Lock()
+	inodes := c.inodes
+	c.inodes = make(map[common.Inum]bool)
+	overflow := c.overflow
+	c.mu.Unlock()
+	return inodes, overflow
+}
+
+// Block returns whether bn changed, or the changes overflowed.
+func (c *Changes) Block(bn common.Bnum) bool {
+	c.mu.Lock()
+	changed := c.overflow || c.blocks[bn]
+	c.mu.Unlock()
+	return changed
+}
+
+// Overflowed returns whether more changed than c could record.
+func (c *Changes) Overflowed() bool {
+	c.mu.Lock()
+	overflow := c.overflow
+	c.mu.Unlock()
+	return overflow
+}
+
+// Track starts recording the changes of the transactions that commit
+// from now on, until Untrack.
+func (st *FsState) Track() *Changes {
+	c := mkChanges()
+	st.trackMu.Lock()
+	st.tracking[c] = true
+	st.trackMu.Unlock()
+	return c
+}
+
+func (st *FsState) Untrack(c *Changes) {
+	st.trackMu.Lock()
+	delete(st.tracking, c)
+	st.trackMu.Unlock()
+}
+
+// Records the changes of op, which is about to commit and still holds
+// its inodes, in the tracked Changes.
+func (st *FsState) recordChanges(op *FsTxn) {
+	st.trackMu.Lock()
+	for c := range st.tracking {
+		c.record(op)
+	}
+	st.trackMu.Unlock()
+}
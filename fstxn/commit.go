@@ -1,19 +1,47 @@
 package fstxn
 
+import (
+	"sync/atomic"
+)
+
 // putInodes may free an inode so must be done before commit
 func (op *FsTxn) preCommit() {
 	op.Atxn.PreCommit()
 }
 
 func (op *FsTxn) postCommit() {
-	op.releaseInodes()
+	op.end()
 	op.Atxn.PostCommit()
 }
 
+// A durable commit also makes the commits before it durable, so it
+// discards the blocks they freed.
+func (op *FsTxn) postCommitDurable(mark uint64) {
+	op.end()
+	op.Atxn.PostCommitDurable(mark)
+}
+
 func (op *FsTxn) commitWait(wait bool) bool {
+	if op.Atxn.Failed() {
+		op.Abort()
+		return false
+	}
 	op.preCommit()
-	ok := op.Atxn.Op.CommitWait(wait)
-	op.postCommit()
+	if op.Atxn.Op.NDirty() > 0 {
+		op.Fs.recordChanges(op)
+	}
+	mark := op.Fs.Discards.Mark()
+	atomic.AddInt64(&op.Fs.committing, 1)
+	ok := op.Atxn.Commit(wait)
+	atomic.AddInt64(&op.Fs.committing, -1)
+	if ok && wait {
+		op.postCommitDurable(mark)
+	} else {
+		op.postCommit()
+	}
+	if ok {
+		op.runCommitted()
+	}
 	return ok
 }
 
@@ -36,15 +64,28 @@ func (op *FsTxn) CommitUnstable() bool {
 // that is only an option if we do log-by-pass writes.
 func (op *FsTxn) CommitFh() bool {
 	op.preCommit()
-	ok := op.Fs.Txn.Flush()
+	mark := op.Fs.Discards.Mark()
+	atomic.AddInt64(&op.Fs.committing, 1)
+	ok := op.Fs.Log.Flush()
+	atomic.AddInt64(&op.Fs.committing, -1)
 	op.postCommit()
+	if ok {
+		op.Fs.Discards.Flush(mark, nil)
+		op.runCommitted()
+	}
 	return ok
 }
 
 // An aborted transaction may free an inode, which results in dirty
 // buffers that need to be written to log. So, call commit.
+//
+// An aborted transaction that wrote anything drops its inodes from the
+// cache, since their copies may have its changes.
 func (op *FsTxn) Abort() bool {
-	op.releaseInodes()
+	if op.Atxn.Op.NDirty() > 0 {
+		op.dropInodes()
+	}
+	op.end()
 	op.Atxn.PostAbort()
 	return true
 }
@@ -1,47 +1,168 @@
 package fstxn
 
 import (
-	"github.com/mit-pdos/go-journal/alloc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/lockmap"
 	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/cache"
+	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/super"
 )
 
 const ICACHESZ uint64 = 100
 
 type FsState struct {
-	Super   *super.FsSuper
-	Txn     *obj.Log
+	*alloctxn.State
 	Icache  *cache.Cache
 	Lockmap *lockmap.LockMap
-	Balloc  *alloc.Alloc
-	Ialloc  *alloc.Alloc
+	// gate keeps transactions out while a snapshot is taken or
+	// deleted (see Quiesce)
+	gate *gate
+	// # transactions waiting for the log, accessed atomically
+	committing int64
+	// the Changes that committing transactions record (see Track)
+	trackMu  *sync.Mutex
+	tracking map[*Changes]bool
 }
 
-func readBitmap(super *super.FsSuper, start common.Bnum, len uint64) []byte {
-	var bitmap []byte
-	for i := uint64(0); i < len; i++ {
-		blk := super.Disk.Read(uint64(start) + i)
-		bitmap = append(bitmap, blk...)
-	}
-	return bitmap
+// Returns an allocator whose groups are the n bitmap blocks starting
+// at start.  Groups are read through the log, since they may be loaded
+// after transactions have committed, and are loaded in the background.
+func mkBitmapAlloc(log *obj.Log, start common.Bnum, n uint64) *alloc.Alloc {
+	a := alloc.MkLazyAlloc(n, func(g uint64) []byte {
+		b := log.Load(addr.MkAddr(start+common.Bnum(g), 0), common.NBITBLOCK)
+		bitmap := make([]byte, len(b.Data))
+		copy(bitmap, b.Data)
+		return bitmap
+	})
+	a.LoadAll()
+	return a
 }
 
 func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
-	balloc := alloc.MkAlloc(readBitmap(super, super.BitmapBlockStart(),
-		super.NBlockBitmap))
-	ialloc := alloc.MkAlloc(readBitmap(super, super.BitmapInodeStart(),
-		super.NInodeBitmap))
+	balloc := mkBitmapAlloc(log, super.BitmapBlockStart(), super.NBlockBitmap)
+	ialloc := mkBitmapAlloc(log, super.BitmapInodeStart(), super.NInodeBitmap)
 	icache := cache.MkCache(ICACHESZ)
+	roots := func(data []byte) []common.Bnum {
+		return inode.Roots(super, data)
+	}
 	st := &FsState{
-		Super:   super,
-		Txn:     log,
-		Icache:  icache,
-		Lockmap: lockmap.MkLockMap(),
-		Balloc:  balloc,
-		Ialloc:  ialloc,
+		State: &alloctxn.State{
+			Super:    super,
+			Log:      log,
+			Balloc:   balloc,
+			Ialloc:   ialloc,
+			Chunks:   alloctxn.MkChunkMap(super, log),
+			Csums:    alloctxn.MkCsums(),
+			Discards: alloctxn.MkDiscards(super.Disk, balloc),
+			Snaps:    alloctxn.MkSnapshots(super, log, roots),
+			Quotas:   alloctxn.MkQuotas(super, log),
+		},
+		Icache:   icache,
+		Lockmap:  lockmap.MkLockMap(),
+		gate:     mkGate(),
+		trackMu:  new(sync.Mutex),
+		tracking: make(map[*Changes]bool),
 	}
 	return st
 }
+
+type gate struct {
+	mu     *sync.Mutex
+	cond   *sync.Cond // signaled when active drops to 0 or closed changes
+	active uint64     // open transactions
+	closed bool
+}
+
+func mkGate() *gate {
+	mu := new(sync.Mutex)
+	return &gate{mu: mu, cond: sync.NewCond(mu)}
+}
+
+func (g *gate) enter() {
+	g.mu.Lock()
+	for g.closed {
+		g.cond.Wait()
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+func (g *gate) leave() {
+	g.mu.Lock()
+	g.active--
+	if g.active == 0 {
+		g.cond.Broadcast()
+	}
+	g.mu.Unlock()
+}
+
+// Quiesce keeps new transactions out and waits for the open ones to
+// finish, for at most timeout.  If some are still open then (e.g., one
+// that waits for the shrinker, whose transactions wait at the gate),
+// it lets transactions in again and returns false.  Otherwise the
+// caller must call Resume.
+func (st *FsState) Quiesce(timeout time.Duration) bool {
+	g := st.gate
+	g.mu.Lock()
+	for g.closed {
+		g.cond.Wait()
+	}
+	g.closed = true
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		g.mu.Lock()
+		g.cond.Broadcast()
+		g.mu.Unlock()
+	})
+	for g.active > 0 && time.Now().Before(deadline) {
+		g.cond.Wait()
+	}
+	timer.Stop()
+	ok := g.active == 0
+	if !ok {
+		g.closed = false
+		g.cond.Broadcast()
+	}
+	g.mu.Unlock()
+	return ok
+}
+
+// Resume lets transactions in again after Quiesce.
+func (st *FsState) Resume() {
+	g := st.gate
+	g.mu.Lock()
+	g.closed = false
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// Committing returns how many transactions are waiting for the log to
+// commit them, which grows when the log is saturated.
+func (st *FsState) Committing() uint64 {
+	return uint64(atomic.LoadInt64(&st.committing))
+}
+
+// FlushDiscards makes the log durable and discards the blocks that
+// transactions that didn't wait freed (e.g., before a clean shutdown).
+func (st *FsState) FlushDiscards() {
+	if st.Discards == nil {
+		return
+	}
+	mark := st.Discards.Mark()
+	st.Log.Flush()
+	st.Discards.Flush(mark, nil)
+}
+
+// Shutdown stops loading allocator bitmaps in the background.
+func (st *FsState) Shutdown() {
+	st.Balloc.StopLoader()
+	st.Ialloc.StopLoader()
+}
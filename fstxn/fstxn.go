@@ -14,23 +14,114 @@ import (
 // fstxn implements transactions using alloctxn.  It adds to alloctxn
 // support for locking inodes and an inode cache.
 //
+// A transaction that gets an inode by a handle of a snapshot reads that
+// snapshot from then on: its inodes are read-only, and not locked or
+// cached, since they never change.
+//
 
 type FsTxn struct {
 	Fs     *FsState
 	Atxn   *alloctxn.AllocTxn
 	inodes map[common.Inum]*inode.Inode
+	snap   *alloctxn.Snapshot // nil for the live file system
+	gated  bool               // entered the gate, and hasn't left
+	// run after a commit, once nothing is locked (see AfterCommit)
+	committed []func()
 }
 
 func Begin(fsstate *FsState) *FsTxn {
+	fsstate.gate.enter()
 	op := &FsTxn{
-		Fs: fsstate,
-		Atxn: alloctxn.Begin(fsstate.Super, fsstate.Txn, fsstate.Balloc,
-			fsstate.Ialloc),
+		Fs:     fsstate,
+		Atxn:   alloctxn.Begin(fsstate.State),
 		inodes: make(map[common.Inum]*inode.Inode),
+		gated:  true,
 	}
 	return op
 }
 
+// BeginQuiesced begins a transaction while the caller keeps others out
+// (see Quiesce).
+func BeginQuiesced(fsstate *FsState) *FsTxn {
+	return &FsTxn{
+		Fs:     fsstate,
+		Atxn:   alloctxn.Begin(fsstate.State),
+		inodes: make(map[common.Inum]*inode.Inode),
+	}
+}
+
+// Ends the transaction, after it committed or aborted.
+func (op *FsTxn) end() {
+	op.releaseInodes()
+	if op.gated {
+		op.gated = false
+		op.Fs.gate.leave()
+	}
+}
+
+// AfterCommit runs f once op has committed, after it released its
+// inodes and locks, so that f can wait (e.g., for room in the
+// shrinker's queue) without holding up other transactions.  f doesn't
+// run if op aborts or fails to commit.
+func (op *FsTxn) AfterCommit(f func()) {
+	op.committed = append(op.committed, f)
+}
+
+func (op *FsTxn) runCommitted() {
+	for _, f := range op.committed {
+		f()
+	}
+	op.committed = nil
+}
+
+// Snapshot returns the snapshot the transaction reads, or nil.
+func (op *FsTxn) Snapshot() *alloctxn.Snapshot {
+	return op.snap
+}
+
+// ReadOnly returns whether the transaction reads a snapshot.
+func (op *FsTxn) ReadOnly() bool {
+	return op.snap != nil
+}
+
+// Fsid returns the NFS fsid of the transaction's inodes: each snapshot
+// is a file system of its own, since its inode numbers are those of
+// the live file system.
+func (op *FsTxn) Fsid() uint64 {
+	fsid := op.Fs.Super.Fsid()
+	if op.snap != nil {
+		return fsid + op.snap.Id
+	}
+	return fsid
+}
+
+// Fh returns the handle of ip.
+func (op *FsTxn) Fh(ip *inode.Inode) fh.Fh {
+	var snap uint64
+	if op.snap != nil {
+		snap = op.snap.Id
+	}
+	return fh.Fh{Ino: ip.Inum, Gen: ip.Gen, Snap: snap}
+}
+
+// ReadSnapshot makes the transaction read snapshot id, which must be
+// the only one it reads.  Returns false if the snapshot doesn't exist
+// (anymore), or if the transaction already has live inodes.
+func (op *FsTxn) ReadSnapshot(id uint64) bool {
+	if op.snap != nil {
+		return op.snap.Id == id
+	}
+	if len(op.inodes) > 0 {
+		return false
+	}
+	s := op.Fs.Snaps.Get(id)
+	if s == nil {
+		return false
+	}
+	op.snap = s
+	return true
+}
+
 func (op *FsTxn) addInode(ip *inode.Inode) {
 	op.inodes[ip.Inum] = ip
 }
@@ -55,9 +146,13 @@ func (op *FsTxn) releaseInodes() {
 	}
 }
 
-func (op *FsTxn) AllocInode(kind nfstypes.Ftype3) *inode.Inode {
+// AllocInode allocates an inode, preferably close to the inode of the
+// directory it will be created in, owned by owner, or by the owner of
+// that directory if owner is nil (e.g., the caller sent no
+// credentials).
+func (op *FsTxn) AllocInode(kind nfstypes.Ftype3, parent common.Inum, owner *alloctxn.Owner) *inode.Inode {
 	var ip *inode.Inode
-	inum := op.Atxn.AllocINum()
+	inum := op.Atxn.AllocINum(parent)
 	if inum != common.NULLINUM {
 		ip = op.GetInodeLocked(inum)
 		if ip.Kind != inode.NF3FREE {
@@ -65,17 +160,53 @@ func (op *FsTxn) AllocInode(kind nfstypes.Ftype3) *inode.Inode {
 		}
 		if !ip.IsShrinking() {
 			util.DPrintf(1, "AllocInode -> # %v\n", inum)
-			ip.InitInode(inum, kind)
-			ip.WriteInode(op.Atxn)
+			if !op.initInode(ip, kind, parent, owner) {
+				return nil
+			}
 		}
 	}
 	return ip
 }
 
+// Initializes ip, owned by owner or by the owner of directory parent,
+// and charges it to that owner.  Returns false if the owner is over
+// quota.
+func (op *FsTxn) initInode(ip *inode.Inode, kind nfstypes.Ftype3, parent common.Inum, cred *alloctxn.Owner) bool {
+	var owner alloctxn.Owner
+	if cred != nil {
+		owner = *cred
+	} else if dip := op.lookupInode(parent); dip != nil {
+		owner = dip.Owner()
+	}
+	if !op.Atxn.ChargeInode(owner) {
+		op.Atxn.FreeINum(ip.Inum)
+		return false
+	}
+	ip.InitInode(ip.Inum, kind)
+	ip.Uid = owner.Uid
+	ip.Gid = owner.Gid
+	ip.WriteInode(op.Atxn)
+	return true
+}
+
+// Drops the cached copies of the inodes op holds, which it may have
+// changed in memory (e.g., initialized one it allocated, or added a
+// name to a directory's cache), so that they are read again as
+// committed.
+func (op *FsTxn) dropInodes() {
+	for inum, ip := range op.inodes {
+		if !ip.IsReadOnly() {
+			op.Fs.Icache.LookupSlot(uint64(inum)).Obj = nil
+		}
+	}
+}
+
 func (op *FsTxn) ReleaseInode(ip *inode.Inode) {
 	util.DPrintf(1, "ReleaseInode %v\n", ip)
 	op.doneInode(ip)
-	op.Fs.Lockmap.Release(ip.Inum)
+	if !ip.IsReadOnly() {
+		op.Fs.Lockmap.Release(ip.Inum)
+	}
 }
 
 func (op *FsTxn) LockInode(inum common.Inum) *cache.Cslot {
@@ -87,12 +218,26 @@ func (op *FsTxn) LockInode(inum common.Inum) *cache.Cslot {
 	return cslot
 }
 
+// Returns the inode inum of the transaction's snapshot.
+func (op *FsTxn) getSnapInode(inum common.Inum) *inode.Inode {
+	if ip := op.lookupInode(inum); ip != nil {
+		return ip
+	}
+	buf := op.Atxn.SnapInodeBuf(op.snap, inum)
+	ip := inode.DecodeReadOnly(op.Fs.Super, buf, inum)
+	op.addInode(ip)
+	return ip
+}
+
 func (op *FsTxn) GetInodeLocked(inum common.Inum) *inode.Inode {
+	if op.snap != nil {
+		return op.getSnapInode(inum)
+	}
 	cslot := op.LockInode(inum)
 	if cslot.Obj == nil {
 		addr := op.Fs.Super.Inum2Addr(inum)
 		buf := op.Atxn.Op.ReadBuf(addr, common.INODESZ*8)
-		i := inode.Decode(buf, inum)
+		i := inode.Decode(op.Fs.Super, buf, inum)
 		util.DPrintf(1, "GetInodeLocked # %v: read inode from disk\n", inum)
 		cslot.Obj = i
 	}
@@ -107,7 +252,17 @@ func (op *FsTxn) GetInodeInumFree(inum common.Inum) *inode.Inode {
 	return ip
 }
 
+func (op *FsTxn) validInum(inum common.Inum) bool {
+	if op.snap != nil {
+		return op.Atxn.SnapValidInum(op.snap, inum)
+	}
+	return op.Atxn.ValidInum(inum)
+}
+
 func (op *FsTxn) GetInodeInum(inum common.Inum) *inode.Inode {
+	if !op.validInum(inum) {
+		return nil
+	}
 	ip := op.GetInodeInumFree(inum)
 	if ip == nil {
 		return nil
@@ -117,6 +272,10 @@ func (op *FsTxn) GetInodeInum(inum common.Inum) *inode.Inode {
 		return nil
 	}
 	if ip.Nlink == 0 {
+		if ip.IsReadOnly() {
+			op.ReleaseInode(ip)
+			return nil
+		}
 		panic("getInodeInum")
 	}
 	return ip
@@ -124,6 +283,9 @@ func (op *FsTxn) GetInodeInum(inum common.Inum) *inode.Inode {
 
 func (op *FsTxn) GetInodeFh(fh3 nfstypes.Nfs_fh3) *inode.Inode {
 	fh := fh.MakeFh(fh3)
+	if fh.Snap != 0 && !op.ReadSnapshot(fh.Snap) {
+		return nil
+	}
 	ip := op.GetInodeInum(fh.Ino)
 	if ip == nil {
 		return nil
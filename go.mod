@@ -10,6 +10,7 @@ require (
 	github.com/tchajed/goose v0.5.3
 	github.com/tchajed/marshal v0.4.3
 	github.com/zeldovich/go-rpcgen v0.1.5
+	golang.org/x/crypto v0.9.0
 	golang.org/x/sys v0.11.0
 )
 
@@ -7,43 +7,97 @@ import (
 	"github.com/tchajed/goose/machine/disk"
 	"github.com/tchajed/marshal"
 
+	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/dcache"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 const NF3FREE nfstypes.Ftype3 = 0
 
+// The blks array holds direct blocks followed by the roots of one tree
+// per level of indirection: blks[nDirect+l-1] is the root of the tree
+// with l levels.  How many of each depends on whether the image is from
+// before superblocks (see layout).
 const (
-	NBLKINO   uint64 = 10 // # blk in an inode's blks array
-	NDIRECT   uint64 = NBLKINO - 2
-	INDIRECT  uint64 = NBLKINO - 2
-	DINDIRECT uint64 = NBLKINO - 1
+	NBLKINO   uint64 = 10                 // # blk in an inode's blks array, at most
+	NINDLEVEL uint64 = 4                  // # levels of indirection, at most
 	NBLKBLK   uint64 = disk.BlockSize / 8 // # blkno per block
-	NINDLEVEL uint64 = 2                  // # levels of indirection
 )
 
+// Files and symlinks that fit in the space of the blks array keep
+// their data in the inode instead, and switch to blocks when they grow
+// beyond that.  Inline inodes have the INLINE bit set in their kind on
+// disk.
+const INLINE uint32 = 1 << 31
+
+// A layout is the format of the on-disk inode, which is that of images
+// from before superblocks or that of images with one: its blks array
+// holds nDirect direct blocks followed by the roots of nIndLevel trees.
+type layout struct {
+	nDirect   uint64
+	nIndLevel uint64
+	inline    bool // small files and symlinks may be inline
+	owners    bool // the inode has an owner
+}
+
+var (
+	// images from before superblocks: 8 direct blocks, a single and a
+	// double indirect tree, and nothing inline
+	legacyLayout = &layout{nDirect: 8, nIndLevel: 2}
+	// images with a superblock: fewer direct blocks for deeper trees,
+	// and the owner's uid and gid in the space of one slot of blks
+	sbLayout = &layout{nDirect: 5, nIndLevel: NINDLEVEL, inline: true, owners: true}
+)
+
+// # of slots of the blks array
+func (lay *layout) nBlk() uint64 {
+	return lay.nDirect + lay.nIndLevel
+}
+
+// # of bytes of inline data, which take the place of the blks array
+func (lay *layout) inlineSize() uint64 {
+	return lay.nBlk() * 8
+}
+
+func layoutOf(sup *super.FsSuper) *layout {
+	if sup.Sb == nil {
+		return legacyLayout
+	}
+	return sbLayout
+}
+
 type Inode struct {
 	// in-memory info:
 	Inum   common.Inum
 	Dcache *dcache.Dcache
+	lay    *layout
 
 	// the on-disk inode:
 	Kind  nfstypes.Ftype3
 	Nlink uint32
 	Gen   uint64
 	Size  uint64
+	// the owner, whose quotas the inode and its blocks count against
+	Uid uint32
+	Gid uint32
 
 	// if ShrinkSize > Size, then the inode is in the process
 	// of shrinking to Size. ShrinkSize is in block units
 	ShrinkSize uint64
 
-	Atime nfstypes.Nfstime3
-	Mtime nfstypes.Nfstime3
-	blks  []common.Bnum
+	Atime  nfstypes.Nfstime3
+	Mtime  nfstypes.Nfstime3
+	blks   []common.Bnum
+	inline bool
+	data   []byte // the layout's inline size, if inline
+	// read from a snapshot, so it must not be written
+	readOnly bool
 }
 
 func NfstimeNow() nfstypes.Nfstime3 {
@@ -60,34 +114,68 @@ func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3) {
 	ip.Inum = inum
 	ip.Kind = kind
 	ip.Nlink = 1
-	ip.Gen = ip.Gen + 1
+	ip.Gen = ip.nextGen()
 	ip.Atime = NfstimeNow()
 	ip.Mtime = NfstimeNow()
+	ip.setInline(ip.lay.inline && (kind == nfstypes.NF3REG || kind == nfstypes.NF3LNK))
+}
+
+// Returns the generation after ip's, which is never 0.
+func (ip *Inode) nextGen() uint64 {
+	g := ip.Gen + 1
+	if g == 0 {
+		return 1
+	}
+	return g
 }
 
-func MkRootInode() *Inode {
+// Owner returns the owner that ip's quotas are charged to.
+func (ip *Inode) Owner() alloctxn.Owner {
+	return alloctxn.Owner{Uid: ip.Uid, Gid: ip.Gid}
+}
+
+func (ip *Inode) setInline(inline bool) {
+	ip.inline = inline
+	if inline {
+		ip.data = make([]byte, ip.lay.inlineSize())
+	} else {
+		ip.data = nil
+	}
+}
+
+// IsInline returns whether ip's data is in the inode.
+func (ip *Inode) IsInline() bool {
+	return ip.inline
+}
+
+// MkRootInode returns the root inode of a new file system sup.
+func MkRootInode(sup *super.FsSuper) *Inode {
 	ip := new(Inode)
-	ip.blks = make([]common.Bnum, NBLKINO)
+	ip.lay = layoutOf(sup)
+	ip.blks = make([]common.Bnum, ip.lay.nBlk())
 	ip.InitInode(common.ROOTINUM, nfstypes.NF3DIR)
 	return ip
 }
 
 func (ip *Inode) String() string {
+	if ip.inline {
+		return fmt.Sprintf("# %d k %d n %d g %d sz %d inline", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size)
+	}
 	return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.blks)
 }
 
-func (ip *Inode) MkFattr() nfstypes.Fattr3 {
+func (ip *Inode) MkFattr(fsid uint64) nfstypes.Fattr3 {
 	return nfstypes.Fattr3{
 		Ftype: ip.Kind,
 		Mode:  0777,
 		Nlink: 1,
-		Uid:   nfstypes.Uid3(0),
-		Gid:   nfstypes.Gid3(0),
+		Uid:   nfstypes.Uid3(ip.Uid),
+		Gid:   nfstypes.Gid3(ip.Gid),
 		Size:  nfstypes.Size3(ip.Size),
 		Used:  nfstypes.Size3(ip.Size),
 		Rdev: nfstypes.Specdata3{Specdata1: nfstypes.Uint32(0),
 			Specdata2: nfstypes.Uint32(0)},
-		Fsid:   nfstypes.Uint64(0),
+		Fsid:   nfstypes.Uint64(fsid),
 		Fileid: nfstypes.Fileid3(ip.Inum),
 		Atime:  ip.Atime,
 		Mtime:  ip.Mtime,
@@ -98,76 +186,220 @@ func (ip *Inode) MkFattr() nfstypes.Fattr3 {
 
 func (ip *Inode) Encode() []byte {
 	enc := marshal.NewEnc(common.INODESZ)
-	enc.PutInt32(uint32(ip.Kind))
+	// a free inode is never inline, so that its kind is 0 on disk
+	inline := ip.inline && ip.Kind != NF3FREE
+	if inline {
+		enc.PutInt32(uint32(ip.Kind) | INLINE)
+	} else {
+		enc.PutInt32(uint32(ip.Kind))
+	}
 	enc.PutInt32(ip.Nlink)
 	enc.PutInt(ip.Gen)
 	enc.PutInt(ip.Size)
 	enc.PutInt(ip.ShrinkSize)
+	if ip.lay.owners {
+		enc.PutInt32(ip.Uid)
+		enc.PutInt32(ip.Gid)
+	}
 	enc.PutInt32(uint32(ip.Atime.Seconds))
 	enc.PutInt32(uint32(ip.Atime.Nseconds))
 	enc.PutInt32(uint32(ip.Mtime.Seconds))
 	enc.PutInt32(uint32(ip.Mtime.Nseconds))
-	enc.PutInts(ip.blks)
+	if inline {
+		enc.PutBytes(ip.data)
+	} else {
+		enc.PutInts(ip.blks)
+	}
 	return enc.Finish()
 }
 
-func Decode(buf *buf.Buf, inum common.Inum) *Inode {
+// Decode decodes inode inum of file system sup.
+func Decode(sup *super.FsSuper, buf *buf.Buf, inum common.Inum) *Inode {
+	return decode(layoutOf(sup), buf.Data, inum)
+}
+
+// DecodeReadOnly decodes an inode of a snapshot of sup.
+func DecodeReadOnly(sup *super.FsSuper, buf *buf.Buf, inum common.Inum) *Inode {
+	ip := decode(layoutOf(sup), buf.Data, inum)
+	ip.readOnly = true
+	return ip
+}
+
+// IsReadOnly returns whether ip is an inode of a snapshot.
+func (ip *Inode) IsReadOnly() bool {
+	return ip.readOnly
+}
+
+// Roots returns the roots of the trees of encoded inode data of sup
+// (e.g., those a snapshot's copy of it shares).
+func Roots(sup *super.FsSuper, data []byte) []common.Bnum {
+	ip := decode(layoutOf(sup), data, common.NULLINUM)
+	var roots = make([]common.Bnum, 0)
+	for _, bn := range ip.blks {
+		if bn != common.NULLBNUM {
+			roots = append(roots, bn)
+		}
+	}
+	return roots
+}
+
+func decode(lay *layout, data []byte, inum common.Inum) *Inode {
 	ip := new(Inode)
-	dec := marshal.NewDec(buf.Data)
+	dec := marshal.NewDec(data)
 	ip.Inum = inum
-	ip.Kind = nfstypes.Ftype3(dec.GetInt32())
+	ip.lay = lay
+	kind := dec.GetInt32()
+	ip.Kind = nfstypes.Ftype3(kind &^ INLINE)
 	ip.Nlink = dec.GetInt32()
 	ip.Gen = dec.GetInt()
 	ip.Size = dec.GetInt()
 	ip.ShrinkSize = dec.GetInt()
+	if lay.owners {
+		ip.Uid = dec.GetInt32()
+		ip.Gid = dec.GetInt32()
+	}
 	ip.Atime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Atime.Nseconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Nseconds = nfstypes.Uint32(dec.GetInt32())
-	ip.blks = dec.GetInts(NBLKINO)
+	if lay.inline && kind&INLINE != 0 {
+		ip.setInline(true)
+		copy(ip.data, dec.GetBytes(lay.inlineSize()))
+		ip.blks = make([]common.Bnum, lay.nBlk())
+	} else {
+		ip.blks = dec.GetInts(lay.nBlk())
+	}
 	return ip
 }
 
+// # of blocks mapped by a tree with level levels of indirection
 func pow(level uint64) uint64 {
-	if level == 0 {
-		return 1
-	}
-	var p uint64 = NBLKBLK
-	for i := uint64(1); i < level; i++ {
-		p = p * p
+	var p uint64 = 1
+	for i := uint64(0); i < level; i++ {
+		p = p * NBLKBLK
 	}
 	return p
 }
 
-func MaxFileSize() uint64 {
-	maxblks := pow(NINDLEVEL)
-	return (NDIRECT + maxblks) * disk.BlockSize
+// MaxFileSize is the largest file size of file system sup.
+func MaxFileSize(sup *super.FsSuper) uint64 {
+	return layoutOf(sup).maxFileSize()
+}
+
+// NDirect is the number of direct blocks of the inodes of sup.
+func NDirect(sup *super.FsSuper) uint64 {
+	return layoutOf(sup).nDirect
+}
+
+// InlineSize is the largest file that the inodes of sup can hold
+// inline, or 0 if they can't.
+func InlineSize(sup *super.FsSuper) uint64 {
+	lay := layoutOf(sup)
+	if !lay.inline {
+		return 0
+	}
+	return lay.inlineSize()
+}
+
+func (lay *layout) maxFileSize() uint64 {
+	var maxblks = lay.nDirect
+	for level := uint64(1); level <= lay.nIndLevel; level++ {
+		maxblks += pow(level)
+	}
+	return maxblks * disk.BlockSize
+}
+
+// Returns the blks index of the tree that maps logical block bn (which
+// must be >= nDirect), the number of levels of that tree, and the
+// offset of bn in that tree.
+func (lay *layout) indirectIndex(bn uint64) (uint64, uint64, uint64) {
+	var off = bn - lay.nDirect
+	var level = uint64(1)
+	for level < lay.nIndLevel && off >= pow(level) {
+		off -= pow(level)
+		level++
+	}
+	return lay.nDirect + level - 1, level, off
 }
 
 func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
-	if ip.Inum >= atxn.Super.NInode() {
+	if ip.Inum == common.NULLINUM || ip.readOnly {
 		panic("WriteInode")
 	}
+	atxn.PreserveInode(ip.Inum)
 	d := ip.Encode()
 	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), common.INODESZ*8, d)
 	util.DPrintf(1, "WriteInode %v\n", ip)
 }
 
 func (ip *Inode) FreeInode(atxn *alloctxn.AllocTxn) {
+	atxn.ReleaseWindow(ip.Inum)
 	ip.Kind = NF3FREE
-	ip.Gen = ip.Gen + 1
+	ip.Gen = ip.nextGen()
+	ip.setInline(false)
 	ip.WriteInode(atxn)
 	atxn.FreeINum(ip.Inum)
+	atxn.UnchargeInode(ip.Owner())
+}
+
+// Moves the inline data of ip to a block, so that ip can grow beyond
+// its inline size.  Returns false if there is no free block.
+func (ip *Inode) unInline(atxn *alloctxn.AllocTxn) bool {
+	data := ip.data[:ip.Size]
+	ip.setInline(false)
+	if len(data) == 0 {
+		return true
+	}
+	blknos, _ := ip.bmap(atxn, 0, 1)
+	if len(blknos) == 0 {
+		return false
+	}
+	blkno := blknos[0]
+	b := make([]byte, disk.BlockSize)
+	copy(b, data)
+	atxn.Op.OverWrite(atxn.Super.Block2addr(blkno), common.NBITBLOCK, b)
+	atxn.SetCsum(blkno, b)
+	util.DPrintf(1, "unInline # %d to block %d\n", ip.Inum, blkno)
+	return true
 }
 
 // Resize updates the inode, but may not free immediately if the inode
 // shrinks. It creates a new thread to free blocks in a separate
 // transaction, if shrinking involves freeing many blocks.  ShrinkSize
 // tracks shrinking progress, and is initialized with the old size.
-func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
+// Returns whether the caller must start shrinking, and false if ip
+// couldn't grow for lack of space.
+func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) (bool, bool) {
+	return ip.ResizeMax(atxn, sz, jrnl.LogBlocks)
+}
+
+// ResizeMax is Resize, but leaves shrinking by more than maxFree blocks
+// to the caller, for a transaction that has more to do (e.g., removing
+// a tree).
+func (ip *Inode) ResizeMax(atxn *alloctxn.AllocTxn, sz uint64, maxFree uint64) (bool, bool) {
+	if sz > ip.lay.maxFileSize() || !atxn.PreserveInode(ip.Inum) {
+		return false, false
+	}
+	if ip.inline {
+		if sz <= ip.lay.inlineSize() {
+			for i := sz; i < ip.Size; i++ {
+				ip.data[i] = 0
+			}
+			ip.Size = sz
+			ip.WriteInode(atxn)
+			return false, true
+		}
+		if !ip.unInline(atxn) {
+			return false, false
+		}
+	}
 	var newSz = sz
 	var doshrink = false
-	oldsz := util.RoundUp(ip.Size, disk.BlockSize)
+	// blocks past ShrinkSize may still be waiting for the shrinker
+	var oldsz = util.RoundUp(ip.Size, disk.BlockSize)
+	if ip.ShrinkSize > oldsz {
+		oldsz = ip.ShrinkSize
+	}
 	util.DPrintf(5, "Resize %v to sz %d\n", oldsz, newSz)
 	ip.Size = newSz
 	newSz = util.RoundUp(sz, disk.BlockSize)
@@ -178,112 +410,248 @@ func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
 	}
 	ip.WriteInode(atxn)
 	if newSz < oldsz {
-		if ip.shrinkFits(atxn, oldsz-newSz) {
+		atxn.ReleaseWindow(ip.Inum)
+		if oldsz-newSz <= maxFree && ip.shrinkFits(atxn, oldsz-newSz) {
 			ip.Shrink(atxn)
 			util.DPrintf(1, "small file delete inside trans\n")
 		} else {
 			doshrink = true
 		}
 	}
-	return doshrink
+	return doshrink, true
+}
+
+// Allocate a block for ip, preferably at goal (0 means the inode's
+// default spot), and charge it to ip's owner.  Regular files allocate
+// from a preallocation window, so that sequential writes to different
+// files don't interleave.
+func (ip *Inode) allocBlock(atxn *alloctxn.AllocTxn, goal common.Bnum) common.Bnum {
+	if !atxn.ChargeBlock(ip.Owner()) {
+		return common.NULLBNUM
+	}
+	return ip.allocCharged(atxn, goal)
+}
+
+// allocBlock for a block already charged to ip's owner, which is
+// credited back if there is no free block.
+func (ip *Inode) allocCharged(atxn *alloctxn.AllocTxn, goal common.Bnum) common.Bnum {
+	var g = goal
+	if g == common.NULLBNUM {
+		g = atxn.InodeGoal(ip.Inum)
+	}
+	var bn common.Bnum
+	if ip.Kind == nfstypes.NF3REG {
+		bn = atxn.AllocBlockWindow(ip.Inum, g)
+	} else {
+		bn = atxn.AllocBlock(g)
+	}
+	if bn == common.NULLBNUM {
+		atxn.UnchargeBlock(ip.Owner())
+	}
+	return bn
+}
+
+// Frees bn, a block of ip, and credits ip's owner if it was the last
+// reference to it.
+func (ip *Inode) freeBlock(atxn *alloctxn.AllocTxn, bn common.Bnum) {
+	if atxn.FreeBlock(bn) {
+		atxn.UnchargeBlock(ip.Owner())
+	}
 }
 
-// Returns blkno and root index block for off. If blkno is 0, failure.
-// Caller must compare root with returned root to decide if a root has
-// been allocated.
-func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint64, off uint64) (common.Bnum, common.Bnum) {
+// Returns bn, or a private copy of it if it is shared (e.g., with a
+// snapshot), for a writer about to change it; level is 0 for a data
+// block.  A copy made to free blocks (e.g., by a truncate) is charged
+// to ip's owner whatever its limits, since freeing mustn't fail over
+// quota.  Returns 0 if there is no space or quota for the copy.
+func (ip *Inode) own(atxn *alloctxn.AllocTxn, bn common.Bnum, level uint64, freeing bool) common.Bnum {
+	if atxn.Shares(bn) == 0 {
+		return bn
+	}
+	if freeing {
+		atxn.ChargeBlockFreeing(ip.Owner())
+	} else if !atxn.ChargeBlock(ip.Owner()) {
+		return common.NULLBNUM
+	}
+	nb := ip.allocCharged(atxn, bn)
+	if nb == common.NULLBNUM {
+		return nb
+	}
+	if !atxn.CopyShared(bn, nb, level > 0) {
+		ip.freeBlock(atxn, nb)
+		return common.NULLBNUM
+	}
+	return nb
+}
+
+// Maps up to n blocks from off in the tree at root_ with level levels,
+// in one walk of the tree: the blocks of a run that share an index
+// block are mapped together.  Returns their block numbers, fewer than
+// n if the tree ends or there is no space, and the root.  Caller must
+// compare root with returned root to decide if a root has been
+// allocated (or copied, if it was shared). goal is where to allocate
+// root, if it doesn't exist.
+func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint64, off uint64, n uint64, goal common.Bnum) ([]common.Bnum, common.Bnum) {
 	var root = root_
 	if root == common.NULLBNUM { // no root?
-		root = atxn.AllocBlock()
+		root = ip.allocBlock(atxn, goal)
 		if root == common.NULLBNUM {
-			return root, root
+			return nil, root
+		}
+	} else {
+		root = ip.own(atxn, root_, level, false)
+		if root == common.NULLBNUM {
+			return nil, root_
 		}
 	}
 	if level == 0 { // leaf?
-		return root, root
+		return []common.Bnum{root}, root
 	}
 
 	divisor := pow(level - 1)
-	o := off / divisor
-	bo := o * 8
-	ind := off % divisor
-
+	var ind = off % divisor
+	var blknos = make([]common.Bnum, 0, n)
 	buf := atxn.ReadBlock(root)
-	nxtroot := buf.BnumGet(bo)
-	util.DPrintf(1, "%d next root %v level %d\n", root, nxtroot, level)
-	blkno, newnextroot := ip.indbmap(atxn, nxtroot, level-1, ind)
-	atxn.AssertValidBlock(newnextroot)
-	atxn.AssertValidBlock(blkno)
-	if newnextroot != nxtroot {
-		buf.BnumPut(bo, newnextroot)
+	for o := off / divisor; o < NBLKBLK && uint64(len(blknos)) < n; o++ {
+		bo := o * 8
+		nxtroot := buf.BnumGet(bo)
+		util.DPrintf(1, "%d next root %v level %d\n", root, nxtroot, level)
+		// place a new child right after its left sibling, or else
+		// right after the index block
+		var childGoal = root + 1
+		if o > 0 && buf.BnumGet(bo-8) != common.NULLBNUM {
+			childGoal = buf.BnumGet(bo-8) + 1
+		}
+		want := util.Min(n-uint64(len(blknos)), divisor-ind)
+		bns, newnextroot := ip.indbmap(atxn, nxtroot, level-1, ind, want, childGoal)
+		atxn.AssertValidBlock(newnextroot)
+		if newnextroot != nxtroot {
+			buf.BnumPut(bo, newnextroot)
+		}
+		blknos = append(blknos, bns...)
+		if uint64(len(bns)) < want {
+			break
+		}
+		ind = 0
+	}
+	return blknos, root
+}
+
+// Returns the block after the root (or direct block) preceding
+// blks[index], as an allocation goal for blks[index], or 0 if there is
+// none.
+func (ip *Inode) goalBefore(index uint64) common.Bnum {
+	if index > 0 && ip.blks[index-1] != common.NULLBNUM {
+		return ip.blks[index-1] + 1
 	}
-	return blkno, root
+	return common.NULLBNUM
 }
 
-// Map logical block number bn to a physical block number, allocating
-// blocks if no block exists for bn.
-func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
-	var blkno = common.NULLBNUM
+// Map n logical blocks from bn to physical block numbers for writing,
+// allocating blocks if no block exists for them, and copying the
+// shared blocks on the way.  Returns fewer than n blocks if there is no
+// space, and whether ip changed.
+func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64, n uint64) ([]common.Bnum, bool) {
+	var blknos = make([]common.Bnum, 0, n)
 	var alloc = false
-	if bn < NDIRECT {
-		if ip.blks[bn] == common.NULLBNUM {
-			ip.blks[bn] = atxn.AllocBlock()
-			if ip.blks[bn] != common.NULLBNUM {
+	for uint64(len(blknos)) < n {
+		b := bn + uint64(len(blknos))
+		if b < ip.lay.nDirect {
+			if ip.blks[b] == common.NULLBNUM {
+				ip.blks[b] = ip.allocBlock(atxn, ip.goalBefore(b))
+				if ip.blks[b] == common.NULLBNUM {
+					break
+				}
 				alloc = true
+			} else {
+				nb := ip.own(atxn, ip.blks[b], 0, false)
+				if nb == common.NULLBNUM {
+					break
+				}
+				if nb != ip.blks[b] {
+					ip.blks[b] = nb
+					alloc = true
+				}
 			}
+			blknos = append(blknos, ip.blks[b])
+			continue
 		}
-		blkno = ip.blks[bn]
-	} else {
-		var off = bn - NDIRECT
-		var root = common.NULLBNUM
-		if off < NBLKBLK {
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[INDIRECT], 1, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[INDIRECT] = root
-			}
-		} else {
-			off -= NBLKBLK
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[DINDIRECT], 2, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[DINDIRECT] = root
-			}
+		index, level, off := ip.lay.indirectIndex(b)
+		want := util.Min(n-uint64(len(blknos)), pow(level)-off)
+		bns, newRoot := ip.indbmap(atxn, ip.blks[index], level, off, want,
+			ip.goalBefore(index))
+		for _, blkno := range bns {
+			atxn.AssertValidBlock(blkno)
 		}
+		if newRoot != ip.blks[index] {
+			ip.blks[index] = newRoot
+			alloc = true
+		}
+		blknos = append(blknos, bns...)
+		if uint64(len(bns)) < want {
+			break
+		}
+	}
+	return blknos, alloc
+}
+
+// Map logical block number bn to a physical block number for reading,
+// which is 0 for a hole.
+func (ip *Inode) lookup(atxn *alloctxn.AllocTxn, bn uint64) common.Bnum {
+	if bn < ip.lay.nDirect {
+		return ip.blks[bn]
+	}
+	index, level, off := ip.lay.indirectIndex(bn)
+	var blkno = ip.blks[index]
+	var o = off
+	for l := level; l > 0 && blkno != common.NULLBNUM; l-- {
+		divisor := pow(l - 1)
+		b := atxn.ReadBlock(blkno)
+		blkno = b.BnumGet((o / divisor) * 8)
+		atxn.AssertValidBlock(blkno)
+		o = o % divisor
 	}
-	return blkno, alloc
+	return blkno
 }
 
-// Returns number of bytes read and eof
+// Returns the bytes read, eof, and false if a block failed its
+// checksum (the data is returned anyway).  Holes read as zeros.
 func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64) ([]byte,
-	bool) {
+	bool, bool) {
 	var n uint64 = uint64(0)
 
 	if offset >= ip.Size {
-		return nil, true
+		return nil, true, true
 	}
 	var count uint64 = bytesToRead
 	if offset+count >= ip.Size {
 		count = ip.Size - offset
 	}
 	util.DPrintf(5, "Read: off %d cnt %d\n", offset, count)
+	if ip.inline {
+		data := make([]byte, count)
+		copy(data, ip.data[offset:offset+count])
+		return data, false, true
+	}
 	var data = make([]byte, 0)
 	var off = offset
+	var ok = true
 	for boff := off / disk.BlockSize; n < count; boff++ {
 		byteoff := off % disk.BlockSize
 		nbytes := util.Min(disk.BlockSize-byteoff, count-n)
-		blkno, alloc := ip.bmap(atxn, boff)
+		blkno := ip.lookup(atxn, boff)
 		if blkno == common.NULLBNUM {
-			break
-		}
-		if alloc { // fill in a hole
-			ip.WriteInode(atxn)
+			data = append(data, make([]byte, nbytes)...)
+			n += nbytes
+			off += nbytes
+			continue
 		}
 		buf := atxn.ReadBlock(blkno)
+		if !atxn.VerifyCsum(blkno, buf.Data) {
+			util.DPrintf(0, "Read: # %d offset %d: checksum mismatch in block %d\n",
+				ip.Inum, boff*disk.BlockSize, blkno)
+			ok = false
+		}
 
 		for b := uint64(0); b < nbytes; b++ {
 			data = append(data, buf.Data[byteoff+b])
@@ -292,32 +660,53 @@ func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64
 		off += nbytes
 	}
 	util.DPrintf(10, "Read: off %d cnt %d -> %v\n", offset, count, data)
-	return data, false
+	return data, false, ok
 }
 
-// Returns number of bytes written and error
+// Returns number of bytes written and error.  Fails the transaction
+// (see alloctxn.FailRead) if a block it writes part of fails its
+// checksum.
 func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	count uint64, dataBuf []byte) (uint64, bool) {
 	var cnt uint64 = uint64(0)
 	var off uint64 = offset
 	var ok bool = true
-	var alloc bool = false
 	var n = count
 	var data = dataBuf
 
 	util.DPrintf(5, "Write: off %d cnt %d\n", offset, count)
-	if offset+count > MaxFileSize() {
+	if offset+count > ip.lay.maxFileSize() {
 		return 0, false
 	}
-	for boff := off / disk.BlockSize; n > uint64(0); boff++ {
-		blkno, new := ip.bmap(atxn, boff)
-		if blkno == common.NULLBNUM {
+	if !atxn.PreserveInode(ip.Inum) {
+		return 0, false
+	}
+	if ip.inline {
+		if offset+count <= ip.lay.inlineSize() {
+			copy(ip.data[offset:], data[:count])
+			if offset+count > ip.Size {
+				ip.Size = offset + count
+			}
+			ip.WriteInode(atxn)
+			return count, true
+		}
+		if !ip.unInline(atxn) {
+			return 0, false
+		}
+	}
+	// map the blocks of the whole write at once
+	var blknos []common.Bnum
+	var alloc = false
+	if n > 0 {
+		first := off / disk.BlockSize
+		blknos, alloc = ip.bmap(atxn, first, (off+n-1)/disk.BlockSize-first+1)
+	}
+	for i := 0; n > uint64(0); i++ {
+		if i == len(blknos) {
 			ok = false
 			break
 		}
-		if new {
-			alloc = true
-		}
+		blkno := blknos[i]
 		byteoff := off % disk.BlockSize
 		var nbytes = disk.BlockSize - byteoff
 		if n < nbytes {
@@ -326,12 +715,21 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 		if byteoff == 0 && nbytes == disk.BlockSize { // block overwrite?
 			addr := atxn.Super.Block2addr(blkno)
 			atxn.Op.OverWrite(addr, common.NBITBLOCK, data[0:nbytes])
+			atxn.SetCsum(blkno, data[0:nbytes])
 		} else {
 			buffer := atxn.ReadBlock(blkno)
+			// don't checksum the rest of a corrupt block as good
+			if !atxn.VerifyCsum(blkno, buffer.Data) {
+				util.DPrintf(0, "Write: # %d offset %d: checksum mismatch in block %d\n",
+					ip.Inum, off-byteoff, blkno)
+				atxn.FailRead()
+				return cnt, false
+			}
 			for b := uint64(0); b < nbytes; b++ {
 				buffer.Data[byteoff+b] = data[b]
 			}
 			buffer.SetDirty()
+			atxn.SetCsum(blkno, buffer.Data)
 		}
 		n -= nbytes
 		data = data[nbytes:]
@@ -349,8 +747,131 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	return cnt, ok
 }
 
+// Clone makes ip, a regular file just allocated, a copy of src that
+// shares its blocks: the roots of src's trees gain a reference, and a
+// writer to either file copies the blocks it changes (see own).
+// Returns false if a root has the most references it can have.
+func (ip *Inode) Clone(atxn *alloctxn.AllocTxn, src *Inode) bool {
+	ip.setInline(src.inline)
+	if src.inline {
+		copy(ip.data, src.data)
+	} else {
+		for i, bn := range src.blks {
+			if bn != common.NULLBNUM && !atxn.Share(bn) {
+				return false
+			}
+			ip.blks[i] = bn
+		}
+	}
+	ip.Size = src.Size
+	ip.ShrinkSize = util.RoundUp(src.Size, disk.BlockSize)
+	ip.WriteInode(atxn)
+	util.DPrintf(1, "Clone # %d to # %d\n", src.Inum, ip.Inum)
+	return true
+}
+
+// SetOwner makes o the owner of ip, moving the charge for ip and its
+// blocks to o.  Returns false if that would take o over quota.
+func (ip *Inode) SetOwner(atxn *alloctxn.AllocTxn, o alloctxn.Owner) bool {
+	if !atxn.PreserveInode(ip.Inum) {
+		return false
+	}
+	if !atxn.MoveCharge(ip.Owner(), o, ip.OwnBlocks(atxn)) {
+		return false
+	}
+	ip.Uid = o.Uid
+	ip.Gid = o.Gid
+	ip.WriteInode(atxn)
+	return true
+}
+
+// OwnBlocks returns the number of blocks of ip that it doesn't share
+// (e.g., with a snapshot or a clone), index blocks included.
+func (ip *Inode) OwnBlocks(atxn *alloctxn.AllocTxn) uint64 {
+	var n uint64
+	if ip.inline {
+		return 0
+	}
+	read := func(bn common.Bnum) []byte {
+		return atxn.ReadBlock(bn).Data
+	}
+	ip.Blocks(read, func(ref BlockRef) bool {
+		if atxn.Shares(ref.Bn) > 0 {
+			return false
+		}
+		n++
+		return true
+	})
+	return n
+}
+
 func (ip *Inode) DecLink(atxn *alloctxn.AllocTxn) bool {
 	ip.Nlink = ip.Nlink - 1
 	ip.WriteInode(atxn)
 	return ip.Nlink == 0
 }
+
+// A BlockRef is a block pointer of an inode: slot Slot of its blks
+// array if Parent is 0, and otherwise slot Slot of index block Parent.
+// Level is 0 for a data block, which maps logical block Lbn, and the
+// number of levels below it for an index block, whose first data
+// block is Lbn.
+type BlockRef struct {
+	Parent common.Bnum
+	Slot   uint64
+	Bn     common.Bnum
+	Level  uint64
+	Lbn    uint64
+}
+
+// Blocks calls f on each non-null block pointer of ip, an index block
+// before the blocks it points to, reading index blocks with read.  It
+// descends into an index block only if f returns true (e.g., fsck
+// doesn't follow out-of-range pointers).
+func (ip *Inode) Blocks(read func(common.Bnum) []byte, f func(ref BlockRef) bool) {
+	var base = ip.lay.nDirect
+	for i := uint64(0); i < uint64(len(ip.blks)); i++ {
+		var level uint64 = 0
+		var lbn = i
+		if i >= ip.lay.nDirect {
+			level = i - ip.lay.nDirect + 1
+			lbn = base
+			base += pow(level)
+		}
+		if ip.blks[i] != common.NULLBNUM {
+			walkRef(read, BlockRef{Slot: i, Bn: ip.blks[i], Level: level, Lbn: lbn}, f)
+		}
+	}
+}
+
+func walkRef(read func(common.Bnum) []byte, ref BlockRef, f func(ref BlockRef) bool) {
+	if !f(ref) || ref.Level == 0 {
+		return
+	}
+	dec := marshal.NewDec(read(ref.Bn))
+	for i := uint64(0); i < NBLKBLK; i++ {
+		bn := common.Bnum(dec.GetInt())
+		if bn != common.NULLBNUM {
+			walkRef(read, BlockRef{
+				Parent: ref.Bn,
+				Slot:   i,
+				Bn:     bn,
+				Level:  ref.Level - 1,
+				Lbn:    ref.Lbn + i*pow(ref.Level-1),
+			}, f)
+		}
+	}
+}
+
+// ClearRef clears block pointer ref, without freeing the block it
+// points to (e.g., fsck dropping a bad pointer).
+func (ip *Inode) ClearRef(atxn *alloctxn.AllocTxn, ref BlockRef) {
+	atxn.PreserveInode(ip.Inum)
+	if ref.Parent == common.NULLBNUM {
+		ip.blks[ref.Slot] = common.NULLBNUM
+		ip.WriteInode(atxn)
+		return
+	}
+	b := atxn.Op.ReadBuf(addr.MkAddr(ref.Parent, ref.Slot*64), 64)
+	b.BnumPut(0, common.NULLBNUM)
+}
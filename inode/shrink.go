@@ -4,6 +4,7 @@ import (
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/tchajed/goose/machine/disk"
 
+	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-nfsd/alloctxn"
@@ -26,19 +27,30 @@ func (ip *Inode) IsShrinking() bool {
 	return s
 }
 
+// ShrinkBlocks returns how many blocks of the file are left to
+// shrink, holes included.
+func (ip *Inode) ShrinkBlocks() uint64 {
+	if !ip.IsShrinking() {
+		return 0
+	}
+	return ip.ShrinkSize - util.RoundUp(ip.Size, disk.BlockSize)
+}
+
 func (ip *Inode) freeIndex(op *alloctxn.AllocTxn, index uint64) {
-	op.FreeBlock(ip.blks[index])
+	ip.freeBlock(op, ip.blks[index])
 	ip.blks[index] = 0
 }
 
 // Frees indirect bn.  Assumes if bn is cleared, then all blocks > bn
-// have been cleared
-func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) common.Bnum {
+// have been cleared.  Returns the root if the whole tree is free now,
+// and the number of blocks below bn that are holes (and thus don't
+// need to be visited one by one).
+func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) (common.Bnum, uint64) {
 	if root == common.NULLBNUM {
-		return 0
+		return 0, bn
 	}
 	if level == 0 {
-		return root
+		return root, 0
 	}
 	divisor := pow(level - 1)
 	off := (bn / divisor)
@@ -47,45 +59,138 @@ func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64
 	b := op.ReadBlock(root)
 	nxtroot := b.BnumGet(boff)
 	op.AssertValidBlock(nxtroot)
+	var skip = ind
 	if nxtroot != 0 {
-		freeroot := ip.indshrink(op, nxtroot, level-1, ind)
+		freeroot, holes := ip.indshrink(op, nxtroot, level-1, ind)
 		if freeroot != 0 {
 			b.BnumPut(boff, 0)
-			op.FreeBlock(freeroot)
+			ip.freeBlock(op, freeroot)
 		}
+		skip = holes
 	}
-	if off == 0 && ind == 0 {
-		return root
+	if off == 0 && ind == skip {
+		return root, skip
 	} else {
-		return common.NULLBNUM
+		return common.NULLBNUM, skip
+	}
+}
+
+// Makes the index blocks on the path to block off of tree index
+// private, before indshrink changes them: a shared subtree that lies
+// beyond the new size cursz (whose first block is start) just loses a
+// reference, and others are copied, if the transaction has room for
+// the copy.  Returns false if it doesn't.
+func (ip *Inode) ownShrinkPath(op *alloctxn.AllocTxn, index uint64, level uint64,
+	off uint64, start uint64, cursz uint64) bool {
+	var root = ip.blks[index]
+	if root != common.NULLBNUM && op.Shares(root) > 0 {
+		if start >= cursz {
+			ip.freeIndex(op, index)
+			return true
+		}
+		if !ip.shrinkFits(op, NINDLEVEL+5+op.CopyCost(root, true)) {
+			return false
+		}
+		root = ip.own(op, root, level, true)
+		if root == common.NULLBNUM {
+			op.Fail()
+			return false
+		}
+		ip.blks[index] = root
+	}
+	var o = off
+	var s = start
+	for l := level; l > 1 && root != common.NULLBNUM; l-- {
+		divisor := pow(l - 1)
+		boff := (o / divisor) * 8
+		b := op.ReadBlock(root)
+		child := b.BnumGet(boff)
+		cstart := s + (o/divisor)*divisor
+		if child != common.NULLBNUM && op.Shares(child) > 0 {
+			if cstart >= cursz {
+				b.BnumPut(boff, common.NULLBNUM)
+				ip.freeBlock(op, child)
+				return true
+			}
+			if !ip.shrinkFits(op, NINDLEVEL+5+op.CopyCost(child, true)) {
+				return false
+			}
+			nc := ip.own(op, child, l-1, true)
+			if nc == common.NULLBNUM {
+				op.Fail()
+				return false
+			}
+			b.BnumPut(boff, nc)
+			child = nc
+		}
+		root = child
+		o = o % divisor
+		s = cstart
 	}
+	return true
 }
 
 // Frees as many blocks as possible, and returns if more shrinking is necessary.
-// 5: inode block, 2xbitmap block, indirect block, double indirect
+// NINDLEVEL+5: inode block, 2xbitmap block, the freed block, its
+// checksum block, and an indirect block per level
 func (ip *Inode) Shrink(op *alloctxn.AllocTxn) bool {
+	if !op.PreserveInode(ip.Inum) {
+		return ip.IsShrinking()
+	}
+	ip.shrink(op)
+	ip.WriteInode(op)
+	return ip.IsShrinking()
+}
+
+func (ip *Inode) shrink(op *alloctxn.AllocTxn) {
 	util.DPrintf(1, "Shrink: from %d to %d\n", ip.ShrinkSize,
 		util.RoundUp(ip.Size, disk.BlockSize))
-	for ip.IsShrinking() && ip.shrinkFits(op, 5) {
-		ip.ShrinkSize -= 1
-		if ip.ShrinkSize < NDIRECT {
+	for ip.IsShrinking() && ip.shrinkFits(op, NINDLEVEL+5) {
+		if ip.ShrinkSize-1 < ip.lay.nDirect {
+			ip.ShrinkSize -= 1
 			ip.freeIndex(op, ip.ShrinkSize)
 		} else {
-			var off = ip.ShrinkSize - NDIRECT
-			if off < NBLKBLK {
-				freeroot := ip.indshrink(op, ip.blks[INDIRECT], 1, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, INDIRECT)
-				}
+			cursz := util.RoundUp(ip.Size, disk.BlockSize)
+			index, level, off := ip.lay.indirectIndex(ip.ShrinkSize - 1)
+			if !ip.ownShrinkPath(op, index, level, off, ip.ShrinkSize-1-off, cursz) {
+				break
+			}
+			ip.ShrinkSize -= 1
+			freeroot, skip := ip.indshrink(op, ip.blks[index], level, off)
+			if freeroot != 0 {
+				ip.freeIndex(op, index)
+			}
+			// skip over holes, but not below the new size
+			if ip.ShrinkSize-skip < cursz {
+				ip.ShrinkSize = cursz
 			} else {
-				off = off - NBLKBLK
-				freeroot := ip.indshrink(op, ip.blks[DINDIRECT], 2, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, DINDIRECT)
-				}
+				ip.ShrinkSize -= skip
 			}
 		}
 	}
-	ip.WriteInode(op)
-	return ip.IsShrinking()
+}
+
+// FreeCopy frees the blocks of the inode in slot of block bn, a copy of
+// an inode block that no snapshot needs anymore, as far as the
+// transaction has room (blocks the inode shares just lose a
+// reference).  Returns whether the inode has no blocks left.
+func FreeCopy(op *alloctxn.AllocTxn, bn common.Bnum, slot uint64) bool {
+	a := addr.MkAddr(bn, slot*common.INODESZ*8)
+	b := op.Op.ReadBuf(a, common.INODESZ*8)
+	ip := decode(layoutOf(op.Super), b.Data, common.NULLINUM)
+	if ip.inline {
+		return true
+	}
+	var end = util.RoundUp(ip.Size, disk.BlockSize)
+	if ip.ShrinkSize > end {
+		end = ip.ShrinkSize
+	}
+	if end == 0 {
+		return true
+	}
+	ip.Size = 0
+	ip.ShrinkSize = end
+	ip.shrink(op)
+	op.Op.OverWrite(a, common.INODESZ*8, ip.Encode())
+	return !ip.IsShrinking()
 }
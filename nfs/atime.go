@@ -0,0 +1,89 @@
+package nfs
+
+import (
+	"fmt"
+
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// READ, READLINK, READDIR and READDIRPLUS update the access time
+// according to the server's AtimePolicy.  An update is committed
+// without waiting for the log to reach the disk, so a crash may lose
+// it, but a read never waits on a disk write.
+//
+
+type AtimePolicy uint32
+
+const (
+	NoAtime     AtimePolicy = iota // only SETATTR changes atime
+	RelAtime                       // update if older than mtime or a day
+	StrictAtime                    // update on every read
+)
+
+const RELATIME_SECS uint64 = 24 * 60 * 60
+
+var atimeNames = []string{"noatime", "relatime", "strictatime"}
+
+func (p AtimePolicy) String() string {
+	if int(p) < len(atimeNames) {
+		return atimeNames[p]
+	}
+	return fmt.Sprintf("atime(%d)", uint32(p))
+}
+
+// ParseAtime parses the name of a policy, as printed by String.
+func ParseAtime(s string) (AtimePolicy, error) {
+	for i, n := range atimeNames {
+		if s == n {
+			return AtimePolicy(i), nil
+		}
+	}
+	return NoAtime, fmt.Errorf("unknown atime policy %q (want noatime, relatime or strictatime)", s)
+}
+
+func timeBefore(a, b nfstypes.Nfstime3) bool {
+	return a.Seconds < b.Seconds || (a.Seconds == b.Seconds && a.Nseconds <= b.Nseconds)
+}
+
+// Returns whether a read of ip at now should update its atime.
+func (p AtimePolicy) update(ip *inode.Inode, now nfstypes.Nfstime3) bool {
+	switch p {
+	case StrictAtime:
+		return true
+	case RelAtime:
+		return timeBefore(ip.Atime, ip.Mtime) ||
+			uint64(now.Seconds) >= uint64(ip.Atime.Seconds)+RELATIME_SECS
+	}
+	return false
+}
+
+// touchAtime updates the atime of ip, which op has read, if the
+// policy says so, and ip isn't in a snapshot.  Returns whether it did.
+func (nfs *Nfs) touchAtime(op *fstxn.FsTxn, ip *inode.Inode) bool {
+	if nfs.Atime == NoAtime || op.ReadOnly() {
+		return false
+	}
+	now := inode.NfstimeNow()
+	if !nfs.Atime.update(ip, now) {
+		return false
+	}
+	ip.Atime = now
+	ip.WriteInode(op.Atxn)
+	return true
+}
+
+// commitRead commits a read, which dirtied only an atime if touched.
+func commitRead(op *fstxn.FsTxn, status *nfstypes.Nfsstat3, touched bool) {
+	if !touched {
+		commitReply(op, status)
+		return
+	}
+	if op.CommitUnstable() {
+		*status = nfstypes.NFS3_OK
+	} else {
+		*status = ioErr(op, nfstypes.NFS3ERR_SERVERFAULT)
+	}
+}
@@ -0,0 +1,111 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// A clone is a new file that shares the blocks of another (a reflink),
+// so that copying a large file takes a single transaction and no space
+// until one of the two is written.  It relies on the share counts that
+// snapshots introduced, and thus on an image with a superblock.
+//
+
+// Locks src and the directory dinum in ascending inum order, and
+// allocates the clone's inode, which mustn't be shrinking.  Returns the
+// three inodes, or an error after aborting op.
+func (nfs *Nfs) cloneInodes(op *fstxn.FsTxn, src common.Inum, dinum common.Inum,
+	name nfstypes.Filename3) (*inode.Inode, *inode.Inode, *inode.Inode, error) {
+	inodes := lockInodes(op, twoInums(src, dinum))
+	if inodes == nil {
+		return nil, nil, nil, errors.New("source or directory was removed")
+	}
+	ip, dip := inodes[0], inodes[1]
+	var err error
+	if ip.Kind != nfstypes.NF3REG {
+		err = errors.New("not a regular file")
+	} else if !isDir(dip) {
+		err = errors.New("not a directory")
+	} else if inum, _ := dir.LookupName(dip, op, name); inum != common.NULLINUM {
+		err = errors.New("already exists")
+	}
+	if err != nil {
+		op.Abort()
+		return nil, nil, nil, err
+	}
+	nip := op.AllocInode(nfstypes.NF3REG, dinum, nil)
+	if nip == nil {
+		op.Abort()
+		return nil, nil, nil, errors.New("out of inodes")
+	}
+	return ip, dip, nip, nil
+}
+
+// Clone makes dst, which must not exist, a copy of the regular file
+// src that shares src's blocks; both are relative to the root.  Either
+// file copies the blocks it changes afterwards.
+func (nfs *Nfs) Clone(src string, dst string) error {
+	if nfs.fsstate.Super.Legacy() {
+		return errors.New("file system doesn't support clones (legacy image)")
+	}
+	name := nfstypes.Filename3(path.Base(dst))
+	if dir.IllegalName(name) || name == "/" || uint64(len(name)) >= dir.MAXNAMELEN {
+		return fmt.Errorf("%s: bad name", dst)
+	}
+	inum, err := nfs.lookupPath(src)
+	if err != nil {
+		return err
+	}
+	dinum, err := nfs.lookupPath(path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if dinum == common.ROOTINUM && name == SNAPDIRNAME {
+		return fmt.Errorf("%s: already exists", dst)
+	}
+	if inum == dinum {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		ip, dip, nip, err := nfs.cloneInodes(op, inum, dinum, name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dst, err)
+		}
+		// blocks beyond the size of a shrinking inode would be shared
+		// without a pointer that frees them
+		if ip.IsShrinking() || nip.IsShrinking() {
+			shrinking := nip.Inum
+			if ip.IsShrinking() {
+				shrinking = ip.Inum
+			}
+			util.DPrintf(1, "Clone: abort to shrink # %v\n", shrinking)
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(shrinking) {
+				return fmt.Errorf("%s: shrinking inode %d failed", dst, shrinking)
+			}
+			continue
+		}
+		if !nip.Clone(op.Atxn, ip) {
+			op.Abort()
+			return fmt.Errorf("%s: blocks of %s are shared too often", dst, src)
+		}
+		if !dir.AddName(dip, op, nip.Inum, name) {
+			op.Abort()
+			return fmt.Errorf("%s: out of space", dst)
+		}
+		if !op.Commit() {
+			return fmt.Errorf("%s: commit failed", dst)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,148 @@
+package nfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+type exportEnt struct {
+	name string
+	inum common.Inum
+}
+
+// Returns the entries of directory inum, other than . and ..
+func (nfs *Nfs) exportEnts(inum common.Inum) ([]exportEnt, error) {
+	op := fstxn.Begin(nfs.fsstate)
+	dip := op.GetInodeInum(inum)
+	if !isDir(dip) {
+		op.Abort()
+		return nil, fmt.Errorf("inode %d isn't a directory", inum)
+	}
+	var ents = make([]exportEnt, 0)
+	dir.ApplyEnts(dip, op, 0, ^uint64(0), func(name string, inum common.Inum, off uint64) {
+		if name != "." && name != ".." {
+			ents = append(ents, exportEnt{name: name, inum: inum})
+		}
+	})
+	op.Abort()
+	return ents, nil
+}
+
+func goTime(t nfstypes.Nfstime3) time.Time {
+	return time.Unix(int64(t.Seconds), int64(t.Nseconds))
+}
+
+// Writes the header of inum as name, and the data of a file or
+// symlink.  Reads in transactions of importChunk blocks, since reading
+// a hole fills it in.
+func (nfs *Nfs) exportFile(tw *tar.Writer, name string, inum common.Inum) (nfstypes.Ftype3, error) {
+	var off uint64 = 0
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		ip := op.GetInodeInum(inum)
+		if ip == nil {
+			op.Abort()
+			return 0, fmt.Errorf("%s: inode %d is free", name, inum)
+		}
+		if off == 0 {
+			hdr := &tar.Header{
+				Name:    name,
+				Mode:    0777, // as reported by MkFattr
+				ModTime: goTime(ip.Mtime),
+			}
+			switch ip.Kind {
+			case nfstypes.NF3DIR:
+				hdr.Typeflag = tar.TypeDir
+				hdr.Name = name + "/"
+			case nfstypes.NF3LNK:
+				data, _, ok := ip.Read(op.Atxn, 0, ip.Size)
+				if !ok {
+					op.Abort()
+					return 0, fmt.Errorf("%s: checksum mismatch", name)
+				}
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname = string(data)
+			default:
+				hdr.Typeflag = tar.TypeReg
+				hdr.Size = int64(ip.Size)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				op.Abort()
+				return 0, err
+			}
+		}
+		if ip.Kind != nfstypes.NF3REG || off >= ip.Size {
+			kind := ip.Kind
+			if !op.Commit() {
+				return 0, fmt.Errorf("%s: commit failed", name)
+			}
+			return kind, nil
+		}
+		data, _, ok := ip.Read(op.Atxn, off, importChunk*disk.BlockSize)
+		if !ok {
+			op.Abort()
+			return 0, fmt.Errorf("%s: checksum mismatch at offset %d", name, off)
+		}
+		if !op.Commit() {
+			return 0, fmt.Errorf("%s: commit failed", name)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return 0, err
+		}
+		off += uint64(len(data))
+	}
+}
+
+func (nfs *Nfs) exportTree(tw *tar.Writer, name string, inum common.Inum) error {
+	kind, err := nfs.exportFile(tw, name, inum)
+	if err != nil || kind != nfstypes.NF3DIR {
+		return err
+	}
+	return nfs.exportDir(tw, name, inum)
+}
+
+func (nfs *Nfs) exportDir(tw *tar.Writer, name string, inum common.Inum) error {
+	ents, err := nfs.exportEnts(inum)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if err := nfs.exportTree(tw, path.Join(name, e.name), e.inum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export writes the tree at src, which is relative to the root, to w
+// as a tar stream.  The names of a directory's entries are relative to
+// it; a file or symlink is named by its last component.  Everything
+// has mode 0777, as over NFS, since inodes don't store modes.
+func (nfs *Nfs) Export(src string, w io.Writer) error {
+	inum, err := nfs.lookupPath(src)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	ents, err := nfs.exportEnts(inum)
+	if err == nil {
+		for _, e := range ents {
+			if err := nfs.exportTree(tw, e.name, e.inum); err != nil {
+				return err
+			}
+		}
+	} else if _, err := nfs.exportFile(tw, path.Base("/"+src), inum); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,141 @@
+package nfs
+
+import (
+	"fmt"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+//
+// Growing a mounted file system: the new blocks are beyond the old
+// size, so they are marked in use in the block bitmap (mkfs marks
+// everything up to the end of the bitmap in use) and nothing can
+// allocate them.  Grow first writes the superblock with the new size,
+// and then clears their bits, one bitmap block per transaction.  A
+// crash in between leaks the new blocks that are still marked in use,
+// which fsck -repair reclaims.
+//
+
+// Clears the bits [lo, hi) of the block bitmap, which are all in one
+// bitmap block, in op: bit by bit up to a byte boundary, and byte by
+// byte in between.
+func clearBitmap(op *fstxn.FsTxn, lo uint64, hi uint64) {
+	start := op.Fs.Super.BitmapBlockStart()
+	for lo < hi && lo%8 != 0 {
+		op.Atxn.WriteBits([]uint64{lo}, uint64(start), false)
+		lo++
+	}
+	for hi > lo && hi%8 != 0 {
+		hi--
+		op.Atxn.WriteBits([]uint64{hi}, uint64(start), false)
+	}
+	if lo < hi {
+		a := addr.MkBitAddr(start, lo)
+		op.Atxn.Op.OverWrite(a, hi-lo, make([]byte, (hi-lo)/8))
+	}
+}
+
+// GrowLimit returns the size of the file system and the largest size
+// it can grow to, which mkfs fixed.
+func (nfs *Nfs) GrowLimit() (uint64, uint64) {
+	sup := nfs.fsstate.Super
+	size := uint64(sup.MaxBnum())
+	if sup.Sb == nil {
+		return size, size
+	}
+	return size, sup.MaxSize()
+}
+
+// Grow grows the file system to nblocks, or to as much of the disk as
+// the block bitmap can describe if nblocks is 0, while it is in use.
+// A disk that is a diskfile.Grower is grown first (for an image file,
+// by extending it).  The reserved blocks grow in proportion.  Grow
+// returns the new size.
+func (nfs *Nfs) Grow(nblocks uint64) (uint64, error) {
+	nfs.sbMu.Lock()
+	defer nfs.sbMu.Unlock()
+	sup := nfs.fsstate.Super
+	if sup.Sb == nil {
+		return 0, fmt.Errorf("a legacy image (without a superblock) can't grow")
+	}
+	d := sup.Disk
+	old := uint64(sup.MaxBnum())
+	var size = nblocks
+	if size == 0 {
+		size = d.Size()
+		if g, ok := d.(diskfile.Grower); ok {
+			n, err := g.Grow(0)
+			if err != nil {
+				return 0, err
+			}
+			size = n
+		}
+		if size > sup.MaxSize() {
+			size = sup.MaxSize()
+		}
+	}
+	if size <= old {
+		return 0, fmt.Errorf("file system already has %d blocks", old)
+	}
+	if size > sup.MaxSize() {
+		return 0, fmt.Errorf("file system can grow to at most %d blocks", sup.MaxSize())
+	}
+	if d.Size() < size {
+		g, ok := d.(diskfile.Grower)
+		if !ok {
+			return 0, fmt.Errorf("disk has %d blocks, not %d", d.Size(), size)
+		}
+		if _, err := g.Grow(size); err != nil {
+			return 0, err
+		}
+	}
+
+	dstart := uint64(sup.DataStart())
+	nres := sup.NReserved() * (size - dstart) / (old - dstart)
+	sb := *sup.Sb
+	sb.Size = size
+	sb.NReserved = nres
+	sb.Write(d)
+	sup.Grow(size, nres)
+	util.DPrintf(1, "Grow: %d -> %d blocks, %d reserved\n", old, size, nres)
+
+	for lo := old; lo < size; {
+		hi := (lo/common.NBITBLOCK + 1) * common.NBITBLOCK
+		if hi > size {
+			hi = size
+		}
+		op := fstxn.Begin(nfs.fsstate)
+		clearBitmap(op, lo, hi)
+		if !op.Commit() {
+			return 0, fmt.Errorf("grow: commit failed")
+		}
+		nfs.fsstate.Balloc.FreeRange(lo, hi)
+		lo = hi
+	}
+	return size, nil
+}
+
+// SetReserved changes the number of data blocks that only deletes,
+// truncates and the shrinker may allocate.
+func (nfs *Nfs) SetReserved(nblocks uint64) error {
+	nfs.sbMu.Lock()
+	defer nfs.sbMu.Unlock()
+	sup := nfs.fsstate.Super
+	if sup.Sb == nil {
+		return fmt.Errorf("a legacy image (without a superblock) has no reserved blocks")
+	}
+	ndata := uint64(sup.MaxBnum() - sup.DataStart())
+	if nblocks >= ndata {
+		return fmt.Errorf("can't reserve %d of %d data blocks", nblocks, ndata)
+	}
+	sb := *sup.Sb
+	sb.NReserved = nblocks
+	sb.Write(sup.Disk)
+	sup.SetReserved(nblocks)
+	util.DPrintf(1, "SetReserved: %d blocks\n", nblocks)
+	return nil
+}
@@ -0,0 +1,306 @@
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Import copies a host directory tree into the file system, and Export
+// writes a tree of the file system as a tar stream.  Both run on a
+// mounted file system, but not over NFS: they use transactions
+// directly.  Import packs as many files into a transaction as fit in
+// half the log; the other half is for the bitmap blocks, since each
+// allocation in a transaction may dirty a different one.
+//
+
+const (
+	importBudget = jrnl.LogBlocks / 2
+	importChunk  = 64 // blocks of file data written at a time
+)
+
+type ImportStats struct {
+	Files    uint64
+	Dirs     uint64
+	Symlinks uint64
+	Bytes    uint64
+	Skipped  uint64 // special files (devices, sockets, ...)
+	Txns     uint64
+}
+
+type importer struct {
+	nfs       *Nfs
+	op        *fstxn.FsTxn
+	shrinking []common.Inum
+	stats     ImportStats
+}
+
+// Commits the current transaction, finishes shrinking the inodes that
+// were skipped because they were shrinking, and begins a new one.
+func (im *importer) commit() error {
+	if !im.op.Commit() {
+		return fmt.Errorf("import: commit failed")
+	}
+	im.stats.Txns++
+	for _, inum := range im.shrinking {
+		if !im.nfs.shrinkst.DoShrink(inum) {
+			return fmt.Errorf("import: shrinking inode %d failed", inum)
+		}
+	}
+	im.shrinking = im.shrinking[:0]
+	im.op = fstxn.Begin(im.nfs.fsstate)
+	return nil
+}
+
+// Commits the current transaction if nblk more blocks might not fit.
+func (im *importer) reserve(nblk uint64) error {
+	if im.op.Atxn.Op.NDirty()+nblk < importBudget {
+		return nil
+	}
+	return im.commit()
+}
+
+// Returns inode inum, locking it if the current transaction doesn't
+// hold it already.
+func (im *importer) inode(inum common.Inum) *inode.Inode {
+	if im.op.OwnInum(inum) {
+		return im.op.GetInodeUnlocked(inum)
+	}
+	return im.op.GetInodeInum(inum)
+}
+
+// Allocates an inode of kind.  An inode that is still shrinking is
+// freed again in this transaction, and shrunk after it commits (the
+// allocator won't hand it out again until then).
+func (im *importer) alloc(kind nfstypes.Ftype3, parent common.Inum) (*inode.Inode, error) {
+	for {
+		ip := im.op.AllocInode(kind, parent, nil)
+		if ip == nil {
+			return nil, fmt.Errorf("out of inodes")
+		}
+		if !ip.IsShrinking() {
+			return ip, nil
+		}
+		util.DPrintf(1, "import: skip shrinking # %v\n", ip.Inum)
+		im.op.Atxn.FreeINum(ip.Inum)
+		im.op.ReleaseInode(ip)
+		im.shrinking = append(im.shrinking, ip.Inum)
+	}
+}
+
+func nfsTime(fi os.FileInfo) nfstypes.Nfstime3 {
+	t := fi.ModTime()
+	return nfstypes.Nfstime3{
+		Seconds:  nfstypes.Uint32(t.Unix()),
+		Nseconds: nfstypes.Uint32(t.Nanosecond()),
+	}
+}
+
+// Makes an inode of kind named name in dinum, with fi's modification
+// time as its atime and mtime.
+func (im *importer) create(dinum common.Inum, name string, kind nfstypes.Ftype3,
+	fi os.FileInfo) (*inode.Inode, error) {
+	if uint64(len(name)) >= dir.MAXNAMELEN {
+		return nil, fmt.Errorf("name too long")
+	}
+	// an inode, its directory entry, and maybe a directory block and
+	// its index blocks
+	if err := im.reserve(2*inode.NINDLEVEL + 4); err != nil {
+		return nil, err
+	}
+	dip := im.inode(dinum)
+	if inum, _ := dir.LookupName(dip, im.op, nfstypes.Filename3(name)); inum != common.NULLINUM {
+		return nil, fmt.Errorf("already exists")
+	}
+	ip, err := im.alloc(kind, dinum)
+	if err != nil {
+		return nil, err
+	}
+	if (kind == nfstypes.NF3DIR && !dir.InitDir(ip, im.op, dinum)) ||
+		!dir.AddName(dip, im.op, ip.Inum, nfstypes.Filename3(name)) {
+		im.nfs.doDecLink(im.op, ip)
+		return nil, fmt.Errorf("out of space")
+	}
+	if kind == nfstypes.NF3DIR {
+		dip.Nlink = dip.Nlink + 1 // for ..
+		dip.WriteInode(im.op.Atxn)
+	}
+	ip.Atime = nfsTime(fi)
+	ip.Mtime = ip.Atime
+	ip.WriteInode(im.op.Atxn)
+	return ip, nil
+}
+
+// Writes data from r to inum, committing whenever the transaction
+// fills up.
+func (im *importer) write(inum common.Inum, r io.Reader) error {
+	var off uint64 = 0
+	for {
+		// a fresh buffer, since the transaction holds on to the
+		// data it overwrites blocks with
+		data := make([]byte, importChunk*disk.BlockSize)
+		n, err := io.ReadFull(r, data)
+		if n > 0 {
+			if err := im.reserve(importChunk + 2*inode.NINDLEVEL + 1); err != nil {
+				return err
+			}
+			ip := im.inode(inum)
+			cnt, ok := ip.Write(im.op.Atxn, off, uint64(n), data[:n])
+			if !ok || cnt != uint64(n) {
+				return fmt.Errorf("out of space")
+			}
+			off += cnt
+			im.stats.Bytes += cnt
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Imports host file path as name in dinum.
+func (im *importer) importFile(dinum common.Inum, name string, path string,
+	fi os.FileInfo) error {
+	var kind nfstypes.Ftype3
+	var r io.Reader
+	switch {
+	case fi.Mode().IsDir():
+		kind = nfstypes.NF3DIR
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		kind, r = nfstypes.NF3LNK, strings.NewReader(target)
+	case fi.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		kind, r = nfstypes.NF3REG, f
+	default:
+		util.DPrintf(0, "import: skipping %s (%v)\n", path, fi.Mode().Type())
+		im.stats.Skipped++
+		return nil
+	}
+	ip, err := im.create(dinum, name, kind, fi)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	switch kind {
+	case nfstypes.NF3DIR:
+		im.stats.Dirs++
+		return im.importDir(ip.Inum, path)
+	case nfstypes.NF3LNK:
+		im.stats.Symlinks++
+	default:
+		im.stats.Files++
+	}
+	if err := im.write(ip.Inum, r); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Imports the entries of host directory path into dinum.  A
+// subdirectory that exists in dinum is merged into; any other
+// existing name is an error.
+func (im *importer) importDir(dinum common.Inum, path string) error {
+	ents, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		p := filepath.Join(path, e.Name())
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			dip := im.inode(dinum)
+			inum, _ := dir.LookupName(dip, im.op, nfstypes.Filename3(e.Name()))
+			if inum != common.NULLINUM && isDir(im.inode(inum)) {
+				if err := im.importDir(inum, p); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := im.importFile(dinum, e.Name(), p, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isDir(ip *inode.Inode) bool {
+	return ip != nil && ip.Kind == nfstypes.NF3DIR
+}
+
+// Returns the inode number of path, which is relative to the root.
+func (nfs *Nfs) lookupPath(path string) (common.Inum, error) {
+	op := fstxn.Begin(nfs.fsstate)
+	defer op.Abort()
+	var inum = common.ROOTINUM
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		dip := op.GetInodeInum(inum)
+		if !isDir(dip) {
+			return common.NULLINUM, fmt.Errorf("%s: not a directory", path)
+		}
+		inum, _ = dir.LookupName(dip, op, nfstypes.Filename3(name))
+		op.ReleaseInode(dip)
+		if inum == common.NULLINUM {
+			return common.NULLINUM, fmt.Errorf("%s: %s not found", path, name)
+		}
+	}
+	return inum, nil
+}
+
+// Import copies the tree at host directory src into directory dst of
+// the file system, preserving file contents, symlinks and modification
+// times (also used as access times).  Directories that exist already
+// are merged into.  On error, what was imported so far stays, up to a
+// partially written file.
+func (nfs *Nfs) Import(src string, dst string) (ImportStats, error) {
+	dinum, err := nfs.lookupPath(dst)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	im := &importer{
+		nfs:       nfs,
+		op:        fstxn.Begin(nfs.fsstate),
+		shrinking: make([]common.Inum, 0),
+	}
+	if !isDir(im.inode(dinum)) {
+		im.op.Abort()
+		return ImportStats{}, fmt.Errorf("%s: not a directory", dst)
+	}
+	err = im.importDir(dinum, src)
+	// commit even on error, since the inodes in the inode cache
+	// reflect this transaction
+	if cerr := im.commit(); err == nil {
+		err = cerr
+	}
+	im.op.Abort()
+	return im.stats, err
+}
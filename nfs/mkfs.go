@@ -0,0 +1,74 @@
+package nfs
+
+import (
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/buf"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+// Mkfs makes an empty file system on d with the geometry in opts,
+// destroying whatever d held.  The superblock is written last, after
+// everything else has reached the disk, so a crash during Mkfs leaves
+// a disk without a superblock.
+func Mkfs(d disk.Disk, opts super.MkfsOpts) (*super.Superblock, error) {
+	sb, err := super.NewSuperblock(d.Size(), opts)
+	if err != nil {
+		return nil, err
+	}
+	fs := super.MkFsSuperSb(d, sb)
+	util.DPrintf(1, "Mkfs: %+v\n", sb)
+
+	// wipe the log (so that recovery doesn't replay an old file
+	// system's transactions) and the old superblock
+	zero := make(disk.Block, disk.BlockSize)
+	for bn := uint64(0); bn < uint64(fs.BitmapBlockStart()); bn++ {
+		d.Write(bn, zero)
+	}
+
+	// everything outside the data area is allocated
+	writeBitmap(d, fs.BitmapBlockStart(), fs.NBlockBitmap,
+		uint64(fs.DataStart()), fs.Size)
+	// inodes 0 (the chunk registry) and 1 (the root) are allocated, and
+	// so are bits beyond the inode table
+	writeBitmap(d, fs.BitmapInodeStart(), fs.NInodeBitmap,
+		uint64(common.ROOTINUM)+1, uint64(fs.NInode()))
+
+	// all inodes are free, there are no inode chunks or snapshots,
+	// and no block has a checksum or is shared
+	for bn := fs.InodeStart(); bn < fs.DataStart(); bn++ {
+		d.Write(uint64(bn), zero)
+	}
+	root := inode.MkRootInode(fs)
+	rootbuf := buf.MkBuf(fs.Inum2Addr(common.ROOTINUM), common.INODESZ*8, root.Encode())
+	rootbuf.WriteDirect(d)
+
+	d.Barrier()
+	sb.Write(d)
+
+	nfs, err := MountNfs(d)
+	if err != nil {
+		return nil, err
+	}
+	nfs.makeRootDir()
+	nfs.ShutdownNfs()
+	return sb, nil
+}
+
+// Write the n bitmap blocks starting at start, with bits [0, lo) and
+// [hi, n*NBITBLOCK) set and the others clear.
+func writeBitmap(d disk.Disk, start common.Bnum, n uint64, lo uint64, hi uint64) {
+	for i := uint64(0); i < n; i++ {
+		blk := make(disk.Block, disk.BlockSize)
+		base := i * common.NBITBLOCK
+		for bit := uint64(0); bit < common.NBITBLOCK; bit++ {
+			if base+bit < lo || base+bit >= hi {
+				blk[bit/8] = blk[bit/8] | 1<<(bit%8)
+			}
+		}
+		d.Write(uint64(start)+i, blk)
+	}
+}
@@ -2,7 +2,6 @@ package nfs
 
 import (
 	"github.com/mit-pdos/go-journal/util"
-	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 
 	"log"
@@ -15,8 +14,13 @@ func (nfs *Nfs) MOUNTPROC3_NULL() {
 func (nfs *Nfs) MOUNTPROC3_MNT(args nfstypes.Dirpath3) nfstypes.Mountres3 {
 	reply := new(nfstypes.Mountres3)
 	util.DPrintf(1, "MOUNT Mount %v\n", args)
+	fh3, ok := nfs.mountFh(string(args))
+	if !ok {
+		reply.Fhs_status = nfstypes.MNT3ERR_NOENT
+		return *reply
+	}
 	reply.Fhs_status = nfstypes.MNT3_OK
-	reply.Mountinfo.Fhandle = fh.MkRootFh3().Data
+	reply.Mountinfo.Fhandle = fh3.Data
 	return *reply
 }
 
@@ -40,5 +44,15 @@ func (nfs *Nfs) MOUNTPROC3_EXPORT() nfstypes.Exportsopt3 {
 		Ex_next:   nil,
 	}
 	res.Ex_dir = "/"
+	// each snapshot is exported too
+	var last = &res
+	for _, s := range nfs.Snapshots() {
+		if s.Deleting {
+			continue
+		}
+		ex := &nfstypes.Exports3{Ex_dir: nfstypes.Dirpath3("/" + SNAPDIRNAME + "/" + s.Name)}
+		last.Ex_next = ex
+		last = ex
+	}
 	return nfstypes.Exportsopt3{P: &res}
 }
@@ -1,16 +1,19 @@
 package nfs
 
 import (
+	"sync"
+	"time"
+
 	"github.com/tchajed/goose/machine/disk"
 
-	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fstxn"
-	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/scrub"
 	"github.com/mit-pdos/go-nfsd/shrinker"
+	"github.com/mit-pdos/go-nfsd/snapshot"
 	"github.com/mit-pdos/go-nfsd/super"
 	"github.com/mit-pdos/go-nfsd/util/stats"
 )
@@ -18,43 +21,144 @@ import (
 type Nfs struct {
 	fsstate  *fstxn.FsState
 	shrinkst *shrinker.ShrinkerSt
+	scrubber *scrub.Scrubber
+	// takes and deletes snapshots
+	snapshotter *snapshot.Snapshotter
+	// removes, copies and measures trees in the background
+	trees *treeJobs
+	// moves removed entries to .trash and reaps them (nil when off)
+	trash *trash
 	// support unstable writes
 	Unstable bool
+	// reply NFS3ERR_JUKEBOX rather than wait for shrinking or a busy log
+	Jukebox bool
+	// when reads update atime
+	Atime AtimePolicy
+	// serializes superblock updates (Grow, SetReserved)
+	sbMu sync.Mutex
 	// statistics
 	stats [NUM_NFS_OPS]stats.Op
 }
 
+// MakeNfs mounts the file system on d, making a new one with the
+// default geometry if d is blank.  It panics if d holds something
+// else.
 func MakeNfs(d disk.Disk) *Nfs {
-	// run first so that disk is initialized before mkLog
-	super := super.MkFsSuper(d)
+	_, err := super.ReadSuperblock(d)
+	if err == super.ErrBlank {
+		_, err = Mkfs(d, super.DefaultMkfsOpts())
+	}
+	if err != nil {
+		panic(err)
+	}
+	nfs, err := MountNfs(d)
+	if err != nil {
+		panic(err)
+	}
+	return nfs
+}
+
+// MountNfs mounts the file system on d, and returns an error if d
+// doesn't hold a valid file system.
+func MountNfs(d disk.Disk) (*Nfs, error) {
+	return mount(d, false)
+}
+
+// MountLegacy mounts the image from before superblocks on d.  Such an
+// image can't be told apart from other data for sure, so it is only
+// mounted when asked for.
+func MountLegacy(d disk.Disk) (*Nfs, error) {
+	return mount(d, true)
+}
+
+func mount(d disk.Disk, legacy bool) (*Nfs, error) {
+	// check the file system before recovery, which would otherwise
+	// happily write to a disk that doesn't hold one.
+	fs, err := super.Open(d, legacy)
+	if err != nil {
+		return nil, err
+	}
+	sb := fs.Sb
 	util.DPrintf(1, "Super: "+
 		"Size %d NBlockBitmap %d NInodeBitmap %d Maxaddr %d\n",
 		d.Size(),
-		super.NBlockBitmap, super.NInodeBitmap, super.Maxaddr)
+		fs.NBlockBitmap, fs.NInodeBitmap, fs.Maxaddr)
 
 	log := obj.MkLog(d) // runs recovery
 
-	i := readRootInode(super)
-	if i.Kind == 0 { // make a new file system?
-		makeFs(super)
+	if sb != nil {
+		sb.Mtime = uint64(time.Now().Unix())
+		sb.Write(d)
 	}
 
-	st := fstxn.MkFsState(super, log)
+	st := fstxn.MkFsState(fs, log)
 	nfs := &Nfs{
 		fsstate:  st,
 		shrinkst: shrinker.MkShrinkerSt(st),
+		scrubber: scrub.MkScrubber(st),
+		trees:    mkTreeJobs(),
 		Unstable: true,
 	}
-	if i.Kind == 0 {
-		nfs.makeRootDir()
-	}
-	return nfs
+	nfs.snapshotter = snapshot.MkSnapshotter(st)
+	// finish shrinks and snapshot deletions that a crash interrupted
+	nfs.shrinkst.StartScavenger()
+	nfs.snapshotter.StartReaper()
+	return nfs, nil
+}
+
+// Superblock returns the superblock, or nil for a legacy image.
+func (nfs *Nfs) Superblock() *super.Superblock {
+	return nfs.fsstate.Super.Sb
+}
+
+// WaitScavenger waits until the shrinks interrupted by a crash, which
+// mount resumes in the background, are done.
+func (nfs *Nfs) WaitScavenger() shrinker.ScavengeStats {
+	return nfs.shrinkst.WaitScavenger()
+}
+
+// StartScrub starts checking the file system in the background at
+// rate inodes per second (0 for the default), or changes the rate if
+// the scrubber is running.
+func (nfs *Nfs) StartScrub(rate uint64) {
+	nfs.scrubber.Start(rate)
+}
+
+func (nfs *Nfs) StopScrub() {
+	nfs.scrubber.Stop()
+}
+
+func (nfs *Nfs) SetScrubRate(rate uint64) {
+	nfs.scrubber.SetRate(rate)
+}
+
+func (nfs *Nfs) ScrubStats() scrub.Stats {
+	return nfs.scrubber.Stats()
+}
+
+// WaitScrub waits until the scrubber finishes its current pass.
+func (nfs *Nfs) WaitScrub() scrub.Stats {
+	return nfs.scrubber.WaitPass()
 }
 
 func (nfs *Nfs) ShutdownNfs() {
+	nfs.shutdown(true)
+}
+
+// A clean shutdown discards the blocks that unstable transactions
+// freed; a crash leaves them.
+func (nfs *Nfs) shutdown(clean bool) {
 	util.DPrintf(1, "Shutdown\n")
+	nfs.stopTrash()
+	nfs.trees.shutdown()
+	nfs.scrubber.Stop()
+	nfs.snapshotter.Shutdown()
 	nfs.shrinkst.Shutdown()
-	nfs.fsstate.Txn.Shutdown()
+	if clean {
+		nfs.fsstate.FlushDiscards()
+	}
+	nfs.fsstate.Shutdown()
+	nfs.fsstate.Log.Shutdown()
 	util.DPrintf(1, "Shutdown done\n")
 }
 
@@ -62,7 +166,7 @@ func (nfs *Nfs) ShutdownNfs() {
 func (nfs *Nfs) Crash() {
 	util.DPrintf(0, "Crash: terminate shrinker\n")
 	nfs.shrinkst.Crash()
-	nfs.ShutdownNfs()
+	nfs.shutdown(false)
 }
 
 func (nfs *Nfs) makeRootDir() {
@@ -77,60 +181,3 @@ func (nfs *Nfs) makeRootDir() {
 		panic("makeRootDir")
 	}
 }
-
-// Make an empty file system
-func makeFs(super *super.FsSuper) {
-	util.DPrintf(1, "mkfs")
-
-	root := inode.MkRootInode()
-	util.DPrintf(1, "root %v\n", root)
-	raddr := super.Inum2Addr(common.ROOTINUM)
-	rootblk := root.Encode()
-	rootbuf := buf.MkBuf(raddr, common.INODESZ*8, rootblk)
-	rootbuf.WriteDirect(super.Disk)
-
-	markAlloc(super, super.DataStart(), super.MaxBnum())
-}
-
-func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
-	util.DPrintf(1, "markAlloc: [0, %d) and [%d,%d)\n", n, m,
-		super.NBlockBitmap*common.NBITBLOCK)
-	if n >= common.Bnum(common.NBITBLOCK) ||
-		m >= common.Bnum(common.NBITBLOCK*super.NBlockBitmap) ||
-		m < n {
-		panic("markAlloc: configuration makes no sense")
-	}
-	blk := make(disk.Block, disk.BlockSize)
-	for bn := uint64(0); bn < uint64(n); bn++ {
-		byte := bn / 8
-		bit := bn % 8
-		blk[byte] = blk[byte] | 1<<bit
-	}
-	super.Disk.Write(uint64(super.BitmapBlockStart()), blk)
-
-	var blk1 = blk
-	blkno := m/common.Bnum(common.NBITBLOCK) + super.BitmapBlockStart()
-	if blkno > super.BitmapBlockStart() {
-		blk1 = make(disk.Block, disk.BlockSize)
-	}
-	for bn := uint64(m) % common.NBITBLOCK; bn < common.NBITBLOCK; bn++ {
-		byte := bn / 8
-		bit := bn % 8
-		blk1[byte] = blk1[byte] | 1<<bit
-	}
-	super.Disk.Write(uint64(blkno), blk1)
-
-	// mark inode 0 and 1 as allocated
-	blk2 := make(disk.Block, disk.BlockSize)
-	blk2[0] = blk2[0] | 1<<0
-	blk2[0] = blk2[0] | 1<<1
-	super.Disk.Write(uint64(super.BitmapInodeStart()), blk2)
-}
-
-func readRootInode(super *super.FsSuper) *inode.Inode {
-	addr := super.Inum2Addr(common.ROOTINUM)
-	blk := super.Disk.Read(uint64(addr.Blkno))
-	buf := buf.MkBufLoad(addr, common.INODESZ*8, blk)
-	i := inode.Decode(buf, common.ROOTINUM)
-	return i
-}
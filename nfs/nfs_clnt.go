@@ -134,6 +134,17 @@ func (clnt *NfsClient) SetattrOp(fh nfstypes.Nfs_fh3, sz uint64) nfstypes.SETATT
 	return reply
 }
 
+// ChownOp changes the owner of fh as root, who may make any change.
+func (clnt *NfsClient) ChownOp(fh nfstypes.Nfs_fh3, uid uint32, gid uint32) nfstypes.SETATTR3res {
+	attr := nfstypes.Sattr3{
+		Uid: nfstypes.Set_uid3{Set_it: true, Uid: nfstypes.Uid3(uid)},
+		Gid: nfstypes.Set_gid3{Set_it: true, Gid: nfstypes.Gid3(gid)},
+	}
+	args := nfstypes.SETATTR3args{Object: fh, New_attributes: attr}
+	reply := clnt.srv.setattr(args, &Cred{})
+	return reply
+}
+
 func (clnt *NfsClient) ReadDirPlusOp(dir nfstypes.Nfs_fh3, cnt uint64) nfstypes.READDIRPLUS3res {
 	args := nfstypes.READDIRPLUS3args{Dir: dir, Dircount: nfstypes.Count3(100), Maxcount: nfstypes.Count3(cnt)}
 	reply := clnt.srv.NFSPROC3_READDIRPLUS(args)
@@ -167,3 +178,9 @@ func Parallel(nthread int, disksz uint64,
 	clnt.Shutdown()
 	return n
 }
+
+func (clnt *NfsClient) FsStatOp(fh nfstypes.Nfs_fh3) nfstypes.FSSTAT3res {
+	args := nfstypes.FSSTAT3args{Fsroot: fh}
+	reply := clnt.srv.NFSPROC3_FSSTAT(args)
+	return reply
+}
@@ -3,7 +3,6 @@ package nfs
 import (
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-nfsd/dir"
-	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
@@ -14,11 +13,10 @@ func Ls3(dip *inode.Inode, op *fstxn.FsTxn, start nfstypes.Cookie3, dircount, ma
 	var last *nfstypes.Entryplus3
 	eof := dir.Apply(dip, op, uint64(start), uint64(dircount), uint64(maxcount),
 		func(ip *inode.Inode, name string, inum common.Inum, off uint64) {
-			fattr := ip.MkFattr()
-			fh := &fh.Fh{Ino: ip.Inum, Gen: ip.Gen}
+			fattr := ip.MkFattr(op.Fsid())
 			ph := nfstypes.Post_op_fh3{
 				Handle_follows: true,
-				Handle:         fh.MakeFh3(),
+				Handle:         op.Fh(ip).MakeFh3(),
 			}
 			pa := nfstypes.Post_op_attr{
 				Attributes_follow: true,
@@ -3,9 +3,12 @@ package nfs
 import (
 	"time"
 
+	"github.com/tchajed/goose/machine/disk"
+
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/fstxn"
@@ -23,18 +26,38 @@ import (
 // lock order).
 //
 
+// Aborts op and replies err, or NFS3ERR_IO if op read a block that
+// failed its checksum (which may be why it failed).
 func errRet(op *fstxn.FsTxn, status *nfstypes.Nfsstat3, err nfstypes.Nfsstat3) {
-	*status = err
+	*status = ioErr(op, err)
 	util.DPrintf(2, "errRet %v", err)
 	op.Abort()
 }
 
+// Returns NFS3ERR_DQUOT if op failed to allocate because a user or
+// group is over quota, and err otherwise.
+func quotaErr(op *fstxn.FsTxn, err nfstypes.Nfsstat3) nfstypes.Nfsstat3 {
+	if op.Atxn.OverQuota() {
+		return nfstypes.NFS3ERR_DQUOT
+	}
+	return err
+}
+
+// Returns NFS3ERR_IO if op read a block that failed its checksum,
+// and err otherwise.
+func ioErr(op *fstxn.FsTxn, err nfstypes.Nfsstat3) nfstypes.Nfsstat3 {
+	if op.Atxn.ReadFailed() {
+		return nfstypes.NFS3ERR_IO
+	}
+	return err
+}
+
 func commitReply(op *fstxn.FsTxn, status *nfstypes.Nfsstat3) {
 	ok := op.Commit()
 	if ok {
 		*status = nfstypes.NFS3_OK
 	} else {
-		*status = nfstypes.NFS3ERR_SERVERFAULT
+		*status = ioErr(op, nfstypes.NFS3ERR_SERVERFAULT)
 	}
 }
 
@@ -46,24 +69,59 @@ func (nfs *Nfs) NFSPROC3_GETATTR(args nfstypes.GETATTR3args) nfstypes.GETATTR3re
 	defer nfs.recordOp(nfstypes.NFSPROC3_GETATTR, time.Now())
 	var reply nfstypes.GETATTR3res
 	util.DPrintf(1, "NFS GetAttr %v\n", args)
+	if isSnapDir(args.Object) {
+		attr, ok := nfs.snapDirAttr()
+		if !ok {
+			reply.Status = nfstypes.NFS3ERR_STALE
+			return reply
+		}
+		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Obj_attributes = attr
+		return reply
+	}
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.Object)
 	if ip == nil {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
 		return reply
 	}
-	reply.Resok.Obj_attributes = ip.MkFattr()
+	reply.Resok.Obj_attributes = ip.MkFattr(op.Fsid())
 	commitReply(op, &reply.Status)
 	return reply
 }
 
+// Transactions waiting for the log beyond which the log counts as
+// saturated, for Jukebox.
+const JUKEBOX_COMMITTING uint64 = 64
+
+// Returns whether the log or the shrinker is too busy to take more
+// changes right now.
+func (nfs *Nfs) saturated() bool {
+	return nfs.fsstate.Committing() >= JUKEBOX_COMMITTING || nfs.shrinkst.Busy()
+}
+
+// With Jukebox, queues ip, which is shrinking, for the shrinker rather
+// than shrink it in this RPC.  Aborts op and returns a new one, for
+// the caller to abort in turn.
+func (nfs *Nfs) jukeboxShrink(op *fstxn.FsTxn, ip *inode.Inode) *fstxn.FsTxn {
+	util.DPrintf(1, "jukebox: # %v is shrinking\n", ip.Inum)
+	inum, nblk := ip.Inum, ip.ShrinkBlocks()
+	op.Abort()
+	nfs.shrinkst.TryStartShrinker(inum, nblk)
+	return fstxn.Begin(nfs.fsstate)
+}
+
 // getShrink may lookup an inode that is shrining. If so, do/help shrinking in a
-// transaction and redo lookup after shrinking.
+// transaction and redo lookup after shrinking.  With Jukebox, it
+// returns NFS3ERR_JUKEBOX instead, and when the log is saturated.
 func (nfs *Nfs) getShrink(fh nfstypes.Nfs_fh3) (*fstxn.FsTxn, *inode.Inode, nfstypes.Nfsstat3) {
 	var op *fstxn.FsTxn
 	var ip *inode.Inode
 	var ok bool
 	var err = nfstypes.NFS3_OK
+	if nfs.Jukebox && nfs.saturated() {
+		return fstxn.Begin(nfs.fsstate), nil, nfstypes.NFS3ERR_JUKEBOX
+	}
 	for {
 		op = fstxn.Begin(nfs.fsstate)
 		ip = op.GetInodeFh(fh)
@@ -73,6 +131,11 @@ func (nfs *Nfs) getShrink(fh nfstypes.Nfs_fh3) (*fstxn.FsTxn, *inode.Inode, nfst
 		if !ip.IsShrinking() {
 			break
 		}
+		if nfs.Jukebox {
+			op = nfs.jukeboxShrink(op, ip)
+			err = nfstypes.NFS3ERR_JUKEBOX
+			break
+		}
 		inum := ip.Inum
 		util.DPrintf(1, "getShrink: abort to shrink")
 		op.Abort()
@@ -87,31 +150,77 @@ func (nfs *Nfs) getShrink(fh nfstypes.Nfs_fh3) (*fstxn.FsTxn, *inode.Inode, nfst
 	return op, ip, err
 }
 
+// Returns whether cred may change the owner of an inode from old to
+// owner: root may make any change, and the owning user may change the
+// group to one they belong to.  An unknown caller may change nothing.
+func mayChown(cred *Cred, old alloctxn.Owner, owner alloctxn.Owner) bool {
+	if old == owner || superuser(cred) {
+		return true
+	}
+	return cred != nil && owner.Uid == old.Uid && cred.Uid == old.Uid &&
+		cred.inGroup(owner.Gid)
+}
+
 func (nfs *Nfs) NFSPROC3_SETATTR(args nfstypes.SETATTR3args) nfstypes.SETATTR3res {
+	return nfs.setattr(args, nil)
+}
+
+// Serves SETATTR for the caller cred (nil if unknown).
+func (nfs *Nfs) setattr(args nfstypes.SETATTR3args, cred *Cred) nfstypes.SETATTR3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_SETATTR, time.Now())
 	var reply nfstypes.SETATTR3res
 
 	util.DPrintf(1, "NFS SetAttr %v\n", args)
+	if err := writable(args.Object); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
 	op, ip, err := nfs.getShrink(args.Object)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 
 	}
+	op.Atxn.UseReserved = superuser(cred)
 	if args.New_attributes.Mode.Set_it {
 		util.DPrintf(1, "NFS SetAttr ignore mode %v\n", args)
 		err = nfstypes.NFS3_OK
 	}
-	if args.New_attributes.Uid.Set_it {
-		util.DPrintf(1, "NFS SetAttr uid not supported %v\n", args)
-	}
-	if args.New_attributes.Gid.Set_it {
-		util.DPrintf(1, "NFS SetAttr gid not supported %v\n", args)
+	if args.New_attributes.Uid.Set_it || args.New_attributes.Gid.Set_it {
+		var owner = ip.Owner()
+		if args.New_attributes.Uid.Set_it {
+			owner.Uid = uint32(args.New_attributes.Uid.Uid)
+		}
+		if args.New_attributes.Gid.Set_it {
+			owner.Gid = uint32(args.New_attributes.Gid.Gid)
+		}
+		if op.Fs.Super.Legacy() {
+			// legacy images have no owners
+			util.DPrintf(1, "NFS SetAttr owner not supported %v\n", args)
+		} else if !mayChown(cred, ip.Owner(), owner) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_PERM)
+			return reply
+		} else if !ip.SetOwner(op.Atxn, owner) {
+			errRet(op, &reply.Status, quotaErr(op, nfstypes.NFS3ERR_NOSPC))
+			return reply
+		}
 	}
 	if args.New_attributes.Size.Set_it {
-		shrink := ip.Resize(op.Atxn, uint64(args.New_attributes.Size.Size))
+		if uint64(args.New_attributes.Size.Size) > inode.MaxFileSize(nfs.fsstate.Super) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_FBIG)
+			return reply
+		}
+		if uint64(args.New_attributes.Size.Size) < ip.Size {
+			// truncating must work on a full file system
+			op.Atxn.UseReserved = true
+		}
+		shrink, ok := ip.Resize(op.Atxn, uint64(args.New_attributes.Size.Size))
+		if !ok {
+			errRet(op, &reply.Status, quotaErr(op, nfstypes.NFS3ERR_NOSPC))
+			return reply
+		}
 		if shrink {
-			nfs.shrinkst.StartShrinker(ip.Inum)
+			nfs.startShrinker(op, ip)
 		}
 		err = nfstypes.NFS3_OK
 	}
@@ -139,7 +248,7 @@ func (nfs *Nfs) NFSPROC3_SETATTR(args nfstypes.SETATTR3args) nfstypes.SETATTR3re
 	}
 	if err == nfstypes.NFS3_OK {
 		reply.Resok.Obj_wcc.After.Attributes_follow = true
-		reply.Resok.Obj_wcc.After.Attributes = ip.MkFattr()
+		reply.Resok.Obj_wcc.After.Attributes = ip.MkFattr(op.Fsid())
 		commitReply(op, &reply.Status)
 	} else {
 		errRet(op, &reply.Status, err)
@@ -182,7 +291,7 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 		if inum == dip.Inum {
 			ip = dip
 		} else {
-			if inum < dip.Inum {
+			if inum < dip.Inum && !op.ReadOnly() {
 				// Abort. Try to lock inodes in order
 				op.Abort()
 				parent := fh.MakeFh(dfh)
@@ -208,16 +317,18 @@ func (nfs *Nfs) NFSPROC3_LOOKUP(args nfstypes.LOOKUP3args) nfstypes.LOOKUP3res {
 	var reply nfstypes.LOOKUP3res
 
 	util.DPrintf(1, "NFS Lookup %v\n", args)
+	if nfs.lookupSnap(args, &reply) {
+		return reply
+	}
 	op, inodes, err := nfs.getInodesLocked(args.What.Dir, args.What.Name)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
 	i := inodes[0]
-	fh := fh.Fh{Ino: i.Inum, Gen: i.Gen}
-	reply.Resok.Object = fh.MakeFh3()
+	reply.Resok.Object = op.Fh(i).MakeFh3()
 	reply.Resok.Obj_attributes.Attributes_follow = true
-	reply.Resok.Obj_attributes.Attributes = i.MkFattr()
+	reply.Resok.Obj_attributes.Attributes = i.MkFattr(op.Fsid())
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -231,28 +342,33 @@ func (nfs *Nfs) NFSPROC3_ACCESS(args nfstypes.ACCESS3args) nfstypes.ACCESS3res {
 	return reply
 }
 
-func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count uint64) (*fstxn.FsTxn, []byte, bool, nfstypes.Nfsstat3) {
+// doRead also returns whether it updated the atime.
+func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count uint64) (*fstxn.FsTxn, []byte, bool, bool, nfstypes.Nfsstat3) {
 	var readCount = count
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(fh)
 	if ip == nil {
-		return op, nil, false, nfstypes.NFS3ERR_STALE
+		return op, nil, false, false, nfstypes.NFS3ERR_STALE
 	}
 	if ip.Kind != kind {
-		return op, nil, false, nfstypes.NFS3ERR_INVAL
+		return op, nil, false, false, nfstypes.NFS3ERR_INVAL
 	}
 	if ip.Kind == nfstypes.NF3LNK {
 		readCount = ip.Size
 	}
-	data, eof := ip.Read(op.Atxn, offset, readCount)
-	return op, data, eof, nfstypes.NFS3_OK
+	data, eof, ok := ip.Read(op.Atxn, offset, readCount)
+	if !ok {
+		return op, nil, false, false, nfstypes.NFS3ERR_IO
+	}
+	touched := nfs.touchAtime(op, ip)
+	return op, data, eof, touched, nfstypes.NFS3_OK
 }
 
 func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_READ, time.Now())
 	var reply nfstypes.READ3res
 	util.DPrintf(1, "NFS Read %v %d %d\n", args.File, args.Offset, args.Count)
-	op, data, eof, err := nfs.doRead(args.File, nfstypes.NF3REG,
+	op, data, eof, touched, err := nfs.doRead(args.File, nfstypes.NF3REG,
 		uint64(args.Offset), uint64(args.Count))
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
@@ -261,12 +377,17 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	reply.Resok.Count = nfstypes.Count3(len(data))
 	reply.Resok.Data = data
 	reply.Resok.Eof = eof
-	commitReply(op, &reply.Status)
+	commitRead(op, &reply.Status, touched)
 	return reply
 }
 
 // XXX Mtime
 func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
+	return nfs.write(args, nil)
+}
+
+// Serves WRITE for the caller cred (nil if unknown).
+func (nfs *Nfs) write(args nfstypes.WRITE3args, cred *Cred) nfstypes.WRITE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_WRITE, time.Now())
 	var reply nfstypes.WRITE3res
 	var ok = true
@@ -274,12 +395,17 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 	util.DPrintf(1, "NFS Write %v off %d cnt %d how %d\n", args.File, args.Offset,
 		args.Count, args.Stable)
 
+	if err := writable(args.File); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
 	op, ip, err := nfs.getShrink(args.File)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 
 	}
+	op.Atxn.UseReserved = superuser(cred)
 	if ip.Kind != nfstypes.NF3REG {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
@@ -291,7 +417,7 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 	count, writeOk := ip.Write(op.Atxn, uint64(args.Offset), uint64(args.Count),
 		args.Data)
 	if !writeOk {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+		errRet(op, &reply.Status, quotaErr(op, nfstypes.NFS3ERR_NOSPC))
 		return reply
 	}
 	// if not supporting unstable writes, upgrade stability
@@ -329,7 +455,7 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 		reply.Resok.Count = nfstypes.Count3(count)
 		reply.Resok.Committed = args.Stable
 		reply.Resok.File_wcc.After.Attributes_follow = true
-		reply.Resok.File_wcc.After.Attributes = ip.MkFattr()
+		reply.Resok.File_wcc.After.Attributes = ip.MkFattr(op.Fsid())
 	} else {
 		util.DPrintf(1, "Write transaction failed")
 		reply.Status = nfstypes.NFS3ERR_SERVERFAULT
@@ -339,11 +465,18 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 
 // getAlloc is complicated because AllocInode() may return an inode
 // that needs to be shrunk, and shrinking runs in its own transaction.
-func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3) (*fstxn.FsTxn, *inode.Inode, *inode.Inode, nfstypes.Nfsstat3) {
+// With Jukebox, getAlloc returns NFS3ERR_JUKEBOX instead, and when the
+// log is saturated.
+func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3,
+	cred *Cred) (*fstxn.FsTxn, *inode.Inode, *inode.Inode, nfstypes.Nfsstat3) {
 	var ip *inode.Inode
 	var dip *inode.Inode
 	var err = nfstypes.NFS3_OK
+	if nfs.Jukebox && nfs.saturated() {
+		return op, nil, nil, nfstypes.NFS3ERR_JUKEBOX
+	}
 	for {
+		op.Atxn.UseReserved = superuser(cred)
 		dip = op.GetInodeFh(dfh)
 		if dip == nil {
 			err = nfstypes.NFS3ERR_STALE
@@ -354,14 +487,19 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 			err = nfstypes.NFS3ERR_EXIST
 			break
 		}
-		ip = op.AllocInode(kind)
+		ip = op.AllocInode(kind, dip.Inum, cred.owner())
 		if ip == nil {
-			err = nfstypes.NFS3ERR_NOSPC
+			err = quotaErr(op, nfstypes.NFS3ERR_NOSPC)
 			break
 		}
 		if !ip.IsShrinking() {
 			break
 		}
+		if nfs.Jukebox {
+			op = nfs.jukeboxShrink(op, ip)
+			err = nfstypes.NFS3ERR_JUKEBOX
+			break
+		}
 		util.DPrintf(1, "getAlloc: abort alloc # %v to shrink", ip.Inum)
 		inum = ip.Inum
 		op.Abort()
@@ -377,21 +515,39 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 	return op, dip, ip, err
 }
 
+// Hands ip, which op made shrinking, to the shrinker once op commits:
+// waiting for room in its queue before would hold ip's lock, and
+// perhaps the snapshot lock, which the shrinker's workers need.
+func (nfs *Nfs) startShrinker(op *fstxn.FsTxn, ip *inode.Inode) {
+	inum, nblk := ip.Inum, ip.ShrinkBlocks()
+	op.AfterCommit(func() {
+		nfs.shrinkst.StartShrinker(inum, nblk)
+	})
+}
+
 func (nfs *Nfs) doDecLink(op *fstxn.FsTxn, ip *inode.Inode) {
+	nfs.doDecLinkMax(op, ip, jrnl.LogBlocks)
+}
+
+// Drops a link to ip, freeing it with the last one, but handing the
+// blocks to the shrinker if there are more than maxFree.
+func (nfs *Nfs) doDecLinkMax(op *fstxn.FsTxn, ip *inode.Inode, maxFree uint64) {
 	if ip.DecLink(op.Atxn) {
-		shrink := ip.Resize(op.Atxn, 0)
+		shrink, _ := ip.ResizeMax(op.Atxn, 0, maxFree)
 		ip.FreeInode(op.Atxn)
 		if shrink {
-			nfs.shrinkst.StartShrinker(ip.Inum)
+			nfs.startShrinker(op, ip)
 		}
 	}
 }
 
+// Creates name in directory dfh, owned by the caller cred (see
+// AllocInode).
 func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3,
-	data []byte) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
+	data []byte, cred *Cred) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
 	beginOp := fstxn.Begin(nfs.fsstate)
 	var dip, ip *inode.Inode
-	op, dip, ip, err = nfs.getAlloc(beginOp, dfh, name, kind)
+	op, dip, ip, err = nfs.getAlloc(beginOp, dfh, name, kind, cred)
 	if err != nfstypes.NFS3_OK {
 		return
 	}
@@ -403,7 +559,7 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 		ok := dir.InitDir(ip, op, dip.Inum)
 		if !ok {
 			nfs.doDecLink(op, ip)
-			err = nfstypes.NFS3ERR_NOSPC
+			err = quotaErr(op, nfstypes.NFS3ERR_NOSPC)
 			return
 		}
 		dip.Nlink = dip.Nlink + 1 // for ..
@@ -413,23 +569,28 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 		_, ok := ip.Write(op.Atxn, uint64(0), uint64(len(data)), data)
 		if !ok {
 			nfs.doDecLink(op, ip)
-			err = nfstypes.NFS3ERR_NOSPC
+			err = quotaErr(op, nfstypes.NFS3ERR_NOSPC)
 			return
 		}
 	}
 	ok := dir.AddName(dip, op, ip.Inum, name)
 	if !ok {
 		nfs.doDecLink(op, ip)
-		err = nfstypes.NFS3ERR_IO
+		err = quotaErr(op, nfstypes.NFS3ERR_IO)
 		return
 	}
 	err = nfstypes.NFS3_OK
-	fh3 = fh.Fh{Ino: ip.Inum, Gen: ip.Gen}.MakeFh3()
-	fattr = ip.MkFattr()
+	fh3 = op.Fh(ip).MakeFh3()
+	fattr = ip.MkFattr(op.Fsid())
 	return
 }
 
 func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
+	return nfs.create(args, nil)
+}
+
+// Serves CREATE for the caller cred (nil if unknown).
+func (nfs *Nfs) create(args nfstypes.CREATE3args, cred *Cred) nfstypes.CREATE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_CREATE, time.Now())
 	var reply nfstypes.CREATE3res
 	util.DPrintf(1, "NFS Create %v\n", args)
@@ -438,7 +599,11 @@ func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 		reply.Status = nfstypes.NFS3ERR_NOTSUPP
 		return reply
 	}
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3REG, nil)
+	if err := creatable(args.Where.Dir, args.Where.Name); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3REG, nil, cred)
 	if err != nfstypes.NFS3_OK {
 		util.DPrintf(1, "Create %v\n", err)
 		errRet(op, &reply.Status, err)
@@ -455,11 +620,20 @@ func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 }
 
 func (nfs *Nfs) NFSPROC3_MKDIR(args nfstypes.MKDIR3args) nfstypes.MKDIR3res {
+	return nfs.mkdir(args, nil)
+}
+
+// Serves MKDIR for the caller cred (nil if unknown).
+func (nfs *Nfs) mkdir(args nfstypes.MKDIR3args, cred *Cred) nfstypes.MKDIR3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_MKDIR, time.Now())
 	var reply nfstypes.MKDIR3res
 
 	util.DPrintf(1, "NFS Mkdir %v\n", args)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR, nil)
+	if err := creatable(args.Where.Dir, args.Where.Name); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR, nil, cred)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -475,11 +649,20 @@ func (nfs *Nfs) NFSPROC3_MKDIR(args nfstypes.MKDIR3args) nfstypes.MKDIR3res {
 }
 
 func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3res {
+	return nfs.symlink(args, nil)
+}
+
+// Serves SYMLINK for the caller cred (nil if unknown).
+func (nfs *Nfs) symlink(args nfstypes.SYMLINK3args, cred *Cred) nfstypes.SYMLINK3res {
 	var reply nfstypes.SYMLINK3res
 	util.DPrintf(1, "NFS SymLink %v\n", args)
 
+	if err := creatable(args.Where.Dir, args.Where.Name); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
 	data := []byte(args.Symlink.Symlink_data)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK, data)
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK, data, cred)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -498,13 +681,13 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 func (nfs *Nfs) NFSPROC3_READLINK(args nfstypes.READLINK3args) nfstypes.READLINK3res {
 	var reply nfstypes.READLINK3res
 	util.DPrintf(1, "NFS ReadLink %v\n", args)
-	op, data, _, err := nfs.doRead(args.Symlink, nfstypes.NF3LNK, uint64(0), uint64(0))
+	op, data, _, touched, err := nfs.doRead(args.Symlink, nfstypes.NF3LNK, uint64(0), uint64(0))
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 	}
 	reply.Resok.Data = nfstypes.Nfspath3(string(data))
-	commitReply(op, &reply.Status)
+	commitRead(op, &reply.Status, touched)
 	return reply
 }
 
@@ -533,11 +716,17 @@ func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bo
 	if isdir && !dir.IsDirEmpty(inodes[0], op) {
 		return op, nfstypes.NFS3ERR_INVAL
 	}
+	// removing must work on a full file system
+	op.Atxn.UseReserved = true
 	ok := dir.RemName(inodes[1], op, name)
 	if !ok {
 		util.DPrintf(0, "Remove failed\n")
 		return op, nfstypes.NFS3ERR_IO
 	}
+	if inodes[0].Kind == nfstypes.NF3DIR {
+		inodes[1].Nlink = inodes[1].Nlink - 1 // for ..
+		inodes[1].WriteInode(op.Atxn)
+	}
 	nfs.doDecLink(op, inodes[0])
 	return op, nfstypes.NFS3_OK
 }
@@ -546,7 +735,11 @@ func (nfs *Nfs) NFSPROC3_REMOVE(args nfstypes.REMOVE3args) nfstypes.REMOVE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_REMOVE, time.Now())
 	var reply nfstypes.REMOVE3res
 	util.DPrintf(1, "NFS Remove %v\n", args)
-	op, err := nfs.doRemove(args.Object.Dir, args.Object.Name, false)
+	if err := writable(args.Object.Dir); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
+	op, err := nfs.remove(args.Object.Dir, args.Object.Name, false)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -559,7 +752,11 @@ func (nfs *Nfs) NFSPROC3_RMDIR(args nfstypes.RMDIR3args) nfstypes.RMDIR3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_RMDIR, time.Now())
 	var reply nfstypes.RMDIR3res
 	util.DPrintf(1, "NFS Rmdir %v\n", args)
-	op, err := nfs.doRemove(args.Object.Dir, args.Object.Name, true)
+	if err := writable(args.Object.Dir); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
+	op, err := nfs.remove(args.Object.Dir, args.Object.Name, true)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -604,6 +801,7 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	var reply nfstypes.RENAME3res
 	var dipto *inode.Inode
 	var dipfrom *inode.Inode
+	var moved *inode.Inode // from, if it is locked
 	var op *fstxn.FsTxn
 	var inodes []*inode.Inode
 	var frominum common.Inum
@@ -611,8 +809,17 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	var success bool = false
 	var done bool = false
 
+	if err := creatable(args.To.Dir, args.To.Name); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
+	if err := writable(args.From.Dir); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
 	for !success {
 		op = fstxn.Begin(nfs.fsstate)
+		moved = nil
 		util.DPrintf(1, "NFS Rename %v\n", args)
 
 		toh := fh.MakeFh(args.To.Dir)
@@ -716,7 +923,34 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 					done = true
 					break
 				}
+				if to.Kind == nfstypes.NF3DIR {
+					dipto.Nlink = dipto.Nlink - 1 // for to's ..
+					dipto.WriteInode(op.Atxn)
+				}
 				nfs.doDecLink(op, to)
+				moved = from
+				success = true
+			} else { // retry
+				op.Abort()
+			}
+		} else if dipto != dipfrom {
+			// a directory that moves gets a new .., so lock from too
+			op.Abort()
+			op = fstxn.Begin(nfs.fsstate)
+			inums := []common.Inum{dipfrom.Inum, dipto.Inum, frominum}
+			inodes = lockInodes(op, inums)
+			if inodes == nil {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+				done = true
+				break
+			}
+			dipfrom = inodes[0]
+			dipto = inodes[1]
+			moved = inodes[2]
+			inum1, _ := dir.LookupName(dipfrom, op, args.From.Name)
+			inum2, _ := dir.LookupName(dipto, op, args.To.Name)
+			if dipfrom.Gen == fromh.Gen && dipto.Gen == toh.Gen &&
+				inum1 == frominum && inum2 == common.NULLINUM {
 				success = true
 			} else { // retry
 				op.Abort()
@@ -735,9 +969,19 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	}
 	ok1 := dir.AddName(dipto, op, frominum, args.To.Name)
 	if !ok1 {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+		errRet(op, &reply.Status, quotaErr(op, nfstypes.NFS3ERR_IO))
 		return reply
 	}
+	if moved != nil && moved.Kind == nfstypes.NF3DIR && dipto != dipfrom {
+		if !dir.WriteEnt(moved, op, dir.DIRENTSZ, dipto.Inum, "..") {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+			return reply
+		}
+		dipfrom.Nlink = dipfrom.Nlink - 1
+		dipfrom.WriteInode(op.Atxn)
+		dipto.Nlink = dipto.Nlink + 1
+		dipto.WriteInode(op.Atxn)
+	}
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -754,6 +998,11 @@ func (nfs *Nfs) NFSPROC3_LINK(args nfstypes.LINK3args) nfstypes.LINK3res {
 func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3res {
 	var reply nfstypes.READDIR3res
 	util.DPrintf(1, "NFS ReadDir %v\n", args)
+	if isSnapDir(args.Dir) {
+		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Reply = nfs.readdirSnap(args.Cookie)
+		return reply
+	}
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.Dir)
 	if ip == nil {
@@ -766,7 +1015,7 @@ func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3re
 	}
 	dirlist := Readdir3(ip, op, args.Cookie, args.Count)
 	reply.Resok.Reply = dirlist
-	commitReply(op, &reply.Status)
+	commitRead(op, &reply.Status, nfs.touchAtime(op, ip))
 	return reply
 }
 
@@ -774,6 +1023,11 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 	defer nfs.recordOp(nfstypes.NFSPROC3_READDIRPLUS, time.Now())
 	var reply nfstypes.READDIRPLUS3res
 	util.DPrintf(1, "NFS ReadDirPlus %v\n", args)
+	if isSnapDir(args.Dir) {
+		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Reply = nfs.readdirplusSnap(args.Cookie)
+		return reply
+	}
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.Dir)
 	if ip == nil {
@@ -786,14 +1040,44 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 	}
 	dirlist := Ls3(ip, op, args.Cookie, args.Dircount, args.Maxcount)
 	reply.Resok.Reply = dirlist
-	commitReply(op, &reply.Status)
+	commitRead(op, &reply.Status, nfs.touchAtime(op, ip))
 	return reply
 }
 
+// FSSTAT reports free space from the allocators' free counts, without
+// scanning the bitmaps.
 func (nfs *Nfs) NFSPROC3_FSSTAT(args nfstypes.FSSTAT3args) nfstypes.FSSTAT3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_FSSTAT, time.Now())
 	var reply nfstypes.FSSTAT3res
 	util.DPrintf(1, "NFS FsStat %v\n", args)
-	reply.Status = nfstypes.NFS3ERR_NOTSUPP
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(liveFsroot(args.Fsroot))
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	super := nfs.fsstate.Super
+	ndata := uint64(super.MaxBnum() - super.DataStart())
+	nfree := nfs.fsstate.Balloc.NumFree()
+	// inodes in the table and in chunks, plus chunks that fit in the
+	// free blocks
+	nchunk := nfs.fsstate.Chunks.NumChunks()
+	ninode := uint64(super.NInode()) - 1 + (nchunk+nfree)*common.INODEBLK
+	ifree := nfs.fsstate.Ialloc.NumFree() + nfs.fsstate.Chunks.NumFree() +
+		nfree*common.INODEBLK
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = ip.MkFattr(op.Fsid())
+	reply.Resok.Tbytes = nfstypes.Size3(ndata * disk.BlockSize)
+	reply.Resok.Fbytes = nfstypes.Size3(nfree * disk.BlockSize)
+	var avail uint64 = 0
+	if nfree > op.Fs.Super.NReserved() {
+		avail = nfree - op.Fs.Super.NReserved()
+	}
+	reply.Resok.Abytes = nfstypes.Size3(avail * disk.BlockSize)
+	reply.Resok.Tfiles = nfstypes.Size3(ninode)
+	reply.Resok.Ffiles = nfstypes.Size3(ifree)
+	reply.Resok.Afiles = reply.Resok.Ffiles
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -801,6 +1085,14 @@ func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 	var reply nfstypes.FSINFO3res
 	util.DPrintf(1, "NFS FsInfo %v\n", args)
 	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(liveFsroot(args.Fsroot))
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	// the attributes carry the fsid, which is derived from the UUID
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = ip.MkFattr(op.Fsid())
 	reply.Resok.Rtmax = 16 * 4096
 	reply.Resok.Rtmult = 4096
 	reply.Resok.Rtpref = reply.Resok.Rtmax
@@ -808,7 +1100,7 @@ func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 	reply.Resok.Wtpref = 16 * 4096
 	reply.Resok.Wtmult = 4096
 	reply.Resok.Dtpref = 16 * 4096
-	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize())
+	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize(nfs.fsstate.Super))
 	reply.Resok.Properties = nfstypes.Uint32(nfstypes.FSF3_HOMOGENEOUS | nfstypes.FSF3_SYMLINK)
 	commitReply(op, &reply.Status)
 	return reply
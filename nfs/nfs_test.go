@@ -1,26 +1,49 @@
 package nfs
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
 
 	"testing"
 
+	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/debugfs"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fsck"
+	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/scrub"
+	"github.com/mit-pdos/go-nfsd/shrinker"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/cryptdisk"
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -151,11 +174,17 @@ func (ts *TestState) ReadLink(fh nfstypes.Nfs_fh3) string {
 }
 
 func (ts *TestState) ReadDirPlus() nfstypes.Dirlistplus3 {
-	reply := ts.clnt.ReadDirPlusOp(fh.MkRootFh3(), inode.NDIRECT*disk.BlockSize)
+	reply := ts.clnt.ReadDirPlusOp(fh.MkRootFh3(), inode.NBLKINO*disk.BlockSize)
 	assert.Equal(ts.t, reply.Status, nfstypes.NFS3_OK)
 	return reply.Resok.Reply
 }
 
+func (ts *TestState) FsStat() nfstypes.FSSTAT3resok {
+	reply := ts.clnt.FsStatOp(fh.MkRootFh3())
+	assert.Equal(ts.t, reply.Status, nfstypes.NFS3_OK)
+	return reply.Resok
+}
+
 func (ts *TestState) Commit(fh nfstypes.Nfs_fh3, cnt uint64) {
 	reply := ts.clnt.CommitOp(fh, cnt)
 	assert.Equal(ts.t, reply.Status, nfstypes.NFS3_OK)
@@ -380,6 +409,30 @@ func TestManyFiles1(t *testing.T) {
 	}
 }
 
+func TestFsStat(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	assert.Greater(ts.t, uint64(st.Tbytes), uint64(st.Fbytes))
+	assert.Greater(ts.t, uint64(st.Tfiles), uint64(st.Ffiles))
+
+	ts.Create("x")
+	st1 := ts.FsStat()
+	assert.Equal(ts.t, st.Ffiles-1, st1.Ffiles)
+
+	fh := ts.Lookup("x", true)
+	data := mkdataval(1, 2*disk.BlockSize)
+	ts.Write(fh, data, nfstypes.FILE_SYNC)
+	st1 = ts.FsStat()
+	assert.Equal(ts.t, uint64(st.Fbytes)-2*disk.BlockSize, uint64(st1.Fbytes))
+
+	ts.Remove("x")
+	st2 := ts.FsStat()
+	assert.Equal(ts.t, st.Fbytes, st2.Fbytes)
+	assert.Equal(ts.t, st.Ffiles, st2.Ffiles)
+}
+
 func TestSymLink(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -391,6 +444,81 @@ func TestSymLink(t *testing.T) {
 	assert.Equal(ts.t, "x", p)
 }
 
+func TestInline(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	free := ts.FsStat().Fbytes
+	target := string(mkdata(inode.InlineSize(ts.clnt.srv.fsstate.Super)))
+	ts.SymLink("l", target)
+	assert.Equal(ts.t, target, ts.ReadLink(ts.Lookup("l", true)))
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	small := mkdataval(1, 50)
+	ts.Write(fhx, small, nfstypes.FILE_SYNC)
+	ts.readcheck(fhx, 0, small)
+	assert.Equal(ts.t, free, ts.FsStat().Fbytes)
+
+	// truncating zeroes the tail
+	ts.Setattr(fhx, 10)
+	ts.Setattr(fhx, 50)
+	ts.readcheck(fhx, 0, append(small[:10:10], make([]byte, 40)...))
+
+	// growing moves the data to blocks
+	ts.Setattr(fhx, 0)
+	ts.Write(fhx, small, nfstypes.FILE_SYNC)
+	big := mkdataval(2, disk.BlockSize)
+	ts.WriteOff(fhx, 50, big, nfstypes.FILE_SYNC)
+	ts.readcheck(fhx, 0, append(small, big...))
+	assert.Equal(ts.t, uint64(free)-2*disk.BlockSize, uint64(ts.FsStat().Fbytes))
+
+	ts.clnt.Shutdown()
+	assert.Empty(ts.t, ts.fsck(false).Problems)
+}
+
+func (ts *TestState) SetAtime(fh nfstypes.Nfs_fh3, atime nfstypes.Nfstime3) {
+	attr := nfstypes.Sattr3{Atime: nfstypes.Set_atime{
+		Set_it: nfstypes.SET_TO_CLIENT_TIME, Atime: atime}}
+	reply := ts.clnt.srv.NFSPROC3_SETATTR(nfstypes.SETATTR3args{Object: fh, New_attributes: attr})
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+}
+
+func TestAtime(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	ts.Write(fhx, mkdata(100), nfstypes.FILE_SYNC)
+	old := nfstypes.Nfstime3{Seconds: 1}
+	ts.SetAtime(fhx, old)
+
+	ts.Read(fhx, 0, 100)
+	assert.Equal(ts.t, old, ts.Getattr(fhx, 100).Atime)
+
+	// relatime updates an atime older than mtime, once
+	srv.Atime = RelAtime
+	ts.Read(fhx, 0, 100)
+	atime := ts.Getattr(fhx, 100).Atime
+	assert.True(ts.t, atime.Seconds > old.Seconds)
+	ts.Read(fhx, 0, 100)
+	assert.Equal(ts.t, atime, ts.Getattr(fhx, 100).Atime)
+
+	ts.SetAtime(fh.MkRootFh3(), old)
+	ts.ReadDirPlus()
+	assert.NotEqual(ts.t, old, ts.GetattrDir(fh.MkRootFh3()).Atime)
+
+	// strictatime updates even an atime in the future
+	future := nfstypes.Nfstime3{Seconds: 4000000000}
+	ts.SetAtime(fhx, future)
+	ts.Read(fhx, 0, 100)
+	assert.Equal(ts.t, future, ts.Getattr(fhx, 100).Atime)
+	srv.Atime = StrictAtime
+	ts.Read(fhx, 0, 100)
+	assert.NotEqual(ts.t, future, ts.Getattr(fhx, 100).Atime)
+}
+
 func TestRename(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -587,7 +715,7 @@ func TestManyHoles(t *testing.T) {
 		fh := ts.Lookup("x", true)
 		for j := 0; j < n; j++ {
 			off := rand.Uint64()
-			off = off % (inode.MaxFileSize() - sz)
+			off = off % (inode.MaxFileSize(ts.clnt.srv.fsstate.Super) - sz)
 			ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
 		}
 		ts.Remove("x")
@@ -613,7 +741,7 @@ func TestClearHole(t *testing.T) {
 		t.Skip("skipping in short mode")
 	}
 
-	const N = inode.NDIRECT + disk.BlockSize/8 + 10
+	N := inode.NDirect(ts.clnt.srv.fsstate.Super) + disk.BlockSize/8 + 10
 
 	sz := uint64(4096)
 	data := mkdataval(byte(1), sz)
@@ -682,7 +810,7 @@ func TestWriteLargeFile(t *testing.T) {
 	defer ts.Close()
 
 	// allocate a double indirect block
-	const N = inode.NDIRECT + disk.BlockSize/8 + 10
+	N := inode.NDirect(ts.clnt.srv.fsstate.Super) + disk.BlockSize/8 + 10
 
 	sz := uint64(4096)
 	x := ts.writeLargeFile("x", N)
@@ -693,6 +821,40 @@ func TestWriteLargeFile(t *testing.T) {
 	ts.Remove("x")
 }
 
+// Write blocks mapped by the triple and quadruple indirect trees
+func TestDeepIndirect(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sz := uint64(4096)
+	nblk := inode.NBLKBLK
+	tind := inode.NDirect(ts.clnt.srv.fsstate.Super) + nblk + nblk*nblk
+	qind := tind + nblk*nblk*nblk
+	bns := []uint64{tind + 1, qind + 1}
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	for i, bn := range bns {
+		ts.WriteOff(x, bn*sz, mkdataval(byte(i+1), sz), nfstypes.FILE_SYNC)
+	}
+	for i, bn := range bns {
+		ts.readcheck(x, bn*sz, mkdataval(byte(i+1), sz))
+	}
+	// writes of several blocks across the ends of the trees
+	ndirect := inode.NDirect(ts.clnt.srv.fsstate.Super)
+	for _, bn := range []uint64{ndirect - 1, ndirect + nblk - 2, tind - 3} {
+		data := mkdata(4 * sz)
+		ts.WriteOff(x, bn*sz, data, nfstypes.FILE_SYNC)
+		ts.readcheck(x, bn*sz, data)
+	}
+	ts.readcheck(x, bns[0]*sz, mkdataval(1, sz))
+	ts.Getattr(x, (qind+2)*sz)
+	ts.Setattr(x, qind*sz)
+	ts.readcheck(x, bns[0]*sz, mkdataval(1, sz))
+	ts.ReadEof(x, qind*sz, sz)
+	ts.Remove("x")
+}
+
 func TestBigWrite(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -734,6 +896,68 @@ func TestBigUnlink(t *testing.T) {
 	}
 }
 
+func TestShrinkMany(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	const N = 10
+	for i := 0; i < N; i++ {
+		// too large to shrink in the remove's transaction
+		ts.writeLargeFile("f"+strconv.Itoa(i), jrnl.LogBlocks+10)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			ts.Remove("f" + strconv.Itoa(i))
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	sst := ts.clnt.srv.shrinkst.Stats()
+	assert.LessOrEqual(ts.t, sst.Active, shrinker.NWORKER)
+	ts.clnt.srv.shrinkst.Shutdown()
+	sst = ts.clnt.srv.shrinkst.Stats()
+	assert.Equal(ts.t, uint64(N), sst.Done)
+	assert.Equal(ts.t, uint64(0), sst.Failed)
+	assert.Equal(ts.t, uint64(0), sst.PendingBytes)
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+}
+
+func TestJukebox(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	srv.Jukebox = true
+	fhx := ts.writeLargeFile("x", 100)
+	ts.writeLargeFile("y", 100)
+	ts.Remove("y")
+
+	// leave x and y's inode shrinking, as after a crash
+	op := fstxn.Begin(srv.fsstate)
+	for _, inum := range []common.Inum{fh.MakeFh(fhx).Ino, fh.MakeFh(fhx).Ino + 1} {
+		ip := op.GetInodeInumFree(inum)
+		ip.ShrinkSize = 100
+		ip.Size = 0
+		ip.WriteInode(op.Atxn)
+	}
+	require.True(ts.t, op.Commit())
+
+	data := mkdataval(1, disk.BlockSize)
+	reply := ts.clnt.WriteOp(fhx, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_JUKEBOX, reply.Status)
+	attr := ts.clnt.CreateOp(fh.MkRootFh3(), "z")
+	assert.Equal(ts.t, nfstypes.NFS3ERR_JUKEBOX, attr.Status)
+
+	// the client retries after the shrinker is done
+	srv.shrinkst.Shutdown()
+	assert.Equal(ts.t, uint64(2), srv.shrinkst.Stats().Done)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.Create("z")
+}
+
 func (ts *TestState) maketoolargefile(name string, wsize int) uint64 {
 	ts.Create(name)
 	sz := uint64(4096 * wsize)
@@ -753,6 +977,43 @@ func (ts *TestState) maketoolargefile(name string, wsize int) uint64 {
 	return i
 }
 
+func TestReserved(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	sb, err := Mkfs(d, super.MkfsOpts{ReservedPct: 10})
+	require.NoError(t, err)
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+	defer ts.Close()
+
+	st := ts.FsStat()
+	ts.writeLargeFile("x", 10)
+	ts.maketoolargefile("big", 50)
+	// ordinary writes stop at the reserved blocks
+	st1 := ts.FsStat()
+	assert.Equal(ts.t, uint64(0), uint64(st1.Abytes))
+	assert.GreaterOrEqual(ts.t, uint64(st1.Fbytes), sb.NReserved*disk.BlockSize)
+	// root may write into them
+	fhx := ts.Lookup("x", true)
+	reply := srv.write(nfstypes.WRITE3args{File: fhx, Offset: nfstypes.Offset3(10 * disk.BlockSize),
+		Count: nfstypes.Count3(disk.BlockSize), Stable: nfstypes.FILE_SYNC, Data: mkdata(disk.BlockSize)},
+		&Cred{})
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+	assert.Less(ts.t, uint64(ts.FsStat().Fbytes), uint64(st1.Fbytes))
+	// but truncating and removing may use them
+	ts.Setattr(ts.Lookup("big", true), disk.BlockSize)
+	ts.Remove("x")
+	ts.Remove("big")
+	srv.shrinkst.Shutdown()
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+
+	require.NoError(ts.t, srv.SetReserved(0))
+	st2 := ts.FsStat()
+	assert.Equal(ts.t, st2.Fbytes, st2.Abytes)
+	assert.Error(ts.t, srv.SetReserved(DISKSZ))
+}
+
 func TestTooLargeFile(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -772,23 +1033,33 @@ func TestInodeExhaust(t *testing.T) {
 	ts := newTestDiskOrMem(t, true)
 	defer ts.Close()
 
-	for j := 0; j < 4; j++ {
-		i := 0
-		for ; ; i++ {
+	// the inode table fills up, but inodes are then allocated from
+	// chunks in the data area
+	ninode := uint64(ts.clnt.srv.fsstate.Super.NInode())
+	n := int(ninode - 2 + 2*common.INODEBLK)
+	for j := 0; j < 2; j++ {
+		var last nfstypes.Nfs_fh3
+		for i := 0; i < n; i++ {
 			s := strconv.Itoa(i)
-			n := "x" + s
-			reply := ts.clnt.CreateOp(fh.MkRootFh3(), n)
-			if reply.Status != nfstypes.NFS3_OK {
-				break
-			}
+			reply := ts.clnt.CreateOp(fh.MkRootFh3(), "x"+s)
+			assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+			last = reply.Resok.Obj.Handle
 		}
-		assert.GreaterOrEqual(ts.t, uint64(i), common.NBITBLOCK*common.NINODEBITMAP-2)
-		i--
-		for ; i >= 0; i-- {
+		assert.GreaterOrEqual(ts.t, uint64(fh.MakeFh(last).Ino), ninode)
+		data := mkdataval(byte(j), 100)
+		ts.Write(last, data, nfstypes.FILE_SYNC)
+		for i := n - 2; i >= 0; i-- {
 			s := strconv.Itoa(i)
-			n := "x" + s
-			ts.Remove(n)
+			ts.Remove("x" + s)
 		}
+
+		// chunk inodes survive a restart
+		ts.clnt.Shutdown()
+		d := ts.clnt.srv.fsstate.Super.Disk
+		ts.clnt.srv = MakeNfs(d)
+		ts.readcheck(last, 0, data)
+		assert.Equal(ts.t, uint64(2), ts.clnt.srv.fsstate.Chunks.NumChunks())
+		ts.Remove("x" + strconv.Itoa(n-1))
 	}
 }
 
@@ -805,6 +1076,813 @@ func TestRestartPersist(t *testing.T) {
 	ts.Lookup("y", true)
 }
 
+func TestSuperblock(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sb := ts.clnt.srv.Superblock()
+	assert.Equal(ts.t, super.MAGIC, sb.Magic)
+	assert.Equal(ts.t, DISKSZ, sb.Size)
+	// MakeNfs reserves as much as go-nfsd-mkfs does by default
+	assert.Equal(ts.t, (sb.Size-sb.DataStart())*super.RESERVEDPCT/100, sb.NReserved)
+	fsid := ts.clnt.srv.fsstate.Super.Fsid()
+	assert.NotEqual(ts.t, uint64(0), fsid)
+	attr := ts.GetattrDir(fh.MkRootFh3())
+	assert.Equal(ts.t, nfstypes.Uint64(fsid), attr.Fsid)
+
+	ts.Create("x")
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	srv, err := MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	ts.Lookup("x", true)
+	sb1 := srv.Superblock()
+	assert.Equal(ts.t, sb.UUID, sb1.UUID)
+	assert.Equal(ts.t, sb.Ctime, sb1.Ctime)
+	assert.GreaterOrEqual(ts.t, sb1.Mtime, sb.Mtime)
+
+	// a blank disk isn't formatted by MountNfs
+	blank := disk.NewMemDisk(DISKSZ)
+	_, err = MountNfs(blank)
+	assert.Equal(ts.t, super.ErrBlank, err)
+
+	// random data isn't formatted or mounted
+	junk := disk.NewMemDisk(DISKSZ)
+	junk.Write(common.LOGSIZE, mkdataval(0x5a, disk.BlockSize))
+	_, err = MountNfs(junk)
+	assert.Equal(ts.t, super.ErrMagic, err)
+	assert.Panics(ts.t, func() { MakeNfs(junk) })
+
+	// data that starts like a legacy block bitmap is mounted as legacy
+	// only when asked, and only if its log and root inode check out
+	junk.Write(common.LOGSIZE, mkdataval(0xff, disk.BlockSize))
+	_, err = MountNfs(junk)
+	assert.Equal(ts.t, super.ErrMagic, err)
+	_, err = MountLegacy(junk)
+	assert.Error(ts.t, err)
+	_, err = MountLegacy(d)
+	assert.Error(ts.t, err)
+
+	// a corrupted superblock is detected
+	corrupt := disk.NewMemDisk(DISKSZ)
+	blk := d.Read(common.LOGSIZE)
+	blk[20]++
+	corrupt.Write(common.LOGSIZE, blk)
+	_, err = MountNfs(corrupt)
+	assert.Equal(ts.t, super.ErrChecksum, err)
+}
+
+func TestMkfs(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	opts := super.MkfsOpts{NInode: 100, ReservedPct: 10, Label: "scratch"}
+	sb, err := Mkfs(d, opts)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), sb.NInodeBlk)
+	assert.Equal(t, "scratch", sb.LabelString())
+	assert.Equal(t, (DISKSZ-sb.DataStart())/10, sb.NReserved)
+
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+	defer ts.Close()
+	assert.Equal(ts.t, sb.UUID, srv.Superblock().UUID)
+	assert.Equal(ts.t, "scratch", srv.Superblock().LabelString())
+
+	st := ts.FsStat()
+	assert.Equal(ts.t, uint64(st.Fbytes)-sb.NReserved*disk.BlockSize, uint64(st.Abytes))
+
+	// the inode table is small, but inodes come from chunks too
+	for i := 0; i < 200; i++ {
+		ts.Create("f" + strconv.Itoa(i))
+	}
+	assert.Equal(ts.t, uint64(3), srv.fsstate.Chunks.NumChunks())
+	for i := 0; i < 200; i++ {
+		ts.Remove("f" + strconv.Itoa(i))
+	}
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	ts.Write(fh, mkdataval(0x5a, 4*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.clnt.Shutdown()
+
+	// formatting over a file system yields an empty one, whose blocks
+	// don't show the old data
+	_, err = Mkfs(d, opts)
+	require.NoError(t, err)
+	srv, err = MountNfs(d)
+	require.NoError(t, err)
+	ts.clnt.srv = srv
+	ts.Lookup("x", false)
+	assert.Equal(ts.t, uint64(0), srv.fsstate.Chunks.NumChunks())
+	ts.Create("y")
+	fh = ts.Lookup("y", true)
+	ts.WriteOff(fh, disk.BlockSize-1, []byte{1}, nfstypes.FILE_SYNC)
+	data := make([]byte, disk.BlockSize)
+	data[disk.BlockSize-1] = 1
+	ts.readcheck(fh, 0, data)
+
+	_, err = Mkfs(disk.NewMemDisk(DISKSZ), super.MkfsOpts{Label: strings.Repeat("x", 33)})
+	assert.Error(ts.t, err)
+	_, err = Mkfs(disk.NewMemDisk(DISKSZ), super.MkfsOpts{ReservedPct: 100})
+	assert.Error(ts.t, err)
+	_, err = Mkfs(disk.NewMemDisk(DISKSZ), super.MkfsOpts{Size: DISKSZ + 1})
+	assert.Error(ts.t, err)
+}
+
+// Makes a file system on d the way go-nfsd did before superblocks,
+// but for the root directory's entries (see makeRootDir).
+func mkfsLegacy(d disk.Disk) {
+	sup := super.MkFsSuper(d)
+	writeBitmap(d, sup.BitmapBlockStart(), sup.NBlockBitmap,
+		uint64(sup.DataStart()), sup.Size)
+	writeBitmap(d, sup.BitmapInodeStart(), sup.NInodeBitmap,
+		uint64(common.ROOTINUM)+1, uint64(sup.NInode()))
+	root := inode.MkRootInode(sup)
+	buf.MkBuf(sup.Inum2Addr(common.ROOTINUM), common.INODESZ*8, root.Encode()).WriteDirect(d)
+}
+
+// Returns slot i of the blks array of inode inum, as on disk.
+func (ts *TestState) rawBlk(inum common.Inum, i uint64) common.Bnum {
+	sup := ts.clnt.srv.fsstate.Super
+	a := sup.Inum2Addr(inum)
+	blk := sup.Disk.Read(uint64(a.Blkno))
+	off := a.Off/8 + 48 + i*8
+	return common.Bnum(marshal.NewDec(blk[off : off+8]).GetInt())
+}
+
+func TestLegacy(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	mkfsLegacy(d)
+	_, err := MountNfs(d)
+	assert.Equal(t, super.ErrMagic, err)
+	srv, err := MountLegacy(d)
+	require.NoError(t, err)
+	srv.makeRootDir()
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+	defer ts.Close()
+	assert.Nil(ts.t, srv.Superblock())
+	nfree := ts.FsStat().Fbytes
+
+	// 8 direct blocks, then the single indirect tree
+	const N = 9
+	data := mkdata(N * disk.BlockSize)
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.Create("s")
+	fhs := ts.Lookup("s", true)
+	ts.Write(fhs, []byte("small"), nfstypes.FILE_SYNC)
+	ts.clnt.Shutdown()
+
+	srv, err = MountLegacy(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	ts.readcheck(fhx, 0, data)
+	assert.Equal(ts.t, []byte("small"), ts.Read(fhs, 0, 5))
+	inum := fh.MakeFh(fhx).Ino
+	bn := ts.rawBlk(inum, 7)
+	require.NotEqual(ts.t, common.NULLBNUM, bn)
+	assert.Equal(ts.t, data[7*disk.BlockSize:8*disk.BlockSize], []byte(d.Read(uint64(bn))))
+	assert.NotEqual(ts.t, common.NULLBNUM, ts.rawBlk(inum, 8))
+	assert.Equal(ts.t, common.NULLBNUM, ts.rawBlk(inum, 9))
+	// nothing is inline
+	assert.NotEqual(ts.t, common.NULLBNUM, ts.rawBlk(fh.MakeFh(fhs).Ino, 0))
+
+	ts.Setattr(fhx, 0)
+	ts.Remove("s")
+	assert.Equal(ts.t, nfree, ts.FsStat().Fbytes)
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err = MountLegacy(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+func TestFsckDup(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	data := mkdata(2 * disk.BlockSize)
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.Create("y")
+	fhy := ts.Lookup("y", true)
+	ts.Write(fhy, data, nfstypes.FILE_SYNC)
+
+	// point y's first block at x's
+	srv := ts.clnt.srv
+	xinum := fh.MakeFh(fhx).Ino
+	yinum := fh.MakeFh(fhy).Ino
+	const blk0 = 56 // blks[0], after the owner
+	op := fstxn.Begin(srv.fsstate)
+	bn := binary.LittleEndian.Uint64(op.GetInodeInumFree(xinum).Encode()[blk0 : blk0+8])
+	enc := op.GetInodeInumFree(yinum).Encode()
+	binary.LittleEndian.PutUint64(enc[blk0:blk0+8], bn)
+	b := buf.MkBuf(srv.fsstate.Super.Inum2Addr(yinum), common.INODESZ*8, enc)
+	inode.Decode(srv.fsstate.Super, b, yinum).WriteInode(op.Atxn)
+	require.True(ts.t, op.Commit())
+	ts.clnt.Shutdown()
+
+	rep := ts.fsck(false)
+	var found = false
+	for _, p := range rep.Problems {
+		if p.Kind == fsck.DupBlock {
+			found = true
+			assert.Equal(ts.t, yinum, p.Inum)
+			assert.Equal(ts.t, fmt.Sprintf("block %d is also used by inode %d", bn, xinum), p.Msg)
+		}
+	}
+	assert.True(ts.t, found)
+	srv, err := MountNfs(srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+// Check the file system on the disk of ts, which must be shut down.
+func (ts *TestState) fsck(repair bool) *fsck.Report {
+	sup := ts.clnt.srv.fsstate.Super
+	rep, err := fsck.Check(sup.Disk, repair, sup.Sb == nil)
+	require.NoError(ts.t, err)
+	for _, p := range rep.Problems {
+		fmt.Printf("%v\n", p)
+	}
+	return rep
+}
+
+// Returns the link count of inode fh3.
+func (ts *TestState) nlink(fh3 nfstypes.Nfs_fh3) uint32 {
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	defer op.Abort()
+	return op.GetInodeFh(fh3).Nlink
+}
+
+// A directory's ".." counts as a link of its parent.
+func TestDirNlink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	n := ts.nlink(root)
+	ts.MkDir("a")
+	ts.MkDir("b")
+	assert.Equal(ts.t, n+2, ts.nlink(root))
+	fha := ts.Lookup("a", true)
+	fhb := ts.Lookup("b", true)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.MkDirOp(fha, "d").Status)
+	assert.Equal(ts.t, uint32(2), ts.nlink(fha))
+
+	// moving d from a to b moves the link, and d's ".."
+	ts.RenameFhs(fha, "d", fhb, "d")
+	assert.Equal(ts.t, uint32(1), ts.nlink(fha))
+	assert.Equal(ts.t, uint32(2), ts.nlink(fhb))
+	fhd := ts.LookupFh(fhb, "d")
+	assert.Equal(ts.t, fh.MakeFh(fhb).Ino, fh.MakeFh(ts.LookupFh(fhd, "..")).Ino)
+
+	// replacing a directory drops the link of the replaced one
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.MkDirOp(fha, "e").Status)
+	ts.RenameFhs(fha, "e", fhb, "d")
+	assert.Equal(ts.t, uint32(1), ts.nlink(fha))
+	assert.Equal(ts.t, uint32(2), ts.nlink(fhb))
+
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RmDirOp(fhb, "d").Status)
+	assert.Equal(ts.t, uint32(1), ts.nlink(fhb))
+	ts.RmDir("a", nfstypes.NFS3_OK)
+	ts.RmDir("b", nfstypes.NFS3_OK)
+	assert.Equal(ts.t, n, ts.nlink(root))
+
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err := MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+func TestFsck(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("a")
+	ts.MkDir("b")
+	fha := ts.Lookup("a", true)
+	fhb := ts.Lookup("b", true)
+	attr := ts.clnt.MkDirOp(fha, "c")
+	assert.Equal(ts.t, nfstypes.NFS3_OK, attr.Status)
+	ts.CreateFh(fha, "x")
+	fhx := ts.LookupFh(fha, "x")
+	ts.Write(fhx, mkdata(10*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.RenameFhs(fha, "c", fhb, "c") // moves ..
+	ts.RenameFhs(fha, "x", fhb, "y")
+	ts.MkDir("d")
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	ts.MkDir("e")
+	attr = ts.clnt.MkDirOp(fhb, "e")
+	assert.Equal(ts.t, nfstypes.NFS3_OK, attr.Status)
+	ts.RenameFhs(fhb, "e", fh.MkRootFh3(), "e") // replaces e
+	attr = ts.clnt.MkDirOp(fhb, "f")
+	assert.Equal(ts.t, nfstypes.NFS3_OK, attr.Status)
+	ts.clnt.Shutdown()
+
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	assert.Equal(ts.t, uint64(6), rep.Dirs) // root a b c e f
+
+	// corrupt the file system: drop b's name, have a file finish a
+	// truncation after a crash, and lose a bitmap bit
+	srv, err := MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	srv.WaitScavenger() // so that it won't finish y's truncation
+	ts.clnt.srv = srv
+	fhy := ts.LookupFh(fhb, "y")
+	op := fstxn.Begin(srv.fsstate)
+	root := op.GetInodeInumFree(common.ROOTINUM)
+	binum, off := dir.LookupName(root, op, "b")
+	dir.WriteEnt(root, op, off, common.NULLINUM, "")
+	ip := op.GetInodeInumFree(fh.MakeFh(fhy).Ino)
+	ip.Size = disk.BlockSize
+	ip.ShrinkSize = 10
+	ip.WriteInode(op.Atxn)
+	op.Atxn.WriteBits([]uint64{uint64(binum)}, uint64(srv.fsstate.Super.BitmapInodeStart()), false)
+	require.True(ts.t, op.Commit())
+	ts.clnt.Shutdown()
+
+	rep = ts.fsck(true)
+	kinds := make(map[string]bool)
+	for _, p := range rep.Problems {
+		kinds[p.Kind] = true
+		assert.True(ts.t, p.Fixed, "%v", p)
+	}
+	assert.True(ts.t, kinds[fsck.Orphan])
+	assert.True(ts.t, kinds[fsck.Shrinking])
+	assert.True(ts.t, kinds[fsck.InodeBitmap])
+	assert.True(ts.t, kinds[fsck.Nlink]) // root lost b's ..
+
+	rep = ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+
+	srv, err = MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	fhlf := ts.Lookup(fsck.LOSTFOUND, true)
+	fhb1 := ts.LookupFh(fhlf, "#"+strconv.FormatUint(uint64(binum), 10))
+	assert.Equal(ts.t, fhb, fhb1)
+	ts.LookupFh(fhb, "c")
+	fhy = ts.LookupFh(fhb, "y")
+	ts.readcheck(fhy, 0, mkdata(10 * disk.BlockSize)[:disk.BlockSize])
+}
+
+func TestChecksum(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	data := mkdata(2 * disk.BlockSize)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	im, err := debugfs.Open(d, false)
+	require.NoError(ts.t, err)
+	ip, err := im.Lookup("x")
+	require.NoError(ts.t, err)
+	var bn common.Bnum
+	im.Blocks(ip, func(ref inode.BlockRef) {
+		if ref.Lbn == 1 {
+			bn = ref.Bn
+		}
+	})
+	im.Close()
+	blk := d.Read(uint64(bn))
+	blk[100] ^= 0xff
+	d.Write(uint64(bn), blk)
+
+	srv, err := MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	ts.readcheck(fhx, 0, data[:disk.BlockSize])
+	reply := ts.clnt.ReadOp(fhx, disk.BlockSize, disk.BlockSize)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, reply.Status)
+	st := srv.fsstate.Csums.Stats()
+	assert.Equal(ts.t, uint64(2), st.Verified)
+	assert.Equal(ts.t, uint64(1), st.Bad)
+
+	// writing part of the block doesn't checksum the corruption as good
+	wreply := ts.clnt.WriteOp(fhx, disk.BlockSize+10, data[:10], nfstypes.FILE_SYNC)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, wreply.Status)
+	reply = ts.clnt.ReadOp(fhx, disk.BlockSize, disk.BlockSize)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, reply.Status)
+
+	// rewriting the block fixes it
+	ts.WriteOff(fhx, disk.BlockSize, data[disk.BlockSize:], nfstypes.FILE_SYNC)
+	ts.readcheck(fhx, 0, data)
+}
+
+func TestChecksumDir(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("d")
+	fhd := ts.Lookup("d", true)
+	ts.CreateFh(fhd, "f")
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	im, err := debugfs.Open(d, false)
+	require.NoError(ts.t, err)
+	ip, err := im.Lookup("d")
+	require.NoError(ts.t, err)
+	var bn common.Bnum
+	im.Blocks(ip, func(ref inode.BlockRef) {
+		bn = ref.Bn
+	})
+	im.Close()
+	blk := d.Read(uint64(bn))
+	blk[2*dir.DIRENTSZ+20] ^= 0xff
+	d.Write(uint64(bn), blk)
+
+	srv, err := MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, ts.clnt.LookupOp(fhd, "f").Status)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, ts.clnt.ReadDirPlusOp(fhd, 4096).Status)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, ts.clnt.CreateOp(fhd, "g").Status)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_IO, ts.clnt.RemoveOp(fhd, "f").Status)
+	ts.RmDir("d", nfstypes.NFS3ERR_IO)
+	// nothing changed
+	ts.Lookup("d", true)
+}
+
+func problemKinds(problems []*fsck.Problem) []string {
+	kinds := make([]string, 0)
+	for _, p := range problems {
+		kinds = append(kinds, p.Kind)
+	}
+	return kinds
+}
+
+func TestScrub(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("a")
+	fha := ts.Lookup("a", true)
+	ts.CreateFh(fha, "x")
+	fhx := ts.LookupFh(fha, "x")
+	ts.Write(fhx, mkdata(2*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.Create("y")
+	fhy := ts.Lookup("y", true)
+	// enough blocks to take several batches
+	ts.Write(fhy, mkdata((3*scrub.BATCH+inode.NDirect(ts.clnt.srv.fsstate.Super))*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.clnt.srv.WaitScavenger()
+
+	srv := ts.clnt.srv
+	srv.StartScrub(100000)
+	srv.WaitScrub() // may have started before the scavenger finished
+	st := srv.WaitScrub()
+	assert.True(ts.t, st.Running)
+	assert.Equal(ts.t, 0, len(st.Last), "%v", st.Last)
+
+	// names and blocks that change during the passes neither show up
+	// as problems nor keep the link checks from running
+	done := make(chan bool)
+	churned := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(churned)
+				return
+			default:
+			}
+			ts.Create("c")
+			ts.Write(ts.Lookup("c", true), mkdata(disk.BlockSize), nfstypes.FILE_SYNC)
+			ts.Rename("c", "d")
+			ts.Remove("d")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// a wrong link count, and a block that doesn't match its checksum
+	op := fstxn.Begin(srv.fsstate)
+	ip := op.GetInodeInum(fh.MakeFh(fhx).Ino)
+	ip.Nlink++
+	ip.WriteInode(op.Atxn)
+	ip.Blocks(func(bn common.Bnum) []byte {
+		return op.Atxn.ReadBlock(bn).Data
+	}, func(ref inode.BlockRef) bool {
+		if ref.Lbn == 1 {
+			op.Atxn.SetCsum(ref.Bn, make([]byte, disk.BlockSize))
+		}
+		return true
+	})
+	ok := op.Commit()
+	assert.True(ts.t, ok)
+
+	srv.WaitScrub() // may have started before the change
+	st = srv.WaitScrub()
+	close(done)
+	<-churned
+	assert.ElementsMatch(ts.t, []string{fsck.Nlink, scrub.Checksum}, problemKinds(st.Last))
+	assert.Less(ts.t, st.Skipped, st.Passes)
+
+	srv.SetScrubRate(1)
+	assert.Equal(ts.t, uint64(1), srv.ScrubStats().Rate)
+	srv.StopScrub()
+	assert.False(ts.t, srv.ScrubStats().Running)
+}
+
+func TestEncrypted(t *testing.T) {
+	checkFlags()
+	raw := disk.NewMemDisk(DISKSZ)
+	key := mkdataval(1, 64)
+	d, err := cryptdisk.Format(raw, key)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: MakeNfs(d)}}
+	defer ts.Close()
+
+	ts.Create("secret-name")
+	fhx := ts.Lookup("secret-name", true)
+	data := []byte(strings.Repeat("plaintext!", 1000))
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.clnt.Crash()
+
+	for a := uint64(0); a < raw.Size(); a++ {
+		blk := raw.Read(a)
+		assert.False(ts.t, bytes.Contains(blk, []byte("secret-name")), "name in block %d", a)
+		assert.False(ts.t, bytes.Contains(blk, []byte("plaintext!")), "data in block %d", a)
+	}
+
+	_, err = cryptdisk.Open(raw, mkdataval(2, 64))
+	assert.Equal(ts.t, cryptdisk.ErrWrongKey, err)
+	_, err = cryptdisk.Wrap(raw, nil)
+	assert.Equal(ts.t, cryptdisk.ErrNeedKey, err)
+
+	// recovery runs on top of the encryption
+	d, err = cryptdisk.Open(raw, key)
+	require.NoError(ts.t, err)
+	srv, err := MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	fhx = ts.Lookup("secret-name", true)
+	ts.readcheck(fhx, 0, data)
+}
+
+func TestGrowEncrypted(t *testing.T) {
+	checkFlags()
+	path := filepath.Join(t.TempDir(), "crypt.img")
+	raw, err := diskfile.Create(path, DISKSZ/2)
+	require.NoError(t, err)
+	d, err := cryptdisk.Format(raw, mkdataval(1, 64))
+	require.NoError(t, err)
+	defer d.Close()
+	_, err = Mkfs(d, super.MkfsOpts{MaxSize: DISKSZ})
+	require.NoError(t, err)
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+
+	// the image grows by the header too
+	n, err := srv.Grow(DISKSZ)
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, DISKSZ, n)
+	assert.Equal(ts.t, DISKSZ, d.Size())
+	assert.Equal(ts.t, DISKSZ+1, raw.Size())
+	ts.writeLargeFile("x", DISKSZ/2)
+	ts.clnt.Shutdown()
+
+	rep, err := fsck.Check(d, false, false)
+	require.NoError(ts.t, err)
+	assert.Empty(ts.t, rep.Problems)
+}
+
+// Returns the bytes that the file at path takes on disk.
+func diskUsage(t *testing.T, path string) uint64 {
+	var st syscall.Stat_t
+	err := syscall.Stat(path, &st)
+	require.NoError(t, err)
+	return uint64(st.Blocks) * 512
+}
+
+func TestDiscard(t *testing.T) {
+	checkFlags()
+	path := filepath.Join(t.TempDir(), "discard.img")
+	d, err := diskfile.Create(path, DISKSZ)
+	require.NoError(t, err)
+	defer d.Close()
+	ts := &TestState{t: t, clnt: &NfsClient{srv: MakeNfs(d)}}
+
+	sz := uint64(2000 * disk.BlockSize)
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	for off := uint64(0); off < sz; off += 100 * disk.BlockSize {
+		ts.WriteOff(fhx, off, mkdata(100*disk.BlockSize), nfstypes.FILE_SYNC)
+	}
+	ts.clnt.Shutdown()
+	before := diskUsage(t, path)
+
+	ts.clnt.srv, err = MountNfs(d)
+	require.NoError(t, err)
+	ts.Remove("x")
+	ts.clnt.Shutdown() // waits for the shrinker
+	st := ts.clnt.srv.fsstate.Discards.Stats()
+	assert.True(t, st.Discarded >= 2000, "%+v", st)
+	assert.Equal(t, uint64(0), st.Failed)
+	assert.Equal(t, uint64(0), st.Pending)
+	after := diskUsage(t, path)
+	assert.True(t, after+sz/2 < before, "%d bytes before, %d after", before, after)
+
+	// the freed blocks can be reused
+	ts.clnt.srv, err = MountNfs(d)
+	require.NoError(t, err)
+	ts.Create("y")
+	fhy := ts.Lookup("y", true)
+	for off := uint64(0); off < sz; off += 100 * disk.BlockSize {
+		ts.WriteOff(fhy, off, mkdata(100*disk.BlockSize), nfstypes.FILE_SYNC)
+	}
+	ts.readcheck(fhy, 0, mkdata(100*disk.BlockSize))
+	ts.clnt.Shutdown()
+}
+
+func TestDebugfs(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("a")
+	fha := ts.Lookup("a", true)
+	ts.CreateFh(fha, "x")
+	fhx := ts.LookupFh(fha, "x")
+	ts.Write(fhx, mkdata(10*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.clnt.Shutdown()
+
+	im, err := debugfs.Open(ts.clnt.srv.fsstate.Super.Disk, false)
+	require.NoError(ts.t, err)
+	defer im.Close()
+
+	dip, err := im.Lookup("/a")
+	require.NoError(ts.t, err)
+	ents, err := im.ReadDir(dip)
+	require.NoError(ts.t, err)
+	names := make([]string, 0)
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	assert.Equal(ts.t, []string{".", "..", "x"}, names)
+
+	ip, err := im.Lookup("a/x")
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, fh.MakeFh(fhx).Ino, ip.Inum)
+	alloc, err := im.InodeAllocated(ip.Inum)
+	require.NoError(ts.t, err)
+	assert.True(ts.t, alloc)
+	_, err = im.Lookup("a/y")
+	assert.Error(ts.t, err)
+
+	refs := make([]inode.BlockRef, 0)
+	im.Blocks(ip, func(ref inode.BlockRef) {
+		refs = append(refs, ref)
+	})
+	assert.Equal(ts.t, 11, len(refs)) // 10 data blocks and an index block
+	bns := []common.Bnum{refs[len(refs)-1].Bn, im.Sup.InodeStart() - 1}
+	owners := im.Owners(bns)
+	assert.Equal(ts.t, ip.Inum, owners[0].Inum)
+	assert.Equal(ts.t, uint64(9), owners[0].Ref.Lbn)
+	assert.NotEmpty(ts.t, owners[1].Region)
+	set, err := im.BlockAllocated(bns[0])
+	require.NoError(ts.t, err)
+	assert.True(ts.t, set)
+}
+
+func TestImportExport(t *testing.T) {
+	checkFlags()
+	src := t.TempDir()
+	want := make(map[string]string)
+	write := func(name string, data []byte) {
+		require.NoError(t, os.WriteFile(filepath.Join(src, name), data, 0644))
+		want[name] = string(data)
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "a", "b"), 0755))
+	for i := 0; i < 200; i++ {
+		write("a/f"+strconv.Itoa(i), []byte(strconv.Itoa(i)))
+	}
+	write("a/b/big", mkdata(700*disk.BlockSize+10)) // spans transactions
+	require.NoError(t, os.Symlink("../f1", filepath.Join(src, "a", "b", "link")))
+	want["a/b/link"] = "../f1"
+
+	d := disk.NewMemDisk(DISKSZ)
+	_, err := Mkfs(d, super.MkfsOpts{NInode: 100}) // needs inode chunks
+	require.NoError(t, err)
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	st, err := srv.Import(src, "/")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(201), st.Files)
+	assert.Equal(t, uint64(2), st.Dirs)
+	assert.Equal(t, uint64(1), st.Symlinks)
+	assert.Less(t, st.Txns, uint64(20))
+	_, err = srv.Import(src, "/") // same names again
+	assert.Error(t, err)
+
+	var b strings.Builder
+	require.NoError(t, srv.Export("/", &b))
+	srv.ShutdownNfs()
+
+	got := make(map[string]string)
+	tr := tar.NewReader(strings.NewReader(b.String()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			got[hdr.Name] = string(data)
+		case tar.TypeSymlink:
+			got[hdr.Name] = hdr.Linkname
+		}
+	}
+	assert.Equal(t, want, got)
+
+	rep, err := fsck.Check(d, false, false)
+	require.NoError(t, err)
+	assert.Empty(t, rep.Problems)
+}
+
+func TestGrow(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	sb, err := Mkfs(d, super.MkfsOpts{Size: DISKSZ/2 + 3, MaxSize: DISKSZ, ReservedPct: 5})
+	require.NoError(t, err)
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+	defer ts.Close()
+
+	st := ts.FsStat()
+	_, err = srv.Grow(DISKSZ + 1) // beyond the disk
+	assert.Error(ts.t, err)
+	_, err = srv.Grow(sb.Size) // not larger
+	assert.Error(ts.t, err)
+	n, err := srv.Grow(0)
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, DISKSZ, n)
+	assert.Equal(ts.t, DISKSZ, srv.Superblock().Size)
+	assert.Greater(ts.t, srv.Superblock().NReserved, sb.NReserved)
+
+	st1 := ts.FsStat()
+	grown := uint64((DISKSZ - sb.Size) * disk.BlockSize)
+	assert.Equal(ts.t, uint64(st.Tbytes)+grown, uint64(st1.Tbytes))
+	assert.Equal(ts.t, uint64(st.Fbytes)+grown, uint64(st1.Fbytes))
+
+	// more than fit before growing
+	ts.writeLargeFile("x", uint64(st.Fbytes)/disk.BlockSize+100)
+	ts.clnt.Shutdown()
+	rep, err := fsck.Check(d, false, false)
+	require.NoError(ts.t, err)
+	assert.Empty(ts.t, rep.Problems)
+
+	// the new size is in the superblock
+	srv, err = MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	assert.Equal(ts.t, DISKSZ, srv.Superblock().Size)
+	n, maxSize := srv.GrowLimit()
+	assert.Equal(ts.t, DISKSZ, n)
+	assert.GreaterOrEqual(ts.t, maxSize, DISKSZ)
+	_, err = srv.Grow(maxSize + 1)
+	assert.Error(ts.t, err)
+	ts.clnt.Shutdown()
+
+	// by default, there is room to grow without -max-size
+	d = disk.NewMemDisk(DISKSZ)
+	sb, err = Mkfs(d, super.MkfsOpts{Size: DISKSZ / 2})
+	require.NoError(ts.t, err)
+	assert.GreaterOrEqual(ts.t, sb.MaxSize(), DISKSZ/2*super.GROWFACTOR)
+	srv, err = MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	n, err = srv.Grow(0)
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, DISKSZ, n)
+}
+
+// Sizes in MB are the same number of blocks for every tool, and those
+// that overflow are rejected.
+func TestMegabytesToBlocks(t *testing.T) {
+	n, err := super.MegabytesToBlocks(400)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(400<<20/disk.BlockSize), n)
+	_, err = super.MegabytesToBlocks(math.MaxUint64 / 16)
+	assert.Error(t, err)
+}
+
 func TestAbortRestart(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -829,6 +1907,44 @@ func TestAbortRestart(t *testing.T) {
 	ts.Lookup("d", false)
 }
 
+func TestRestartScavenge(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	fhx := ts.writeLargeFile("x", 100)
+	fhy := ts.writeLargeFile("y", 100)
+
+	// crash after x was truncated and y removed, but before their
+	// blocks were freed
+	srv := ts.clnt.srv
+	op := fstxn.Begin(srv.fsstate)
+	root := op.GetInodeInumFree(common.ROOTINUM)
+	_, off := dir.LookupName(root, op, "y")
+	dir.WriteEnt(root, op, off, common.NULLINUM, "")
+	for i, f := range []nfstypes.Nfs_fh3{fhx, fhy} {
+		ip := op.GetInodeInumFree(fh.MakeFh(f).Ino)
+		ip.ShrinkSize = 100
+		ip.Size = 0
+		if i == 1 {
+			ip.Kind = inode.NF3FREE
+			ip.Nlink = 0
+			op.Atxn.FreeINum(ip.Inum)
+		}
+		ip.WriteInode(op.Atxn)
+	}
+	require.True(ts.t, op.Commit())
+	ts.clnt.Crash()
+
+	ts.clnt.srv = MakeNfs(srv.fsstate.Super.Disk)
+	sst := ts.clnt.srv.WaitScavenger()
+	assert.Equal(ts.t, uint64(2), sst.Inodes)
+	ts.Getattr(fhx, 0)
+	ts.Remove("x")
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+	assert.Equal(ts.t, st.Ffiles, ts.FsStat().Ffiles)
+}
+
 func TestRestartReclaim(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -846,13 +1962,640 @@ func TestRestartReclaim(t *testing.T) {
 	// Create will try re-allocate inode fhx.Ino, but abort since
 	// it must be shrunk first (because above the server
 	// ''crashed'' immediately after remove). Then, retrying,
-	// Create will allocate the next inode.
+	// Create will allocate the inode closest to the root directory,
+	// which is fhx.Ino again, with a new generation number.
 	ts.Create("x")
 	fh3 := ts.Lookup("x", true)
 	fht := fh.MakeFh(fh3)
-	assert.Equal(ts.t, fhx.Ino+1, fht.Ino)
+	assert.Equal(ts.t, fhx.Ino, fht.Ino)
+	assert.NotEqual(ts.t, fhx.Gen, fht.Gen)
 
 	ts.maketoolargefile("y", 50)
 	fhx3 = ts.Lookup("y", true)
 	ts.Getattr(fhx3, sz)
 }
+
+func TestSnapshot(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	data := mkdata(20 * disk.BlockSize)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.MkDir("d")
+	ts.Create("y")
+
+	srv := ts.clnt.srv
+	require.NoError(ts.t, srv.CreateSnapshot("s1"))
+	assert.Error(ts.t, srv.CreateSnapshot("s1"))
+	assert.Error(ts.t, srv.CreateSnapshot("a/b"))
+
+	// change the live file system
+	newdata := mkdataval(1, disk.BlockSize)
+	ts.WriteOff(fhx, disk.BlockSize, newdata, nfstypes.FILE_SYNC)
+	ts.Remove("y")
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	ts.Create("z")
+
+	// the snapshot has the old state, read-only
+	fhs := ts.Lookup(SNAPDIRNAME, true)
+	ts.GetattrDir(fhs)
+	fhs1 := ts.LookupFh(fhs, "s1")
+	ts.GetattrDir(fhs1)
+	fhx1 := ts.LookupFh(fhs1, "x")
+	attr := ts.Getattr(fhx1, uint64(len(data)))
+	assert.NotEqual(ts.t, ts.Getattr(fhx, uint64(len(data))).Fsid, attr.Fsid)
+	ts.readcheck(fhx1, 0, data)
+	ts.LookupFh(fhs1, "y")
+	ts.LookupFh(fhs1, "d")
+	assert.Equal(ts.t, nfstypes.NFS3ERR_NOENT, ts.clnt.LookupOp(fhs1, "z").Status)
+	ts.WriteErr(fhx1, newdata, nfstypes.FILE_SYNC, nfstypes.NFS3ERR_ROFS)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_ROFS, ts.clnt.CreateOp(fhs1, "w").Status)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_ROFS, ts.clnt.RemoveOp(fhs1, "x").Status)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_EXIST, ts.clnt.CreateOp(fh.MkRootFh3(), SNAPDIRNAME).Status)
+	dl := ts.clnt.ReadDirPlusOp(fhs, inode.NBLKINO*disk.BlockSize)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, dl.Status)
+	names := make([]string, 0)
+	for e := dl.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		names = append(names, string(e.Name))
+	}
+	assert.Equal(ts.t, []string{".", "..", "s1"}, names)
+
+	ts.readcheck(fhx, disk.BlockSize, newdata)
+	ts.readcheck(fhx, 0, data[:disk.BlockSize])
+
+	// the snapshot survives a restart, and fsck accounts for its blocks
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err := MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	ts.readcheck(fhx1, 0, data)
+	assert.Equal(ts.t, 1, len(srv.Snapshots()))
+
+	// and so does the scrubber, which walks them the same way
+	srv.WaitScavenger()
+	srv.StartScrub(100000)
+	srv.WaitScrub()
+	scr := srv.WaitScrub()
+	srv.StopScrub()
+	assert.Equal(ts.t, 0, len(scr.Last), "%v", scr.Last)
+
+	// deleting it makes its handles stale, and frees its blocks
+	require.NoError(ts.t, srv.DeleteSnapshot("s1"))
+	ts.GetattrFail(fhx1)
+	srv.WaitSnapshots()
+	assert.Empty(ts.t, srv.Snapshots())
+	ts.Remove("x")
+	ts.Remove("z")
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+
+	ts.clnt.Shutdown()
+	rep = ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err = MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+// An aborted transaction leaves no trace in the inode cache of the
+// inodes it allocated or the names it added.
+func TestAbortCached(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	st := ts.clnt.srv.fsstate
+
+	op := fstxn.Begin(st)
+	dip := op.GetInodeInumFree(common.ROOTINUM)
+	ip := op.AllocInode(nfstypes.NF3REG, dip.Inum, nil)
+	require.NotNil(ts.t, ip)
+	inum := ip.Inum
+	assert.True(ts.t, dir.AddName(dip, op, inum, "x"))
+	op.Abort()
+
+	op = fstxn.Begin(st)
+	assert.Equal(ts.t, inode.NF3FREE, op.GetInodeInumFree(inum).Kind)
+	op.Abort()
+	ts.Lookup("x", false)
+	ts.Create("x")
+}
+
+func TestClone(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	data := mkdata(20 * disk.BlockSize)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.MkDir("d")
+	used := st.Fbytes - ts.FsStat().Fbytes
+
+	srv := ts.clnt.srv
+	require.NoError(ts.t, srv.Clone("x", "d/c"))
+	assert.Error(ts.t, srv.Clone("x", "d/c"))
+	assert.Error(ts.t, srv.Clone("d", "e"))
+	assert.Error(ts.t, srv.Clone("nope", "e"))
+	assert.Equal(ts.t, st.Fbytes-used, ts.FsStat().Fbytes)
+
+	// writing either file copies the block it changes
+	fhd := ts.Lookup("d", true)
+	fhc := ts.LookupFh(fhd, "c")
+	ts.Getattr(fhc, uint64(len(data)))
+	ts.readcheck(fhc, 0, data)
+	newdata := mkdataval(1, disk.BlockSize)
+	ts.WriteOff(fhc, 10*disk.BlockSize, newdata, nfstypes.FILE_SYNC)
+	ts.readcheck(fhc, 10*disk.BlockSize, newdata)
+	ts.readcheck(fhx, 0, data)
+	ts.WriteOff(fhx, 0, newdata, nfstypes.FILE_SYNC)
+	ts.readcheck(fhc, 0, data[:10*disk.BlockSize])
+
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err := MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+
+	// a shared block is freed with its last reference
+	ts.Remove("x")
+	ts.readcheck(fhc, 0, data[:10*disk.BlockSize])
+	ts.readcheck(fhc, 11*disk.BlockSize, data[11*disk.BlockSize:])
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RemoveOp(fhd, "c").Status)
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+
+	ts.clnt.Shutdown()
+	rep = ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err = MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+func TestTree(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	srv := ts.clnt.srv
+	ts.MkDir("d")
+	fhd := ts.Lookup("d", true)
+	const N = 300
+	for i := 0; i < N; i++ {
+		ts.CreateFh(fhd, fmt.Sprintf("f%d", i))
+		ts.Write(ts.LookupFh(fhd, fmt.Sprintf("f%d", i)), mkdata(disk.BlockSize), nfstypes.UNSTABLE)
+	}
+	ts.CreateFh(fhd, "big")
+	fhbig := ts.LookupFh(fhd, "big")
+	data := mkdata(100 * disk.BlockSize)
+	ts.Write(fhbig, data, nfstypes.FILE_SYNC)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.MkDirOp(fhd, "e").Status)
+	fhe := ts.LookupFh(fhd, "e")
+	assert.Equal(ts.t, nfstypes.NFS3_OK,
+		ts.clnt.SymLinkOp(fhe, "l", nfstypes.Nfspath3("../big")).Status)
+
+	run := func(op TreeOp, p string, dst string) TreeJobInfo {
+		id, err := srv.StartTreeJob(op, p, dst)
+		require.NoError(ts.t, err)
+		info, ok := srv.WaitTreeJob(id)
+		assert.True(ts.t, ok)
+		assert.True(ts.t, info.Done)
+		assert.Equal(ts.t, "", info.Err)
+		return info
+	}
+
+	du := run(TreeDu, "d", "")
+	assert.Equal(ts.t, uint64(2), du.Dirs)
+	assert.Equal(ts.t, uint64(N+1), du.Files)
+	assert.Equal(ts.t, uint64(1), du.Symlinks)
+	assert.Equal(ts.t, N*disk.BlockSize+uint64(len(data)+len("../big")), du.Bytes)
+	assert.Less(ts.t, uint64(100), du.Blocks)
+
+	_, err := srv.StartTreeJob(TreeCopy, "d", "d/e/c")
+	assert.Error(ts.t, err)
+	_, err = srv.StartTreeJob(TreeRemove, "/", "")
+	assert.Error(ts.t, err)
+	_, err = srv.StartTreeJob(TreeRemove, "nope", "")
+	assert.Error(ts.t, err)
+	assert.Error(ts.t, srv.CancelTreeJob(1000))
+
+	cp := run(TreeCopy, "d", "c")
+	assert.Equal(ts.t, du.Dirs, cp.Dirs)
+	assert.Equal(ts.t, du.Files, cp.Files)
+	assert.Equal(ts.t, du.Bytes, cp.Bytes)
+	assert.Less(ts.t, uint64(1), cp.Txns)
+	fhc := ts.Lookup("c", true)
+	ts.readcheck(ts.LookupFh(fhc, "big"), 0, data)
+	ts.LookupFh(fhc, fmt.Sprintf("f%d", N-1))
+	assert.Equal(ts.t, "../big", ts.ReadLink(ts.LookupFh(ts.LookupFh(fhc, "e"), "l")))
+
+	// copy while the files it clones are written, which takes the
+	// share lock while holding their inode locks
+	done := make(chan bool)
+	wrote := make(chan bool)
+	go func() {
+		defer close(wrote)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			fh := ts.LookupFh(fhd, fmt.Sprintf("f%d", i%N))
+			ts.Write(fh, mkdata(disk.BlockSize), nfstypes.UNSTABLE)
+		}
+	}()
+	run(TreeCopy, "d", "c2")
+	close(done)
+	<-wrote
+	run(TreeRemove, "c2", "")
+
+	rm := run(TreeRemove, "d", "")
+	assert.Equal(ts.t, du.Dirs, rm.Dirs)
+	assert.Equal(ts.t, du.Files, rm.Files)
+	ts.Lookup("d", false)
+	ts.readcheck(ts.LookupFh(fhc, "big"), 0, data)
+	run(TreeRemove, "c", "")
+	assert.Equal(ts.t, 6, len(srv.TreeJobs()))
+
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err = MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	srv.WaitScavenger()
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+}
+
+func TestTrash(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st := ts.FsStat()
+	srv := ts.clnt.srv
+	srv.StartTrash(TrashPolicy{Retention: time.Hour, Interval: time.Hour})
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	data := mkdata(10 * disk.BlockSize)
+	ts.Write(fhx, data, nfstypes.FILE_SYNC)
+	ts.MkDir("d")
+	fhd := ts.Lookup("d", true)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.MkDirOp(fhd, "e").Status)
+	fhe := ts.LookupFh(fhd, "e")
+	ts.CreateFh(fhe, "f")
+
+	ts.Remove("x")
+	ts.Lookup("x", false)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RemoveOp(fhe, "f").Status)
+	ts.RmDir("d", nfstypes.NFS3ERR_INVAL)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RmDirOp(fhd, "e").Status)
+	items := srv.TrashItems()
+	require.Equal(ts.t, 3, len(items))
+	paths := make(map[string]string)
+	for _, it := range items {
+		paths[it.Path] = it.Name
+	}
+	assert.Contains(ts.t, paths, "/x")
+	assert.Contains(ts.t, paths, "/d/e/f")
+	assert.Contains(ts.t, paths, "/d/e")
+
+	// the paths follow renames of the directories they were in
+	ts.Rename("d", "d2")
+	for _, it := range srv.TrashItems() {
+		if it.Name == paths["/d/e/f"] {
+			assert.Equal(ts.t, "/d2/e/f", it.Path)
+		}
+	}
+	ts.Rename("d2", "d")
+
+	// an item can be renamed back
+	fht := ts.Lookup(TRASHDIRNAME, true)
+	ts.readcheck(ts.LookupFh(fht, paths["/x"]), 0, data)
+	ts.RenameFhs(fht, paths["/x"], fh.MkRootFh3(), "x")
+	ts.readcheck(ts.Lookup("x", true), 0, data)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RemoveOp(fht, paths["/x"]+trashInfo).Status)
+	ts.GetattrDir(ts.LookupFh(fht, paths["/d/e"]))
+
+	// the reaper frees what is older than the retention
+	n, err := srv.reapTrash(time.Now())
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, uint64(0), n)
+	n, err = srv.reapTrash(time.Now().Add(2 * time.Hour))
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, uint64(2), n)
+	assert.Empty(ts.t, srv.TrashItems())
+
+	// and everything while space is low
+	ts.Remove("x")
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	srv.trash.policy.MinFreePct = 100
+	n, err = srv.ReapTrash()
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, uint64(2), n)
+	ts.RmDir(TRASHDIRNAME, nfstypes.NFS3_OK)
+	assert.Equal(ts.t, st.Fbytes, ts.FsStat().Fbytes)
+
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err = MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+}
+
+func (ts *TestState) quota(kind alloctxn.QuotaKind, id uint32) alloctxn.Quota {
+	q, _ := ts.clnt.srv.fsstate.Quotas.Get(alloctxn.QuotaId{Kind: kind, Id: id})
+	return q
+}
+
+func TestQuota(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	ts.MkDir("u")
+	fhu := ts.Lookup("u", true)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(fhu, 1000, 100).Status)
+	attr := ts.GetattrDir(fhu)
+	assert.Equal(ts.t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(ts.t, nfstypes.Gid3(100), attr.Gid)
+
+	// without credentials, new files belong to the owner of their directory
+	ts.CreateFh(fhu, "a")
+	fha := ts.LookupFh(fhu, "a")
+	attr = ts.Getattr(fha, 0)
+	assert.Equal(ts.t, nfstypes.Uid3(1000), attr.Uid)
+	q := ts.quota(alloctxn.UserQuota, 1000)
+	assert.Equal(ts.t, uint64(2), q.Inodes)
+	assert.Equal(ts.t, q.Inodes, ts.quota(alloctxn.GroupQuota, 100).Inodes)
+
+	// hard limits
+	require.NoError(ts.t, srv.SetQuota(alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: 1000},
+		alloctxn.QuotaLimits{BlockHard: q.Blocks + 4, InodeHard: 3}))
+	ts.CreateFh(fhu, "b")
+	assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, ts.clnt.CreateOp(fhu, "c").Status)
+	ts.WriteOff(fha, 0, mkdata(4*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.WriteOff(fha, 3*disk.BlockSize, mkdata(disk.BlockSize), nfstypes.FILE_SYNC)
+	reply := ts.clnt.WriteOp(fha, 4*disk.BlockSize, mkdata(disk.BlockSize), nfstypes.FILE_SYNC)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, reply.Status)
+	// even for root, who may use the reserved blocks
+	rreply := srv.write(nfstypes.WRITE3args{File: fha, Offset: nfstypes.Offset3(4 * disk.BlockSize),
+		Count: nfstypes.Count3(disk.BlockSize), Stable: nfstypes.FILE_SYNC, Data: mkdata(disk.BlockSize)},
+		&Cred{})
+	assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, rreply.Status)
+
+	// the root, with no limits, may still write, and take the file
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	ts.Write(fhx, mkdata(8*disk.BlockSize), nfstypes.FILE_SYNC)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, ts.clnt.ChownOp(fhx, 1000, 100).Status)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(fha, 0, 0).Status)
+	assert.Equal(ts.t, uint64(2), ts.quota(alloctxn.UserQuota, 1000).Inodes)
+	assert.Equal(ts.t, q.Blocks, ts.quota(alloctxn.UserQuota, 1000).Blocks)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(fha, 1000, 100).Status)
+
+	// freeing gives the space back
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.RemoveOp(fhu, "a").Status)
+	assert.Equal(ts.t, q.Blocks, ts.quota(alloctxn.UserQuota, 1000).Blocks)
+	ts.CreateFh(fhu, "c")
+
+	// RQUOTA reports users, and groups with version 2
+	rq := srv.RQUOTAPROC_GETQUOTA(nfstypes.Getquota_args{Gqa_pathp: "/", Gqa_uid: 1000})
+	require.Equal(ts.t, nfstypes.Q_OK, rq.Status)
+	assert.True(ts.t, rq.Gqr_rquota.Rq_active)
+	assert.Equal(ts.t, uint32(3), rq.Gqr_rquota.Rq_fhardlimit)
+	assert.Equal(ts.t, uint32(3), rq.Gqr_rquota.Rq_curfiles)
+	assert.Equal(ts.t, int32(disk.BlockSize), rq.Gqr_rquota.Rq_bsize)
+	rq = srv.RQUOTAPROC_GETQUOTA(nfstypes.Getquota_args{Gqa_pathp: "/", Gqa_uid: 5})
+	assert.Equal(ts.t, nfstypes.Q_NOQUOTA, rq.Status)
+	rq = srv.EXT_RQUOTAPROC_GETACTIVEQUOTA(nfstypes.Ext_getquota_args{Gqa_pathp: "/",
+		Gqa_type: int32(nfstypes.GRPQUOTA), Gqa_id: 100})
+	assert.Equal(ts.t, nfstypes.Q_NOQUOTA, rq.Status)
+	rq = srv.EXT_RQUOTAPROC_GETQUOTA(nfstypes.Ext_getquota_args{Gqa_pathp: "/",
+		Gqa_type: int32(nfstypes.GRPQUOTA), Gqa_id: 100})
+	require.Equal(ts.t, nfstypes.Q_OK, rq.Status)
+	assert.Equal(ts.t, uint32(3), rq.Gqr_rquota.Rq_curfiles)
+
+	// a soft limit holds once its grace period is over
+	require.NoError(ts.t, srv.SetQuotaGrace(time.Second, time.Second))
+	require.NoError(ts.t, srv.SetQuota(alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: 1000},
+		alloctxn.QuotaLimits{}))
+	require.NoError(ts.t, srv.SetQuota(alloctxn.QuotaId{Kind: alloctxn.GroupQuota, Id: 100},
+		alloctxn.QuotaLimits{InodeSoft: 3}))
+	ts.CreateFh(fhu, "d")
+	assert.NotEqual(ts.t, uint64(0), ts.quota(alloctxn.GroupQuota, 100).InodeExpire)
+	time.Sleep(2 * time.Second)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, ts.clnt.CreateOp(fhu, "e").Status)
+
+	// quotas and owners persist
+	ts.clnt.Shutdown()
+	rep := ts.fsck(false)
+	assert.Empty(ts.t, rep.Problems)
+	srv, err := MountNfs(ts.clnt.srv.fsstate.Super.Disk)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	assert.Equal(ts.t, uint64(4), ts.quota(alloctxn.UserQuota, 1000).Inodes)
+	assert.Equal(ts.t, uint64(3), ts.quota(alloctxn.GroupQuota, 100).InodeSoft)
+	bg, ig := srv.QuotaGrace()
+	assert.Equal(ts.t, time.Second, bg)
+	assert.Equal(ts.t, time.Second, ig)
+	attr = ts.GetattrDir(ts.Lookup("u", true))
+	assert.Equal(ts.t, nfstypes.Uid3(1000), attr.Uid)
+}
+
+// Only root may give a file away; its owner may change its group to
+// one of theirs.
+func TestChownPerm(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(fhx, 1000, 100).Status)
+
+	chown := func(cred *Cred, uid uint32, gid uint32) nfstypes.Nfsstat3 {
+		attr := nfstypes.Sattr3{
+			Uid: nfstypes.Set_uid3{Set_it: true, Uid: nfstypes.Uid3(uid)},
+			Gid: nfstypes.Set_gid3{Set_it: true, Gid: nfstypes.Gid3(gid)},
+		}
+		args := nfstypes.SETATTR3args{Object: fhx, New_attributes: attr}
+		return srv.setattr(args, cred).Status
+	}
+	owner := &Cred{Owner: alloctxn.Owner{Uid: 1000, Gid: 100}, Gids: []uint32{200}}
+	other := &Cred{Owner: alloctxn.Owner{Uid: 1001, Gid: 100}, Gids: []uint32{300}}
+
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, chown(owner, 1001, 100))
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, chown(owner, 1000, 300))
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, chown(other, 1000, 300))
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, chown(nil, 1000, 200))
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM,
+		srv.NFSPROC3_SETATTR(nfstypes.SETATTR3args{Object: fhx, New_attributes: nfstypes.Sattr3{
+			Uid: nfstypes.Set_uid3{Set_it: true, Uid: 0}}}).Status)
+	assert.Equal(ts.t, uint64(1), ts.quota(alloctxn.UserQuota, 1000).Inodes)
+
+	// changing nothing is no change
+	assert.Equal(ts.t, nfstypes.NFS3_OK, chown(other, 1000, 100))
+	assert.Equal(ts.t, nfstypes.NFS3_OK, chown(owner, 1000, 200))
+	attr := ts.Getattr(fhx, 0)
+	assert.Equal(ts.t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(ts.t, nfstypes.Gid3(200), attr.Gid)
+	assert.Equal(ts.t, uint64(1), ts.quota(alloctxn.GroupQuota, 200).Inodes)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, chown(&Cred{}, 1001, 300))
+	assert.Equal(ts.t, nfstypes.Uid3(1001), ts.Getattr(fhx, 0).Uid)
+}
+
+// Concurrent creates don't go over a limit together
+func TestQuotaParallel(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	ts.MkDir("u")
+	fhu := ts.Lookup("u", true)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(fhu, 1000, 100).Status)
+	require.NoError(ts.t, srv.SetQuota(alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: 1000},
+		alloctxn.QuotaLimits{InodeHard: 11}))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var created = 0
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status := ts.clnt.CreateOp(fhu, "x"+strconv.Itoa(i)).Status
+			if status == nfstypes.NFS3_OK {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(ts.t, 10, created)
+	assert.Equal(ts.t, uint64(11), ts.quota(alloctxn.UserQuota, 1000).Inodes)
+}
+
+func TestQuotaFull(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	sb, err := Mkfs(d, super.MkfsOpts{ReservedPct: 10, NQuota: 1})
+	require.NoError(t, err)
+	srv, err := MountNfs(d)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: srv}}
+	defer ts.Close()
+
+	// root's user and group take two entries, and the header one slot
+	n := sb.NQuotaBlk*super.NQUOTABLK - 3
+	for i := uint64(0); i <= n; i++ {
+		name := "f" + strconv.Itoa(int(i))
+		ts.Create(name)
+		status := ts.clnt.ChownOp(ts.Lookup(name, true), uint32(1000+i), 0).Status
+		if i < n {
+			assert.Equal(ts.t, nfstypes.NFS3_OK, status)
+		} else {
+			// no room for the user's entry
+			assert.Equal(ts.t, nfstypes.NFS3ERR_DQUOT, status)
+		}
+	}
+	assert.Equal(ts.t, int(n+2), len(srv.Quotas()))
+	assert.Error(ts.t, srv.SetQuota(alloctxn.QuotaId{Kind: alloctxn.GroupQuota, Id: 5},
+		alloctxn.QuotaLimits{InodeHard: 1}))
+
+	// removing a user's last file frees its entry
+	ts.Remove("f0")
+	assert.Equal(ts.t, nfstypes.NFS3_OK, ts.clnt.ChownOp(ts.Lookup("f"+strconv.Itoa(int(n)), true),
+		uint32(1000+n), 0).Status)
+	_, ok := srv.fsstate.Quotas.Get(alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: 1000})
+	assert.False(ts.t, ok)
+	ts.clnt.Shutdown()
+	assert.Empty(ts.t, ts.fsck(false).Problems)
+	srv, err = MountNfs(d)
+	require.NoError(ts.t, err)
+	ts.clnt.srv = srv
+	assert.Equal(ts.t, int(n+2), len(srv.Quotas()))
+}
+
+func TestRpcOwner(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	s := MakeRpcServer()
+	ts.clnt.srv.RegisterRpcs(s)
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	go s.Run(sconn)
+	clnt := rfc1057.MakeClient(cconn, nfstypes.NFS_PROGRAM, nfstypes.NFS_V3)
+
+	create := func(cred rfc1057.Opaque_auth, name string) nfstypes.Fattr3 {
+		args := nfstypes.CREATE3args{
+			Where: nfstypes.Diropargs3{Dir: fh.MkRootFh3(), Name: nfstypes.Filename3(name)},
+			How:   nfstypes.Createhow3{Mode: nfstypes.UNCHECKED},
+		}
+		var res nfstypes.CREATE3res
+		require.NoError(ts.t, clnt.Call(nfstypes.NFSPROC3_CREATE, cred, rfc1057.Opaque_auth{}, &args, &res))
+		require.Equal(ts.t, nfstypes.NFS3_OK, res.Status)
+		return res.Resok.Obj_attributes.Attributes
+	}
+
+	// a new file belongs to the caller
+	body, err := xdr.EncodeBuf(&rfc1057.Auth_unix{Machinename: "c", Uid: 1000, Gid: 100})
+	require.NoError(ts.t, err)
+	attr := create(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: body}, "x")
+	assert.Equal(ts.t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(ts.t, nfstypes.Gid3(100), attr.Gid)
+	assert.Equal(ts.t, nfstypes.Uid3(1000), ts.Getattr(ts.Lookup("x", true), 0).Uid)
+	assert.Equal(ts.t, uint64(1), ts.quota(alloctxn.UserQuota, 1000).Inodes)
+	assert.Equal(ts.t, uint64(1), ts.quota(alloctxn.GroupQuota, 100).Inodes)
+
+	// or, without credentials, to the owner of its directory
+	attr = create(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE}, "y")
+	assert.Equal(ts.t, nfstypes.Uid3(0), attr.Uid)
+
+	// the owner may change the group to one of their other groups
+	setgid := func(cred rfc1057.Opaque_auth, gid uint32) nfstypes.Nfsstat3 {
+		args := nfstypes.SETATTR3args{Object: ts.Lookup("x", true), New_attributes: nfstypes.Sattr3{
+			Gid: nfstypes.Set_gid3{Set_it: true, Gid: nfstypes.Gid3(gid)}}}
+		var res nfstypes.SETATTR3res
+		require.NoError(ts.t, clnt.Call(nfstypes.NFSPROC3_SETATTR, cred, rfc1057.Opaque_auth{}, &args, &res))
+		return res.Status
+	}
+	body, err = xdr.EncodeBuf(&rfc1057.Auth_unix{Machinename: "c", Uid: 1000, Gid: 100, Gids: []uint32{200}})
+	require.NoError(ts.t, err)
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, setgid(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE}, 200))
+	assert.Equal(ts.t, nfstypes.NFS3ERR_PERM, setgid(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: body}, 300))
+	assert.Equal(ts.t, nfstypes.NFS3_OK, setgid(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: body}, 200))
+	assert.Equal(ts.t, nfstypes.Gid3(200), ts.Getattr(ts.Lookup("x", true), 0).Gid)
+}
+
+// Owners have their own fields, so they leave files and generations
+// their full range.
+func TestOwnerLayout(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sup := ts.clnt.srv.fsstate.Super
+	assert.Less(ts.t, uint64(16<<40), inode.MaxFileSize(sup))
+	ts.Create("x")
+	inum := fh.MakeFh(ts.Lookup("x", true)).Ino
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	enc := op.GetInodeInum(inum).Encode()
+	op.Abort()
+	ip := inode.Decode(sup, buf.MkBuf(sup.Inum2Addr(inum), common.INODESZ*8, enc), inum)
+	ip.Gen = 1<<40 + 1
+	ip.Uid = 1<<32 - 2
+	ip.Gid = 1<<31 + 5
+	ip.ShrinkSize = 1 << 34
+	dip := inode.Decode(sup, buf.MkBuf(sup.Inum2Addr(inum), common.INODESZ*8, ip.Encode()), inum)
+	assert.Equal(ts.t, uint64(1<<40+1), dip.Gen)
+	assert.Equal(ts.t, uint32(1<<32-2), dip.Uid)
+	assert.Equal(ts.t, uint32(1<<31+5), dip.Gid)
+	assert.Equal(ts.t, uint64(1<<34), dip.ShrinkSize)
+}
@@ -0,0 +1,163 @@
+package nfs
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Quotas are kept by alloctxn, and enforced with NFS3ERR_DQUOT.  The
+// RQUOTA program reports them to quota(1) on clients, for the users
+// (version 1) and groups (version 2) that have an entry; it answers
+// for every export alike, since snapshots share the live file
+// system's quotas.  Limits and usage go out in blocks, with rq_bsize
+// the block size.
+//
+
+// Quotas returns the entries of the quota table, users first.
+func (nfs *Nfs) Quotas() []alloctxn.Quota {
+	return nfs.fsstate.Quotas.List()
+}
+
+// QuotaGrace returns the grace periods for blocks and inodes.
+func (nfs *Nfs) QuotaGrace() (time.Duration, time.Duration) {
+	b, i := nfs.fsstate.Quotas.Grace()
+	return time.Duration(b) * time.Second, time.Duration(i) * time.Second
+}
+
+func (nfs *Nfs) quotaTxn(f func(op *fstxn.FsTxn) error) error {
+	if nfs.fsstate.Super.Legacy() {
+		return fmt.Errorf("file system doesn't support quotas (legacy image)")
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	if err := f(op); err != nil {
+		op.Abort()
+		return err
+	}
+	if !op.Commit() {
+		return fmt.Errorf("commit failed")
+	}
+	return nil
+}
+
+// SetQuota sets the limits of a user or group; all zero limits remove
+// them.
+func (nfs *Nfs) SetQuota(id alloctxn.QuotaId, limits alloctxn.QuotaLimits) error {
+	if id.Kind != alloctxn.UserQuota && id.Kind != alloctxn.GroupQuota {
+		return fmt.Errorf("bad quota kind %d", id.Kind)
+	}
+	err := nfs.quotaTxn(func(op *fstxn.FsTxn) error {
+		if !op.Atxn.SetQuota(id, limits) {
+			return fmt.Errorf("quota table is full")
+		}
+		return nil
+	})
+	util.DPrintf(1, "SetQuota %v %+v: %v\n", id, limits, err)
+	return err
+}
+
+// SetQuotaGrace sets the grace periods for blocks and inodes, of at
+// least a second each.
+func (nfs *Nfs) SetQuotaGrace(block time.Duration, inode time.Duration) error {
+	if block < time.Second || inode < time.Second {
+		return fmt.Errorf("grace periods must be at least a second")
+	}
+	return nfs.quotaTxn(func(op *fstxn.FsTxn) error {
+		op.Atxn.SetGrace(uint64(block/time.Second), uint64(inode/time.Second))
+		return nil
+	})
+}
+
+func clamp32(n uint64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+func timeLeft(expire uint64, now uint64) uint32 {
+	if expire <= now {
+		return 0
+	}
+	return clamp32(expire - now)
+}
+
+// Returns the quota of id on the export path, for RQUOTA; if active,
+// only if it has limits.
+func (nfs *Nfs) getQuota(path string, id alloctxn.QuotaId, active bool) nfstypes.Getquota_rslt {
+	var res nfstypes.Getquota_rslt
+	res.Status = nfstypes.Q_NOQUOTA
+	if _, ok := nfs.mountFh(path); !ok {
+		return res
+	}
+	q, ok := nfs.fsstate.Quotas.Get(id)
+	limited := q.QuotaLimits != (alloctxn.QuotaLimits{})
+	if !ok || (active && !limited) {
+		return res
+	}
+	now := uint64(time.Now().Unix())
+	res.Status = nfstypes.Q_OK
+	res.Gqr_rquota = nfstypes.Rquota{
+		Rq_bsize:      int32(disk.BlockSize),
+		Rq_active:     limited,
+		Rq_bhardlimit: clamp32(q.BlockHard),
+		Rq_bsoftlimit: clamp32(q.BlockSoft),
+		Rq_curblocks:  clamp32(q.Blocks),
+		Rq_fhardlimit: clamp32(q.InodeHard),
+		Rq_fsoftlimit: clamp32(q.InodeSoft),
+		Rq_curfiles:   clamp32(q.Inodes),
+		Rq_btimeleft:  timeLeft(q.BlockExpire, now),
+		Rq_ftimeleft:  timeLeft(q.InodeExpire, now),
+	}
+	return res
+}
+
+// Returns the id of an RQUOTA version 2 request, and false if its type
+// is unknown.
+func extQuotaId(args nfstypes.Ext_getquota_args) (alloctxn.QuotaId, bool) {
+	switch uint32(args.Gqa_type) {
+	case nfstypes.USRQUOTA:
+		return alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: uint32(args.Gqa_id)}, true
+	case nfstypes.GRPQUOTA:
+		return alloctxn.QuotaId{Kind: alloctxn.GroupQuota, Id: uint32(args.Gqa_id)}, true
+	}
+	return alloctxn.QuotaId{}, false
+}
+
+func (nfs *Nfs) RQUOTAPROC_GETQUOTA(args nfstypes.Getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetQuota %v\n", args)
+	id := alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: uint32(args.Gqa_uid)}
+	return nfs.getQuota(args.Gqa_pathp, id, false)
+}
+
+func (nfs *Nfs) RQUOTAPROC_GETACTIVEQUOTA(args nfstypes.Getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetActiveQuota %v\n", args)
+	id := alloctxn.QuotaId{Kind: alloctxn.UserQuota, Id: uint32(args.Gqa_uid)}
+	return nfs.getQuota(args.Gqa_pathp, id, true)
+}
+
+func (nfs *Nfs) EXT_RQUOTAPROC_GETQUOTA(args nfstypes.Ext_getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA ext GetQuota %v\n", args)
+	id, ok := extQuotaId(args)
+	if !ok {
+		return nfstypes.Getquota_rslt{Status: nfstypes.Q_NOQUOTA}
+	}
+	return nfs.getQuota(args.Gqa_pathp, id, false)
+}
+
+func (nfs *Nfs) EXT_RQUOTAPROC_GETACTIVEQUOTA(args nfstypes.Ext_getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA ext GetActiveQuota %v\n", args)
+	id, ok := extQuotaId(args)
+	if !ok {
+		return nfstypes.Getquota_rslt{Status: nfstypes.Q_NOQUOTA}
+	}
+	return nfs.getQuota(args.Gqa_pathp, id, true)
+}
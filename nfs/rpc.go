@@ -0,0 +1,234 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// RpcServer serves RPCs like rfc1057's server, which doesn't pass its
+// handlers the credentials of a call, but passes the AUTH_UNIX
+// credentials to the handlers that want them: those of the NFS
+// procedures that make inodes, which belong to the caller, of those
+// that may allocate blocks, which root may take from the reserve, and
+// of SETATTR, which changes owners only for the callers allowed to.
+//
+
+// A Cred is the caller of a call: its uid and gid, which own the inodes
+// it makes, and its other groups.
+type Cred struct {
+	alloctxn.Owner
+	Gids []uint32
+}
+
+// Returns the owner of the inodes cred makes, or nil if cred is nil.
+func (cred *Cred) owner() *alloctxn.Owner {
+	if cred == nil {
+		return nil
+	}
+	return &cred.Owner
+}
+
+// Returns whether cred is in group gid.
+func (cred *Cred) inGroup(gid uint32) bool {
+	if cred.Gid == gid {
+		return true
+	}
+	for _, g := range cred.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// CredHandler handles a call from cred, which is nil if the call had
+// no AUTH_UNIX credentials.
+type CredHandler func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error)
+
+type RpcServer struct {
+	handlers map[uint32]map[uint32]map[uint32]CredHandler
+}
+
+func MakeRpcServer() *RpcServer {
+	return &RpcServer{
+		handlers: make(map[uint32]map[uint32]map[uint32]CredHandler),
+	}
+}
+
+func (s *RpcServer) Register(prog, vers, proc uint32, handler CredHandler) {
+	if _, ok := s.handlers[prog]; !ok {
+		s.handlers[prog] = make(map[uint32]map[uint32]CredHandler)
+	}
+	if _, ok := s.handlers[prog][vers]; !ok {
+		s.handlers[prog][vers] = make(map[uint32]CredHandler)
+	}
+	s.handlers[prog][vers][proc] = handler
+}
+
+// RegisterMany registers handlers that don't need credentials.
+func (s *RpcServer) RegisterMany(regs []xdr.ProcRegistration) {
+	for _, r := range regs {
+		h := r.Handler
+		s.Register(r.Prog, r.Vers, r.Proc, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+			return h(args)
+		})
+	}
+}
+
+// Run serves the calls that arrive on rw, each in its own goroutine,
+// until reading fails.
+func (s *RpcServer) Run(rw io.ReadWriter) error {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+			return err
+		}
+		hlen := binary.BigEndian.Uint32(hdr[:])
+		if hlen&(1<<31) == 0 {
+			return fmt.Errorf("fragments not supported")
+		}
+		buf := make([]byte, hlen&0x7fffffff)
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return err
+		}
+		go func() {
+			if err := s.handle(rw, buf); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}()
+	}
+}
+
+// Returns the caller of a call with credentials cred, or nil if they
+// aren't AUTH_UNIX.
+func callCred(cred rfc1057.Opaque_auth) *Cred {
+	if cred.Flavor != rfc1057.AUTH_UNIX {
+		return nil
+	}
+	var au rfc1057.Auth_unix
+	if err := xdr.DecodeBuf(cred.Body, &au); err != nil {
+		return nil
+	}
+	return &Cred{Owner: alloctxn.Owner{Uid: au.Uid, Gid: au.Gid}, Gids: au.Gids}
+}
+
+// Returns whether cred is root, who may use the reserved blocks and
+// change owners.
+func superuser(cred *Cred) bool {
+	return cred != nil && cred.Uid == 0
+}
+
+func (s *RpcServer) handle(w io.Writer, buf []byte) error {
+	rd := xdr.MakeReader(buf)
+	var req rfc1057.Rpc_msg
+	req.Xdr(rd)
+	if err := rd.Error(); err != nil {
+		return err
+	}
+	if req.Body.Mtype != rfc1057.CALL {
+		return fmt.Errorf("request mtype %d != CALL", req.Body.Mtype)
+	}
+
+	var res rfc1057.Rpc_msg
+	var resdata xdr.Xdrable
+	res.Xid = req.Xid
+	res.Body.Mtype = rfc1057.REPLY
+	call := req.Body.Cbody
+	if call.Rpcvers != 2 {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.RPC_MISMATCH
+	} else {
+		res.Body.Rbody.Stat = rfc1057.MSG_ACCEPTED
+		stat := &res.Body.Rbody.Areply.Reply_data.Stat
+		if vers, ok := s.handlers[call.Prog]; !ok {
+			*stat = rfc1057.PROG_UNAVAIL
+		} else if procs, ok := vers[call.Vers]; !ok {
+			*stat = rfc1057.PROG_MISMATCH
+		} else if h, ok := procs[call.Proc]; !ok {
+			*stat = rfc1057.PROC_UNAVAIL
+		} else if data, err := h(callCred(call.Cred), rd); err != nil {
+			*stat = rfc1057.GARBAGE_ARGS
+		} else {
+			resdata = data
+			*stat = rfc1057.SUCCESS
+		}
+	}
+
+	// 4 bytes at the front for the length
+	var reserveLen [4]byte
+	wr := xdr.MakeWriter(reserveLen[:])
+	res.Xdr(wr)
+	if resdata != nil {
+		resdata.Xdr(wr)
+	}
+	if err := wr.Error(); err != nil {
+		return err
+	}
+	wbuf := wr.WriteBuf()
+	binary.BigEndian.PutUint32(wbuf[0:4], (1<<31)|uint32(len(wbuf)-4))
+	_, err := w.Write(wbuf)
+	return err
+}
+
+// RegisterRpcs registers the NFS procedures with s, passing the
+// callers of those that make inodes or may allocate blocks.
+func (nfs *Nfs) RegisterRpcs(s *RpcServer) {
+	s.RegisterMany(nfstypes.NFS_PROGRAM_NFS_V3_regs(nfs))
+	reg := func(proc uint32, h CredHandler) {
+		s.Register(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, proc, h)
+	}
+	reg(nfstypes.NFSPROC3_CREATE, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+		var in nfstypes.CREATE3args
+		in.Xdr(args)
+		if err := args.Error(); err != nil {
+			return nil, err
+		}
+		out := nfs.create(in, cred)
+		return &out, nil
+	})
+	reg(nfstypes.NFSPROC3_MKDIR, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+		var in nfstypes.MKDIR3args
+		in.Xdr(args)
+		if err := args.Error(); err != nil {
+			return nil, err
+		}
+		out := nfs.mkdir(in, cred)
+		return &out, nil
+	})
+	reg(nfstypes.NFSPROC3_SYMLINK, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+		var in nfstypes.SYMLINK3args
+		in.Xdr(args)
+		if err := args.Error(); err != nil {
+			return nil, err
+		}
+		out := nfs.symlink(in, cred)
+		return &out, nil
+	})
+	reg(nfstypes.NFSPROC3_WRITE, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+		var in nfstypes.WRITE3args
+		in.Xdr(args)
+		if err := args.Error(); err != nil {
+			return nil, err
+		}
+		out := nfs.write(in, cred)
+		return &out, nil
+	})
+	reg(nfstypes.NFSPROC3_SETATTR, func(cred *Cred, args *xdr.XdrState) (xdr.Xdrable, error) {
+		var in nfstypes.SETATTR3args
+		in.Xdr(args)
+		if err := args.Error(); err != nil {
+			return nil, err
+		}
+		out := nfs.setattr(in, cred)
+		return &out, nil
+	})
+}
@@ -0,0 +1,257 @@
+package nfs
+
+import (
+	"strings"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Snapshots appear read-only under the .snapshot directory of the
+// root, which isn't on disk (nor listed in the root): LOOKUP of
+// .snapshot in the root returns a handle whose Snap is fh.SNAPDIR, and
+// the NFS procedures answer for it directly.  Its entries are the
+// snapshots, whose roots have handles with the snapshot's id; a
+// transaction that gets an inode by such a handle reads that snapshot
+// (see fstxn).  Every procedure that changes something returns
+// NFS3ERR_ROFS for handles in snapshots.  Each snapshot reports an
+// fsid of its own, since its inode numbers are those of the live file
+// system.
+//
+
+const SNAPDIRNAME = ".snapshot"
+
+// The fileid of .snapshot, which no inode has
+const SNAPDIRFILEID = nfstypes.Fileid3(fh.SNAPDIR)
+
+// CreateSnapshot takes a snapshot named name of the file system as it
+// is now.
+func (nfs *Nfs) CreateSnapshot(name string) error {
+	return nfs.snapshotter.Create(name)
+}
+
+// DeleteSnapshot deletes snapshot name; its space is freed in the
+// background.
+func (nfs *Nfs) DeleteSnapshot(name string) error {
+	return nfs.snapshotter.Delete(name)
+}
+
+// Snapshots returns the snapshots, oldest first.
+func (nfs *Nfs) Snapshots() []alloctxn.SnapshotInfo {
+	return nfs.snapshotter.List()
+}
+
+// WaitSnapshots waits until the space of deleted snapshots is free.
+func (nfs *Nfs) WaitSnapshots() {
+	nfs.snapshotter.Wait()
+}
+
+func isSnapDir(fh3 nfstypes.Nfs_fh3) bool {
+	return fh.MakeFh(fh3).Snap == fh.SNAPDIR
+}
+
+func isLiveRoot(fh3 nfstypes.Nfs_fh3) bool {
+	h := fh.MakeFh(fh3)
+	return h.Ino == common.ROOTINUM && h.Snap == 0
+}
+
+// Returns the live root's handle for .snapshot's, which has no inode,
+// for the procedures that only want the file system.
+func liveFsroot(fh3 nfstypes.Nfs_fh3) nfstypes.Nfs_fh3 {
+	if isSnapDir(fh3) {
+		return fh.MkRootFh3()
+	}
+	return fh3
+}
+
+// Returns NFS3ERR_ROFS if one of fhs is in a snapshot, or is .snapshot.
+func writable(fhs ...nfstypes.Nfs_fh3) nfstypes.Nfsstat3 {
+	for _, fh3 := range fhs {
+		if fh.IsSnap(fh3) {
+			return nfstypes.NFS3ERR_ROFS
+		}
+	}
+	return nfstypes.NFS3_OK
+}
+
+// Returns the status of creating name in dfh: .snapshot exists in the
+// root already.
+func creatable(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) nfstypes.Nfsstat3 {
+	if err := writable(dfh); err != nfstypes.NFS3_OK {
+		return err
+	}
+	if isLiveRoot(dfh) && name == SNAPDIRNAME {
+		return nfstypes.NFS3ERR_EXIST
+	}
+	return nfstypes.NFS3_OK
+}
+
+func (nfs *Nfs) rootAttr() (nfstypes.Fattr3, bool) {
+	op := fstxn.Begin(nfs.fsstate)
+	root := op.GetInodeInum(common.ROOTINUM)
+	if root == nil {
+		op.Abort()
+		return nfstypes.Fattr3{}, false
+	}
+	fattr := root.MkFattr(op.Fsid())
+	op.Abort()
+	return fattr, true
+}
+
+// Returns the attributes of .snapshot, which are those of the live
+// root but for the fileid, size and mode.
+func (nfs *Nfs) snapDirAttr() (nfstypes.Fattr3, bool) {
+	fattr, ok := nfs.rootAttr()
+	fattr.Fileid = SNAPDIRFILEID
+	fattr.Size = 0
+	fattr.Used = 0
+	fattr.Mode = 0555
+	return fattr, ok
+}
+
+// Returns the handle and attributes of the root of snapshot id.
+func (nfs *Nfs) snapRoot(id uint64) (nfstypes.Nfs_fh3, nfstypes.Fattr3, bool) {
+	op := fstxn.Begin(nfs.fsstate)
+	if !op.ReadSnapshot(id) {
+		op.Abort()
+		return nfstypes.Nfs_fh3{}, nfstypes.Fattr3{}, false
+	}
+	ip := op.GetInodeInum(common.ROOTINUM)
+	if ip == nil {
+		op.Abort()
+		return nfstypes.Nfs_fh3{}, nfstypes.Fattr3{}, false
+	}
+	fh3 := op.Fh(ip).MakeFh3()
+	fattr := ip.MkFattr(op.Fsid())
+	op.Abort()
+	return fh3, fattr, true
+}
+
+// Answers LOOKUP of .snapshot in the root, and of the names in
+// .snapshot.  Returns false for other lookups.
+func (nfs *Nfs) lookupSnap(args nfstypes.LOOKUP3args, reply *nfstypes.LOOKUP3res) bool {
+	name := args.What.Name
+	var fh3 nfstypes.Nfs_fh3
+	var fattr nfstypes.Fattr3
+	var ok bool
+	if isLiveRoot(args.What.Dir) && name == SNAPDIRNAME {
+		fh3 = fh.MkSnapDirFh3()
+		fattr, ok = nfs.snapDirAttr()
+	} else if !isSnapDir(args.What.Dir) {
+		return false
+	} else if name == "." {
+		fh3 = fh.MkSnapDirFh3()
+		fattr, ok = nfs.snapDirAttr()
+	} else if name == ".." {
+		fh3 = fh.MkRootFh3()
+		fattr, ok = nfs.rootAttr()
+	} else if s := nfs.fsstate.Snaps.Lookup(string(name)); s != nil {
+		fh3, fattr, ok = nfs.snapRoot(s.Id)
+	}
+	if !ok {
+		reply.Status = nfstypes.NFS3ERR_NOENT
+		return true
+	}
+	reply.Status = nfstypes.NFS3_OK
+	reply.Resok.Object = fh3
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = fattr
+	return true
+}
+
+// The entries of .snapshot: ".", "..", and the snapshots.  The cookie
+// of an entry is its index plus one.  There are few enough of them that
+// a reply always holds them all.
+type snapEnt struct {
+	name   string
+	fileid nfstypes.Fileid3
+	snap   uint64 // id, for a snapshot
+}
+
+func (nfs *Nfs) snapEnts() []snapEnt {
+	ents := []snapEnt{
+		{name: ".", fileid: SNAPDIRFILEID},
+		{name: "..", fileid: nfstypes.Fileid3(common.ROOTINUM)},
+	}
+	for _, s := range nfs.fsstate.Snaps.List() {
+		if s.Deleting {
+			continue
+		}
+		ents = append(ents, snapEnt{name: s.Name, fileid: nfstypes.Fileid3(common.ROOTINUM), snap: s.Id})
+	}
+	return ents
+}
+
+func (nfs *Nfs) readdirSnap(cookie nfstypes.Cookie3) nfstypes.Dirlist3 {
+	var lst *nfstypes.Entry3
+	var last *nfstypes.Entry3
+	for i, ent := range nfs.snapEnts() {
+		if uint64(i) < uint64(cookie) {
+			continue
+		}
+		e := &nfstypes.Entry3{
+			Fileid: ent.fileid,
+			Name:   nfstypes.Filename3(ent.name),
+			Cookie: nfstypes.Cookie3(i + 1),
+		}
+		if last == nil {
+			lst = e
+		} else {
+			last.Nextentry = e
+		}
+		last = e
+	}
+	return nfstypes.Dirlist3{Entries: lst, Eof: true}
+}
+
+func (nfs *Nfs) readdirplusSnap(cookie nfstypes.Cookie3) nfstypes.Dirlistplus3 {
+	var lst *nfstypes.Entryplus3
+	var last *nfstypes.Entryplus3
+	for i, ent := range nfs.snapEnts() {
+		if uint64(i) < uint64(cookie) {
+			continue
+		}
+		e := &nfstypes.Entryplus3{
+			Fileid: ent.fileid,
+			Name:   nfstypes.Filename3(ent.name),
+			Cookie: nfstypes.Cookie3(i + 1),
+		}
+		if ent.snap != 0 {
+			fh3, fattr, ok := nfs.snapRoot(ent.snap)
+			if !ok {
+				continue // deleted meanwhile
+			}
+			e.Name_handle = nfstypes.Post_op_fh3{Handle_follows: true, Handle: fh3}
+			e.Name_attributes = nfstypes.Post_op_attr{Attributes_follow: true, Attributes: fattr}
+		}
+		if last == nil {
+			lst = e
+		} else {
+			last.Nextentry = e
+		}
+		last = e
+	}
+	return nfstypes.Dirlistplus3{Entries: lst, Eof: true}
+}
+
+// Returns the root handle of the mount path: that of snapshot name for
+// /.snapshot/name, and the live root's for any other path.
+func (nfs *Nfs) mountFh(path string) (nfstypes.Nfs_fh3, bool) {
+	prefix := "/" + SNAPDIRNAME + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return fh.MkRootFh3(), true
+	}
+	name := strings.TrimRight(strings.TrimPrefix(path, prefix), "/")
+	s := nfs.fsstate.Snaps.Lookup(name)
+	if s == nil {
+		return nfstypes.Nfs_fh3{}, false
+	}
+	fh3, _, ok := nfs.snapRoot(s.Id)
+	util.DPrintf(1, "MOUNT snapshot %q: %v\n", name, ok)
+	return fh3, ok
+}
@@ -1,6 +1,7 @@
 package nfs
 
 import (
+	"fmt"
 	"io"
 	"time"
 
@@ -47,3 +48,51 @@ func (nfs *Nfs) ResetOpStats() {
 		nfs.stats[i].Reset()
 	}
 }
+
+// WriteAllocStats reports how often goal-directed allocations landed
+// at their goal, as a measure of fragmentation.
+func (nfs *Nfs) WriteAllocStats(w io.Writer) {
+	bs := nfs.fsstate.Balloc.Stats()
+	is := nfs.fsstate.Ialloc.Stats()
+	fmt.Fprintf(w, "%-8s %10s %10s %7s\n", "alloc", "goal", "hit", "frag%")
+	fmt.Fprintf(w, "%-8s %10d %10d %7.1f\n", "block", bs.Goal, bs.Hit, bs.Fragmentation())
+	fmt.Fprintf(w, "%-8s %10d %10d %7.1f\n", "inode", is.Goal, is.Hit, is.Fragmentation())
+}
+
+func (nfs *Nfs) ResetAllocStats() {
+	nfs.fsstate.Balloc.ResetStats()
+	nfs.fsstate.Ialloc.ResetStats()
+}
+
+// WriteShrinkStats reports the progress of shrinking large files in
+// the background.
+func (nfs *Nfs) WriteShrinkStats(w io.Writer) {
+	st := nfs.shrinkst.Stats()
+	fmt.Fprintf(w, "shrink: %d queued, %d active, %d done, %d failed, %d bytes pending\n",
+		st.Queued, st.Active, st.Done, st.Failed, st.PendingBytes)
+}
+
+// WriteCsumStats reports how many data blocks reads verified, and how
+// many of those failed their checksum.
+func (nfs *Nfs) WriteCsumStats(w io.Writer) {
+	st := nfs.fsstate.Csums.Stats()
+	fmt.Fprintf(w, "checksum: %d verified, %d bad\n", st.Verified, st.Bad)
+}
+
+// WriteDiscardStats reports how many freed blocks were discarded, on
+// a disk that can discard.
+func (nfs *Nfs) WriteDiscardStats(w io.Writer) {
+	if nfs.fsstate.Discards == nil {
+		return
+	}
+	st := nfs.fsstate.Discards.Stats()
+	fmt.Fprintf(w, "discard: %d blocks, %d failed, %d pending\n",
+		st.Discarded, st.Failed, st.Pending)
+}
+
+// WriteScrubStats reports the progress of the background scrubber.
+func (nfs *Nfs) WriteScrubStats(w io.Writer) {
+	st := nfs.scrubber.Stats()
+	fmt.Fprintf(w, "scrub: running %v, %d inodes/s, %d passes, %d problems, %d skipped\n",
+		st.Running, st.Rate, st.Passes, st.Problems, st.Skipped)
+}
@@ -0,0 +1,583 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// With the trash on, REMOVE and RMDIR move the entry into the directory
+// .trash of the root (made when first needed) rather than free it, so
+// that a user can get it back with RENAME.  The entry is renamed
+// <unix seconds>-<inum>-<name>, next to a file of the same name plus
+// .info that records the directory the entry was removed from, its
+// name there, and the time it was removed.  Removing an entry below
+// .trash, or .trash itself, frees it as before, and so does a remove
+// that the trash can't take (for lack of an inode or space for the
+// .info file): the trash doesn't use the reserved blocks, which are
+// for removes that free space.
+//
+// The reaper frees the items older than the retention, and the oldest
+// ones early while free space is below MinFreePct, with the remove of
+// tree jobs, so that large files go to the shrinker.
+//
+// A remove only walks up ".." to tell whether the directory is below
+// .trash, dropping each directory's lock before taking its parent's,
+// which may have a higher inum.  The original path is found only when
+// the trash is listed, from the recorded directory; it thus follows
+// the renames of that directory since, and an item removed from a
+// directory that is itself in the trash (as rm -r does) gets a path
+// below that item's.
+//
+
+const TRASHDIRNAME = ".trash"
+
+const (
+	trashInfo     = ".info"
+	trashMaxDepth = 64 // directories a path records
+	trashInterval = time.Minute
+	trashMaxInfo  = 4096 // bytes of an .info file that are read
+)
+
+// TrashPolicy says how long removed entries stay in the trash, and the
+// free space below which the reaper frees them early.
+type TrashPolicy struct {
+	Retention  time.Duration // 0 keeps items until space runs low
+	MinFreePct uint64        // of the data blocks; 0 never frees early
+	Interval   time.Duration // between reaper passes (0 for a minute)
+}
+
+// TrashItem describes an entry of the trash.
+type TrashItem struct {
+	Name    string // in .trash
+	Path    string // before it was removed ("" if unknown, e.g. the .info file is gone)
+	Removed time.Time
+}
+
+type trash struct {
+	policy TrashPolicy
+	mu     *sync.Mutex // serializes reaper passes
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// StartTrash makes REMOVE and RMDIR move entries to the trash, and
+// starts the reaper.  It must be called before serving requests.
+func (nfs *Nfs) StartTrash(policy TrashPolicy) {
+	if policy.Interval == 0 {
+		policy.Interval = trashInterval
+	}
+	t := &trash{
+		policy: policy,
+		mu:     new(sync.Mutex),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	nfs.trash = t
+	go nfs.trashReaper(t)
+}
+
+// Stops the reaper, interrupting its pass.
+func (nfs *Nfs) stopTrash() {
+	if nfs.trash == nil {
+		return
+	}
+	close(nfs.trash.stop)
+	<-nfs.trash.done
+}
+
+func (nfs *Nfs) trashReaper(t *trash) {
+	defer close(t.done)
+	ticker := time.NewTicker(t.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			n, err := nfs.reapTrash(time.Now())
+			if err != nil {
+				util.DPrintf(0, "trash reaper: %v\n", err)
+			} else if n > 0 {
+				util.DPrintf(1, "trash reaper: freed %d items\n", n)
+			}
+		}
+	}
+}
+
+// ReapTrash frees the items of the trash that the policy lets go now,
+// and returns how many.
+func (nfs *Nfs) ReapTrash() (uint64, error) {
+	if nfs.trash == nil {
+		return 0, errors.New("the trash is off")
+	}
+	return nfs.reapTrash(time.Now())
+}
+
+func (nfs *Nfs) reapTrash(now time.Time) (uint64, error) {
+	t := nfs.trash
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tinum, items, _ := nfs.trashItems()
+	var n uint64 = 0
+	for _, it := range items {
+		expired := t.policy.Retention != 0 && now.Sub(it.Removed) >= t.policy.Retention
+		if !expired && !nfs.trashLow() {
+			break // the items after it are younger
+		}
+		job := &treeJob{info: TreeJobInfo{Op: TreeRemove, Path: it.Name}, cancel: t.stop}
+		err := nfs.runTree(job, func(tw *treeWalker) error {
+			if err := tw.remove(tinum, it.Name); err != nil {
+				return err
+			}
+			return tw.remove(tinum, it.Name+trashInfo)
+		})
+		if err != nil {
+			return n, fmt.Errorf("%s: %v", it.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Reports whether the free blocks, counting those the shrinker is
+// about to free, are fewer than MinFreePct of the data blocks.
+func (nfs *Nfs) trashLow() bool {
+	pct := nfs.trash.policy.MinFreePct
+	if pct == 0 {
+		return false
+	}
+	super := nfs.fsstate.Super
+	ndata := uint64(super.MaxBnum() - super.DataStart())
+	nfree := nfs.fsstate.Balloc.NumFree() + nfs.shrinkst.Stats().PendingBytes/disk.BlockSize
+	return nfree*100 < ndata*pct
+}
+
+// TrashItems returns the items of the trash, oldest first.
+func (nfs *Nfs) TrashItems() []TrashItem {
+	tinum, items, infos := nfs.trashItems()
+	if tinum == common.NULLINUM {
+		return items
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	defer op.Abort()
+	tp := &trashPaths{
+		op:      op,
+		tinum:   tinum,
+		origins: make(map[string]trashOrigin),
+		paths:   make(map[string]string),
+		names:   make(map[common.Inum]map[common.Inum]string),
+	}
+	for _, it := range items {
+		inum, ok := infos[it.Name+trashInfo]
+		if !ok {
+			continue
+		}
+		if o, ok := readTrashInfo(op, inum); ok {
+			tp.origins[it.Name] = o
+		}
+	}
+	for i := range items {
+		items[i].Path = tp.item(items[i].Name)
+	}
+	return items
+}
+
+func trashName(now time.Time, inum common.Inum, name nfstypes.Filename3) string {
+	id := fmt.Sprintf("%d-%d-%s", now.Unix(), inum, name)
+	if max := int(dir.MAXNAMELEN) - 1 - len(trashInfo); len(id) > max {
+		id = id[:max]
+	}
+	return id
+}
+
+// Returns the time an item of the trash was removed, from its name.
+func parseTrashName(name string) (time.Time, bool) {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 || strings.HasSuffix(name, trashInfo) {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// Returns the trash directory, its items, oldest first, and the inums
+// of their .info files by name, or NULLINUM if there is no trash.
+// Entries that users put there are left out.
+func (nfs *Nfs) trashItems() (common.Inum, []TrashItem, map[string]common.Inum) {
+	op := fstxn.Begin(nfs.fsstate)
+	defer op.Abort()
+	items := make([]TrashItem, 0)
+	infos := make(map[string]common.Inum)
+	root := op.GetInodeInum(common.ROOTINUM)
+	tinum, _ := dir.LookupName(root, op, TRASHDIRNAME)
+	op.ReleaseInode(root)
+	if tinum == common.NULLINUM {
+		return common.NULLINUM, items, infos
+	}
+	tip := op.GetInodeInum(tinum)
+	if !isDir(tip) {
+		return common.NULLINUM, items, infos
+	}
+	dir.ApplyEnts(tip, op, 0, ^uint64(0), func(name string, inum common.Inum, off uint64) {
+		if t, ok := parseTrashName(name); ok {
+			items = append(items, TrashItem{Name: name, Removed: t})
+		} else if strings.HasSuffix(name, trashInfo) {
+			infos[name] = inum
+		}
+	})
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Removed.Equal(items[j].Removed) {
+			return items[i].Name < items[j].Name
+		}
+		return items[i].Removed.Before(items[j].Removed)
+	})
+	return tinum, items, infos
+}
+
+// Where an item of the trash was removed from, as its .info file says.
+type trashOrigin struct {
+	dir  common.Inum
+	gen  uint64
+	name string
+}
+
+func formatTrashInfo(o trashOrigin, now time.Time) []byte {
+	return []byte(fmt.Sprintf("dir=%d\ngen=%d\nname=%q\ntime=%d\n", o.dir, o.gen, o.name, now.Unix()))
+}
+
+// Reads the .info file inum, which the caller must not hold locked (it
+// may have a lower inum than the trash).
+func readTrashInfo(op *fstxn.FsTxn, inum common.Inum) (trashOrigin, bool) {
+	var o trashOrigin
+	ip := op.GetInodeInum(inum)
+	if ip == nil {
+		return o, false
+	}
+	defer op.ReleaseInode(ip)
+	if ip.Kind != nfstypes.NF3REG {
+		return o, false
+	}
+	data, _, ok := ip.Read(op.Atxn, 0, trashMaxInfo)
+	if !ok {
+		return o, false
+	}
+	var found = 0
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "dir":
+			var n uint64
+			n, err = strconv.ParseUint(kv[1], 10, 64)
+			o.dir = common.Inum(n)
+		case "gen":
+			o.gen, err = strconv.ParseUint(kv[1], 10, 64)
+		case "name":
+			o.name, err = strconv.Unquote(kv[1])
+		default:
+			continue
+		}
+		if err != nil {
+			return o, false
+		}
+		found++
+	}
+	return o, found == 3
+}
+
+// Resolves the paths of the items of the trash, holding one inode at a
+// time.  It reads each directory at most once, to name its
+// subdirectories.
+type trashPaths struct {
+	op      *fstxn.FsTxn
+	tinum   common.Inum
+	origins map[string]trashOrigin                 // by item name
+	paths   map[string]string                      // by item name
+	names   map[common.Inum]map[common.Inum]string // of a directory's subdirectories
+}
+
+// Returns the path that item had, or "" if its directory is gone.
+func (tp *trashPaths) item(name string) string {
+	if p, ok := tp.paths[name]; ok {
+		return p
+	}
+	tp.paths[name] = "" // in case the item is below itself
+	o, ok := tp.origins[name]
+	if !ok {
+		return ""
+	}
+	ip := tp.op.GetInodeInum(o.dir)
+	if !isDir(ip) || ip.Gen != o.gen {
+		if ip != nil {
+			tp.op.ReleaseInode(ip)
+		}
+		return ""
+	}
+	tp.op.ReleaseInode(ip)
+	d := tp.dir(o.dir)
+	if d == "" {
+		return ""
+	}
+	p := path.Join(d, o.name)
+	tp.paths[name] = p
+	return p
+}
+
+// Returns the path of directory inum, or "" if it is gone.
+func (tp *trashPaths) dir(inum common.Inum) string {
+	names := make([]string, 0)
+	var prefix = "/"
+	for depth := 0; inum != common.ROOTINUM; depth++ {
+		if depth == trashMaxDepth {
+			prefix = "/..."
+			break
+		}
+		ip := tp.op.GetInodeInum(inum)
+		if !isDir(ip) {
+			if ip != nil {
+				tp.op.ReleaseInode(ip)
+			}
+			return ""
+		}
+		parent, _ := dir.LookupName(ip, tp.op, "..")
+		tp.op.ReleaseInode(ip)
+		name, ok := tp.subdirs(parent)[inum]
+		if !ok {
+			return ""
+		}
+		if parent == tp.tinum {
+			prefix = tp.item(name)
+			if prefix == "" {
+				return ""
+			}
+			break
+		}
+		names = append(names, name)
+		inum = parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return path.Join(append([]string{prefix}, names...)...)
+}
+
+// Returns the names of the entries of directory dinum by inum.
+func (tp *trashPaths) subdirs(dinum common.Inum) map[common.Inum]string {
+	if names, ok := tp.names[dinum]; ok {
+		return names
+	}
+	names := make(map[common.Inum]string)
+	tp.names[dinum] = names
+	dip := tp.op.GetInodeInum(dinum)
+	if dip == nil {
+		return names
+	}
+	if isDir(dip) {
+		dir.ApplyEnts(dip, tp.op, 0, ^uint64(0), func(n string, i common.Inum, off uint64) {
+			if n != "." && n != ".." {
+				names[i] = n
+			}
+		})
+	}
+	tp.op.ReleaseInode(dip)
+	return names
+}
+
+// Returns whether directory inum is the trash tinum or below it, and
+// false if inum isn't a directory any more.
+func (nfs *Nfs) inTrash(inum common.Inum, tinum common.Inum) (bool, bool) {
+	op := fstxn.Begin(nfs.fsstate)
+	defer op.Abort()
+	for depth := 0; inum != common.ROOTINUM && depth < trashMaxDepth; depth++ {
+		if inum == tinum {
+			return true, true
+		}
+		ip := op.GetInodeInum(inum)
+		if !isDir(ip) {
+			if ip != nil {
+				op.ReleaseInode(ip)
+			}
+			return false, false
+		}
+		parent, _ := dir.LookupName(ip, op, "..")
+		op.ReleaseInode(ip)
+		inum = parent
+	}
+	return false, true
+}
+
+// Returns the trash directory, making it if there is none.  On error,
+// it returns a transaction for the caller to abort.
+func (nfs *Nfs) trashDir() (*fstxn.FsTxn, common.Inum, nfstypes.Nfsstat3) {
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		root := op.GetInodeInum(common.ROOTINUM)
+		inum, _ := dir.LookupName(root, op, TRASHDIRNAME)
+		op.Abort()
+		if inum != common.NULLINUM {
+			return nil, inum, nfstypes.NFS3_OK
+		}
+		op, err, _, _ := nfs.doCreate(fh.MkRootFh3(), TRASHDIRNAME, nfstypes.NF3DIR, nil, nil)
+		if err == nfstypes.NFS3ERR_EXIST {
+			op.Abort()
+			continue
+		}
+		if err != nfstypes.NFS3_OK {
+			return op, common.NULLINUM, err
+		}
+		if !op.Commit() {
+			return fstxn.Begin(nfs.fsstate), common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+		}
+	}
+}
+
+// Removes the entry name of directory dfh, moving it to the trash if
+// the trash is on.
+func (nfs *Nfs) remove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bool) (*fstxn.FsTxn, nfstypes.Nfsstat3) {
+	if nfs.trash == nil || dir.IllegalName(name) {
+		return nfs.doRemove(dfh, name, isdir)
+	}
+	h := fh.MakeFh(dfh)
+	if h.Ino == common.ROOTINUM && name == TRASHDIRNAME {
+		return nfs.doRemove(dfh, name, isdir)
+	}
+	for {
+		op, tinum, err := nfs.trashDir()
+		if err == nfstypes.NFS3ERR_NOSPC || err == nfstypes.NFS3ERR_DQUOT {
+			util.DPrintf(1, "trash: no trash directory, remove %v\n", name)
+			op.Abort()
+			return nfs.doRemove(dfh, name, isdir)
+		}
+		if err != nfstypes.NFS3_OK {
+			return op, err
+		}
+		if in, ok := nfs.inTrash(h.Ino, tinum); in || !ok {
+			return nfs.doRemove(dfh, name, isdir)
+		}
+		op, err, done := nfs.doTrash(h, name, isdir, tinum)
+		if done {
+			return op, err
+		}
+	}
+}
+
+// Moves the entry name of directory h to trash directory tinum.  It
+// returns false, after aborting, if something changed meanwhile, so
+// that the caller retries.
+func (nfs *Nfs) doTrash(h fh.Fh, name nfstypes.Filename3, isdir bool,
+	tinum common.Inum) (*fstxn.FsTxn, nfstypes.Nfsstat3, bool) {
+	op := fstxn.Begin(nfs.fsstate)
+	dip := op.GetInodeFh(h.MakeFh3())
+	if dip == nil {
+		return op, nfstypes.NFS3ERR_STALE, true
+	}
+	inum, _ := dir.LookupName(dip, op, name)
+	if inum == common.NULLINUM {
+		return op, nfstypes.NFS3ERR_NOENT, true
+	}
+	op.Abort()
+	if h.Ino == tinum || inum == tinum {
+		// the trash moved
+		op, err := nfs.doRemove(h.MakeFh3(), name, isdir)
+		return op, err, true
+	}
+
+	op = fstxn.Begin(nfs.fsstate)
+	inums := []common.Inum{h.Ino, inum, tinum}
+	sort.Slice(inums, func(i, j int) bool { return inums[i] < inums[j] })
+	inodes := lockInodes(op, inums)
+	if inodes == nil {
+		return nil, nfstypes.NFS3_OK, false
+	}
+	byInum := make(map[common.Inum]int)
+	for i, inm := range inums {
+		byInum[inm] = i
+	}
+	dip, ip, tip := inodes[byInum[h.Ino]], inodes[byInum[inum]], inodes[byInum[tinum]]
+	if again, _ := dir.LookupName(dip, op, name); dip.Gen != h.Gen || again != inum {
+		op.Abort()
+		return nil, nfstypes.NFS3_OK, false
+	}
+	if !isDir(tip) {
+		// something other than a directory took the trash's name
+		op.Abort()
+		op, err := nfs.doRemove(h.MakeFh3(), name, isdir)
+		return op, err, true
+	}
+	if isdir && ip.Kind != nfstypes.NF3DIR {
+		return op, nfstypes.NFS3ERR_INVAL, true
+	}
+	if isdir && !dir.IsDirEmpty(ip, op) {
+		return op, nfstypes.NFS3ERR_INVAL, true
+	}
+	nip := op.AllocInode(nfstypes.NF3REG, tinum, nil)
+	if nip == nil {
+		util.DPrintf(1, "trash: out of inodes, remove %v\n", name)
+		op.Abort()
+		op, err := nfs.doRemove(h.MakeFh3(), name, isdir)
+		return op, err, true
+	}
+	if nip.IsShrinking() {
+		util.DPrintf(1, "trash: abort alloc # %v to shrink", nip.Inum)
+		op.Abort()
+		if !nfs.shrinkst.DoShrink(nip.Inum) {
+			return fstxn.Begin(nfs.fsstate), nfstypes.NFS3ERR_SERVERFAULT, true
+		}
+		return nil, nfstypes.NFS3_OK, false
+	}
+	now := time.Now()
+	id := trashName(now, inum, name)
+	info := formatTrashInfo(trashOrigin{dir: h.Ino, gen: h.Gen, name: string(name)}, now)
+	if _, ok := nip.Write(op.Atxn, 0, uint64(len(info)), info); !ok ||
+		!dir.AddName(tip, op, nip.Inum, nfstypes.Filename3(id+trashInfo)) {
+		util.DPrintf(1, "trash: out of space, remove %v\n", name)
+		op.Abort()
+		op, err := nfs.doRemove(h.MakeFh3(), name, isdir)
+		return op, err, true
+	}
+	if !dir.AddName(tip, op, inum, nfstypes.Filename3(id)) {
+		util.DPrintf(1, "trash: out of space, remove %v\n", name)
+		op.Abort()
+		op, err := nfs.doRemove(h.MakeFh3(), name, isdir)
+		return op, err, true
+	}
+	if !dir.RemName(dip, op, name) {
+		return op, nfstypes.NFS3ERR_IO, true
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		if !dir.WriteEnt(ip, op, dir.DIRENTSZ, tinum, "..") {
+			return op, nfstypes.NFS3ERR_IO, true
+		}
+		dip.Nlink = dip.Nlink - 1
+		dip.WriteInode(op.Atxn)
+		tip.Nlink = tip.Nlink + 1
+		tip.WriteInode(op.Atxn)
+	}
+	util.DPrintf(1, "trash: %v -> %s\n", name, id)
+	return op, nfstypes.NFS3_OK, true
+}
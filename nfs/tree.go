@@ -0,0 +1,717 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Tree jobs remove, copy or measure (du) a whole tree inside the
+// server, rather than with an RPC per entry.  A job runs in the
+// background and packs as many entries into a transaction as fit in
+// half the log, like Import, reporting its progress as it goes; it can
+// be canceled between entries, keeping what it did so far.
+//
+// A transaction holds the locks of the inodes it got until it commits,
+// so a job locks inodes in ascending inum order, as RPCs do: when it
+// needs an inode below one it holds, it commits first, and then looks
+// up the entry again, which may have changed meanwhile.  It also
+// commits before it locks or allocates an inode once its transaction
+// holds the share lock, which the transaction takes on the first share
+// count it reads or changes, since others take the share lock while
+// holding inode locks.  Removing a
+// file frees at most treeMaxFree of its blocks in the job's
+// transaction, and hands larger files to the shrinker.  Copying a file
+// clones it if the image has share counts, and copies its data
+// otherwise.
+//
+
+const (
+	treeBudget    = jrnl.LogBlocks / 2
+	treeMaxFree   = 16  // blocks a remove frees itself
+	treeMaxLocked = 256 // inodes a transaction of a job locks
+	treeMaxRounds = 10  // times a directory is emptied before giving up
+	treeMaxDone   = 16  // finished jobs kept for reporting
+	// an entry's inodes and their bitmap, its directory block and the
+	// index blocks above it, the share blocks of a clone's roots, and
+	// the blocks a remove frees with their bitmap, checksum and share
+	// blocks
+	treeEntryCost = 2*inode.NINDLEVEL + 4 + inode.NBLKINO + 3*treeMaxFree
+)
+
+type TreeOp string
+
+const (
+	TreeRemove TreeOp = "remove"
+	TreeCopy   TreeOp = "copy"
+	TreeDu     TreeOp = "du"
+)
+
+var ErrCanceled = errors.New("canceled")
+
+// TreeJobInfo reports the progress of a tree job: the entries removed,
+// copied or measured so far.
+type TreeJobInfo struct {
+	Id       uint64
+	Op       TreeOp
+	Path     string
+	Dst      string // for copy
+	Files    uint64
+	Dirs     uint64
+	Symlinks uint64
+	Bytes    uint64 // sizes of files and symlinks
+	Blocks   uint64 // for du, index blocks included
+	Txns     uint64
+	Done     bool
+	Err      string
+}
+
+type treeJob struct {
+	info     TreeJobInfo
+	cancel   chan struct{}
+	canceled bool
+}
+
+type treeJobs struct {
+	mu     *sync.Mutex
+	cond   *sync.Cond // signaled when a job finishes
+	jobs   []*treeJob // oldest first
+	nextId uint64
+	closed bool
+}
+
+func mkTreeJobs() *treeJobs {
+	mu := new(sync.Mutex)
+	return &treeJobs{
+		mu:     mu,
+		cond:   sync.NewCond(mu),
+		jobs:   make([]*treeJob, 0),
+		nextId: 1,
+	}
+}
+
+func (tj *treeJobs) add(info TreeJobInfo) (*treeJob, error) {
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	if tj.closed {
+		return nil, errors.New("file system is shutting down")
+	}
+	info.Id = tj.nextId
+	tj.nextId++
+	job := &treeJob{info: info, cancel: make(chan struct{})}
+	tj.jobs = append(tj.jobs, job)
+	return job, nil
+}
+
+func (tj *treeJobs) update(job *treeJob, f func(info *TreeJobInfo)) {
+	tj.mu.Lock()
+	f(&job.info)
+	tj.mu.Unlock()
+}
+
+// Marks job done, and forgets the oldest finished jobs beyond
+// treeMaxDone.
+func (tj *treeJobs) finish(job *treeJob, err error) {
+	tj.mu.Lock()
+	job.info.Done = true
+	if err != nil {
+		job.info.Err = err.Error()
+	}
+	var ndone = 0
+	for _, j := range tj.jobs {
+		if j.info.Done {
+			ndone++
+		}
+	}
+	jobs := make([]*treeJob, 0, len(tj.jobs))
+	for _, j := range tj.jobs {
+		if j.info.Done && ndone > treeMaxDone {
+			ndone--
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	tj.jobs = jobs
+	tj.cond.Broadcast()
+	tj.mu.Unlock()
+}
+
+func (tj *treeJobs) lookup(id uint64) *treeJob {
+	for _, j := range tj.jobs {
+		if j.info.Id == id {
+			return j
+		}
+	}
+	return nil
+}
+
+func (tj *treeJobs) cancelLocked(job *treeJob) {
+	if !job.canceled {
+		job.canceled = true
+		close(job.cancel)
+	}
+}
+
+// Cancels the running jobs and waits for them, and refuses new ones.
+func (tj *treeJobs) shutdown() {
+	tj.mu.Lock()
+	tj.closed = true
+	for {
+		var running = false
+		for _, j := range tj.jobs {
+			if !j.info.Done {
+				tj.cancelLocked(j)
+				running = true
+			}
+		}
+		if !running {
+			break
+		}
+		tj.cond.Wait()
+	}
+	tj.mu.Unlock()
+}
+
+// TreeJobs returns the running tree jobs and the last ones that
+// finished, oldest first.
+func (nfs *Nfs) TreeJobs() []TreeJobInfo {
+	tj := nfs.trees
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	infos := make([]TreeJobInfo, 0, len(tj.jobs))
+	for _, j := range tj.jobs {
+		infos = append(infos, j.info)
+	}
+	return infos
+}
+
+// CancelTreeJob stops tree job id after the entry it is working on.
+func (nfs *Nfs) CancelTreeJob(id uint64) error {
+	tj := nfs.trees
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	job := tj.lookup(id)
+	if job == nil {
+		return fmt.Errorf("no tree job %d", id)
+	}
+	tj.cancelLocked(job)
+	return nil
+}
+
+// WaitTreeJob waits until tree job id is done, and returns false if
+// there is no such job.
+func (nfs *Nfs) WaitTreeJob(id uint64) (TreeJobInfo, bool) {
+	tj := nfs.trees
+	tj.mu.Lock()
+	defer tj.mu.Unlock()
+	for {
+		job := tj.lookup(id)
+		if job == nil {
+			return TreeJobInfo{}, false
+		}
+		if job.info.Done {
+			return job.info, true
+		}
+		tj.cond.Wait()
+	}
+}
+
+// Returns the directory of p and the name of p in it, for a p other
+// than the root.
+func (nfs *Nfs) lookupParent(p string) (common.Inum, string, error) {
+	p = path.Clean("/" + p)
+	name := path.Base(p)
+	if p == "/" {
+		return common.NULLINUM, "", errors.New("the root has no name")
+	}
+	if uint64(len(name)) >= dir.MAXNAMELEN {
+		return common.NULLINUM, "", fmt.Errorf("%s: name too long", p)
+	}
+	dinum, err := nfs.lookupPath(path.Dir(p))
+	return dinum, name, err
+}
+
+// StartTreeJob starts removing the tree at p, copying it to the new
+// path dst, or adding up its sizes, in the background; both paths are
+// relative to the root.  It returns the job's id, or an error if the
+// paths are bad.
+func (nfs *Nfs) StartTreeJob(top TreeOp, p string, dst string) (uint64, error) {
+	if _, err := nfs.lookupPath(p); err != nil {
+		return 0, err
+	}
+	var run func(tw *treeWalker) error
+	switch top {
+	case TreeRemove:
+		dinum, name, err := nfs.lookupParent(p)
+		if err != nil {
+			return 0, err
+		}
+		run = func(tw *treeWalker) error {
+			return tw.remove(dinum, name)
+		}
+	case TreeCopy:
+		sdinum, name, err := nfs.lookupParent(p)
+		if err != nil {
+			return 0, err
+		}
+		ddinum, dname, err := nfs.lookupParent(dst)
+		if err != nil {
+			return 0, err
+		}
+		src, to := path.Clean("/"+p), path.Clean("/"+dst)
+		if to == src || (len(to) > len(src) && to[:len(src)+1] == src+"/") {
+			return 0, fmt.Errorf("can't copy %s into itself", src)
+		}
+		if ddinum == common.ROOTINUM && dname == SNAPDIRNAME {
+			return 0, fmt.Errorf("%s: already exists", to)
+		}
+		run = func(tw *treeWalker) error {
+			return tw.copy(sdinum, name, ddinum, dname)
+		}
+	case TreeDu:
+		inum, _ := nfs.lookupPath(p)
+		run = func(tw *treeWalker) error {
+			return tw.du(inum)
+		}
+	default:
+		return 0, fmt.Errorf("bad tree operation %q", top)
+	}
+	job, err := nfs.trees.add(TreeJobInfo{Op: top, Path: p, Dst: dst})
+	if err != nil {
+		return 0, err
+	}
+	util.DPrintf(1, "tree job %d: %s %s %s\n", job.info.Id, top, p, dst)
+	go func() {
+		err := nfs.runTree(job, run)
+		util.DPrintf(1, "tree job %d: done %v\n", job.info.Id, err)
+		nfs.trees.finish(job, err)
+	}()
+	return job.info.Id, nil
+}
+
+// Runs run with a walker for job, and ends its last transaction.
+func (nfs *Nfs) runTree(job *treeJob, run func(tw *treeWalker) error) error {
+	tw := &treeWalker{nfs: nfs, job: job, kind: job.info.Op,
+		shrinking: make([]common.Inum, 0)}
+	tw.begin()
+	err := run(tw)
+	if cerr := tw.end(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type treeWalker struct {
+	nfs       *Nfs
+	job       *treeJob
+	kind      TreeOp
+	op        *fstxn.FsTxn
+	held      common.Inum // highest inum op locked
+	nlocked   uint64
+	shrinking []common.Inum
+}
+
+func (tw *treeWalker) begin() {
+	tw.op = fstxn.Begin(tw.nfs.fsstate)
+	// removing must work on a full file system
+	tw.op.Atxn.UseReserved = tw.kind == TreeRemove
+	tw.held = common.NULLINUM
+	tw.nlocked = 0
+}
+
+// Ends the current transaction (even on error, since the inodes in the
+// inode cache reflect it), and finishes shrinking the inodes that were
+// in the way.
+func (tw *treeWalker) end() error {
+	var ok = true
+	if tw.kind == TreeDu {
+		tw.op.Abort()
+	} else {
+		ok = tw.op.Commit()
+	}
+	tw.nfs.trees.update(tw.job, func(info *TreeJobInfo) { info.Txns++ })
+	if !ok {
+		return errors.New("commit failed")
+	}
+	for _, inum := range tw.shrinking {
+		if !tw.nfs.shrinkst.DoShrink(inum) {
+			return fmt.Errorf("shrinking inode %d failed", inum)
+		}
+	}
+	tw.shrinking = tw.shrinking[:0]
+	return nil
+}
+
+func (tw *treeWalker) commit() error {
+	err := tw.end()
+	tw.begin()
+	return err
+}
+
+// Commits first if another entry might not fit in the transaction.
+func (tw *treeWalker) reserve() error {
+	if tw.op.Atxn.Op.NDirty()+treeEntryCost < treeBudget {
+		return nil
+	}
+	return tw.commit()
+}
+
+// Shrinks inum, which is in the way, after committing.
+func (tw *treeWalker) shrink(inum common.Inum) error {
+	tw.shrinking = append(tw.shrinking, inum)
+	return tw.commit()
+}
+
+func (tw *treeWalker) canceled() bool {
+	select {
+	case <-tw.job.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (tw *treeWalker) count(ip *inode.Inode, blocks uint64) {
+	kind, size := ip.Kind, ip.Size
+	tw.nfs.trees.update(tw.job, func(info *TreeJobInfo) {
+		switch kind {
+		case nfstypes.NF3DIR:
+			info.Dirs++
+		case nfstypes.NF3LNK:
+			info.Symlinks++
+			info.Bytes += size
+		default:
+			info.Files++
+			info.Bytes += size
+		}
+		info.Blocks += blocks
+	})
+}
+
+// Returns inodes inums (nil for a free one), locking those that the
+// transaction doesn't hold in ascending order, after committing if it
+// holds a higher one or too many, or holds the share lock (see
+// alloctxn.Sharing).
+func (tw *treeWalker) lock(inums ...common.Inum) ([]*inode.Inode, error) {
+	var restart = tw.nlocked+uint64(len(inums)) > treeMaxLocked
+	for _, inum := range inums {
+		if !tw.op.OwnInum(inum) && (inum < tw.held || tw.op.Atxn.Sharing()) {
+			restart = true
+		}
+	}
+	if restart {
+		if err := tw.commit(); err != nil {
+			return nil, err
+		}
+	}
+	sorted := make([]common.Inum, len(inums))
+	copy(sorted, inums)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, inum := range sorted {
+		if tw.op.OwnInum(inum) {
+			continue
+		}
+		if tw.op.GetInodeInum(inum) != nil {
+			tw.nlocked++
+		}
+		if inum > tw.held {
+			tw.held = inum
+		}
+	}
+	ips := make([]*inode.Inode, len(inums))
+	for i, inum := range inums {
+		if tw.op.OwnInum(inum) {
+			ips[i] = tw.op.GetInodeUnlocked(inum)
+		}
+	}
+	return ips, nil
+}
+
+// Locks directory dinum, its entry name, and others, and returns them
+// (the entry is nil if there is none).
+func (tw *treeWalker) lockEntry(dinum common.Inum, name string,
+	others ...common.Inum) ([]*inode.Inode, *inode.Inode, error) {
+	for {
+		ips, err := tw.lock(append([]common.Inum{dinum}, others...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isDir(ips[0]) {
+			return nil, nil, fmt.Errorf("directory %d was removed", dinum)
+		}
+		inum, _ := dir.LookupName(ips[0], tw.op, nfstypes.Filename3(name))
+		if inum == common.NULLINUM {
+			return ips, nil, nil
+		}
+		ips, err = tw.lock(append([]common.Inum{dinum, inum}, others...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !isDir(ips[0]) {
+			return nil, nil, fmt.Errorf("directory %d was removed", dinum)
+		}
+		// the entry may have changed if lock committed
+		again, _ := dir.LookupName(ips[0], tw.op, nfstypes.Filename3(name))
+		if again == inum && ips[1] != nil {
+			ip := ips[1]
+			return append(ips[:1], ips[2:]...), ip, nil
+		}
+	}
+}
+
+type treeEnt struct {
+	name string
+	inum common.Inum
+}
+
+// Returns the entries of directory dip, other than . and ..
+func (tw *treeWalker) ents(dip *inode.Inode) []treeEnt {
+	var ents = make([]treeEnt, 0)
+	dir.ApplyEnts(dip, tw.op, 0, ^uint64(0), func(name string, inum common.Inum, off uint64) {
+		if name != "." && name != ".." {
+			ents = append(ents, treeEnt{name: name, inum: inum})
+		}
+	})
+	return ents
+}
+
+// Removes the entry name of directory dinum, and the tree below it.
+func (tw *treeWalker) remove(dinum common.Inum, name string) error {
+	for round := 0; ; round++ {
+		if tw.canceled() {
+			return ErrCanceled
+		}
+		if err := tw.reserve(); err != nil {
+			return err
+		}
+		dips, ip, err := tw.lockEntry(dinum, name)
+		if err != nil || ip == nil {
+			return err
+		}
+		dip := dips[0]
+		if ip.IsShrinking() {
+			if err := tw.shrink(ip.Inum); err != nil {
+				return err
+			}
+			continue
+		}
+		if ip.Kind == nfstypes.NF3DIR && !dir.IsDirEmpty(ip, tw.op) {
+			if round >= treeMaxRounds {
+				return fmt.Errorf("%s: directory keeps filling up", name)
+			}
+			for _, e := range tw.ents(ip) {
+				if err := tw.remove(ip.Inum, e.name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !dir.RemName(dip, tw.op, nfstypes.Filename3(name)) {
+			return fmt.Errorf("%s: remove failed", name)
+		}
+		if ip.Kind == nfstypes.NF3DIR {
+			dip.Nlink = dip.Nlink - 1 // for ..
+			dip.WriteInode(tw.op.Atxn)
+		}
+		tw.count(ip, 0)
+		tw.nfs.doDecLinkMax(tw.op, ip, treeMaxFree)
+		return nil
+	}
+}
+
+// Allocates an inode of kind in directory dinum.  An inode that is
+// still shrinking is freed again, and shrunk after the transaction
+// commits.
+func (tw *treeWalker) alloc(kind nfstypes.Ftype3, dinum common.Inum) *inode.Inode {
+	for {
+		ip := tw.op.AllocInode(kind, dinum, nil)
+		if ip == nil || !ip.IsShrinking() {
+			return ip
+		}
+		util.DPrintf(1, "tree: skip shrinking # %v\n", ip.Inum)
+		tw.op.Atxn.FreeINum(ip.Inum)
+		tw.op.ReleaseInode(ip)
+		tw.shrinking = append(tw.shrinking, ip.Inum)
+	}
+}
+
+// Copies the entry name of directory sdinum to the new entry dname of
+// directory ddinum, and the tree below it.
+func (tw *treeWalker) copy(sdinum common.Inum, name string, ddinum common.Inum, dname string) error {
+	for {
+		if tw.canceled() {
+			return ErrCanceled
+		}
+		if err := tw.reserve(); err != nil {
+			return err
+		}
+		dips, ip, err := tw.lockEntry(sdinum, name, ddinum)
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			return fmt.Errorf("%s was removed", name)
+		}
+		ddip := dips[1]
+		if !isDir(ddip) {
+			return fmt.Errorf("directory %d was removed", ddinum)
+		}
+		if inum, _ := dir.LookupName(ddip, tw.op, nfstypes.Filename3(dname)); inum != common.NULLINUM {
+			return fmt.Errorf("%s: already exists", dname)
+		}
+		if ip.Kind == nfstypes.NF3REG && ip.IsShrinking() {
+			if err := tw.shrink(ip.Inum); err != nil {
+				return err
+			}
+			continue
+		}
+		// the new inode may be a shrinking one, whose lock a shrinker
+		// worker holds while it waits for the share lock
+		if tw.op.Atxn.Sharing() {
+			if err := tw.commit(); err != nil {
+				return err
+			}
+			continue
+		}
+		nip := tw.alloc(ip.Kind, ddinum)
+		if nip == nil {
+			return errors.New("out of inodes")
+		}
+		if !tw.copyInode(ip, nip, ddip) || !dir.AddName(ddip, tw.op, nip.Inum, nfstypes.Filename3(dname)) {
+			tw.nfs.doDecLink(tw.op, nip)
+			return fmt.Errorf("%s: out of space", dname)
+		}
+		if ip.Kind == nfstypes.NF3DIR {
+			ddip.Nlink = ddip.Nlink + 1 // for ..
+			ddip.WriteInode(tw.op.Atxn)
+		}
+		nip.Atime = ip.Atime
+		nip.Mtime = ip.Mtime
+		nip.WriteInode(tw.op.Atxn)
+		tw.count(ip, 0)
+		if ip.Kind == nfstypes.NF3DIR {
+			return tw.copyEnts(ip.Inum, nip.Inum)
+		}
+		if ip.Kind == nfstypes.NF3REG && tw.nfs.fsstate.Super.Legacy() {
+			return tw.copyData(ip.Inum, nip.Inum, name)
+		}
+		return nil
+	}
+}
+
+// Makes nip, a new inode in directory ddip, a copy of ip, but for the
+// entries of a directory and the data of a file that can't be cloned.
+func (tw *treeWalker) copyInode(ip *inode.Inode, nip *inode.Inode, ddip *inode.Inode) bool {
+	switch ip.Kind {
+	case nfstypes.NF3DIR:
+		return dir.InitDir(nip, tw.op, ddip.Inum)
+	case nfstypes.NF3LNK:
+		data, _, ok := ip.Read(tw.op.Atxn, 0, ip.Size)
+		if !ok {
+			return false
+		}
+		_, ok = nip.Write(tw.op.Atxn, 0, uint64(len(data)), data)
+		return ok
+	default:
+		if tw.nfs.fsstate.Super.Legacy() {
+			return true
+		}
+		return nip.Clone(tw.op.Atxn, ip)
+	}
+}
+
+func (tw *treeWalker) copyEnts(sdinum common.Inum, ddinum common.Inum) error {
+	ips, err := tw.lock(sdinum)
+	if err != nil {
+		return err
+	}
+	if !isDir(ips[0]) {
+		return fmt.Errorf("directory %d was removed", sdinum)
+	}
+	for _, e := range tw.ents(ips[0]) {
+		if err := tw.copy(sdinum, e.name, ddinum, e.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the data of file inum to the file copy, importChunk blocks at
+// a time.
+func (tw *treeWalker) copyData(inum common.Inum, copy common.Inum, name string) error {
+	var off uint64 = 0
+	for {
+		if tw.canceled() {
+			return ErrCanceled
+		}
+		if tw.op.Atxn.Op.NDirty()+importChunk+treeEntryCost >= treeBudget {
+			if err := tw.commit(); err != nil {
+				return err
+			}
+		}
+		ips, err := tw.lock(inum, copy)
+		if err != nil {
+			return err
+		}
+		if ips[0] == nil || ips[1] == nil {
+			return fmt.Errorf("%s was removed", name)
+		}
+		data, eof, ok := ips[0].Read(tw.op.Atxn, off, importChunk*disk.BlockSize)
+		if !ok {
+			return fmt.Errorf("%s: checksum mismatch at offset %d", name, off)
+		}
+		if eof || len(data) == 0 {
+			return nil
+		}
+		n, ok := ips[1].Write(tw.op.Atxn, off, uint64(len(data)), data)
+		if !ok || n != uint64(len(data)) {
+			return fmt.Errorf("%s: out of space", name)
+		}
+		off += n
+	}
+}
+
+// Adds up the sizes and blocks of the tree at inum.
+func (tw *treeWalker) du(inum common.Inum) error {
+	if tw.canceled() {
+		return ErrCanceled
+	}
+	ips, err := tw.lock(inum)
+	if err != nil {
+		return err
+	}
+	ip := ips[0]
+	if ip == nil {
+		return nil // removed meanwhile
+	}
+	var blocks uint64 = 0
+	ip.Blocks(func(bn common.Bnum) []byte {
+		return tw.op.Atxn.ReadBlock(bn).Data
+	}, func(ref inode.BlockRef) bool {
+		blocks++
+		return true
+	})
+	tw.count(ip, blocks)
+	if ip.Kind != nfstypes.NF3DIR {
+		return nil
+	}
+	for _, e := range tw.ents(ip) {
+		if err := tw.du(e.inum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * The remote quota protocol, which quota(1) on clients uses to show a
+ * user's quotas on an NFS mount.  Version 2 can ask for a group's as
+ * well.  rquota_xdr.go and rquota_types.go are generated with:
+ *
+ *   go-rpcgen -i rquota.x -o rquota_xdr.go -t rquota_types.go \
+ *     -p nfstypes -unsigned-enum -const-type uint32
+ *
+ * (and the !goose build tag added to rquota_xdr.go, as to nfs_xdr.go).
+ */
+
+const RQ_PATHLEN = 1024;
+
+struct getquota_args {
+	string gqa_pathp<RQ_PATHLEN>;	/* path to filesystem of interest */
+	int gqa_uid;			/* user id */
+};
+
+const USRQUOTA = 0;
+const GRPQUOTA = 1;
+
+struct ext_getquota_args {
+	string gqa_pathp<RQ_PATHLEN>;	/* path to filesystem of interest */
+	int gqa_type;			/* USRQUOTA or GRPQUOTA */
+	int gqa_id;			/* user or group id */
+};
+
+/*
+ * Limits and usage are in units of rq_bsize bytes, and time left in
+ * seconds.
+ */
+struct rquota {
+	int rq_bsize;
+	bool rq_active;
+	unsigned int rq_bhardlimit;
+	unsigned int rq_bsoftlimit;
+	unsigned int rq_curblocks;
+	unsigned int rq_fhardlimit;
+	unsigned int rq_fsoftlimit;
+	unsigned int rq_curfiles;
+	unsigned int rq_btimeleft;
+	unsigned int rq_ftimeleft;
+};
+
+enum gqr_status {
+	Q_OK = 1,		/* quota returned */
+	Q_NOQUOTA = 2,		/* no quota for the id */
+	Q_EPERM = 3		/* no permission to access quota */ };
+
+union getquota_rslt switch (gqr_status status) {
+case Q_OK:
+	rquota gqr_rquota;
+case Q_NOQUOTA:
+	void;
+case Q_EPERM:
+	void;
+};
+
+program RQUOTAPROG {
+	version RQUOTAVERS {
+		getquota_rslt RQUOTAPROC_GETQUOTA(getquota_args) = 1;
+		getquota_rslt RQUOTAPROC_GETACTIVEQUOTA(getquota_args) = 2;
+	} = 1;
+	version EXT_RQUOTAVERS {
+		getquota_rslt EXT_RQUOTAPROC_GETQUOTA(ext_getquota_args) = 1;
+		getquota_rslt EXT_RQUOTAPROC_GETACTIVEQUOTA(ext_getquota_args) = 2;
+	} = 2;
+} = 100011;
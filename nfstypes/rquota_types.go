@@ -0,0 +1,47 @@
+package nfstypes
+
+const RQ_PATHLEN uint32 = 1024
+
+type Getquota_args struct {
+	Gqa_pathp string
+	Gqa_uid   int32
+}
+
+const USRQUOTA uint32 = 0
+const GRPQUOTA uint32 = 1
+
+type Ext_getquota_args struct {
+	Gqa_pathp string
+	Gqa_type  int32
+	Gqa_id    int32
+}
+type Rquota struct {
+	Rq_bsize      int32
+	Rq_active     bool
+	Rq_bhardlimit uint32
+	Rq_bsoftlimit uint32
+	Rq_curblocks  uint32
+	Rq_fhardlimit uint32
+	Rq_fsoftlimit uint32
+	Rq_curfiles   uint32
+	Rq_btimeleft  uint32
+	Rq_ftimeleft  uint32
+}
+type Gqr_status uint32
+
+const Q_OK Gqr_status = 1
+const Q_NOQUOTA Gqr_status = 2
+const Q_EPERM Gqr_status = 3
+
+type Getquota_rslt struct {
+	Status     Gqr_status
+	Gqr_rquota Rquota
+}
+
+const RQUOTAPROG uint32 = 100011
+const RQUOTAVERS uint32 = 1
+const RQUOTAPROC_GETQUOTA uint32 = 1
+const RQUOTAPROC_GETACTIVEQUOTA uint32 = 2
+const EXT_RQUOTAVERS uint32 = 2
+const EXT_RQUOTAPROC_GETQUOTA uint32 = 1
+const EXT_RQUOTAPROC_GETACTIVEQUOTA uint32 = 2
@@ -0,0 +1,545 @@
+package scrub
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fsck"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+type dup struct {
+	bn    common.Bnum
+	inum  common.Inum
+	owner string // describes the block's other owner
+}
+
+// A name in a directory
+type dirName struct {
+	ent fsck.Ent
+	dir bool // names a directory
+}
+
+// The names of a directory, as the pass last read them
+type dirNames struct {
+	dotdot common.Inum
+	names  []dirName
+}
+
+// A pass over all inodes
+type pass struct {
+	s       *Scrubber
+	st      *fstxn.FsState
+	changes *fstxn.Changes // by the transactions that committed since the pass started
+
+	problems []*fsck.Problem // the first MAXPROBLEMS
+	nproblem int
+	global   bool // whether the link checks ran
+
+	claims *fsck.Claims
+	dups   []dup
+	nlink  map[common.Inum]uint32 // allocated inodes
+	dirs   map[common.Inum]*dirNames
+}
+
+func mkPass(s *Scrubber) *pass {
+	sup := s.fsstate.Super
+	return &pass{
+		s:        s,
+		st:       s.fsstate,
+		changes:  s.fsstate.Track(),
+		problems: make([]*fsck.Problem, 0),
+		claims:   fsck.MkClaims(sup.NBlockBitmap*common.NBITBLOCK, s.owners),
+		dups:     make([]dup, 0),
+		nlink:    make(map[common.Inum]uint32),
+		dirs:     make(map[common.Inum]*dirNames),
+	}
+}
+
+func (p *pass) report(kind string, inum common.Inum, format string, a ...interface{}) {
+	pr := &fsck.Problem{Kind: kind, Inum: inum, Msg: fmt.Sprintf(format, a...)}
+	util.DPrintf(0, "Scrub: %v\n", pr)
+	p.nproblem++
+	if len(p.problems) < MAXPROBLEMS {
+		p.problems = append(p.problems, pr)
+	}
+}
+
+func (p *pass) inData(bn common.Bnum) bool {
+	return bn >= p.st.Super.DataStart() && bn < p.st.Super.MaxBnum()
+}
+
+// Records inum as the owner of bn, remembering bn as a duplicate if it
+// already has one and isn't shared.  A shared block is claimed once,
+// and the blocks below it with it.
+func (p *pass) claim(bn common.Bnum, inum common.Inum) bool {
+	if !p.claims.Covers(bn) { // the file system grew
+		return true
+	}
+	if p.claims.Claim(bn, inum) {
+		return true
+	}
+	if alloctxn.ReadShares(p.st.Super, p.st.Log, bn) > 0 {
+		return false
+	}
+	p.dups = append(p.dups, dup{bn: bn, inum: inum, owner: p.claims.Dup(bn)})
+	return false
+}
+
+// Returns the kind of inum as committed, without locking it.
+func (p *pass) peekKind(op *fstxn.FsTxn, inum common.Inum) nfstypes.Ftype3 {
+	b := op.Atxn.Op.ReadBuf(p.st.Super.Inum2Addr(inum), 32)
+	kind := marshal.NewDec(b.Data).GetInt32()
+	return nfstypes.Ftype3(kind &^ inode.INLINE)
+}
+
+// Returns the inodes to check: those of the table, then those of the
+// chunks.
+func (p *pass) inums() []common.Inum {
+	var inums = make([]common.Inum, 0)
+	for inum := common.ROOTINUM; inum < p.st.Super.NInode(); inum++ {
+		inums = append(inums, inum)
+	}
+	for _, bn := range p.st.Chunks.Bnums() {
+		for i := uint64(0); i < common.INODEBLK; i++ {
+			inums = append(inums, p.st.Super.ChunkInum(bn, i))
+		}
+	}
+	return inums
+}
+
+// Checks all inodes and then the global invariants.  Returns false if
+// the scrubber was stopped.
+func (p *pass) run() bool {
+	defer p.st.Untrack(p.changes)
+	for _, inum := range p.inums() {
+		if p.isFree(inum) {
+			continue
+		}
+		if !p.s.throttle() {
+			return false
+		}
+		p.checkInode(inum)
+	}
+	p.metaWalk().ClaimRegistry()
+	p.metaWalk().ClaimSnapshots()
+	p.checkDups()
+	p.checkBlockBitmap()
+	if !p.settle() {
+		util.DPrintf(1, "Scrub: file system kept changing, skipping link checks\n")
+		return true
+	}
+	p.global = true
+	p.checkLinks()
+	return true
+}
+
+// Reads the inodes that transactions changed since the pass read them
+// again, until a round of rereading sees no more changes, so that the
+// link counts and names the pass has are those of one moment.  Rounds
+// aren't throttled, to keep them short, but have at most MAXRECHECK
+// inodes.  Returns whether that happened within MAXROUNDS.
+func (p *pass) settle() bool {
+	for round := 0; round <= MAXROUNDS; round++ {
+		inums, overflow := p.changes.TakeInodes()
+		if overflow || len(inums) > MAXRECHECK {
+			return false
+		}
+		if len(inums) == 0 {
+			return true
+		}
+		if round == MAXROUNDS {
+			break
+		}
+		for inum := range inums {
+			p.recheck(inum)
+		}
+	}
+	return false
+}
+
+// Returns whether inum is free, done shrinking, and its bitmap bit
+// agrees, so that skipping it doesn't cost a turn.
+func (p *pass) isFree(inum common.Inum) bool {
+	op := fstxn.Begin(p.st)
+	b := op.Atxn.Op.ReadBuf(p.st.Super.Inum2Addr(inum), common.INODESZ*8)
+	ip := inode.Decode(p.st.Super, b, inum)
+	var free = ip.Kind == inode.NF3FREE && !ip.IsShrinking()
+	if free && p.st.Super.InTable(inum) {
+		free = !testBit(op, p.st.Super.BitmapInodeStart(), uint64(inum))
+	}
+	op.Abort()
+	return free
+}
+
+// The state of checking an inode across lock holds
+type inodeCheck struct {
+	started  bool
+	gen      uint64
+	kind     nfstypes.Ftype3
+	shrink   bool
+	limit    uint64 // blocks at or beyond limit are beyond the size
+	beyond   uint64
+	checked  bool   // whether cursor is set
+	cursor   uint64 // Lbn of the last ref checked
+	clevel   uint64 // NINDLEVEL - Level of the last ref checked
+	pruned   map[common.Bnum]bool
+	dirblks  map[uint64]common.Bnum // logical -> physical, for a directory
+	finished bool
+}
+
+func (p *pass) checkInode(inum common.Inum) {
+	c := &inodeCheck{pruned: make(map[common.Bnum]bool)}
+	for !c.finished {
+		op := fstxn.Begin(p.st)
+		if !op.Atxn.ValidInum(inum) { // its chunk went away
+			op.Abort()
+			return
+		}
+		ip := op.GetInodeInumFree(inum)
+		if !c.started {
+			if !p.checkFields(op, ip, c) {
+				op.Abort()
+				return
+			}
+		} else if ip.Gen != c.gen || ip.Kind != c.kind {
+			op.Abort() // reused meanwhile; the next pass will see it
+			return
+		}
+		p.checkBlocks(op, ip, c)
+		if c.finished {
+			if c.beyond > 0 {
+				p.report(fsck.BeyondSize, inum, "blocks up to %d, but size is %d blocks",
+					c.beyond, c.limit)
+			}
+			if c.dirblks != nil {
+				p.dirs[inum] = p.readDir(op, ip, c.dirblks, true)
+			}
+		}
+		op.Abort()
+	}
+}
+
+// Checks the fields of ip, and returns whether to check its blocks.
+func (p *pass) checkFields(op *fstxn.FsTxn, ip *inode.Inode, c *inodeCheck) bool {
+	c.started = true
+	c.gen = ip.Gen
+	c.kind = ip.Kind
+	c.shrink = ip.IsShrinking()
+	c.limit = util.RoundUp(ip.Size, disk.BlockSize)
+	if c.shrink {
+		c.limit = ip.ShrinkSize
+	}
+	if p.st.Super.InTable(ip.Inum) && !c.shrink {
+		set := testBit(op, p.st.Super.BitmapInodeStart(), uint64(ip.Inum))
+		if set != (ip.Kind != inode.NF3FREE) {
+			p.report(fsck.InodeBitmap, ip.Inum, "bitmap bit is %v for a %s inode",
+				set, fsck.KindString(ip.Kind))
+		}
+	}
+	switch ip.Kind {
+	case inode.NF3FREE:
+		return c.shrink
+	case nfstypes.NF3REG, nfstypes.NF3DIR, nfstypes.NF3LNK:
+	default:
+		p.report(fsck.BadKind, ip.Inum, "unknown kind %d", ip.Kind)
+		return false
+	}
+	p.nlink[ip.Inum] = ip.Nlink
+	if ip.Gen == 0 {
+		p.report(fsck.BadGen, ip.Inum, "generation is 0")
+	}
+	if ip.IsInline() && (ip.Kind == nfstypes.NF3DIR || ip.Size > inode.InlineSize(p.st.Super)) {
+		p.report(fsck.BadInline, ip.Inum, "inline %s of %d bytes",
+			fsck.KindString(ip.Kind), ip.Size)
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		c.dirblks = make(map[uint64]common.Bnum)
+		if ip.Size%dir.DIRENTSZ != 0 {
+			p.report(fsck.DirSize, ip.Inum, "size %d isn't a multiple of %d",
+				ip.Size, dir.DIRENTSZ)
+		}
+	}
+	return true
+}
+
+// Checks the next BATCH block pointers of ip after c's cursor (all of
+// them for a directory), in the order ip.Blocks visits them, and sets
+// c.finished if there are no more.
+func (p *pass) checkBlocks(op *fstxn.FsTxn, ip *inode.Inode, c *inodeCheck) {
+	var n uint64 = 0
+	var more = false
+	read := func(bn common.Bnum) []byte {
+		return op.Atxn.ReadBlock(bn).Data
+	}
+	ip.Blocks(read, func(ref inode.BlockRef) bool {
+		if more {
+			return false
+		}
+		if c.checked && ref.Lbn+span(ref.Level) <= c.cursor {
+			return false // checked in an earlier batch
+		}
+		if !c.after(ref) {
+			// an ancestor of where the last batch stopped
+			return !c.pruned[ref.Bn]
+		}
+		if c.dirblks == nil && n == BATCH {
+			more = true
+			return false
+		}
+		n++
+		c.checked = true
+		c.cursor, c.clevel = ref.Lbn, inode.NINDLEVEL-ref.Level
+		if !p.checkRef(op, ip, c, ref) {
+			c.pruned[ref.Bn] = true
+			return false
+		}
+		return true
+	})
+	if !more {
+		c.finished = true
+	}
+}
+
+// Returns whether ref comes after c's cursor in the order of
+// ip.Blocks, which visits refs by Lbn, and an index block before the
+// blocks it points to.
+func (c *inodeCheck) after(ref inode.BlockRef) bool {
+	if !c.checked {
+		return true
+	}
+	if ref.Lbn != c.cursor {
+		return ref.Lbn > c.cursor
+	}
+	return inode.NINDLEVEL-ref.Level > c.clevel
+}
+
+// Checks block pointer ref of ip, and returns whether to descend into
+// it.
+func (p *pass) checkRef(op *fstxn.FsTxn, ip *inode.Inode, c *inodeCheck, ref inode.BlockRef) bool {
+	if !p.inData(ref.Bn) {
+		p.report(fsck.BadBlock, ip.Inum, "block %d is outside the data area", ref.Bn)
+		return false
+	}
+	if !p.claim(ref.Bn, ip.Inum) {
+		return false
+	}
+	if !testBit(op, p.st.Super.BitmapBlockStart(), uint64(ref.Bn)) {
+		p.report(fsck.BlockBitmap, ip.Inum, "block %d is in use, but marked free", ref.Bn)
+	}
+	if ref.Lbn >= c.limit && ref.Lbn+1 > c.beyond {
+		c.beyond = ref.Lbn + 1
+	}
+	if ref.Level == 0 {
+		if c.dirblks != nil {
+			c.dirblks[ref.Lbn] = ref.Bn
+		}
+		// a shrinking inode's blocks may have lost their checksums
+		if !c.shrink && ref.Lbn < c.limit {
+			data := op.Atxn.ReadBlock(ref.Bn).Data
+			if !op.Atxn.VerifyCsum(ref.Bn, data) {
+				p.report(Checksum, ip.Inum, "block %d (offset %d) doesn't match its checksum",
+					ref.Bn, ref.Lbn*disk.BlockSize)
+			}
+		}
+	}
+	return true
+}
+
+// Returns the names of directory dip, whose blocks are blks, and
+// checks its entries if report.
+func (p *pass) readDir(op *fstxn.FsTxn, dip *inode.Inode, blks map[uint64]common.Bnum,
+	report bool) *dirNames {
+	read := func(bn common.Bnum) []byte {
+		return op.Atxn.ReadBlock(bn).Data
+	}
+	ents := fsck.DirEnts(dip.Size, blks, read)
+	d := &dirNames{dotdot: fsck.DotDotInum(ents), names: make([]dirName, 0)}
+	if report && !fsck.DotOk(dip.Inum, ents) {
+		p.report(fsck.Dot, dip.Inum, "\".\" doesn't name the directory")
+	}
+	if report && d.dotdot == common.NULLINUM {
+		p.report(fsck.DotDot, dip.Inum, "no \"..\"")
+	}
+	names := make(map[string]bool)
+	for i, e := range ents {
+		if e.Bad {
+			if report {
+				p.report(fsck.BadEntry, dip.Inum, "malformed entry at offset %d", e.Off)
+			}
+			continue
+		}
+		if i < 2 || e.Inum == common.NULLINUM {
+			continue
+		}
+		var kind = inode.NF3FREE
+		if op.Atxn.ValidInum(e.Inum) {
+			kind = p.peekKind(op, e.Inum)
+		}
+		if pk, msg := fsck.CheckEnt(e, kind, names); pk != "" {
+			if report {
+				p.report(pk, dip.Inum, "%s", msg)
+			}
+			continue
+		}
+		d.names = append(d.names, dirName{ent: e, dir: kind == nfstypes.NF3DIR})
+	}
+	return d
+}
+
+// Reads inum again, after a transaction changed it: its link count
+// and, for a directory, its names.  Its blocks were claimed (or not)
+// already, and the blocks whose allocation changed are left out of the
+// checks of blocks.
+func (p *pass) recheck(inum common.Inum) {
+	delete(p.nlink, inum)
+	delete(p.dirs, inum)
+	op := fstxn.Begin(p.st)
+	if !op.Atxn.ValidInum(inum) {
+		op.Abort()
+		return
+	}
+	ip := op.GetInodeInumFree(inum)
+	switch ip.Kind {
+	case nfstypes.NF3REG, nfstypes.NF3LNK:
+	case nfstypes.NF3DIR:
+		blks := make(map[uint64]common.Bnum)
+		read := func(bn common.Bnum) []byte {
+			return op.Atxn.ReadBlock(bn).Data
+		}
+		ip.Blocks(read, func(ref inode.BlockRef) bool {
+			if !p.inData(ref.Bn) {
+				return false
+			}
+			if ref.Level == 0 {
+				blks[ref.Lbn] = ref.Bn
+			}
+			return true
+		})
+		p.dirs[inum] = p.readDir(op, ip, blks, false)
+	default:
+		op.Abort()
+		return
+	}
+	p.nlink[inum] = ip.Nlink
+	op.Abort()
+}
+
+// Returns a walk that claims the blocks of the chunk registry and the
+// snapshots, skipping those outside the data area.  Snapshots never
+// change, but their maps grow, so these claims are as racy as the
+// others.
+func (p *pass) metaWalk() *fsck.MetaWalk {
+	return &fsck.MetaWalk{
+		Sup: p.st.Super,
+		Log: p.st.Log,
+		Bad: func(b fsck.MetaBlock) {},
+		Claim: func(b fsck.MetaBlock) bool {
+			return p.claim(b.Bn, b.Owner())
+		},
+	}
+}
+
+// Reports the blocks used twice, but not those whose allocation or
+// share count changed during the pass, which may have passed from one
+// owner to another between the checks of the two.
+func (p *pass) checkDups() {
+	for _, d := range p.dups {
+		if p.changes.Block(d.bn) {
+			continue
+		}
+		inum := d.inum
+		if inum == fsck.MetaOwner || inum == fsck.MapOwner || inum == fsck.SnapOwner {
+			inum = common.NULLINUM
+		}
+		p.report(fsck.DupBlock, inum, "block %d is also used by %s", d.bn, d.owner)
+	}
+}
+
+// Reports the blocks marked allocated that nothing uses, as one
+// problem, leaving out those whose allocation changed during the pass;
+// blocks in use but marked free were reported per inode.
+func (p *pass) checkBlockBitmap() {
+	sup := p.st.Super
+	op := fstxn.Begin(p.st)
+	var n uint64 = 0
+	var first common.Bnum = 0
+	for i := uint64(0); i < sup.NBlockBitmap; i++ {
+		a := addr.MkAddr(sup.BitmapBlockStart()+common.Bnum(i), 0)
+		data := op.Atxn.Op.ReadBuf(a, common.NBITBLOCK).Data
+		for j := uint64(0); j < common.NBITBLOCK; j++ {
+			bn := common.Bnum(i*common.NBITBLOCK + j)
+			if !p.inData(bn) || !p.claims.Covers(bn) {
+				continue
+			}
+			if data[j/8]&(1<<(j%8)) != 0 && !p.claims.IsUsed(bn) && !p.changes.Block(bn) {
+				if n == 0 {
+					first = bn
+				}
+				n++
+			}
+		}
+	}
+	op.Abort()
+	if n > 0 {
+		p.report(fsck.BlockBitmap, common.NULLINUM,
+			"%d blocks (first %d) marked allocated, but unused", n, first)
+	}
+}
+
+// Checks link counts, "..", reachability, and that a directory has one
+// name, against the names of the directories.
+func (p *pass) checkLinks() {
+	dinums := make([]common.Inum, 0, len(p.dirs))
+	for dinum := range p.dirs {
+		dinums = append(dinums, dinum)
+	}
+	sort.Slice(dinums, func(i, j int) bool { return dinums[i] < dinums[j] })
+	nref := make(map[common.Inum]uint32) // # names, plus subdirectories' ..
+	parent := map[common.Inum]common.Inum{common.ROOTINUM: common.ROOTINUM}
+	for _, dinum := range dinums {
+		for _, n := range p.dirs[dinum].names {
+			nref[n.ent.Inum]++
+			if !n.dir {
+				continue
+			}
+			if _, ok := parent[n.ent.Inum]; ok {
+				p.report(fsck.DirLink, dinum, "%s", fsck.DirLinkMsg(n.ent))
+				continue
+			}
+			parent[n.ent.Inum] = dinum
+			nref[dinum]++ // for ..
+		}
+	}
+	inums := make([]common.Inum, 0, len(p.nlink))
+	for inum := range p.nlink {
+		inums = append(inums, inum)
+	}
+	sort.Slice(inums, func(i, j int) bool { return inums[i] < inums[j] })
+	for _, inum := range inums {
+		nlink := p.nlink[inum]
+		want := fsck.WantNlink(inum, nref[inum])
+		if want == 0 {
+			p.report(fsck.Orphan, inum, "unreachable inode")
+			continue
+		}
+		if nlink != want {
+			p.report(fsck.Nlink, inum, "%s", fsck.NlinkMsg(nlink, want))
+		}
+		d, isdir := p.dirs[inum]
+		par, ok := parent[inum]
+		if isdir && ok && d.dotdot != common.NULLINUM && d.dotdot != par {
+			p.report(fsck.DotDot, inum, "\"..\" doesn't name parent %d", par)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package scrub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fsck"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+)
+
+//
+// The scrubber checks a mounted file system in the background, in
+// passes over all inodes, at most Rate inodes per second.  It uses
+// ordinary transactions, which it always aborts, and holds an inode's
+// lock for at most BATCH of its blocks (a directory's for all of its
+// entries), so it doesn't hold up NFS operations for long.
+//
+// What it checks under an inode's lock is exact: the inode's kind and
+// bitmap bit, its block pointers, their bitmap bits and checksums, and
+// a directory's entries.  The checks that span inodes could see some
+// inodes before a transaction and others after it, so the pass tracks
+// what transactions change meanwhile (see fstxn.Changes).  It leaves
+// the blocks that were allocated, freed or shared meanwhile out of the
+// checks for duplicate and leaked blocks.  For link counts, "..", and
+// directories with two names, it rereads the inodes that changed,
+// until a round of rereading sees no more changes; if the file system
+// doesn't hold still for that long, it skips those checks.  Problems
+// are logged and kept in the stats; repairs are left to fsck.
+//
+
+const (
+	DEFRATE     uint64 = 100  // inodes per second
+	BATCH       uint64 = 64   // blocks checked per lock hold
+	MAXPROBLEMS int    = 100  // kept per pass
+	MAXROUNDS   int    = 8    // of rereading changed inodes per pass
+	MAXRECHECK  int    = 1024 // inodes reread per round
+)
+
+// Kinds of problems, besides fsck's
+const (
+	Checksum = "checksum" // data block doesn't match its checksum
+)
+
+type Stats struct {
+	Running  bool            `json:"running"`
+	Rate     uint64          `json:"rate"`      // inodes per second
+	Passes   uint64          `json:"passes"`    // finished
+	Inodes   uint64          `json:"inodes"`    // checked in this pass
+	Problems uint64          `json:"problems"`  // found in all passes
+	Skipped  uint64          `json:"skipped"`   // passes without link checks
+	Last     []*fsck.Problem `json:"last_pass"` // problems of the last pass
+}
+
+type Scrubber struct {
+	fsstate  *fstxn.FsState
+	mu       *sync.Mutex
+	cond     *sync.Cond // signaled when a pass ends or the worker exits
+	running  bool
+	stop     chan struct{}
+	rate     uint64
+	passes   uint64
+	inodes   uint64
+	problems uint64
+	skipped  uint64
+	last     []*fsck.Problem
+	// blocks the last pass found used twice, whose owners the next
+	// pass records, to name them
+	owners map[common.Bnum]common.Inum
+}
+
+func MkScrubber(st *fstxn.FsState) *Scrubber {
+	mu := new(sync.Mutex)
+	return &Scrubber{
+		fsstate: st,
+		mu:      mu,
+		cond:    sync.NewCond(mu),
+		rate:    DEFRATE,
+		last:    make([]*fsck.Problem, 0),
+	}
+}
+
+// Start starts scrubbing at rate inodes per second (0 keeps the
+// current rate), or changes the rate if the scrubber is running.
+func (s *Scrubber) Start(rate uint64) {
+	s.mu.Lock()
+	if rate != 0 {
+		s.rate = rate
+	}
+	if !s.running {
+		s.running = true
+		s.stop = make(chan struct{})
+		go func() { s.worker() }()
+	}
+	s.mu.Unlock()
+}
+
+// SetRate changes the rate, whether or not the scrubber is running.
+func (s *Scrubber) SetRate(rate uint64) {
+	if rate == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.rate = rate
+	s.mu.Unlock()
+}
+
+// Stop stops the scrubber in the middle of its pass, and waits for it.
+func (s *Scrubber) Stop() {
+	s.mu.Lock()
+	if s.running {
+		close(s.stop)
+		for s.running {
+			s.cond.Wait()
+		}
+	}
+	s.mu.Unlock()
+}
+
+// WaitPass waits until the scrubber finishes a pass (or stops), and
+// returns the stats.
+func (s *Scrubber) WaitPass() Stats {
+	s.mu.Lock()
+	passes := s.passes
+	for s.running && s.passes == passes {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+	return s.Stats()
+}
+
+func (s *Scrubber) Stats() Stats {
+	s.mu.Lock()
+	st := Stats{
+		Running:  s.running,
+		Rate:     s.rate,
+		Passes:   s.passes,
+		Inodes:   s.inodes,
+		Problems: s.problems,
+		Skipped:  s.skipped,
+		Last:     s.last,
+	}
+	s.mu.Unlock()
+	return st
+}
+
+// Waits for the next inode's turn; returns false if stopped.
+func (s *Scrubber) throttle() bool {
+	s.mu.Lock()
+	s.inodes++
+	d := time.Second / time.Duration(s.rate)
+	stop := s.stop
+	s.mu.Unlock()
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Scrubber) worker() {
+	util.DPrintf(0, "Scrub: started\n")
+	for {
+		p := mkPass(s)
+		if !p.run() {
+			break
+		}
+		s.mu.Lock()
+		s.passes++
+		s.inodes = 0
+		s.problems += uint64(p.nproblem)
+		if !p.global {
+			s.skipped++
+		}
+		s.last = p.problems
+		s.owners = p.claims.Dups()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		util.DPrintf(0, "Scrub: pass done, %d problems\n", p.nproblem)
+	}
+	s.mu.Lock()
+	s.running = false
+	s.inodes = 0
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	util.DPrintf(0, "Scrub: stopped\n")
+}
+
+// Returns whether bit num is set in the n bitmap blocks at start, as
+// committed.
+func testBit(op *fstxn.FsTxn, start common.Bnum, num uint64) bool {
+	off := num % common.NBITBLOCK
+	b := op.Atxn.Op.ReadBuf(addr.MkAddr(start+common.Bnum(num/common.NBITBLOCK), off), 1)
+	return b.Data[0]&(1<<(off%8)) != 0
+}
+
+// # logical blocks below a block pointer of level
+func span(level uint64) uint64 {
+	var n uint64 = 1
+	for i := uint64(0); i < level; i++ {
+		n = n * (disk.BlockSize / 8)
+	}
+	return n
+}
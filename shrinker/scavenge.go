@@ -0,0 +1,98 @@
+package shrinker
+
+import (
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/buf"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/inode"
+)
+
+//
+// A crash stops the shrinker threads, leaving inodes (freed ones too)
+// with ShrinkSize beyond their size, and their blocks allocated until
+// the inode is used again.  The scavenger finds them at mount by
+// scanning the inode table and the inode chunks, a block of inodes at
+// a time, and queues them for the shrinker threads.  It reads
+// the inodes through the log rather than the inode cache, and
+// DoShrink rechecks each one under its lock, so it can run alongside
+// NFS operations (which may shrink an inode first).
+//
+
+type ScavengeStats struct {
+	Done   bool
+	Inodes uint64 // shrinks resumed
+}
+
+// Returns the inodes in inode block bn, starting at inum, that are
+// shrinking.
+func (shrinkst *ShrinkerSt) scanBlock(bn common.Bnum, inum common.Inum) []*inode.Inode {
+	b := shrinkst.fsstate.Log.Load(addr.MkAddr(bn, 0), common.NBITBLOCK)
+	ips := make([]*inode.Inode, 0)
+	for i := uint64(0); i < common.INODEBLK; i++ {
+		data := b.Data[i*common.INODESZ : (i+1)*common.INODESZ]
+		ip := inode.Decode(shrinkst.fsstate.Super, buf.MkBuf(addr.MkAddr(bn, i*common.INODESZ*8),
+			common.INODESZ*8, data), inum+common.Inum(i))
+		if ip.Inum != common.NULLINUM && ip.IsShrinking() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func (shrinkst *ShrinkerSt) scavenger() {
+	sup := shrinkst.fsstate.Super
+	nfree := shrinkst.fsstate.Balloc.NumFree()
+	var st ScavengeStats
+	blks := make([]common.Bnum, 0)
+	for bn := sup.InodeStart(); bn < sup.CsumStart(); bn++ {
+		blks = append(blks, bn)
+	}
+	blks = append(blks, shrinkst.fsstate.Chunks.Bnums()...)
+	for _, bn := range blks {
+		if shrinkst.crashed() {
+			break
+		}
+		var first = common.Inum(uint64(bn-sup.InodeStart()) * common.INODEBLK)
+		if bn >= sup.DataStart() {
+			first = sup.ChunkInum(bn, 0)
+		}
+		for _, ip := range shrinkst.scanBlock(bn, first) {
+			util.DPrintf(1, "Scavenger: resume shrinking # %d\n", ip.Inum)
+			shrinkst.enqueue(ip.Inum, ip.ShrinkBlocks(), true)
+			st.Inodes++
+		}
+	}
+	shrinkst.drain()
+	if st.Inodes > 0 {
+		util.DPrintf(0, "Scavenger: resumed %d interrupted shrinks, %d -> %d free blocks\n",
+			st.Inodes, nfree, shrinkst.fsstate.Balloc.NumFree())
+	}
+	st.Done = true
+	shrinkst.mu.Lock()
+	shrinkst.scavenge = st
+	shrinkst.nthread--
+	shrinkst.condShut.Broadcast()
+	shrinkst.mu.Unlock()
+}
+
+// StartScavenger finishes interrupted shrinks in the background.
+func (shrinkst *ShrinkerSt) StartScavenger() {
+	shrinkst.mu.Lock()
+	shrinkst.nthread = shrinkst.nthread + 1
+	shrinkst.scavenge = ScavengeStats{}
+	shrinkst.mu.Unlock()
+	go func() { shrinkst.scavenger() }()
+}
+
+// WaitScavenger waits for the scavenger to queue the interrupted
+// shrinks and for them to finish, and returns what it did.
+func (shrinkst *ShrinkerSt) WaitScavenger() ScavengeStats {
+	shrinkst.mu.Lock()
+	for !shrinkst.scavenge.Done && !shrinkst.crash {
+		shrinkst.condShut.Wait()
+	}
+	st := shrinkst.scavenge
+	shrinkst.mu.Unlock()
+	return st
+}
@@ -3,17 +3,56 @@ package shrinker
 import (
 	"sync"
 
+	"github.com/tchajed/goose/machine/disk"
+
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/util"
 	"github.com/mit-pdos/go-nfsd/fstxn"
 )
 
+//
+// Large files are shrunk in the background, by a pool of at most
+// NWORKER threads that take inodes from a queue.  An inode is queued
+// at most once; shrinking it again while it is being shrunk queues it
+// again, which is harmless, since DoShrink stops once it is done.
+// StartShrinker blocks while MAXQUEUE inodes are waiting, to slow down
+// clients that remove large files faster than they can be shrunk.
+// Workers exit when the queue is empty.
+//
+// The queue itself is not on disk, but the inodes are: ShrinkSize says
+// how far an inode still has to shrink, and the scavenger queues them
+// again after a crash.
+//
+
+const (
+	NWORKER  uint64 = 4
+	MAXQUEUE uint64 = 1024
+)
+
 type ShrinkerSt struct {
 	mu       *sync.Mutex
-	condShut *sync.Cond
-	nthread  uint32
+	condShut *sync.Cond // signaled when the queue or nthread changes
+	nthread  uint32     // workers and the scavenger
+	nworker  uint64
+	queue    []common.Inum
+	queued   map[common.Inum]uint64 // blocks to free, for each queued inode
+	nqueued  uint64                 // blocks to free in the queue
+	nactive  uint64                 // inodes being shrunk
+	nactblk  uint64                 // blocks to free in those
+	ndone    uint64
+	nfailed  uint64
 	fsstate  *fstxn.FsState
 	crash    bool
+	scavenge ScavengeStats
+}
+
+// ShrinkStats reports the progress of background shrinking.
+type ShrinkStats struct {
+	Queued       uint64 // inodes waiting
+	Active       uint64 // inodes being shrunk
+	Done         uint64
+	Failed       uint64 // left shrinking on disk, to be retried on access
+	PendingBytes uint64 // still to be freed by queued and active shrinks
 }
 
 func MkShrinkerSt(st *fstxn.FsState) *ShrinkerSt {
@@ -22,8 +61,11 @@ func MkShrinkerSt(st *fstxn.FsState) *ShrinkerSt {
 		mu:       mu,
 		condShut: sync.NewCond(mu),
 		nthread:  0,
+		queue:    make([]common.Inum, 0),
+		queued:   make(map[common.Inum]uint64),
 		fsstate:  st,
 		crash:    false,
+		scavenge: ScavengeStats{Done: true},
 	}
 	return shrinkst
 }
@@ -37,7 +79,8 @@ func (shrinkst *ShrinkerSt) crashed() bool {
 
 // If caller changes file size and shrinking is in progress (because
 // an earlier call truncated the file), then help/wait with/for
-// shrinking.  Also, called by shrinker.
+// shrinking.  Also, called by shrinker.  Returns false if a
+// transaction failed, leaving inum shrinking.
 func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
 	var more = true
 	var ok = true
@@ -45,9 +88,12 @@ func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
 		op := fstxn.Begin(shrinkst.fsstate)
 		ip := op.GetInodeInumFree(inum)
 		if ip == nil {
-			panic("shrink")
+			util.DPrintf(0, "doShrink: bad inum %v\n", inum)
+			op.Abort()
+			return false
 		}
 		util.DPrintf(1, "%p: doShrink %v\n", op.Atxn.Id(), ip.Inum)
+		op.Atxn.UseReserved = true
 		more = ip.Shrink(op.Atxn)
 		ok = op.Commit()
 		if !ok {
@@ -60,6 +106,8 @@ func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
 	return ok
 }
 
+// Shutdown waits for the queue to drain and the workers and the
+// scavenger to exit.
 func (shrinker *ShrinkerSt) Shutdown() {
 	shrinker.mu.Lock()
 	for shrinker.nthread > 0 {
@@ -69,33 +117,133 @@ func (shrinker *ShrinkerSt) Shutdown() {
 	shrinker.mu.Unlock()
 }
 
+// Crash stops the workers after their current transaction, and drops
+// the queue.
 func (shrinker *ShrinkerSt) Crash() {
 	shrinker.mu.Lock()
 	shrinker.crash = true
+	shrinker.condShut.Broadcast()
 	for shrinker.nthread > 0 {
 		util.DPrintf(1, "Crash: wait %d\n", shrinker.nthread)
 		shrinker.condShut.Wait()
 	}
+	shrinker.queue = shrinker.queue[:0]
+	shrinker.queued = make(map[common.Inum]uint64)
+	shrinker.nqueued = 0
 	shrinker.mu.Unlock()
 }
 
-// for large files, start a separate thread
-func (shrinkst *ShrinkerSt) StartShrinker(inum common.Inum) {
-	util.DPrintf(1, "start shrink thread\n")
+// Queues inum, which has nblk blocks to free, and starts a worker if
+// there are fewer than NWORKER.  If the queue is full, waits for room
+// if wait is set, and otherwise returns false.
+func (shrinkst *ShrinkerSt) enqueue(inum common.Inum, nblk uint64, wait bool) bool {
+	var ok = true
 	shrinkst.mu.Lock()
-	shrinkst.nthread = shrinkst.nthread + 1
+	for !shrinkst.crash {
+		if old, ok := shrinkst.queued[inum]; ok {
+			shrinkst.nqueued = shrinkst.nqueued - old + nblk
+			shrinkst.queued[inum] = nblk
+			break
+		}
+		if uint64(len(shrinkst.queue)) < MAXQUEUE {
+			shrinkst.queue = append(shrinkst.queue, inum)
+			shrinkst.queued[inum] = nblk
+			shrinkst.nqueued += nblk
+			if shrinkst.nworker < NWORKER {
+				shrinkst.nworker++
+				shrinkst.nthread++
+				go func() { shrinkst.worker() }()
+			}
+			shrinkst.condShut.Broadcast()
+			break
+		}
+		if !wait {
+			ok = false
+			break
+		}
+		util.DPrintf(1, "enqueue: queue full, wait\n")
+		shrinkst.condShut.Wait()
+	}
 	shrinkst.mu.Unlock()
-	go func() { shrinkst.shrinker(inum) }()
+	return ok
+}
+
+// StartShrinker shrinks inum, which has nblk blocks to free, in the
+// background.
+func (shrinkst *ShrinkerSt) StartShrinker(inum common.Inum, nblk uint64) {
+	util.DPrintf(1, "start shrink # %d\n", inum)
+	shrinkst.enqueue(inum, nblk, true)
+}
+
+// TryStartShrinker is like StartShrinker, but doesn't wait for room
+// in the queue; if there is none, inum stays shrinking on disk, for
+// a later access or the scavenger to queue.  Returns whether inum is
+// queued.
+func (shrinkst *ShrinkerSt) TryStartShrinker(inum common.Inum, nblk uint64) bool {
+	return shrinkst.enqueue(inum, nblk, false)
 }
 
-func (shrinkst *ShrinkerSt) shrinker(inum common.Inum) {
-	ok := shrinkst.DoShrink(inum)
-	if !ok {
-		panic("shrink")
+// Busy returns whether the queue is full.
+func (shrinkst *ShrinkerSt) Busy() bool {
+	shrinkst.mu.Lock()
+	full := uint64(len(shrinkst.queue)) >= MAXQUEUE
+	shrinkst.mu.Unlock()
+	return full
+}
+
+func (shrinkst *ShrinkerSt) worker() {
+	shrinkst.mu.Lock()
+	for len(shrinkst.queue) > 0 && !shrinkst.crash {
+		inum := shrinkst.queue[0]
+		shrinkst.queue = shrinkst.queue[1:]
+		nblk := shrinkst.queued[inum]
+		delete(shrinkst.queued, inum)
+		shrinkst.nqueued -= nblk
+		shrinkst.nactive++
+		shrinkst.nactblk += nblk
+		shrinkst.condShut.Broadcast()
+		shrinkst.mu.Unlock()
+
+		ok := shrinkst.DoShrink(inum)
+		if ok {
+			util.DPrintf(1, "Shrinker: done shrinking # %d\n", inum)
+		} else {
+			util.DPrintf(0, "Shrinker: shrinking # %d failed; left for later\n", inum)
+		}
+
+		shrinkst.mu.Lock()
+		shrinkst.nactive--
+		shrinkst.nactblk -= nblk
+		if ok {
+			shrinkst.ndone++
+		} else {
+			shrinkst.nfailed++
+		}
 	}
-	util.DPrintf(1, "Shrinker: done shrinking # %d\n", inum)
+	shrinkst.nworker--
+	shrinkst.nthread--
+	shrinkst.condShut.Broadcast()
+	shrinkst.mu.Unlock()
+}
+
+// Waits until nothing is queued or being shrunk.
+func (shrinkst *ShrinkerSt) drain() {
 	shrinkst.mu.Lock()
-	shrinkst.nthread = shrinkst.nthread - 1
-	shrinkst.condShut.Signal()
+	for (len(shrinkst.queue) > 0 || shrinkst.nactive > 0) && !shrinkst.crash {
+		shrinkst.condShut.Wait()
+	}
+	shrinkst.mu.Unlock()
+}
+
+func (shrinkst *ShrinkerSt) Stats() ShrinkStats {
+	shrinkst.mu.Lock()
+	st := ShrinkStats{
+		Queued:       uint64(len(shrinkst.queue)),
+		Active:       shrinkst.nactive,
+		Done:         shrinkst.ndone,
+		Failed:       shrinkst.nfailed,
+		PendingBytes: (shrinkst.nqueued + shrinkst.nactblk) * disk.BlockSize,
+	}
 	shrinkst.mu.Unlock()
+	return st
 }
@@ -0,0 +1,239 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+)
+
+//
+// The snapshotter takes and deletes snapshots (see alloctxn/snapshot.go).
+// Both run in a transaction of their own while no other is open, which
+// they wait for at most QUIESCE at a time, NTRY times.  Deleting a
+// snapshot only marks it; the reaper then frees its copies of inode
+// blocks (and the blocks only those reference) in the background, in
+// transactions that fit in the log, and finally its map.  Mount starts
+// the reaper for snapshots whose deletion a crash interrupted.
+//
+
+const (
+	QUIESCE = time.Second
+	NTRY    = 10
+)
+
+var ErrBusy = errors.New("file system is busy")
+
+type Snapshotter struct {
+	fsstate *fstxn.FsState
+	mu      *sync.Mutex // serializes Create and Delete
+	reapMu  *sync.Mutex
+	cond    *sync.Cond // signaled when the reaper exits
+	reaping bool
+	again   bool // another snapshot was deleted while reaping
+	stop    bool
+}
+
+func MkSnapshotter(st *fstxn.FsState) *Snapshotter {
+	reapMu := new(sync.Mutex)
+	return &Snapshotter{
+		fsstate: st,
+		mu:      new(sync.Mutex),
+		reapMu:  reapMu,
+		cond:    sync.NewCond(reapMu),
+	}
+}
+
+// List returns the snapshots, oldest first, including those being
+// deleted.
+func (sn *Snapshotter) List() []alloctxn.SnapshotInfo {
+	return sn.fsstate.Snaps.List()
+}
+
+// Keeps other transactions out, and begins one.
+func (sn *Snapshotter) begin() *fstxn.FsTxn {
+	for i := 0; i < NTRY; i++ {
+		if sn.fsstate.Quiesce(QUIESCE) {
+			return fstxn.BeginQuiesced(sn.fsstate)
+		}
+		util.DPrintf(1, "Snapshot: waiting for transactions\n")
+	}
+	return nil
+}
+
+// Commits op (or aborts it if err is set), and lets other transactions
+// in again.
+func (sn *Snapshotter) end(op *fstxn.FsTxn, err error) error {
+	if err != nil {
+		op.Abort()
+	} else if !op.Commit() {
+		err = errors.New("commit failed")
+	}
+	sn.fsstate.Resume()
+	return err
+}
+
+// Create takes a snapshot named name of the file system as it is now.
+func (sn *Snapshotter) Create(name string) error {
+	if err := alloctxn.ValidSnapshotName(name); err != nil {
+		return err
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	op := sn.begin()
+	if op == nil {
+		return ErrBusy
+	}
+	err := sn.end(op, op.Atxn.CreateSnapshot(name))
+	if err == nil {
+		util.DPrintf(0, "Snapshot: created %q\n", name)
+	}
+	return err
+}
+
+// Delete deletes snapshot name; its space is freed in the background.
+func (sn *Snapshotter) Delete(name string) error {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	s := sn.fsstate.Snaps.Lookup(name)
+	if s == nil {
+		return fmt.Errorf("no snapshot %q", name)
+	}
+	op := sn.begin()
+	if op == nil {
+		return ErrBusy
+	}
+	op.Atxn.DeleteSnapshot(s)
+	if err := sn.end(op, nil); err != nil {
+		return err
+	}
+	util.DPrintf(0, "Snapshot: deleted %q\n", name)
+	sn.StartReaper()
+	return nil
+}
+
+// StartReaper frees the space of deleted snapshots in the background,
+// if there are any.
+func (sn *Snapshotter) StartReaper() {
+	sn.reapMu.Lock()
+	if sn.stop {
+		sn.reapMu.Unlock()
+		return
+	}
+	if sn.reaping {
+		sn.again = true
+	} else if len(sn.fsstate.Snaps.Deleting()) > 0 {
+		sn.reaping = true
+		go func() { sn.reaper() }()
+	}
+	sn.reapMu.Unlock()
+}
+
+// Wait waits until the reaper is done.
+func (sn *Snapshotter) Wait() {
+	sn.reapMu.Lock()
+	for sn.reaping {
+		sn.cond.Wait()
+	}
+	sn.reapMu.Unlock()
+}
+
+// Shutdown stops the reaper, and waits for it.  Snapshots it didn't
+// finish are reaped after the next mount.
+func (sn *Snapshotter) Shutdown() {
+	sn.reapMu.Lock()
+	sn.stop = true
+	for sn.reaping {
+		sn.cond.Wait()
+	}
+	sn.reapMu.Unlock()
+}
+
+func (sn *Snapshotter) stopped() bool {
+	sn.reapMu.Lock()
+	stop := sn.stop
+	sn.reapMu.Unlock()
+	return stop
+}
+
+func (sn *Snapshotter) reaper() {
+	for {
+		for _, s := range sn.fsstate.Snaps.Deleting() {
+			if !sn.reap(s) {
+				break
+			}
+		}
+		sn.reapMu.Lock()
+		if !sn.again || sn.stop {
+			sn.reaping = false
+			sn.cond.Broadcast()
+			sn.reapMu.Unlock()
+			return
+		}
+		sn.again = false
+		sn.reapMu.Unlock()
+	}
+}
+
+// Reclaimed blocks may come from the reserve, as freeing a file does.
+func (sn *Snapshotter) beginReap() *fstxn.FsTxn {
+	op := fstxn.Begin(sn.fsstate)
+	op.Atxn.UseReserved = true
+	return op
+}
+
+// Frees the copies and map of deleted snapshot s.  Returns false if
+// the reaper stopped or a commit failed.
+func (sn *Snapshotter) reap(s *alloctxn.Snapshot) bool {
+	util.DPrintf(1, "Snapshot: reaping %d %q\n", s.Id, s.Name)
+	for {
+		if sn.stopped() {
+			return false
+		}
+		bn, c, ok := sn.fsstate.Snaps.NextCopy(s)
+		if !ok {
+			break
+		}
+		if !sn.releaseCopy(s, bn, c) {
+			return false
+		}
+	}
+	for {
+		op := sn.beginReap()
+		done := op.Atxn.RemoveSnapshot(s, jrnl.LogBlocks/2)
+		if !op.Commit() {
+			return false
+		}
+		if done {
+			return true
+		}
+	}
+}
+
+// Releases the copy c of inode block bn that s has, first freeing the
+// blocks of its inodes if s was the last snapshot with c.
+func (sn *Snapshotter) releaseCopy(s *alloctxn.Snapshot, bn common.Bnum, c common.Bnum) bool {
+	var op = sn.beginReap()
+	if !op.Atxn.CopyIsShared(c) {
+		for slot := uint64(0); slot < common.INODEBLK; slot++ {
+			if op.Atxn.CopySkips(bn, slot) {
+				continue
+			}
+			for !inode.FreeCopy(op.Atxn, c, slot) {
+				if !op.Commit() {
+					return false
+				}
+				op = sn.beginReap()
+			}
+		}
+	}
+	op.Atxn.ReleaseCopy(s, bn)
+	return op.Commit()
+}
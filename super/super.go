@@ -1,7 +1,10 @@
 package super
 
 import (
+	"sync/atomic"
+
 	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
@@ -10,13 +13,21 @@ import (
 type FsSuper struct {
 	Disk         disk.Disk
 	Size         uint64
-	nLog         uint64 // including commit block
+	Sb           *Superblock // nil for a legacy image
+	nLog         uint64      // including commit block
+	nSuper       uint64      // 1 if there is a superblock
 	NBlockBitmap uint64
 	NInodeBitmap uint64
 	nInodeBlk    uint64
+	nCsumBlk     uint64 // 0 for a legacy image, as are the next
+	nShareBlk    uint64
+	nSnapBlk     uint64
+	nQuotaBlk    uint64
 	Maxaddr      uint64
 }
 
+// MkFsSuper returns the layout of a legacy image, which has no
+// superblock and whose layout is derived from the disk size.
 func MkFsSuper(d disk.Disk) *FsSuper {
 	sz := d.Size()
 	nblockbitmap := (sz / common.NBITBLOCK) + 1
@@ -25,18 +36,97 @@ func MkFsSuper(d disk.Disk) *FsSuper {
 		Disk:         d,
 		Size:         sz,
 		nLog:         common.LOGSIZE,
+		nSuper:       0,
 		NBlockBitmap: nblockbitmap,
 		NInodeBitmap: common.NINODEBITMAP,
 		nInodeBlk:    (common.NINODEBITMAP * common.NBITBLOCK * common.INODESZ) / disk.BlockSize,
 		Maxaddr:      sz}
 }
 
+// Open returns the layout of the file system on d, after checking that
+// d holds one, before anything (e.g., log recovery) writes to it: the
+// layout its superblock records, or, if legacy, that of an image from
+// before superblocks.
+func Open(d disk.Disk, legacy bool) (*FsSuper, error) {
+	if legacy {
+		err := CheckLegacy(d)
+		if err != nil {
+			return nil, err
+		}
+		return MkFsSuper(d), nil
+	}
+	sb, err := ReadSuperblock(d)
+	if err != nil {
+		return nil, err
+	}
+	return MkFsSuperSb(d, sb), nil
+}
+
+// MkFsSuperSb returns the layout recorded in superblock sb.
+func MkFsSuperSb(d disk.Disk, sb *Superblock) *FsSuper {
+	return &FsSuper{
+		Disk:         d,
+		Size:         sb.Size,
+		Sb:           sb,
+		nLog:         sb.NLog,
+		nSuper:       1,
+		NBlockBitmap: sb.NBlockBitmap,
+		NInodeBitmap: sb.NInodeBitmap,
+		nInodeBlk:    sb.NInodeBlk,
+		nCsumBlk:     sb.NCsumBlk,
+		nShareBlk:    sb.NShareBlk,
+		nSnapBlk:     sb.NSnapBlk,
+		nQuotaBlk:    sb.NQuotaBlk,
+		Maxaddr:      sb.Size}
+}
+
+// Fsid derives the NFS fsid from the UUID.
+func (fs *FsSuper) Fsid() uint64 {
+	if fs.Sb == nil {
+		return 0
+	}
+	lo := marshal.NewDec(fs.Sb.UUID[0:8]).GetInt()
+	hi := marshal.NewDec(fs.Sb.UUID[8:16]).GetInt()
+	return lo ^ hi
+}
+
+// NReserved returns the number of data blocks reserved for the
+// superuser.
+func (fs *FsSuper) NReserved() uint64 {
+	if fs.Sb == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&fs.Sb.NReserved)
+}
+
 func (fs *FsSuper) MaxBnum() common.Bnum {
-	return common.Bnum(fs.Maxaddr)
+	return common.Bnum(atomic.LoadUint64(&fs.Maxaddr))
+}
+
+// MaxSize returns the largest size the file system can grow to, which
+// is limited by the size of the block bitmap.
+func (fs *FsSuper) MaxSize() uint64 {
+	return fs.NBlockBitmap*common.NBITBLOCK - 1
+}
+
+// Grow makes blocks up to size part of the file system, with nreserved
+// of its data blocks reserved, while it is in use.  The caller must
+// have written the superblock, and frees the new blocks afterwards.
+func (fs *FsSuper) Grow(size uint64, nreserved uint64) {
+	atomic.StoreUint64(&fs.Sb.Size, size)
+	atomic.StoreUint64(&fs.Sb.NReserved, nreserved)
+	atomic.StoreUint64(&fs.Size, size)
+	atomic.StoreUint64(&fs.Maxaddr, size)
+}
+
+// SetReserved changes the number of reserved data blocks while the
+// file system is in use.  The caller must have written the superblock.
+func (fs *FsSuper) SetReserved(nreserved uint64) {
+	atomic.StoreUint64(&fs.Sb.NReserved, nreserved)
 }
 
 func (fs *FsSuper) BitmapBlockStart() common.Bnum {
-	return common.Bnum(fs.nLog)
+	return common.Bnum(fs.nLog + fs.nSuper)
 }
 
 func (fs *FsSuper) BitmapInodeStart() common.Bnum {
@@ -47,10 +137,61 @@ func (fs *FsSuper) InodeStart() common.Bnum {
 	return fs.BitmapInodeStart() + common.Bnum(fs.NInodeBitmap)
 }
 
-func (fs *FsSuper) DataStart() common.Bnum {
+func (fs *FsSuper) CsumStart() common.Bnum {
 	return fs.InodeStart() + common.Bnum(fs.nInodeBlk)
 }
 
+func (fs *FsSuper) ShareStart() common.Bnum {
+	return fs.CsumStart() + common.Bnum(fs.nCsumBlk)
+}
+
+func (fs *FsSuper) SnapStart() common.Bnum {
+	return fs.ShareStart() + common.Bnum(fs.nShareBlk)
+}
+
+func (fs *FsSuper) NSnapBlk() uint64 {
+	return fs.nSnapBlk
+}
+
+func (fs *FsSuper) QuotaStart() common.Bnum {
+	return fs.SnapStart() + common.Bnum(fs.nSnapBlk)
+}
+
+// NQuota returns the number of entries of the quota table, including
+// the one with the grace periods.
+func (fs *FsSuper) NQuota() uint64 {
+	return fs.nQuotaBlk * NQUOTABLK
+}
+
+func (fs *FsSuper) DataStart() common.Bnum {
+	return fs.QuotaStart() + common.Bnum(fs.nQuotaBlk)
+}
+
+// Legacy returns whether the image is from before superblocks, and so
+// has no checksums, snapshots, quotas or owners.
+func (fs *FsSuper) Legacy() bool {
+	return fs.Sb == nil
+}
+
+// Quota2addr returns the address of entry i of the quota table.
+func (fs *FsSuper) Quota2addr(i uint64) addr.Addr {
+	return addr.MkAddr(fs.QuotaStart()+common.Bnum(i/NQUOTABLK),
+		(i%NQUOTABLK)*QUOTASZ*8)
+}
+
+// Share2addr returns the address of the 16-bit share count of block
+// bn.
+func (fs *FsSuper) Share2addr(bn common.Bnum) addr.Addr {
+	return addr.MkAddr(fs.ShareStart()+common.Bnum(uint64(bn)/NSHAREBLK),
+		(uint64(bn)%NSHAREBLK)*16)
+}
+
+// Csum2addr returns the address of the 32-bit checksum of block bn.
+func (fs *FsSuper) Csum2addr(bn common.Bnum) addr.Addr {
+	return addr.MkAddr(fs.CsumStart()+common.Bnum(uint64(bn)/NCSUMBLK),
+		(uint64(bn)%NCSUMBLK)*32)
+}
+
 func (fs *FsSuper) Block2addr(blkno common.Bnum) addr.Addr {
 	return addr.MkAddr(blkno, 0)
 }
@@ -59,7 +200,27 @@ func (fs *FsSuper) NInode() common.Inum {
 	return common.Inum(fs.nInodeBlk * common.INODEBLK)
 }
 
+// Inodes beyond the inode table live in inode chunks: data blocks
+// that hold INODEBLK inodes each.  The inum of slot i in chunk block bn
+// is bn*INODEBLK+i, which is always >= NInode(), because data blocks
+// follow the inode table.
+func (fs *FsSuper) InTable(inum common.Inum) bool {
+	return inum < fs.NInode()
+}
+
+func (fs *FsSuper) ChunkInum(bn common.Bnum, slot uint64) common.Inum {
+	return common.Inum(uint64(bn)*common.INODEBLK + slot)
+}
+
+func (fs *FsSuper) Inum2Chunk(inum common.Inum) (common.Bnum, uint64) {
+	return common.Bnum(uint64(inum) / common.INODEBLK), uint64(inum) % common.INODEBLK
+}
+
 func (fs *FsSuper) Inum2Addr(inum common.Inum) addr.Addr {
-	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/common.INODEBLK),
-		(uint64(inum)%common.INODEBLK)*common.INODESZ*8)
+	if fs.InTable(inum) {
+		return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/common.INODEBLK),
+			(uint64(inum)%common.INODEBLK)*common.INODESZ*8)
+	}
+	bn, slot := fs.Inum2Chunk(inum)
+	return addr.MkAddr(bn, slot*common.INODESZ*8)
 }
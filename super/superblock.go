@@ -0,0 +1,399 @@
+package super
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// The superblock lives in the block right after the log, and records
+// the layout of the file system, so that an image is always mounted
+// with the layout it was made with.  It is written directly to disk
+// (never through the log): at mkfs and at mount.
+//
+// Between the inode table and the data area are the checksum blocks,
+// the share blocks (a 16-bit count of the extra references to each
+// block, from snapshots), the snapshot table and the quota table (see
+// alloctxn.Quotas).  Images from before superblocks have none of them.
+//
+
+const (
+	MAGIC     uint64 = 0x42534453464e4f47 // "GONFSDSB"
+	VERSION   uint64 = 1
+	LABELSZ   uint64 = 32
+	SBSZ      uint64 = 8 + 8 + 16 + 8*8 + LABELSZ + 4*8 + 4
+	NCSUMBLK  uint64 = disk.BlockSize / 4 // # checksums per block
+	NSHAREBLK uint64 = disk.BlockSize / 2 // # share counts per block
+)
+
+var (
+	ErrBlank = errors.New("no file system (superblock is blank)")
+	ErrMagic = errors.New("not a go-nfsd file system (bad superblock magic; " +
+		"an image from before superblocks must be mounted as legacy)")
+	ErrChecksum = errors.New("superblock checksum mismatch")
+)
+
+type Superblock struct {
+	Magic        uint64
+	Version      uint64
+	UUID         [16]byte
+	Size         uint64 // # blocks in the file system
+	NLog         uint64
+	NBlockBitmap uint64
+	NInodeBitmap uint64
+	NInodeBlk    uint64
+	Ctime        uint64 // creation time (Unix seconds)
+	Mtime        uint64 // last mount time (Unix seconds)
+	NReserved    uint64 // # data blocks not available to ordinary writes
+	Label        [LABELSZ]byte
+	NCsumBlk     uint64 // # checksum blocks
+	NShareBlk    uint64 // # share blocks
+	NSnapBlk     uint64 // # snapshot table blocks
+	NQuotaBlk    uint64 // # quota table blocks
+}
+
+// MkfsOpts describes the geometry of a new file system.  Zero
+// values select the defaults.
+type MkfsOpts struct {
+	Size        uint64 // # blocks (default: the whole disk)
+	MaxSize     uint64 // # blocks the file system can grow to (default: see GROWFACTOR)
+	NInode      uint64 // # inodes in the inode table
+	ReservedPct uint64 // % of data blocks reserved (see DefaultMkfsOpts)
+	NQuota      uint64 // # users and groups with quotas (default NQUOTA)
+	Label       string
+}
+
+// GROWFACTOR is how many times its size a file system can grow to by
+// default: the block bitmap, checksum and share tables, which can't
+// move, are sized for that much, which costs about 0.6% of the size.
+// The default stays below MAXSNAPSIZE if the size does.
+const GROWFACTOR uint64 = 4
+
+// MAXSNAPSIZE is the size (in blocks) from which a file system is too
+// large for snapshots, whose maps index blocks with three levels of
+// pointers.
+const MAXSNAPSIZE uint64 = (disk.BlockSize / 8) * (disk.BlockSize / 8) * (disk.BlockSize / 8)
+
+// RESERVEDPCT is the default percentage of data blocks reserved for
+// the superuser (see DefaultMkfsOpts).
+const RESERVEDPCT uint64 = 5
+
+// DefaultMkfsOpts returns the options every tool makes a file system
+// with unless told otherwise.  Unlike the other defaults, that of
+// ReservedPct isn't its zero value, since 0 reserves nothing.
+func DefaultMkfsOpts() MkfsOpts {
+	return MkfsOpts{ReservedPct: RESERVEDPCT}
+}
+
+// NQUOTA is the default number of entries of the quota table, for users
+// and groups together.
+const NQUOTA uint64 = 1023
+
+// QUOTASZ is the size of an entry of the quota table, and NQUOTABLK
+// the number of entries per block.
+const (
+	QUOTASZ   uint64 = 64
+	NQUOTABLK uint64 = disk.BlockSize / QUOTASZ
+)
+
+// MegabytesToBlocks returns the number of blocks in mb megabytes, the
+// unit of the sizes the tools and the admin API take, or an error if
+// that many blocks overflow.
+func MegabytesToBlocks(mb uint64) (uint64, error) {
+	const blocksPerMB = (1 << 20) / disk.BlockSize
+	if mb > math.MaxUint64/blocksPerMB {
+		return 0, fmt.Errorf("%d MB is too large", mb)
+	}
+	return mb * blocksPerMB, nil
+}
+
+func divUp(n uint64, m uint64) uint64 {
+	return (n + m - 1) / m
+}
+
+// NewSuperblock returns a superblock for a new file system with a
+// fresh UUID and the geometry in opts, on a disk of dsize blocks.
+func NewSuperblock(dsize uint64, opts MkfsOpts) (*Superblock, error) {
+	var size = opts.Size
+	if size == 0 {
+		size = dsize
+	}
+	var ninode = opts.NInode
+	if ninode == 0 {
+		ninode = common.NINODEBITMAP * common.NBITBLOCK
+	}
+	if uint64(len(opts.Label)) > LABELSZ {
+		return nil, fmt.Errorf("label %q is longer than %d bytes", opts.Label, LABELSZ)
+	}
+	if opts.ReservedPct >= 100 {
+		return nil, fmt.Errorf("can't reserve %d%% of blocks", opts.ReservedPct)
+	}
+	if size > dsize {
+		return nil, fmt.Errorf("file system of %d blocks doesn't fit on disk of %d blocks",
+			size, dsize)
+	}
+	var maxSize = opts.MaxSize
+	if maxSize == 0 {
+		maxSize = size * GROWFACTOR
+		if size < MAXSNAPSIZE && maxSize >= MAXSNAPSIZE {
+			maxSize = MAXSNAPSIZE - 1
+		}
+	}
+	if maxSize < size {
+		return nil, fmt.Errorf("maximum size %d is less than the size %d", maxSize, size)
+	}
+	sb := &Superblock{
+		Magic:        MAGIC,
+		Version:      VERSION,
+		Size:         size,
+		NLog:         common.LOGSIZE,
+		NBlockBitmap: maxSize/common.NBITBLOCK + 1,
+		NInodeBitmap: divUp(ninode, common.NBITBLOCK),
+		NInodeBlk:    divUp(ninode, common.INODEBLK),
+		Ctime:        uint64(time.Now().Unix()),
+	}
+	sb.Mtime = sb.Ctime
+	sb.NCsumBlk = divUp(sb.NBlockBitmap*common.NBITBLOCK, NCSUMBLK)
+	sb.NShareBlk = divUp(sb.NBlockBitmap*common.NBITBLOCK, NSHAREBLK)
+	sb.NSnapBlk = 1
+	var nquota = opts.NQuota
+	if nquota == 0 {
+		nquota = NQUOTA
+	}
+	// the first entry holds the grace periods
+	sb.NQuotaBlk = divUp(nquota+1, NQUOTABLK)
+	if sb.DataStart() < size {
+		sb.NReserved = (size - sb.DataStart()) * opts.ReservedPct / 100
+	}
+	copy(sb.Label[:], opts.Label)
+	_, err := rand.Read(sb.UUID[:])
+	if err != nil {
+		panic(err)
+	}
+	err = sb.validate(dsize)
+	if err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// MaxSize returns the largest size the file system can grow to, which
+// is limited by the size of the block bitmap.
+func (sb *Superblock) MaxSize() uint64 {
+	return sb.NBlockBitmap*common.NBITBLOCK - 1
+}
+
+// DataStart returns the first data block of the layout.
+func (sb *Superblock) DataStart() uint64 {
+	return sb.NLog + 1 + sb.NBlockBitmap + sb.NInodeBitmap + sb.NInodeBlk + sb.NCsumBlk +
+		sb.NShareBlk + sb.NSnapBlk + sb.NQuotaBlk
+}
+
+// LabelString returns the label without padding.
+func (sb *Superblock) LabelString() string {
+	n := 0
+	for n < len(sb.Label) && sb.Label[n] != 0 {
+		n++
+	}
+	return string(sb.Label[:n])
+}
+
+func (sb *Superblock) Encode() []byte {
+	enc := marshal.NewEnc(SBSZ)
+	enc.PutInt(sb.Magic)
+	enc.PutInt(sb.Version)
+	enc.PutBytes(sb.UUID[:])
+	enc.PutInt(sb.Size)
+	enc.PutInt(sb.NLog)
+	enc.PutInt(sb.NBlockBitmap)
+	enc.PutInt(sb.NInodeBitmap)
+	enc.PutInt(sb.NInodeBlk)
+	enc.PutInt(sb.Ctime)
+	enc.PutInt(sb.Mtime)
+	enc.PutInt(sb.NReserved)
+	enc.PutBytes(sb.Label[:])
+	enc.PutInt(sb.NCsumBlk)
+	enc.PutInt(sb.NShareBlk)
+	enc.PutInt(sb.NSnapBlk)
+	enc.PutInt(sb.NQuotaBlk)
+	data := enc.Finish()
+	enc.PutInt32(crc32.ChecksumIEEE(data[:SBSZ-4]))
+	return enc.Finish()
+}
+
+func decodeSuperblock(data []byte) *Superblock {
+	sb := &Superblock{}
+	dec := marshal.NewDec(data)
+	sb.Magic = dec.GetInt()
+	sb.Version = dec.GetInt()
+	copy(sb.UUID[:], dec.GetBytes(16))
+	sb.Size = dec.GetInt()
+	sb.NLog = dec.GetInt()
+	sb.NBlockBitmap = dec.GetInt()
+	sb.NInodeBitmap = dec.GetInt()
+	sb.NInodeBlk = dec.GetInt()
+	sb.Ctime = dec.GetInt()
+	sb.Mtime = dec.GetInt()
+	sb.NReserved = dec.GetInt()
+	copy(sb.Label[:], dec.GetBytes(LABELSZ))
+	sb.NCsumBlk = dec.GetInt()
+	sb.NShareBlk = dec.GetInt()
+	sb.NSnapBlk = dec.GetInt()
+	sb.NQuotaBlk = dec.GetInt()
+	return sb
+}
+
+// UUIDString formats the UUID in the usual 8-4-4-4-12 form.
+func (sb *Superblock) UUIDString() string {
+	u := sb.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Write writes the superblock to its block on d.
+func (sb *Superblock) Write(d disk.Disk) {
+	blk := make(disk.Block, disk.BlockSize)
+	copy(blk, sb.Encode())
+	d.Write(common.LOGSIZE, blk)
+	d.Barrier()
+}
+
+func isZero(blk disk.Block) bool {
+	for _, b := range blk {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that the layout in sb makes sense for a disk of dsize blocks.
+func (sb *Superblock) validate(dsize uint64) error {
+	if sb.Version != VERSION {
+		return fmt.Errorf("unsupported file system version %d (want %d)",
+			sb.Version, VERSION)
+	}
+	if sb.NLog != common.LOGSIZE {
+		return fmt.Errorf("unsupported log size %d (want %d)",
+			sb.NLog, common.LOGSIZE)
+	}
+	if sb.Size > dsize {
+		return fmt.Errorf("file system has %d blocks, but disk only %d",
+			sb.Size, dsize)
+	}
+	if sb.NBlockBitmap*common.NBITBLOCK <= sb.Size ||
+		sb.NInodeBitmap == 0 || sb.NInodeBlk == 0 ||
+		sb.NInodeBlk*common.INODEBLK > sb.NInodeBitmap*common.NBITBLOCK ||
+		sb.NCsumBlk*NCSUMBLK < sb.NBlockBitmap*common.NBITBLOCK ||
+		sb.NShareBlk*NSHAREBLK < sb.NBlockBitmap*common.NBITBLOCK ||
+		sb.NSnapBlk == 0 || sb.NQuotaBlk == 0 {
+		return fmt.Errorf("superblock has inconsistent layout %+v", sb)
+	}
+	if sb.DataStart() >= sb.Size {
+		return fmt.Errorf("file system of %d blocks is too small for its layout",
+			sb.Size)
+	}
+	if sb.NReserved >= sb.Size-sb.DataStart() {
+		return fmt.Errorf("%d reserved blocks, but only %d data blocks",
+			sb.NReserved, sb.Size-sb.DataStart())
+	}
+	return nil
+}
+
+// ReadSuperblock reads and validates the superblock of d.  It returns
+// ErrBlank if the superblock's block is all zeros (e.g., a new disk),
+// and ErrMagic if it holds something else, which may be an image from
+// before superblocks (see CheckLegacy).
+func ReadSuperblock(d disk.Disk) (*Superblock, error) {
+	if d.Size() <= common.LOGSIZE {
+		return nil, fmt.Errorf("disk of %d blocks is too small", d.Size())
+	}
+	blk := d.Read(common.LOGSIZE)
+	if isZero(blk) {
+		return nil, ErrBlank
+	}
+	sb := decodeSuperblock(blk)
+	if sb.Magic != MAGIC {
+		return nil, ErrMagic
+	}
+	if sb.Version != VERSION {
+		return nil, sb.validate(d.Size())
+	}
+	dec := marshal.NewDec(blk[SBSZ-4:])
+	if dec.GetInt32() != crc32.ChecksumIEEE(blk[:SBSZ-4]) {
+		return nil, ErrChecksum
+	}
+	err := sb.validate(d.Size())
+	if err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// CheckLegacy checks, as far as it can be told, that d holds an image
+// from before superblocks, which has no magic number to recognize it
+// by: that the block where the superblock is now is its first bitmap
+// block, that the log headers make sense, and that the root inode is
+// a directory.
+func CheckLegacy(d disk.Disk) error {
+	if d.Size() <= common.LOGSIZE {
+		return fmt.Errorf("disk of %d blocks is too small", d.Size())
+	}
+	blk := d.Read(common.LOGSIZE)
+	if isZero(blk) {
+		return ErrBlank
+	}
+	if decodeSuperblock(blk).Magic == MAGIC {
+		return fmt.Errorf("not a legacy image (it has a superblock)")
+	}
+	// the log, the bitmaps and the inode table are allocated
+	if blk[0] != 0xff {
+		return fmt.Errorf("not a legacy image (bad block bitmap)")
+	}
+	err := checkLog(d)
+	if err != nil {
+		return err
+	}
+	fs := MkFsSuper(d)
+	if uint64(fs.DataStart()) >= fs.Size {
+		return fmt.Errorf("disk of %d blocks is too small", d.Size())
+	}
+	a := fs.Inum2Addr(common.ROOTINUM)
+	dec := marshal.NewDec(d.Read(uint64(a.Blkno))[a.Off/8:])
+	kind := nfstypes.Ftype3(dec.GetInt32())
+	nlink := dec.GetInt32()
+	if kind != nfstypes.NF3DIR || nlink == 0 {
+		return fmt.Errorf("not a legacy image (root inode isn't a directory)")
+	}
+	return nil
+}
+
+// Returns an error unless the log headers of d make sense: the
+// transactions between the log's start and end fit in the log, and
+// write to blocks of d beyond it.
+func checkLog(d disk.Disk) error {
+	nlog := common.LOGSIZE - 2 // 2 for the headers
+	hdr1 := marshal.NewDec(d.Read(0))
+	end := hdr1.GetInt()
+	addrs := hdr1.GetInts(nlog)
+	start := marshal.NewDec(d.Read(1)).GetInt()
+	if start > end || end-start > nlog {
+		return fmt.Errorf("bad log header (start %d, end %d)", start, end)
+	}
+	for pos := start; pos < end; pos++ {
+		bn := addrs[pos%nlog]
+		if bn < common.LOGSIZE || bn >= d.Size() {
+			return fmt.Errorf("bad log header (logged write to block %d)", bn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package cryptdisk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tchajed/goose/machine/disk"
+	"github.com/tchajed/marshal"
+	"golang.org/x/crypto/xts"
+
+	"github.com/mit-pdos/go-nfsd/util/diskfile"
+)
+
+//
+// A Disk encrypts another disk with AES-XTS, one block per XTS sector
+// numbered by block, so that everything the file system writes (the
+// log, the superblock, inodes, directories and data) is ciphertext on
+// the underlying disk.  Block 0 of the underlying disk holds a
+// plaintext header with a check value of the key, so that opening the
+// disk with the wrong key fails instead of decrypting garbage; the
+// file system sees the blocks after it, numbered from 0.
+//
+// Blocks that were never written are all zeros on the underlying disk
+// and read as zeros (so that a new encrypted disk is blank), which
+// reveals which blocks were never written, but nothing else.
+//
+
+const (
+	MAGIC   = "gonfsdxt"
+	VERSION = uint64(1)
+	SALTSZ  = 32
+	KEYENV  = "GO_NFSD_KEY" // hex key, if there is no key file
+)
+
+var (
+	ErrNotEncrypted = errors.New("disk isn't encrypted (no encryption header)")
+	ErrWrongKey     = errors.New("wrong encryption key")
+	ErrNeedKey      = fmt.Errorf("disk is encrypted; give a key file or set %s", KEYENV)
+)
+
+type Disk struct {
+	d disk.Disk
+	c *xts.Cipher
+}
+
+// assert that Disk implements disk.Disk
+var _ disk.Disk = &Disk{}
+
+// A discardDisk is a Disk on a disk that can discard blocks.
+type discardDisk struct {
+	*Disk
+	dd diskfile.Discarder
+}
+
+var _ diskfile.Discarder = &discardDisk{}
+
+// A growDisk is a Disk on a disk that can grow.
+type growDisk struct {
+	*Disk
+	g diskfile.Grower
+}
+
+var _ diskfile.Grower = &growDisk{}
+
+// A discardGrowDisk is a Disk on a disk that can discard blocks and
+// grow.
+type discardGrowDisk struct {
+	*discardDisk
+	g diskfile.Grower
+}
+
+var _ diskfile.Discarder = &discardGrowDisk{}
+var _ diskfile.Grower = &discardGrowDisk{}
+
+// Returns the encrypted disk on d, which can discard and grow if d
+// can.
+func mkDisk(d disk.Disk, c *xts.Cipher) disk.Disk {
+	cd := &Disk{d: d, c: c}
+	dd, discards := d.(diskfile.Discarder)
+	g, grows := d.(diskfile.Grower)
+	if discards && grows {
+		return &discardGrowDisk{discardDisk: &discardDisk{Disk: cd, dd: dd}, g: g}
+	}
+	if discards {
+		return &discardDisk{Disk: cd, dd: dd}
+	}
+	if grows {
+		return &growDisk{Disk: cd, g: g}
+	}
+	return cd
+}
+
+func newCipher(key []byte) (*xts.Cipher, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, fmt.Errorf("key has %d bytes; want 32 (AES-128-XTS) or 64 (AES-256-XTS)",
+			len(key))
+	}
+	return xts.NewCipher(aes.NewCipher, key)
+}
+
+func checkValue(key []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// Format makes d an encrypted disk with key, which loses what d held.
+func Format(d disk.Disk, key []byte) (disk.Disk, error) {
+	c, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if d.Size() < 2 {
+		return nil, fmt.Errorf("disk of %d blocks is too small", d.Size())
+	}
+	salt := make([]byte, SALTSZ)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutBytes([]byte(MAGIC))
+	enc.PutInt(VERSION)
+	enc.PutBytes(salt)
+	enc.PutBytes(checkValue(key, salt))
+	d.Write(0, enc.Finish())
+	// wipe what d held (in plaintext), so that the file system's
+	// blocks read as zeros
+	zero := make(disk.Block, disk.BlockSize)
+	for a := uint64(1); a < d.Size(); a++ {
+		if !isZero(d.Read(a)) {
+			d.Write(a, zero)
+		}
+	}
+	d.Barrier()
+	return mkDisk(d, c), nil
+}
+
+// IsEncrypted returns whether d has an encryption header.
+func IsEncrypted(d disk.Disk) bool {
+	if d.Size() == 0 {
+		return false
+	}
+	return bytes.Equal(d.Read(0)[:len(MAGIC)], []byte(MAGIC))
+}
+
+// Open opens encrypted disk d with key, and returns ErrWrongKey if key
+// isn't the one d was formatted with.
+func Open(d disk.Disk, key []byte) (disk.Disk, error) {
+	c, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(d) {
+		return nil, ErrNotEncrypted
+	}
+	dec := marshal.NewDec(d.Read(0))
+	dec.GetBytes(uint64(len(MAGIC)))
+	version := dec.GetInt()
+	if version != VERSION {
+		return nil, fmt.Errorf("unsupported encryption version %d (want %d)", version, VERSION)
+	}
+	salt := dec.GetBytes(SALTSZ)
+	check := dec.GetBytes(sha256.Size)
+	if !hmac.Equal(check, checkValue(key, salt)) {
+		return nil, ErrWrongKey
+	}
+	return mkDisk(d, c), nil
+}
+
+// Wrap opens d with key, or returns d itself if key is nil and d isn't
+// encrypted.
+func Wrap(d disk.Disk, key []byte) (disk.Disk, error) {
+	if key == nil {
+		if IsEncrypted(d) {
+			return nil, ErrNeedKey
+		}
+		return d, nil
+	}
+	return Open(d, key)
+}
+
+// WrapKeyFile is Wrap with the key that LoadKey(path) loads.
+func WrapKeyFile(d disk.Disk, path string) (disk.Disk, error) {
+	key, err := LoadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(d, key)
+}
+
+// FormatKeyFile formats d with the key that LoadKey(path) loads, or
+// returns d itself if there is no key.
+func FormatKeyFile(d disk.Disk, path string) (disk.Disk, error) {
+	key, err := LoadKey(path)
+	if err != nil || key == nil {
+		return d, err
+	}
+	return Format(d, key)
+}
+
+// LoadKey reads a hex key from the file at path, or from the KEYENV
+// environment variable if path is empty.  It returns a nil key if
+// neither is set.
+func LoadKey(path string) ([]byte, error) {
+	var s = os.Getenv(KEYENV)
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		if path != "" {
+			return nil, fmt.Errorf("%s: empty key file", path)
+		}
+		return nil, nil
+	}
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("key isn't hex: %v", err)
+	}
+	if _, err := newCipher(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Disk) ReadTo(a uint64, b disk.Block) {
+	d.d.ReadTo(a+1, b)
+	if isZero(b[:disk.BlockSize]) {
+		return // never written
+	}
+	d.c.Decrypt(b[:disk.BlockSize], b[:disk.BlockSize], a)
+}
+
+func (d *Disk) Read(a uint64) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, b)
+	return b
+}
+
+func (d *Disk) Write(a uint64, v disk.Block) {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block-sized (%d bytes)", len(v)))
+	}
+	b := make(disk.Block, disk.BlockSize)
+	d.c.Encrypt(b, v, a)
+	d.d.Write(a+1, b)
+}
+
+func (d *Disk) Size() uint64 {
+	return d.d.Size() - 1
+}
+
+func (d *Disk) Barrier() {
+	d.d.Barrier()
+}
+
+func (d *Disk) Close() {
+	d.d.Close()
+}
+
+func (d *discardDisk) Discard(a uint64, n uint64) error {
+	return d.dd.Discard(a+1, n)
+}
+
+// Grows g, which holds the header before the encrypted blocks, to
+// nblocks encrypted blocks.  The new blocks read as zeros underneath,
+// so they read as zeros here too.
+func grow(g diskfile.Grower, nblocks uint64) (uint64, error) {
+	var n = nblocks
+	if n != 0 {
+		n++
+	}
+	sz, err := g.Grow(n)
+	if err != nil {
+		return 0, err
+	}
+	return sz - 1, nil
+}
+
+func (d *growDisk) Grow(nblocks uint64) (uint64, error) {
+	return grow(d.g, nblocks)
+}
+
+func (d *discardGrowDisk) Grow(nblocks uint64) (uint64, error) {
+	return grow(d.g, nblocks)
+}
@@ -0,0 +1,28 @@
+package diskfile
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+var _ Discarder = &fileDisk{}
+
+// Discard punches a hole in an image file, and issues BLKDISCARD on a
+// device.
+func (d *fileDisk) Discard(a uint64, n uint64) error {
+	off, sz := a*disk.BlockSize, n*disk.BlockSize
+	if !d.dev {
+		return unix.Fallocate(int(d.f.Fd()),
+			unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(off), int64(sz))
+	}
+	r := [2]uint64{off, sz}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, d.f.Fd(), unix.BLKDISCARD,
+		uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
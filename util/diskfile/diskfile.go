@@ -0,0 +1,59 @@
+package diskfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// Size returns the number of blocks in the file or block device at
+// path.
+func Size(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// Seek works for block devices, whose Stat size is 0
+	sz, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz) / disk.BlockSize, nil
+}
+
+// Open opens an existing disk image or block device, using all of it.
+func Open(path string) (disk.Disk, error) {
+	n, err := Size(path)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s: smaller than a block", path)
+	}
+	return newFileDisk(path, n)
+}
+
+// Create opens the disk image at path, creating it if it doesn't exist
+// and resizing it to nblocks.  A block device keeps its size, and
+// nblocks must not be larger than that.  An nblocks of 0 means the
+// current size.
+func Create(path string, nblocks uint64) (disk.Disk, error) {
+	n, err := Size(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if nblocks == 0 {
+		nblocks = n
+	}
+	if nblocks == 0 {
+		return nil, fmt.Errorf("%s: no size given", path)
+	}
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode()&os.ModeDevice != 0 && nblocks > n {
+		return nil, fmt.Errorf("%s: device has %d blocks, not %d", path, n, nblocks)
+	}
+	return newFileDisk(path, nblocks)
+}
@@ -0,0 +1,137 @@
+package diskfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// A Grower is a disk whose size can change while it is in use, e.g.,
+// because the image was extended or the device resized.
+type Grower interface {
+	disk.Disk
+	// Grow makes the disk nblocks long, or as long as its backing
+	// file or device is now if nblocks is 0, and returns the new
+	// size.  It never shrinks the disk.
+	Grow(nblocks uint64) (uint64, error)
+}
+
+// A Discarder is a disk that can tell its backing store that blocks
+// are unused (e.g., so that a sparse image file shrinks).
+type Discarder interface {
+	disk.Disk
+	// Discard tells the backing store that blocks [a, a+n) are
+	// unused; they may read as anything afterwards.
+	Discard(a uint64, n uint64) error
+}
+
+// A fileDisk is like goose's disk.FileDisk, but can grow.
+type fileDisk struct {
+	f         *os.File
+	dev       bool
+	numBlocks uint64 // accessed atomically
+}
+
+var _ Grower = &fileDisk{}
+
+func newFileDisk(path string, n uint64) (disk.Disk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d := &fileDisk{f: f, dev: !fi.Mode().IsRegular(), numBlocks: n}
+	if !d.dev && uint64(fi.Size()) != n*disk.BlockSize {
+		if err := f.Truncate(int64(n * disk.BlockSize)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *fileDisk) ReadTo(a uint64, b disk.Block) {
+	if uint64(len(b)) != disk.BlockSize {
+		panic("buffer is not block-sized")
+	}
+	if a >= d.Size() {
+		panic(fmt.Errorf("out-of-bounds read at %v", a))
+	}
+	_, err := d.f.ReadAt(b, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("read failed: " + err.Error())
+	}
+}
+
+func (d *fileDisk) Read(a uint64) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, b)
+	return b
+}
+
+func (d *fileDisk) Write(a uint64, v disk.Block) {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block-sized (%d bytes)", len(v)))
+	}
+	if a >= d.Size() {
+		panic(fmt.Errorf("out-of-bounds write at %v", a))
+	}
+	_, err := d.f.WriteAt(v, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("write failed: " + err.Error())
+	}
+}
+
+func (d *fileDisk) Size() uint64 {
+	return atomic.LoadUint64(&d.numBlocks)
+}
+
+func (d *fileDisk) Barrier() {
+	if err := d.f.Sync(); err != nil {
+		panic("file sync failed: " + err.Error())
+	}
+}
+
+func (d *fileDisk) Close() {
+	if err := d.f.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// Grow extends an image file to nblocks; a device must already be
+// that large.
+func (d *fileDisk) Grow(nblocks uint64) (uint64, error) {
+	sz, err := d.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	avail := uint64(sz) / disk.BlockSize
+	if nblocks == 0 {
+		nblocks = avail
+	}
+	if nblocks < d.Size() {
+		return 0, fmt.Errorf("can't shrink the disk from %d to %d blocks", d.Size(), nblocks)
+	}
+	if nblocks > avail {
+		if d.dev {
+			return 0, fmt.Errorf("device has %d blocks, not %d", avail, nblocks)
+		}
+		if err := d.f.Truncate(int64(nblocks * disk.BlockSize)); err != nil {
+			return 0, err
+		}
+		// the new size must be durable before the file system
+		// records it
+		if err := d.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	atomic.StoreUint64(&d.numBlocks, nblocks)
+	return nblocks, nil
+}
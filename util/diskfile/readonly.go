@@ -0,0 +1,85 @@
+package diskfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/tchajed/goose/machine/disk"
+)
+
+// An overlay keeps writes in memory, on top of a file opened
+// read-only, so that log recovery can run without modifying the image.
+type overlay struct {
+	mu     sync.Mutex
+	f      *os.File
+	n      uint64
+	writes map[uint64]disk.Block
+}
+
+// OpenReadOnly opens an existing disk image or block device without
+// ever writing to it: writes (e.g., by log recovery) are kept in
+// memory and seen by later reads.
+func OpenReadOnly(path string) (disk.Disk, error) {
+	n, err := Size(path)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s: smaller than a block", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &overlay{f: f, n: n, writes: make(map[uint64]disk.Block)}, nil
+}
+
+func (d *overlay) ReadTo(a uint64, b disk.Block) {
+	if a >= d.n {
+		panic(fmt.Errorf("out-of-bounds read at %v", a))
+	}
+	d.mu.Lock()
+	blk, ok := d.writes[a]
+	if ok {
+		copy(b, blk)
+	}
+	d.mu.Unlock()
+	if ok {
+		return
+	}
+	_, err := d.f.ReadAt(b[:disk.BlockSize], int64(a*disk.BlockSize))
+	if err != nil {
+		panic(fmt.Errorf("read %d: %v", a, err))
+	}
+}
+
+func (d *overlay) Read(a uint64) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, b)
+	return b
+}
+
+func (d *overlay) Write(a uint64, v disk.Block) {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block-sized (%d bytes)", len(v)))
+	}
+	if a >= d.n {
+		panic(fmt.Errorf("out-of-bounds write at %v", a))
+	}
+	blk := make(disk.Block, disk.BlockSize)
+	copy(blk, v)
+	d.mu.Lock()
+	d.writes[a] = blk
+	d.mu.Unlock()
+}
+
+func (d *overlay) Size() uint64 {
+	return d.n
+}
+
+func (d *overlay) Barrier() {}
+
+func (d *overlay) Close() {
+	d.f.Close()
+}